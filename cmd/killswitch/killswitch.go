@@ -0,0 +1,46 @@
+package killswitch
+
+import (
+	"log"
+	"paqet/internal/conf"
+	"paqet/internal/tun"
+
+	"github.com/spf13/cobra"
+)
+
+var confPath string
+
+func init() {
+	enableCmd.Flags().StringVarP(&confPath, "config", "c", "config.yaml", "Path to the client configuration file.")
+	Cmd.AddCommand(enableCmd, disableCmd)
+}
+
+var Cmd = &cobra.Command{
+	Use:   "killswitch",
+	Short: "Manages the TUN kill switch firewall rules.",
+	Long:  `The kill switch set by 'tun.kill_switch' drops all egress except through the TUN device and to the paqet server. paqet leaves it in place on exit so nothing leaks while the tunnel is down; these commands install it ahead of time or remove it.`,
+}
+
+var enableCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Installs the kill switch for the configured TUN device and server.",
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := conf.LoadFromFile(confPath)
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		if err := tun.EnableKillSwitch(cfg); err != nil {
+			log.Fatalf("Failed to enable kill switch: %v", err)
+		}
+	},
+}
+
+var disableCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Removes the kill switch, allowing traffic outside the tunnel.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := tun.DisableKillSwitch(); err != nil {
+			log.Fatalf("Failed to disable kill switch: %v", err)
+		}
+	},
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"os"
 	"paqet/cmd/iface"
+	"paqet/cmd/killswitch"
 	"paqet/cmd/ping"
 	"paqet/cmd/run"
 	"paqet/cmd/secret"
+	"paqet/cmd/tun"
+	"paqet/cmd/usage"
 	"paqet/cmd/version"
 	"paqet/internal/flog"
 
@@ -23,6 +26,9 @@ func main() {
 	rootCmd.AddCommand(ping.Cmd)
 	rootCmd.AddCommand(secret.Cmd)
 	rootCmd.AddCommand(iface.Cmd)
+	rootCmd.AddCommand(killswitch.Cmd)
+	rootCmd.AddCommand(tun.Cmd)
+	rootCmd.AddCommand(usage.Cmd)
 	rootCmd.AddCommand(version.Cmd)
 	registerPlatformCommands(rootCmd)
 
@@ -6,9 +6,12 @@ import (
 	"os/signal"
 	"paqet/internal/client"
 	"paqet/internal/conf"
+	"paqet/internal/dns"
 	"paqet/internal/flog"
 	"paqet/internal/forward"
+	"paqet/internal/httpproxy"
 	"paqet/internal/socks"
+	"paqet/internal/tproxy"
 	"paqet/internal/tun"
 	"syscall"
 )
@@ -38,12 +41,31 @@ func startClient(cfg *conf.Conf) {
 		if err != nil {
 			flog.Fatalf("Failed to initialize SOCKS5: %v", err)
 		}
+		if ss.HTTP != nil {
+			h, err := httpproxy.New(client, *ss.HTTP)
+			if err != nil {
+				flog.Fatalf("Failed to initialize HTTP proxy: %v", err)
+			}
+			s.Mixed(h)
+		}
 		if err := s.Start(ctx, ss); err != nil {
 			flog.Fatalf("SOCKS5 encountered an error: %v", err)
 		}
 	}
+	for _, hh := range cfg.HTTPProxy {
+		if hh.Mixed {
+			continue
+		}
+		h, err := httpproxy.New(client, hh)
+		if err != nil {
+			flog.Fatalf("Failed to initialize HTTP proxy: %v", err)
+		}
+		if err := h.Start(ctx, hh.Listen.String()); err != nil {
+			flog.Fatalf("HTTP proxy encountered an error: %v", err)
+		}
+	}
 	for _, ff := range cfg.Forward {
-		f, err := forward.New(client, ff.Listen.String(), ff.Target.String(), ff.Streams)
+		f, err := forward.New(client, ff.Name, ff.Listen.String(), ff.Target.String(), ff.Streams)
 		if err != nil {
 			flog.Fatalf("Failed to initialize Forward: %v", err)
 		}
@@ -51,13 +73,42 @@ func startClient(cfg *conf.Conf) {
 			flog.Infof("Forward encountered an error: %v", err)
 		}
 	}
+	for _, rr := range cfg.Reverse {
+		r := forward.NewReverse(client, rr.Listen.String(), rr.Target.String(), rr.Protocol)
+		if err := r.Start(ctx); err != nil {
+			flog.Infof("Reverse encountered an error: %v", err)
+		}
+	}
+
+	var tproxies []*tproxy.TProxy
+	for _, tt := range cfg.TProxy {
+		t, err := tproxy.New(client, tt)
+		if err != nil {
+			flog.Fatalf("Failed to initialize tproxy: %v", err)
+		}
+		if err := t.Start(ctx); err != nil {
+			flog.Fatalf("tproxy encountered an error: %v", err)
+		}
+		tproxies = append(tproxies, t)
+	}
+
+	var resolver *dns.Resolver
+	if cfg.DNS != nil {
+		resolver = dns.New(client, cfg.DNS)
+		if err := resolver.Start(ctx); err != nil {
+			flog.Fatalf("DNS resolver encountered an error: %v", err)
+		}
+	}
 
 	var tunDev *tun.TUN
 	if cfg.TUN != nil {
-		tunDev, err = tun.New(client, cfg.TUN, cfg.Server.Addr.IP.String())
+		tunDev, err = tun.New(client, cfg.TUN, cfg.Server.Addr)
 		if err != nil {
 			flog.Fatalf("Failed to initialize TUN: %v", err)
 		}
+		if resolver != nil {
+			tunDev.SetResolver(resolver)
+		}
 		if err := tunDev.Start(ctx); err != nil {
 			flog.Fatalf("TUN encountered an error: %v", err)
 		}
@@ -65,8 +116,11 @@ func startClient(cfg *conf.Conf) {
 
 	<-ctx.Done()
 
-	// Restore routes before the process exits.
+	// Restore routes and capture rules before the process exits.
 	if tunDev != nil {
 		tunDev.Close()
 	}
+	for _, t := range tproxies {
+		t.Close()
+	}
 }
@@ -1,7 +1,10 @@
 package run
 
 import (
+	"io"
 	"log"
+	"os"
+	"paqet/internal/accesslog"
 	"paqet/internal/conf"
 	"paqet/internal/flog"
 
@@ -39,5 +42,35 @@ var Cmd = &cobra.Command{
 }
 
 func initialize(cfg *conf.Conf) {
-	flog.SetLevel(cfg.Log.Level)
+	opts := flog.Options{
+		Level:  cfg.Log.Level,
+		Format: cfg.Log.Format,
+		Levels: cfg.Log.Levels,
+	}
+	rotate := flog.RotateOptions{
+		MaxSize:    cfg.Log.MaxSize,
+		Interval:   cfg.Log.RotateInterval,
+		MaxBackups: cfg.Log.MaxBackups,
+		Compress:   cfg.Log.Compress,
+	}
+	if cfg.Log.File != "" {
+		w, err := flog.OpenFile(cfg.Log.File, rotate)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		opts.Output = w
+	}
+	flog.Setup(opts)
+
+	if a := cfg.Log.Access; a != nil {
+		var w io.Writer = os.Stdout
+		if a.File != "stdout" {
+			f, err := flog.OpenFile(a.File, rotate)
+			if err != nil {
+				log.Fatalf("Failed to open access log: %v", err)
+			}
+			w = f
+		}
+		accesslog.Setup(w, a.Format)
+	}
 }
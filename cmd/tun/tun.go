@@ -0,0 +1,28 @@
+package tun
+
+import (
+	"log"
+	"paqet/internal/tun"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	Cmd.AddCommand(cleanupCmd)
+}
+
+var Cmd = &cobra.Command{
+	Use:   "tun",
+	Short: "Manages the system settings of TUN mode.",
+}
+
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Restores routes and DNS after a TUN client exited uncleanly.",
+	Long:  `On Linux, a client in TUN mode records the routes and DNS settings it changes in /run/paqet/tun.json. If the process is killed or crashes, 'paqet tun cleanup' undoes those changes; the next TUN start also does so by itself. The kill switch is left alone, see 'paqet killswitch'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := tun.Cleanup(); err != nil {
+			log.Fatalf("TUN cleanup failed: %v", err)
+		}
+	},
+}
@@ -0,0 +1,76 @@
+package usage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"paqet/internal/conf"
+	"paqet/internal/usage"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var confPath string
+
+func init() {
+	Cmd.Flags().StringVarP(&confPath, "config", "c", "config.yaml", "Path to the server configuration file.")
+}
+
+var Cmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Prints per-user traffic accounting and quotas.",
+	Long:  `The 'usage' command reads the usage file configured under 'listen.usage' and prints byte counters and quota consumption per user. A running server writes the file every flush_interval.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := conf.LoadFromFile(confPath)
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		u := cfg.Listen.Usage
+		if cfg.Role != "server" || u == nil {
+			log.Fatalf("Usage command requires a server configuration with listen.usage")
+		}
+		users, err := usage.Load(u.File)
+		if err != nil {
+			log.Fatalf("Failed to read usage file: %v", err)
+		}
+		printUsage(u, users)
+	},
+}
+
+func printUsage(u *conf.Usage, users map[string]*usage.Record) {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tTCP UP\tTCP DOWN\tUDP UP\tUDP DOWN\tTODAY\tMONTH\tLAST SEEN")
+	for _, name := range names {
+		r := users[name]
+		daily, monthly := u.Limits(name)
+		day, month := r.Periods(now)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			name,
+			usage.FormatBytes(r.Total.TCPUp),
+			usage.FormatBytes(r.Total.TCPDown),
+			usage.FormatBytes(r.Total.UDPUp),
+			usage.FormatBytes(r.Total.UDPDown),
+			quota(day, daily),
+			quota(month, monthly),
+			r.LastSeen.Local().Format("2006-01-02 15:04"),
+		)
+	}
+	w.Flush()
+}
+
+func quota(used uint64, limit int64) string {
+	if limit <= 0 {
+		return usage.FormatBytes(used)
+	}
+	return fmt.Sprintf("%s / %s", usage.FormatBytes(used), usage.FormatBytes(uint64(limit)))
+}
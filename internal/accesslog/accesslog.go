@@ -0,0 +1,166 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"paqet/internal/tnet"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Record describes one finished stream. Up is client to target, Down is
+// target to client.
+type Record struct {
+	Time     time.Time     // when the stream started
+	Side     string        // "client" or "server"
+	Client   string        // client address as seen by the logging side
+	User     string        // authenticated identity, empty if none
+	Type     string        // PTCP, PUDP, PUDPDGM, ...
+	Dest     string        // target address
+	Up       uint64        // bytes client -> target
+	Down     uint64        // bytes target -> client
+	Duration time.Duration // stream lifetime
+	Reason   string        // why the stream ended
+}
+
+var (
+	enabled atomic.Bool
+	mu      sync.Mutex
+	out     io.Writer
+	format  string
+)
+
+// Setup directs access records to w in the given format ("json" or "clf").
+func Setup(w io.Writer, f string) {
+	mu.Lock()
+	defer mu.Unlock()
+	out, format = w, f
+	enabled.Store(w != nil)
+}
+
+// Enabled reports whether records are written. Callers use it to skip byte
+// counting when there is no access log.
+func Enabled() bool { return enabled.Load() }
+
+// Log writes r if the access log is enabled.
+func Log(r Record) {
+	if !enabled.Load() {
+		return
+	}
+	line := encode(r)
+	mu.Lock()
+	defer mu.Unlock()
+	out.Write(line)
+}
+
+type jsonRecord struct {
+	Time     string  `json:"time"`
+	Side     string  `json:"side"`
+	Client   string  `json:"client"`
+	User     string  `json:"user,omitempty"`
+	Type     string  `json:"type"`
+	Dest     string  `json:"dest"`
+	Up       uint64  `json:"bytes_up"`
+	Down     uint64  `json:"bytes_down"`
+	Duration float64 `json:"duration"` // seconds
+	Reason   string  `json:"reason"`
+}
+
+func encode(r Record) []byte {
+	if format == "json" {
+		b, _ := json.Marshal(jsonRecord{
+			Time:     r.Time.Format(time.RFC3339Nano),
+			Side:     r.Side,
+			Client:   r.Client,
+			User:     r.User,
+			Type:     r.Type,
+			Dest:     r.Dest,
+			Up:       r.Up,
+			Down:     r.Down,
+			Duration: r.Duration.Seconds(),
+			Reason:   r.Reason,
+		})
+		return append(b, '\n')
+	}
+
+	// CLF-like: client user [time] "TYPE dest" up down duration side "reason"
+	user := r.User
+	if user == "" {
+		user = "-"
+	}
+	return fmt.Appendf(nil, "%s %s [%s] \"%s %s\" %d %d %.3f %s %q\n",
+		r.Client, user, r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Type, r.Dest, r.Up, r.Down, r.Duration.Seconds(), r.Side, r.Reason)
+}
+
+// Counter is implemented by anything that counts the bytes it moved, such
+// as a stream wrapped with Count.
+type Counter interface {
+	Rx() uint64 // bytes received
+	Tx() uint64 // bytes sent
+}
+
+// Stream logs a finished stream or flow. The server reads uploads from its
+// streams while the client writes them.
+func Stream(s Counter, side, client, user, typ, dest string, start time.Time, reason string) {
+	up, down := s.Rx(), s.Tx()
+	if side == "client" {
+		up, down = down, up
+	}
+	Log(Record{
+		Time:     start,
+		Side:     side,
+		Client:   client,
+		User:     user,
+		Type:     typ,
+		Dest:     dest,
+		Up:       up,
+		Down:     down,
+		Duration: time.Since(start),
+		Reason:   reason,
+	})
+}
+
+// Reason turns the error a stream handler ended with into a close reason.
+func Reason(ctx context.Context, err error) string {
+	switch {
+	case ctx.Err() != nil:
+		return "shutdown"
+	case err == nil, errors.Is(err, io.EOF):
+		return "eof"
+	default:
+		return err.Error()
+	}
+}
+
+// Strm counts the bytes read from and written to a stream.
+type Strm struct {
+	tnet.Strm
+	rx atomic.Uint64
+	tx atomic.Uint64
+}
+
+// Count wraps strm with byte counters.
+func Count(strm tnet.Strm) *Strm { return &Strm{Strm: strm} }
+
+func (s *Strm) Read(p []byte) (int, error) {
+	n, err := s.Strm.Read(p)
+	s.rx.Add(uint64(n))
+	return n, err
+}
+
+func (s *Strm) Write(p []byte) (int, error) {
+	n, err := s.Strm.Write(p)
+	s.tx.Add(uint64(n))
+	return n, err
+}
+
+// Rx returns the bytes read from the stream so far.
+func (s *Strm) Rx() uint64 { return s.rx.Load() }
+
+// Tx returns the bytes written to the stream so far.
+func (s *Strm) Tx() uint64 { return s.tx.Load() }
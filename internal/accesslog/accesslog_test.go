@@ -0,0 +1,75 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func testRecord() Record {
+	return Record{
+		Time:     time.Date(2026, 10, 18, 14, 0, 0, 0, time.UTC),
+		Side:     "server",
+		Client:   "203.0.113.5:40000",
+		User:     "alice",
+		Type:     "PTCP",
+		Dest:     "example.com:443",
+		Up:       1200,
+		Down:     56000,
+		Duration: 2500 * time.Millisecond,
+		Reason:   "eof",
+	}
+}
+
+func TestCLF(t *testing.T) {
+	var buf bytes.Buffer
+	Setup(&buf, "clf")
+	defer Setup(nil, "")
+
+	Log(testRecord())
+	want := `203.0.113.5:40000 alice [18/Oct/2026:14:00:00 +0000] "PTCP example.com:443" 1200 56000 2.500 server "eof"` + "\n"
+	if buf.String() != want {
+		t.Fatalf("got  %q\nwant %q", buf.String(), want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	Setup(&buf, "json")
+	defer Setup(nil, "")
+
+	Log(testRecord())
+	var m map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if m["user"] != "alice" || m["bytes_down"] != float64(56000) || m["duration"] != 2.5 {
+		t.Fatalf("unexpected record: %v", m)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	Setup(nil, "")
+	if Enabled() {
+		t.Fatal("access log should be disabled")
+	}
+	Log(testRecord()) // must not panic
+}
+
+func TestReason(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if r := Reason(ctx, io.EOF); r != "eof" {
+		t.Fatalf("expected eof, got %s", r)
+	}
+	if r := Reason(ctx, errors.New("connection refused")); r != "connection refused" {
+		t.Fatalf("unexpected reason %s", r)
+	}
+	cancel()
+	if r := Reason(ctx, nil); r != "shutdown" {
+		t.Fatalf("expected shutdown, got %s", r)
+	}
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	ipBoundIf   = 25  // IP_BOUND_IF
+	ipv6BoundIf = 125 // IPV6_BOUND_IF
+)
+
+// bindControl binds sockets to iface with IP_BOUND_IF.
+func bindControl(iface *net.Interface, _ int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if strings.HasSuffix(network, "6") {
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6BoundIf, iface.Index)
+			} else {
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipBoundIf, iface.Index)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
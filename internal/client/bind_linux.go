@@ -0,0 +1,25 @@
+package client
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindControl binds sockets to iface with SO_BINDTODEVICE and, if mark is
+// set, marks them with SO_MARK so firewall and policy rules can tell them
+// apart from tunneled traffic.
+func bindControl(iface *net.Interface, mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface.Name)
+			if serr == nil && mark != 0 {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !windows
+
+package client
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindControl is a no-op where there is no way to pin a socket to an
+// interface.
+func bindControl(iface *net.Interface, _ int) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
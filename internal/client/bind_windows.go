@@ -0,0 +1,35 @@
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	ipUnicastIf   = 31 // IP_UNICAST_IF
+	ipv6UnicastIf = 31 // IPV6_UNICAST_IF
+)
+
+// bindControl binds sockets to iface with IP_UNICAST_IF. The IPv4 option
+// takes the index in network byte order.
+func bindControl(iface *net.Interface, _ int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			h := syscall.Handle(fd)
+			if strings.HasSuffix(network, "6") {
+				serr = syscall.SetsockoptInt(h, syscall.IPPROTO_IPV6, ipv6UnicastIf, iface.Index)
+				return
+			}
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], uint32(iface.Index))
+			serr = syscall.SetsockoptInt(h, syscall.IPPROTO_IP, ipUnicastIf, int(binary.NativeEndian.Uint32(b[:])))
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
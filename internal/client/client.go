@@ -2,11 +2,14 @@ package client
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"paqet/internal/conf"
 	"paqet/internal/flog"
+	"paqet/internal/pkg/geoip"
 	"paqet/internal/pkg/iterator"
 	"paqet/internal/socket"
+	"paqet/internal/spa"
 	"paqet/internal/transport"
 	"sync"
 )
@@ -15,8 +18,11 @@ type Client struct {
 	cfg      *conf.Conf
 	iter     *iterator.Iterator[*timedConn]
 	udpPool  *udpPool
+	dgMuxes  sync.Map // tnet.DatagramConn -> *datagramMux
+	reverse  sync.Map // reverse rule ID -> *reverseRule
 	mu       sync.Mutex
-	protocol string // resolved protocol (set by probe for auto mode)
+	protocol string    // resolved protocol (set by probe for auto mode)
+	geo      *geoip.DB // country database for route rules
 }
 
 func New(cfg *conf.Conf) (*Client, error) {
@@ -26,6 +32,13 @@ func New(cfg *conf.Conf) (*Client, error) {
 		udpPool:  &udpPool{},
 		protocol: cfg.Transport.Protocol,
 	}
+	if cfg.Route != nil && cfg.Route.GeoIP != "" {
+		db, err := geoip.Open(cfg.Route.GeoIP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load GeoIP database: %w", err)
+		}
+		c.geo = db
+	}
 	return c, nil
 }
 
@@ -41,7 +54,7 @@ func (c *Client) Start(ctx context.Context) error {
 	}
 
 	for i := range c.cfg.Transport.Conn {
-		tc, err := newTimedConn(ctx, c.cfg, c.protocol)
+		tc, err := newTimedConn(ctx, c.cfg, c.protocol, c.acceptStrms)
 		if err != nil {
 			flog.Errorf("failed to establish connection %d: %v", i+1, err)
 			return err
@@ -75,7 +88,17 @@ func (c *Client) Start(ctx context.Context) error {
 func (c *Client) probeProtocols(ctx context.Context) (string, error) {
 	newConn := func() (net.PacketConn, error) {
 		netCfg := c.cfg.Network
-		return socket.New(ctx, &netCfg)
+		pConn, err := socket.New(ctx, &netCfg)
+		if err != nil {
+			return nil, err
+		}
+		if c.cfg.SPA != nil {
+			if err := spa.SendKnock(pConn, c.cfg.Server.Addr, c.cfg.SPA); err != nil {
+				pConn.Close()
+				return nil, err
+			}
+		}
+		return pConn, nil
 	}
 
 	results, err := transport.Probe(c.cfg.Server.Addr, &c.cfg.Transport, newConn)
@@ -3,33 +3,36 @@ package client
 import (
 	"fmt"
 	"paqet/internal/flog"
+	"paqet/internal/protocol"
 	"paqet/internal/tnet"
 	"time"
 )
 
 const maxRetries = 10
 
-func (c *Client) newConn() (tnet.Conn, error) {
+// newConn returns the next usable connection and the server features
+// negotiated on it.
+func (c *Client) newConn() (tnet.Conn, protocol.Features, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	tc := c.iter.Next()
-	conn := tc.getConn()
+	conn, peer := tc.getPeer()
 	if conn == nil {
 		tc.triggerReconnect()
-		return nil, fmt.Errorf("connection unavailable, reconnecting")
+		return nil, 0, fmt.Errorf("connection unavailable, reconnecting")
 	}
 	if err := conn.Ping(false); err != nil {
 		flog.Infof("connection lost, retrying....")
 		tc.triggerReconnect()
-		return nil, fmt.Errorf("connection lost, reconnecting")
+		return nil, 0, fmt.Errorf("connection lost, reconnecting")
 	}
 	go tc.sendTCPF(conn)
-	return conn, nil
+	return conn, peer, nil
 }
 
-func (c *Client) newStrm() (tnet.Strm, error) {
+func (c *Client) newStrm() (tnet.Strm, protocol.Features, error) {
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		conn, err := c.newConn()
+		conn, peer, err := c.newConn()
 		if err != nil {
 			flog.Debugf("session creation failed (attempt %d/%d), retrying", attempt+1, maxRetries)
 			backoff(attempt)
@@ -41,9 +44,9 @@ func (c *Client) newStrm() (tnet.Strm, error) {
 			backoff(attempt)
 			continue
 		}
-		return strm, nil
+		return strm, peer, nil
 	}
-	return nil, fmt.Errorf("failed to create stream after %d attempts", maxRetries)
+	return nil, 0, fmt.Errorf("failed to create stream after %d attempts", maxRetries)
 }
 
 func backoff(attempt int) {
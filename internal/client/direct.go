@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/tnet"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// directStrm is a TCP connection dialed from this machine, so inbounds can
+// treat it like a tunnel stream.
+type directStrm struct {
+	*net.TCPConn
+}
+
+func (s *directStrm) SID() int { return 0 }
+
+// directDialer dials from this machine. With TUN enabled the default
+// route points into the tunnel, so sockets are bound to the network
+// interface to leave through it and carry tun.mark past the kill switch.
+// With fake-IP DNS, names are resolved by asking the TUN DNS server over
+// that interface: the system resolver hands out fake IPs.
+func (c *Client) directDialer() *net.Dialer {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if c.cfg.TUN == nil {
+		return d
+	}
+	if c.cfg.Network.Interface != nil {
+		d.Control = bindControl(c.cfg.Network.Interface, c.cfg.TUN.Mark)
+	}
+	if c.cfg.TUN.FakeIP == "" {
+		return d
+	}
+	dns := net.JoinHostPort(c.cfg.TUN.DNS, "53")
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			rd := net.Dialer{Timeout: 5 * time.Second, Control: d.Control}
+			return rd.DialContext(ctx, network, dns)
+		},
+	}
+	return d
+}
+
+func (c *Client) tcpDirect(addr string) (tnet.Strm, error) {
+	conn, err := c.directDialer().Dial("tcp", addr)
+	if err != nil {
+		flog.Debugf("direct TCP to %s failed: %v", addr, err)
+		return nil, err
+	}
+	flog.Debugf("direct TCP connection established for %s", addr)
+	return &directStrm{TCPConn: conn.(*net.TCPConn)}, nil
+}
+
+func (c *Client) udpDirect(key uint64, lAddr, tAddr string) (UDPFlow, bool, uint64, error) {
+	if v, ok := c.udpPool.flows.Load(key); ok {
+		return v.(UDPFlow), false, key, nil
+	}
+	conn, err := c.directDialer().Dial("udp", tAddr)
+	if err != nil {
+		flog.Debugf("direct UDP to %s failed: %v", tAddr, err)
+		return nil, false, 0, err
+	}
+	var flow UDPFlow = &directFlow{conn: conn.(*net.UDPConn)}
+	if existing, loaded := c.udpPool.flows.LoadOrStore(key, flow); loaded {
+		flow.Close()
+		return existing.(UDPFlow), false, key, nil
+	}
+	flog.Debugf("direct UDP flow established for %s -> %s", lAddr, tAddr)
+	return flow, true, key, nil
+}
+
+// directFlow is a UDP flow over a local socket.
+type directFlow struct {
+	conn   *net.UDPConn
+	rx, tx atomic.Uint64
+}
+
+func (f *directFlow) WritePacket(b []byte) error {
+	n, err := f.conn.Write(b)
+	f.tx.Add(uint64(n))
+	return err
+}
+
+// ReadPacket turns the ICMP errors the socket reports into the
+// *buffer.Unreachable tunnel flows return.
+func (f *directFlow) ReadPacket(b []byte) (int, error) {
+	n, err := f.conn.Read(b)
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return 0, &buffer.Unreachable{Code: 3}
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return 0, &buffer.Unreachable{Code: 1}
+	case errors.Is(err, syscall.ENETUNREACH):
+		return 0, &buffer.Unreachable{Code: 0}
+	}
+	f.rx.Add(uint64(n))
+	return n, err
+}
+
+func (f *directFlow) SetReadDeadline(t time.Time) error { return f.conn.SetReadDeadline(t) }
+func (f *directFlow) SID() int                          { return 0 }
+func (f *directFlow) Close() error                      { return f.conn.Close() }
+func (f *directFlow) Rx() uint64                        { return f.rx.Load() }
+func (f *directFlow) Tx() uint64                        { return f.tx.Load() }
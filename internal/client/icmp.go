@@ -0,0 +1,26 @@
+package client
+
+import (
+	"errors"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+)
+
+// ErrICMPUnsupported is returned by ICMP when the server predates PICMP.
+var ErrICMPUnsupported = errors.New("server does not support ICMP tunneling")
+
+// ICMP opens a stream for one echo flow. The caller writes PICMP frames
+// carrying echo requests and reads PICMP frames carrying the replies.
+func (c *Client) ICMP() (tnet.Strm, error) {
+	strm, peer, err := c.newStrm()
+	if err != nil {
+		flog.Debugf("failed to create stream for ICMP: %v", err)
+		return nil, err
+	}
+	if !peer.Has(protocol.FeatICMP) {
+		strm.Close()
+		return nil, ErrICMPUnsupported
+	}
+	return strm, nil
+}
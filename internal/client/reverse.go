@@ -0,0 +1,123 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"sync/atomic"
+	"time"
+)
+
+// ErrReverseUnsupported is returned by Reverse when the server predates
+// reverse listeners.
+var ErrReverseUnsupported = errors.New("server does not support reverse listeners")
+
+// ReverseHandler serves a stream the server opened for a peer accepted on
+// a reverse listener. from is the peer's address as the server saw it.
+type ReverseHandler func(strm tnet.Strm, from string)
+
+// reverseRule is what a PRCONN stream is handed to.
+type reverseRule struct {
+	network string
+	handler ReverseHandler
+}
+
+// reverseCounter generates reverse rule IDs.
+var reverseCounter atomic.Uint64
+
+// ReverseListener is a listener the server holds open for this client.
+type ReverseListener struct {
+	c    *Client
+	id   uint64
+	strm tnet.Strm
+}
+
+// Reverse asks the server to listen on addr for network ("tcp" or "udp")
+// and hands every peer accepted there to h. Streams of TCP peers are
+// framed already when the server supports half-close.
+func (c *Client) Reverse(network, addr string, h ReverseHandler) (*ReverseListener, error) {
+	strm, peer, err := c.newStrm()
+	if err != nil {
+		flog.Debugf("failed to create stream for reverse %s %s: %v", network, addr, err)
+		return nil, err
+	}
+	if !peer.Has(protocol.FeatReverse) {
+		strm.Close()
+		return nil, ErrReverseUnsupported
+	}
+
+	lAddr, err := tnet.NewAddr(addr)
+	if err != nil {
+		strm.Close()
+		return nil, err
+	}
+	p := protocol.Proto{Type: protocol.PRTCP, Addr: lAddr, Flow: reverseCounter.Add(1)}
+	if network == "udp" {
+		p.Type = protocol.PRUDP
+	}
+
+	// Register first: the server may open streams as soon as it replies.
+	c.reverse.Store(p.Flow, &reverseRule{network: network, handler: h})
+	if err := p.Write(strm); err != nil {
+		c.reverse.Delete(p.Flow)
+		strm.Close()
+		return nil, err
+	}
+	if err := readReply(strm); err != nil {
+		c.reverse.Delete(p.Flow)
+		strm.Close()
+		return nil, err
+	}
+
+	flog.Debugf("reverse %s listener on %s established on stream %d", network, addr, strm.SID())
+	return &ReverseListener{c: c, id: p.Flow, strm: strm}, nil
+}
+
+// Wait blocks until the server closes the listener or the connection that
+// carries it fails.
+func (l *ReverseListener) Wait() {
+	io.Copy(io.Discard, l.strm)
+}
+
+// Close asks the server to stop listening.
+func (l *ReverseListener) Close() error {
+	l.c.reverse.Delete(l.id)
+	return l.strm.Close()
+}
+
+// acceptStrms serves the streams the server opens on conn until the
+// connection closes. peer is what the server announced on conn.
+func (c *Client) acceptStrms(conn tnet.Conn, peer protocol.Features) {
+	for {
+		strm, err := conn.AcceptStrm()
+		if err != nil {
+			return
+		}
+		go c.handleServerStrm(strm, peer)
+	}
+}
+
+func (c *Client) handleServerStrm(strm tnet.Strm, peer protocol.Features) {
+	strm.SetReadDeadline(time.Now().Add(replyTimeout))
+	var p protocol.Proto
+	if err := p.Read(strm); err != nil || p.Type != protocol.PRCONN {
+		flog.Debugf("unexpected server stream %d: %v", strm.SID(), err)
+		strm.Close()
+		return
+	}
+	strm.SetReadDeadline(time.Time{})
+
+	v, ok := c.reverse.Load(p.Flow)
+	if !ok {
+		flog.Debugf("server stream %d for unknown reverse rule %d", strm.SID(), p.Flow)
+		strm.Close()
+		return
+	}
+	rule := v.(*reverseRule)
+	if rule.network == "tcp" && peer.Has(protocol.FeatHalfClose) {
+		strm = tnet.Framed(strm)
+	}
+	rule.handler(strm, p.Addr.String())
+}
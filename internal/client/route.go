@@ -0,0 +1,121 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/hash"
+	"paqet/internal/tnet"
+	"strconv"
+)
+
+// ErrBlocked is returned by DialTCP and DialUDP for destinations the
+// routing rules block.
+var ErrBlocked = errors.New("blocked by routing rules")
+
+// Route returns the routing action for a connection from inbound to addr:
+// conf.RouteTunnel, conf.RouteDirect or conf.RouteBlock.
+func (c *Client) Route(inbound, addr string) string {
+	r := c.cfg.Route
+	if r == nil {
+		return conf.RouteTunnel
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	port, _ := strconv.Atoi(portStr)
+	action := r.Action(inbound, host, port, c.country)
+	flog.Debugf("route %s -> %s: %s", inbound, addr, action)
+	return action
+}
+
+func (c *Client) country(ip netip.Addr) string {
+	if c.geo == nil {
+		return ""
+	}
+	return c.geo.Country(ip)
+}
+
+// NeedsHost reports whether the name behind addr, an IP destination, is
+// worth waiting for: addr is a fake IP that means nothing to the server,
+// or the routing rules for inbound look at names.
+func (c *Client) NeedsHost(inbound, addr string) bool {
+	if c.cfg.Route != nil && c.cfg.Route.UsesNames(inbound) {
+		return true
+	}
+	if c.cfg.TUN == nil || c.cfg.TUN.FakeIP == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	pool, err := netip.ParsePrefix(c.cfg.TUN.FakeIP)
+	return err == nil && pool.Contains(ip.Unmap())
+}
+
+// DialTCP connects to addr for inbound as the routing rules decide: over
+// a tunnel stream like TCP, directly from this machine, or not at all.
+func (c *Client) DialTCP(inbound, addr string) (tnet.Strm, error) {
+	switch c.Route(inbound, addr) {
+	case conf.RouteBlock:
+		return nil, ErrBlocked
+	case conf.RouteDirect:
+		return c.tcpDirect(addr)
+	}
+	return c.TCP(addr)
+}
+
+// DialUDP is UDP with the routing rules applied. Direct flows share the
+// flow pool, so CloseUDP works for both.
+func (c *Client) DialUDP(inbound, lAddr, tAddr string) (UDPFlow, bool, uint64, error) {
+	return c.dialUDP(inbound, hash.AddrPair(lAddr, tAddr), lAddr, tAddr)
+}
+
+// DialUDPHost is DialUDP for a flow whose destination is known by name,
+// e.g. from sniffing: the flow is still looked up by lAddr and tAddr, but
+// a new one is routed and opened to host at tAddr's port.
+func (c *Client) DialUDPHost(inbound, lAddr, tAddr, host string) (UDPFlow, bool, uint64, error) {
+	dest := tAddr
+	if _, port, err := net.SplitHostPort(tAddr); err == nil && host != "" {
+		dest = net.JoinHostPort(host, port)
+	}
+	return c.dialUDP(inbound, hash.AddrPair(lAddr, tAddr), lAddr, dest)
+}
+
+// HasUDP reports whether a flow for lAddr and tAddr is open, so inbounds
+// know when a datagram starts a new one.
+func (c *Client) HasUDP(lAddr, tAddr string) bool {
+	_, ok := c.udpPool.flows.Load(hash.AddrPair(lAddr, tAddr))
+	return ok
+}
+
+func (c *Client) dialUDP(inbound string, key uint64, lAddr, tAddr string) (UDPFlow, bool, uint64, error) {
+	if v, ok := c.udpPool.flows.Load(key); ok {
+		return v.(UDPFlow), false, key, nil
+	}
+	switch c.Route(inbound, tAddr) {
+	case conf.RouteBlock:
+		return nil, false, 0, ErrBlocked
+	case conf.RouteDirect:
+		return c.udpDirect(key, lAddr, tAddr)
+	}
+	return c.udp(key, lAddr, tAddr)
+}
+
+// LogType is the access log type for a stream or flow returned by DialTCP
+// or DialUDP: typ for tunnel traffic and DIRECT otherwise.
+func LogType(v any, typ string) string {
+	switch v.(type) {
+	case *directStrm, *directFlow:
+		return "DIRECT"
+	}
+	return typ
+}
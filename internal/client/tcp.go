@@ -1,13 +1,19 @@
 package client
 
 import (
+	"fmt"
 	"paqet/internal/flog"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
+	"time"
 )
 
+// replyTimeout bounds the wait for the server's dial result; it sits above
+// the server's own 10s dial timeout.
+const replyTimeout = 15 * time.Second
+
 func (c *Client) TCP(addr string) (tnet.Strm, error) {
-	strm, err := c.newStrm()
+	strm, peer, err := c.newStrm()
 	if err != nil {
 		flog.Debugf("failed to create stream for TCP %s: %v", addr, err)
 		return nil, err
@@ -20,7 +26,8 @@ func (c *Client) TCP(addr string) (tnet.Strm, error) {
 		return nil, err
 	}
 
-	p := protocol.Proto{Type: protocol.PTCP, Addr: tAddr}
+	p := tcpHeader(peer, tAddr)
+	reply := p.Type == protocol.PTCPR
 	err = p.Write(strm)
 	if err != nil {
 		flog.Debugf("failed to write TCP protocol header for %s on stream %d: %v", addr, strm.SID(), err)
@@ -28,6 +35,48 @@ func (c *Client) TCP(addr string) (tnet.Strm, error) {
 		return nil, err
 	}
 
+	if reply {
+		if err := readReply(strm); err != nil {
+			flog.Debugf("TCP stream %d for %s rejected: %v", strm.SID(), addr, err)
+			strm.Close()
+			return nil, err
+		}
+	}
+
+	// Both ends frame the data from here on so either side can half-close.
+	if peer.Has(protocol.FeatHalfClose) {
+		strm = tnet.Framed(strm)
+	}
+
 	flog.Debugf("TCP stream %d established for %s", strm.SID(), addr)
 	return strm, nil
 }
+
+// tcpHeader builds the stream header for a TCP connection. Servers without
+// reply support get a plain PTCP; dial failures then only show up as a
+// closed stream.
+func tcpHeader(peer protocol.Features, addr *tnet.Addr) protocol.Proto {
+	if peer.Has(protocol.FeatReply) {
+		return protocol.Proto{Type: protocol.PTCPR, Addr: addr}
+	}
+	return protocol.Proto{Type: protocol.PTCP, Addr: addr}
+}
+
+// readReply waits for the PREPLY that answers a stream request and turns a
+// non-OK code into a *protocol.ReplyError.
+func readReply(strm tnet.Strm) error {
+	strm.SetReadDeadline(time.Now().Add(replyTimeout))
+	defer strm.SetReadDeadline(time.Time{})
+
+	var p protocol.Proto
+	if err := p.Read(strm); err != nil {
+		return err
+	}
+	if p.Type != protocol.PREPLY {
+		return fmt.Errorf("unexpected reply type %s", protocol.TypeName(p.Type))
+	}
+	if p.Code != protocol.ReplyOK {
+		return &protocol.ReplyError{Code: p.Code}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"testing"
+)
+
+func TestTCPHeaderFallback(t *testing.T) {
+	addr := &tnet.Addr{Host: "example.com", Port: 443}
+	tests := []struct {
+		peer protocol.Features
+		want protocol.PType
+	}{
+		{protocol.Legacy.Features, protocol.PTCP},
+		{protocol.FeatUDPFlow | protocol.FeatHalfClose, protocol.PTCP},
+		{protocol.FeatReply, protocol.PTCPR},
+		{protocol.Supported, protocol.PTCPR},
+	}
+	for _, tt := range tests {
+		p := tcpHeader(tt.peer, addr)
+		if p.Type != tt.want || p.Addr != addr {
+			t.Errorf("tcpHeader(%s) = %s, want %s", tt.peer, protocol.TypeName(p.Type), protocol.TypeName(tt.want))
+		}
+	}
+}
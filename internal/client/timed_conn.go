@@ -7,31 +7,40 @@ import (
 	"paqet/internal/flog"
 	"paqet/internal/protocol"
 	"paqet/internal/socket"
+	"paqet/internal/spa"
 	"paqet/internal/tnet"
 	"paqet/internal/transport"
 	"sync"
 	"time"
 )
 
+// helloTimeout bounds the wait for the server's hello answer.
+const helloTimeout = 5 * time.Second
+
 type timedConn struct {
 	cfg         *conf.Conf
 	conn        tnet.Conn
 	expire      time.Time
 	ctx         context.Context
-	protocol    string // resolved protocol name
+	protocol    string            // resolved protocol name
+	peer        protocol.Features // server features for conn, guarded by mu
+	accept      func(tnet.Conn, protocol.Features)
 	mu          sync.Mutex
 	reconnectCh chan struct{}
 }
 
-func newTimedConn(ctx context.Context, cfg *conf.Conf, proto string) (*timedConn, error) {
+// newTimedConn dials the server. accept serves the streams the server
+// opens on each connection.
+func newTimedConn(ctx context.Context, cfg *conf.Conf, proto string, accept func(tnet.Conn, protocol.Features)) (*timedConn, error) {
 	var err error
 	tc := &timedConn{
 		cfg:         cfg,
 		ctx:         ctx,
 		protocol:    proto,
+		accept:      accept,
 		reconnectCh: make(chan struct{}, 1),
 	}
-	tc.conn, err = tc.createConn()
+	tc.conn, tc.peer, err = tc.createConn()
 	if err != nil {
 		return nil, err
 	}
@@ -42,11 +51,17 @@ func newTimedConn(ctx context.Context, cfg *conf.Conf, proto string) (*timedConn
 	return tc, nil
 }
 
-func (tc *timedConn) createConn() (tnet.Conn, error) {
+func (tc *timedConn) createConn() (tnet.Conn, protocol.Features, error) {
 	netCfg := tc.cfg.Network
 	pConn, err := socket.New(tc.ctx, &netCfg)
 	if err != nil {
-		return nil, fmt.Errorf("could not create raw packet conn: %w", err)
+		return nil, 0, fmt.Errorf("could not create raw packet conn: %w", err)
+	}
+	if tc.cfg.SPA != nil {
+		if err := spa.SendKnock(pConn, tc.cfg.Server.Addr, tc.cfg.SPA); err != nil {
+			pConn.Close()
+			return nil, 0, fmt.Errorf("could not send knock: %w", err)
+		}
 	}
 
 	var conn tnet.Conn
@@ -58,27 +73,61 @@ func (tc *timedConn) createConn() (tnet.Conn, error) {
 	}
 	if err != nil {
 		pConn.Close()
-		return nil, err
+		return nil, 0, err
+	}
+	peer, err := exchangeHello(conn)
+	if err != nil {
+		conn.Close()
+		pConn.Close()
+		return nil, 0, err
 	}
 	err = tc.sendTCPF(conn)
 	if err != nil {
 		conn.Close()
 		pConn.Close()
-		return nil, err
+		return nil, 0, err
 	}
-	return conn, nil
+	go tc.accept(conn, peer)
+	return conn, peer, nil
 }
 
-func (tc *timedConn) waitConn() tnet.Conn {
+func (tc *timedConn) waitConn() (tnet.Conn, protocol.Features) {
 	for {
-		if c, err := tc.createConn(); err == nil {
-			return c
+		if c, peer, err := tc.createConn(); err == nil {
+			return c, peer
 		} else {
 			time.Sleep(time.Second)
 		}
 	}
 }
 
+// exchangeHello announces our protocol version on the first stream of conn
+// and returns the features the server supports. Servers that predate the
+// hello close the stream, which selects the legacy feature set.
+func exchangeHello(conn tnet.Conn) (protocol.Features, error) {
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return 0, err
+	}
+	defer strm.Close()
+
+	local := protocol.Local()
+	p := protocol.Proto{Type: protocol.PHELLO, Hello: &local}
+	if err := p.Write(strm); err != nil {
+		return 0, err
+	}
+
+	strm.SetReadDeadline(time.Now().Add(helloTimeout))
+	var reply protocol.Proto
+	if err := reply.Read(strm); err != nil || reply.Type != protocol.PHELLO {
+		flog.Infof("server did not answer hello (%v), using legacy protocol", err)
+		return protocol.Legacy.Features, nil
+	}
+	peer := reply.Hello.Features & protocol.Supported
+	flog.Debugf("server protocol v%d, features %s", reply.Hello.Version, peer)
+	return peer, nil
+}
+
 func (tc *timedConn) sendTCPF(conn tnet.Conn) error {
 	strm, err := conn.OpenStrm()
 	if err != nil {
@@ -137,10 +186,11 @@ func (tc *timedConn) reconnect() {
 	flog.Infof("reconnecting...")
 
 	// Use waitConn which retries until success.
-	newConn := tc.waitConn()
+	newConn, peer := tc.waitConn()
 
 	tc.mu.Lock()
 	tc.conn = newConn
+	tc.peer = peer
 	tc.mu.Unlock()
 
 	flog.Infof("reconnected successfully")
@@ -152,3 +202,11 @@ func (tc *timedConn) getConn() tnet.Conn {
 	defer tc.mu.Unlock()
 	return tc.conn
 }
+
+// getPeer returns the current connection with the server features
+// negotiated on it.
+func (tc *timedConn) getPeer() (tnet.Conn, protocol.Features) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.conn, tc.peer
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"net"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"testing"
+	"time"
+)
+
+type pipeStrm struct{ net.Conn }
+
+func (s pipeStrm) SID() int          { return 1 }
+func (s pipeStrm) CloseWrite() error { return tnet.ErrHalfClose }
+
+// helloConn opens one in-memory stream, whose far end is served by server.
+type helloConn struct {
+	tnet.Conn
+	server func(net.Conn)
+}
+
+func (c helloConn) OpenStrm() (tnet.Strm, error) {
+	strm, peer := net.Pipe()
+	go func() {
+		defer peer.Close()
+		peer.SetDeadline(time.Now().Add(time.Second))
+		c.server(peer)
+	}()
+	return pipeStrm{strm}, nil
+}
+
+func TestExchangeHello(t *testing.T) {
+	readHello := func(t *testing.T, c net.Conn) {
+		var p protocol.Proto
+		if err := p.Read(c); err != nil || p.Type != protocol.PHELLO || *p.Hello != protocol.Local() {
+			t.Errorf("client hello = %+v, %v", p.Hello, err)
+		}
+	}
+
+	// A server from before the hello closes the stream on the unknown type.
+	f, err := exchangeHello(helloConn{server: func(c net.Conn) { readHello(t, c) }})
+	if err != nil || f != protocol.Legacy.Features {
+		t.Errorf("legacy server: features = %s, %v", f, err)
+	}
+
+	f, err = exchangeHello(helloConn{server: func(c net.Conn) {
+		readHello(t, c)
+		h := protocol.Hello{Version: protocol.Version, Features: protocol.FeatReply | protocol.FeatHalfClose | 1<<15}
+		p := protocol.Proto{Type: protocol.PHELLO, Hello: &h}
+		p.Write(c)
+	}})
+	if want := protocol.FeatReply | protocol.FeatHalfClose; err != nil || f != want {
+		t.Errorf("features = %s, %v; want %s", f, err, want)
+	}
+}
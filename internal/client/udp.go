@@ -1,7 +1,7 @@
 package client
 
 import (
-	"context"
+	"paqet/internal/accesslog"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/hash"
 	"paqet/internal/protocol"
@@ -12,54 +12,85 @@ import (
 // udpStreamCounter generates unique keys for uncached UDP streams
 var udpStreamCounter uint64
 
-// UDP returns a cached or new UDP stream for the given address pair.
-// Used by TUN mode where stream reuse is beneficial.
-func (c *Client) UDP(lAddr, tAddr string) (tnet.Strm, bool, uint64, error) {
-	key := hash.AddrPair(lAddr, tAddr)
-	if v, ok := c.udpPool.strms.Load(key); ok {
-		strm := v.(tnet.Strm)
-		flog.Debugf("reusing UDP stream %d for %s -> %s", strm.SID(), lAddr, tAddr)
-		return strm, false, key, nil
+// UDP returns a cached or new UDP flow for the given address pair.
+// Used by SOCKS5 and TUN mode where flow reuse is beneficial. Flows use
+// transport datagrams when the connection supports them and a stream
+// otherwise.
+func (c *Client) UDP(lAddr, tAddr string) (UDPFlow, bool, uint64, error) {
+	return c.udp(hash.AddrPair(lAddr, tAddr), lAddr, tAddr)
+}
+
+// udp returns the flow cached under key or opens one from lAddr to tAddr.
+func (c *Client) udp(key uint64, lAddr, tAddr string) (UDPFlow, bool, uint64, error) {
+	if v, ok := c.udpPool.flows.Load(key); ok {
+		flow := v.(UDPFlow)
+		flog.Debugf("reusing UDP flow %d for %s -> %s", flow.SID(), lAddr, tAddr)
+		return flow, false, key, nil
 	}
 
-	strm, err := c.newStrm()
+	var flow UDPFlow
+	sess, err := c.UDPDatagramNew(tAddr)
+	if err != nil {
+		flog.Debugf("datagram session for %s -> %s failed, using a stream: %v", lAddr, tAddr, err)
+	}
+	if sess != nil {
+		flow = sess
+	} else {
+		strm, err := c.udpStrm(lAddr, tAddr, key)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		flow = &streamFlow{Strm: strm}
+	}
+
+	// Use LoadOrStore to handle concurrent insertions atomically
+	if existing, loaded := c.udpPool.flows.LoadOrStore(key, flow); loaded {
+		// Another goroutine already inserted, close our flow and use existing
+		flow.Close()
+		existingFlow := existing.(UDPFlow)
+		flog.Debugf("reusing UDP flow %d for %s -> %s (concurrent insert)", existingFlow.SID(), lAddr, tAddr)
+		return existingFlow, false, key, nil
+	}
+
+	flog.Debugf("established UDP flow %d for %s -> %s", flow.SID(), lAddr, tAddr)
+	return flow, true, key, nil
+}
+
+// udpStrm opens a counted UDP stream for the flow identified by key.
+func (c *Client) udpStrm(lAddr, tAddr string, key uint64) (*accesslog.Strm, error) {
+	strm, peer, err := c.newStrm()
 	if err != nil {
 		flog.Debugf("failed to create stream for UDP %s -> %s: %v", lAddr, tAddr, err)
-		return nil, false, 0, err
+		return nil, err
 	}
 
 	taddr, err := tnet.NewAddr(tAddr)
 	if err != nil {
 		flog.Debugf("invalid UDP address %s: %v", tAddr, err)
 		strm.Close()
-		return nil, false, 0, err
+		return nil, err
 	}
-	p := protocol.Proto{Type: protocol.PUDP, Addr: taddr}
+	// The pair hash, seeded per process, doubles as the flow ID so the
+	// server gives every local source its own outbound socket.
+	p := udpHeader(peer, taddr, key)
 	err = p.Write(strm)
 	if err != nil {
 		flog.Debugf("failed to write UDP protocol header for %s -> %s on stream %d: %v", lAddr, tAddr, strm.SID(), err)
 		strm.Close()
-		return nil, false, 0, err
-	}
-
-	// Use LoadOrStore to handle concurrent insertions atomically
-	if existing, loaded := c.udpPool.strms.LoadOrStore(key, strm); loaded {
-		// Another goroutine already inserted, close our stream and use existing
-		strm.Close()
-		existingStrm := existing.(tnet.Strm)
-		flog.Debugf("reusing UDP stream %d for %s -> %s (concurrent insert)", existingStrm.SID(), lAddr, tAddr)
-		return existingStrm, false, key, nil
+		return nil, err
 	}
 
-	flog.Debugf("established UDP stream %d for %s -> %s", strm.SID(), lAddr, tAddr)
-	return strm, true, key, nil
+	// Flows are shared by every packet, so they are counted here rather
+	// than by each caller.
+	return accesslog.Count(strm), nil
 }
 
 // UDPNew creates a new UDP stream without caching.
 // Used by forward mode for parallel streams to the same target.
+// Streams opened with the same flow share one server-side socket.
 // Returns the stream and a unique key for cleanup.
-func (c *Client) UDPNew(tAddr string) (tnet.Strm, uint64, error) {
-	strm, err := c.newStrm()
+func (c *Client) UDPNew(tAddr string, flow uint64) (tnet.Strm, uint64, error) {
+	strm, peer, err := c.newStrm()
 	if err != nil {
 		flog.Debugf("failed to create stream for UDP -> %s: %v", tAddr, err)
 		return nil, 0, err
@@ -71,7 +102,7 @@ func (c *Client) UDPNew(tAddr string) (tnet.Strm, uint64, error) {
 		strm.Close()
 		return nil, 0, err
 	}
-	p := protocol.Proto{Type: protocol.PUDP, Addr: taddr}
+	p := udpHeader(peer, taddr, flow)
 	err = p.Write(strm)
 	if err != nil {
 		flog.Debugf("failed to write UDP protocol header for -> %s on stream %d: %v", tAddr, strm.SID(), err)
@@ -86,6 +117,15 @@ func (c *Client) UDPNew(tAddr string) (tnet.Strm, uint64, error) {
 	return strm, key, nil
 }
 
+// udpHeader builds the stream header for a UDP flow. Servers without flow
+// support get a plain PUDP and one socket per stream.
+func udpHeader(peer protocol.Features, addr *tnet.Addr, flow uint64) protocol.Proto {
+	if peer.Has(protocol.FeatUDPFlow) {
+		return protocol.Proto{Type: protocol.PUDPF, Addr: addr, Flow: flow}
+	}
+	return protocol.Proto{Type: protocol.PUDP, Addr: addr}
+}
+
 // CloseUDPStream closes a stream directly (for UDPNew streams).
 func (c *Client) CloseUDPStream(strm tnet.Strm) {
 	if strm != nil {
@@ -96,77 +136,3 @@ func (c *Client) CloseUDPStream(strm tnet.Strm) {
 func (c *Client) CloseUDP(key uint64) error {
 	return c.udpPool.delete(key)
 }
-
-// UDPDatagramSession represents a datagram-based UDP forwarding session.
-// Uses QUIC datagrams for unreliable, high-throughput UDP forwarding.
-type UDPDatagramSession struct {
-	conn   tnet.DatagramConn
-	ctx    context.Context
-	cancel context.CancelFunc
-}
-
-// UDPDatagramNew creates a new datagram-based UDP session if the transport supports it.
-// Returns nil if datagrams are not supported (caller should fall back to streams).
-func (c *Client) UDPDatagramNew(ctx context.Context, tAddr string) (*UDPDatagramSession, error) {
-	// Get a connection and check if it supports datagrams
-	tc := c.iter.Next()
-	if tc == nil {
-		return nil, nil // No connections available
-	}
-
-	conn := tc.getConn()
-	if conn == nil {
-		return nil, nil
-	}
-
-	// Check if connection supports datagrams
-	dgConn, ok := conn.(tnet.DatagramConn)
-	if !ok || !dgConn.SupportsDatagrams() {
-		flog.Debugf("connection doesn't support datagrams, falling back to streams")
-		return nil, nil
-	}
-
-	// Open a control stream to register the datagram session
-	strm, err := conn.OpenStrm()
-	if err != nil {
-		return nil, err
-	}
-
-	taddr, err := tnet.NewAddr(tAddr)
-	if err != nil {
-		strm.Close()
-		return nil, err
-	}
-
-	// Send PUDPDGM protocol header to register datagram mode
-	p := protocol.Proto{Type: protocol.PUDPDGM, Addr: taddr}
-	if err := p.Write(strm); err != nil {
-		strm.Close()
-		return nil, err
-	}
-	strm.Close() // Control stream no longer needed
-
-	sessCtx, cancel := context.WithCancel(ctx)
-	flog.Infof("established UDP datagram session for -> %s", tAddr)
-
-	return &UDPDatagramSession{
-		conn:   dgConn,
-		ctx:    sessCtx,
-		cancel: cancel,
-	}, nil
-}
-
-// Send sends a UDP packet via QUIC datagram.
-func (s *UDPDatagramSession) Send(data []byte) error {
-	return s.conn.SendDatagram(data)
-}
-
-// Receive receives a UDP packet via QUIC datagram.
-func (s *UDPDatagramSession) Receive() ([]byte, error) {
-	return s.conn.ReceiveDatagram(s.ctx)
-}
-
-// Close closes the datagram session.
-func (s *UDPDatagramSession) Close() {
-	s.cancel()
-}
@@ -0,0 +1,270 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"paqet/internal/accesslog"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPFlow carries the packets of one local UDP flow through the tunnel.
+type UDPFlow interface {
+	WritePacket(b []byte) error
+	// ReadPacket returns a *buffer.Unreachable when the target answered
+	// with an ICMP destination unreachable; the flow stays usable.
+	ReadPacket(b []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+	SID() int // stream ID, for logs
+	Close() error
+	Rx() uint64
+	Tx() uint64
+}
+
+// streamFlow sends length-framed packets over a reliable stream.
+type streamFlow struct {
+	*accesslog.Strm
+}
+
+func (f *streamFlow) WritePacket(b []byte) error {
+	return buffer.WriteUDPFrame(f.Strm, b)
+}
+
+func (f *streamFlow) ReadPacket(b []byte) (int, error) {
+	return buffer.ReadUDPFrame(f.Strm, b)
+}
+
+// dgramSessionCounter generates datagram session IDs.
+var dgramSessionCounter atomic.Uint64
+
+// dgramQueueLen is how many received packets a session buffers before it
+// drops, as a congested link would.
+const dgramQueueLen = 256
+
+type dgramPacket struct {
+	data []byte
+	err  error
+}
+
+// UDPDatagramSession is a UDP flow over unreliable transport datagrams.
+// Every datagram starts with the session ID as a uvarint. The PUDPDGM
+// stream that opened the session stays open: packets too large for a
+// datagram and unreachable notices travel on it, and closing it ends the
+// session on both sides. The server drops datagrams for sessions it has
+// not registered yet, so packets go over the stream until its PREPLY
+// confirms the session.
+type UDPDatagramSession struct {
+	id    uint64
+	conn  tnet.DatagramConn
+	strm  tnet.Strm
+	mux   *datagramMux
+	ready atomic.Bool // the server confirmed the session
+
+	recv     chan dgramPacket
+	done     chan struct{}
+	once     sync.Once
+	deadline atomic.Pointer[time.Time]
+
+	rx, tx atomic.Uint64
+}
+
+// UDPDatagramNew opens a datagram session to tAddr. It returns nil without
+// an error when the connection or the server lacks datagram support; the
+// caller then falls back to streams.
+func (c *Client) UDPDatagramNew(tAddr string) (*UDPDatagramSession, error) {
+	conn, peer, err := c.newConn()
+	if err != nil {
+		return nil, err
+	}
+	dgConn, ok := conn.(tnet.DatagramConn)
+	if !ok || !dgConn.SupportsDatagrams() || !peer.Has(protocol.FeatDatagram) {
+		return nil, nil
+	}
+
+	taddr, err := tnet.NewAddr(tAddr)
+	if err != nil {
+		return nil, err
+	}
+	strm, err := conn.OpenStrm()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &UDPDatagramSession{
+		id:   dgramSessionCounter.Add(1),
+		conn: dgConn,
+		strm: strm,
+		recv: make(chan dgramPacket, dgramQueueLen),
+		done: make(chan struct{}),
+	}
+	s.mux = c.datagramMux(dgConn)
+	s.mux.sessions.Store(s.id, s)
+
+	p := protocol.Proto{Type: protocol.PUDPDGM, Addr: taddr, Flow: s.id}
+	if err := p.Write(strm); err != nil {
+		s.Close()
+		return nil, err
+	}
+	go s.readStrm()
+
+	flog.Debugf("established UDP datagram session %d on stream %d for -> %s", s.id, strm.SID(), tAddr)
+	return s, nil
+}
+
+// readStrm waits for the server to confirm the session, then queues the
+// packets that arrive on the session stream and ends the session when the
+// server closes it.
+func (s *UDPDatagramSession) readStrm() {
+	defer s.Close()
+	if err := readReply(s.strm); err != nil {
+		flog.Debugf("UDP datagram session %d on stream %d failed: %v", s.id, s.strm.SID(), err)
+		return
+	}
+	s.ready.Store(true)
+
+	bufp := buffer.UPool.Get().(*[]byte)
+	defer buffer.UPool.Put(bufp)
+	buf := *bufp
+	for {
+		n, err := buffer.ReadUDPFrame(s.strm, buf)
+		var unreach *buffer.Unreachable
+		switch {
+		case errors.As(err, &unreach):
+			s.deliver(dgramPacket{err: err})
+		case err != nil:
+			return
+		default:
+			s.deliver(dgramPacket{data: append([]byte(nil), buf[:n]...)})
+		}
+	}
+}
+
+func (s *UDPDatagramSession) deliver(p dgramPacket) {
+	select {
+	case s.recv <- p:
+	default:
+	}
+}
+
+// WritePacket sends b as one datagram, or over the session stream if it
+// does not fit or the server has not confirmed the session yet.
+func (s *UDPDatagramSession) WritePacket(b []byte) error {
+	ready := s.ready.Load()
+	var err error
+	if ready {
+		bufp := buffer.UPool.Get().(*[]byte)
+		defer buffer.UPool.Put(bufp)
+		dg := binary.AppendUvarint((*bufp)[:0], s.id)
+		dg = append(dg, b...)
+		err = s.conn.SendDatagram(dg)
+	}
+	if !ready || errors.Is(err, tnet.ErrDatagramTooLarge) {
+		err = buffer.WriteUDPFrame(s.strm, b)
+	}
+	if err != nil {
+		return err
+	}
+	s.tx.Add(uint64(len(b)))
+	return nil
+}
+
+// ReadPacket returns the next packet from either path.
+func (s *UDPDatagramSession) ReadPacket(b []byte) (int, error) {
+	var timeout <-chan time.Time
+	if d := s.deadline.Load(); d != nil {
+		t := time.NewTimer(time.Until(*d))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p := <-s.recv:
+		if p.err != nil {
+			return 0, p.err
+		}
+		if len(p.data) > len(b) {
+			return 0, io.ErrShortBuffer
+		}
+		s.rx.Add(uint64(len(p.data)))
+		return copy(b, p.data), nil
+	case <-s.done:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *UDPDatagramSession) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		s.deadline.Store(nil)
+	} else {
+		s.deadline.Store(&t)
+	}
+	return nil
+}
+
+func (s *UDPDatagramSession) SID() int { return s.strm.SID() }
+
+// Close ends the session. The server tears down its side when the
+// session stream closes.
+func (s *UDPDatagramSession) Close() error {
+	s.once.Do(func() {
+		s.mux.sessions.Delete(s.id)
+		close(s.done)
+		s.strm.Close()
+	})
+	return nil
+}
+
+func (s *UDPDatagramSession) Rx() uint64 { return s.rx.Load() }
+func (s *UDPDatagramSession) Tx() uint64 { return s.tx.Load() }
+
+// datagramMux hands the datagrams received on one connection to their
+// sessions.
+type datagramMux struct {
+	conn     tnet.DatagramConn
+	sessions sync.Map // uint64 -> *UDPDatagramSession
+}
+
+// datagramMux returns the receiver for conn, starting it on first use.
+func (c *Client) datagramMux(conn tnet.DatagramConn) *datagramMux {
+	m := &datagramMux{conn: conn}
+	if v, loaded := c.dgMuxes.LoadOrStore(conn, m); loaded {
+		return v.(*datagramMux)
+	}
+	go func() {
+		m.run()
+		c.dgMuxes.Delete(conn)
+	}()
+	return m
+}
+
+// run dispatches datagrams until the connection fails, then ends every
+// session on it.
+func (m *datagramMux) run() {
+	defer m.sessions.Range(func(_, v any) bool {
+		v.(*UDPDatagramSession).Close()
+		return true
+	})
+	for {
+		data, err := m.conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			flog.Debugf("datagram receiver for %s stopped: %v", m.conn.RemoteAddr(), err)
+			return
+		}
+		id, n := binary.Uvarint(data)
+		if n <= 0 {
+			continue
+		}
+		if v, ok := m.sessions.Load(id); ok {
+			v.(*UDPDatagramSession).deliver(dgramPacket{data: data[n:]})
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"testing"
+	"time"
+)
+
+// sendConn records the datagrams sent on it.
+type sendConn struct {
+	tnet.DatagramConn
+	sent chan []byte
+}
+
+func (c *sendConn) SendDatagram(b []byte) error {
+	c.sent <- append([]byte(nil), b...)
+	return nil
+}
+
+func TestDatagramSessionWaitsForReply(t *testing.T) {
+	c, peer := net.Pipe()
+	defer peer.Close()
+	conn := &sendConn{sent: make(chan []byte, 1)}
+	s := &UDPDatagramSession{
+		id:   5,
+		conn: conn,
+		strm: pipeStrm{c},
+		mux:  &datagramMux{},
+		recv: make(chan dgramPacket, dgramQueueLen),
+		done: make(chan struct{}),
+	}
+	go s.readStrm()
+
+	// Unconfirmed, the packet goes over the stream.
+	go s.WritePacket([]byte("first"))
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	if n, err := buffer.ReadUDPFrame(peer, buf); err != nil || string(buf[:n]) != "first" {
+		t.Fatalf("stream frame %q, %v", buf[:n], err)
+	}
+	select {
+	case dg := <-conn.sent:
+		t.Fatalf("datagram %q sent before the server confirmed the session", dg)
+	default:
+	}
+
+	ok := protocol.Proto{Type: protocol.PREPLY, Code: protocol.ReplyOK}
+	if err := ok.Write(peer); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); !s.ready.Load(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("session not ready after the reply")
+		}
+	}
+	if err := s.WritePacket([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	want := append(binary.AppendUvarint(nil, s.id), "second"...)
+	if dg := <-conn.sent; string(dg) != string(want) {
+		t.Errorf("datagram = %q, want %q", dg, want)
+	}
+}
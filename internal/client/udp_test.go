@@ -0,0 +1,24 @@
+package client
+
+import (
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"testing"
+)
+
+func TestUDPHeaderFallback(t *testing.T) {
+	addr := &tnet.Addr{Host: "192.0.2.1", Port: 51820}
+
+	p := udpHeader(protocol.Legacy.Features, addr, 42)
+	if p.Type != protocol.PUDP || p.Flow != 0 {
+		t.Errorf("legacy server got %s with flow %d, want PUDP without flow", protocol.TypeName(p.Type), p.Flow)
+	}
+	p = udpHeader(protocol.FeatReply, addr, 42)
+	if p.Type != protocol.PUDP {
+		t.Errorf("server without udp-flow got %s, want PUDP", protocol.TypeName(p.Type))
+	}
+	p = udpHeader(protocol.FeatUDPFlow, addr, 42)
+	if p.Type != protocol.PUDPF || p.Flow != 42 || p.Addr != addr {
+		t.Errorf("udp-flow server got %s with flow %d, want PUDPF with flow 42", protocol.TypeName(p.Type), p.Flow)
+	}
+}
@@ -0,0 +1,107 @@
+package conf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Bandwidth configures server-side traffic shaping. Upload is client to
+// target, download is target to client. Users are the names from spa.users;
+// clients without one are shaped per source IP.
+type Bandwidth struct {
+	Global  RateLimit `yaml:"global"`
+	PerUser RateLimit `yaml:"per_user"`
+	PerConn RateLimit `yaml:"per_conn"`
+}
+
+// RateLimit is an upload/download limit such as "10mbit" or "2MB" per second.
+// Empty or "0" disables a direction.
+type RateLimit struct {
+	Upload_   string `yaml:"upload"`
+	Download_ string `yaml:"download"`
+	Burst_    string `yaml:"burst"` // bytes, e.g. "1MB"; default one second of traffic
+
+	Upload   int64 `yaml:"-"` // bytes per second
+	Download int64 `yaml:"-"`
+	Burst    int64 `yaml:"-"`
+}
+
+func (b *Bandwidth) validate() []error {
+	var errors []error
+	errors = append(errors, b.Global.validate("bandwidth.global")...)
+	errors = append(errors, b.PerUser.validate("bandwidth.per_user")...)
+	errors = append(errors, b.PerConn.validate("bandwidth.per_conn")...)
+	return errors
+}
+
+func (r *RateLimit) validate(name string) []error {
+	var errors []error
+	var err error
+	if r.Upload, err = ParseRate(r.Upload_); err != nil {
+		errors = append(errors, fmt.Errorf("%s.upload: %v", name, err))
+	}
+	if r.Download, err = ParseRate(r.Download_); err != nil {
+		errors = append(errors, fmt.Errorf("%s.download: %v", name, err))
+	}
+	if r.Burst, err = ParseSize(r.Burst_); err != nil {
+		errors = append(errors, fmt.Errorf("%s.burst: %v", name, err))
+	}
+	return errors
+}
+
+// ParseRate parses a rate into bytes per second. Byte units (B, KB, MB, GB)
+// are powers of 1024; bit units (kbit, mbit, gbit) are powers of 1000.
+// A bare number is bytes per second.
+func ParseRate(s string) (int64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	for _, u := range []struct {
+		suffix string
+		bits   int64
+	}{{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1}} {
+		if num, ok := strings.CutSuffix(lower, u.suffix); ok {
+			n, err := parseNumber(num)
+			if err != nil {
+				return 0, fmt.Errorf("invalid rate '%s'", s)
+			}
+			return int64(n * float64(u.bits) / 8), nil
+		}
+	}
+	n, err := ParseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate '%s'", s)
+	}
+	return n, nil
+}
+
+// ParseSize parses a byte count with an optional B, KB, MB, GB or TB suffix
+// (powers of 1024). Empty means zero.
+func ParseSize(s string) (int64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	if lower == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}} {
+		if num, ok := strings.CutSuffix(lower, u.suffix); ok {
+			lower, mult = num, u.mult
+			break
+		}
+	}
+	n, err := parseNumber(lower)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+func parseNumber(s string) (float64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number '%s'", s)
+	}
+	return n, nil
+}
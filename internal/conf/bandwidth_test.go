@@ -0,0 +1,34 @@
+package conf
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"1000", 1000},
+		{"2MB", 2 << 20},
+		{"512kb", 512 << 10},
+		{"10mbit", 1250000},
+		{"1.5 Gbit", 187500000},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if err != nil {
+			t.Errorf("ParseRate(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"fast", "-1MB", "10 parsecs"} {
+		if _, err := ParseRate(bad); err == nil {
+			t.Errorf("ParseRate(%q) should fail", bad)
+		}
+	}
+}
@@ -11,15 +11,22 @@ import (
 )
 
 type Conf struct {
-	Role      string    `yaml:"role"`
-	Log       Log       `yaml:"log"`
-	Listen    Server    `yaml:"listen"`
-	SOCKS5    []SOCKS5  `yaml:"socks5"`
-	Forward   []Forward `yaml:"forward"`
-	TUN       *TUN      `yaml:"tun"`
-	Network   Network   `yaml:"network"`
-	Server    Server    `yaml:"server"`
-	Transport Transport `yaml:"transport"`
+	Role      string      `yaml:"role"`
+	Log       Log         `yaml:"log"`
+	Listen    Server      `yaml:"listen"`
+	SOCKS5    []SOCKS5    `yaml:"socks5"`
+	HTTPProxy []HTTPProxy `yaml:"http_proxy"`
+	Forward   []Forward   `yaml:"forward"`
+	Reverse   []Reverse   `yaml:"reverse"`
+	TProxy    []TProxy    `yaml:"tproxy"`
+	TUN       *TUN        `yaml:"tun"`
+	Network   Network     `yaml:"network"`
+	Server    Server      `yaml:"server"`
+	Transport Transport   `yaml:"transport"`
+	SPA       *SPA        `yaml:"spa"`
+	Egress    *Egress     `yaml:"egress"`
+	Route     *Route      `yaml:"route"`
+	DNS       *DNS        `yaml:"dns"`
 }
 
 func LoadFromFile(path string) (*Conf, error) {
@@ -53,15 +60,36 @@ func (c *Conf) setDefaults() {
 	for i := range c.SOCKS5 {
 		c.SOCKS5[i].setDefaults()
 	}
+	for i := range c.HTTPProxy {
+		c.HTTPProxy[i].setDefaults()
+	}
 	for i := range c.Forward {
 		c.Forward[i].setDefaults()
 	}
+	for i := range c.Reverse {
+		c.Reverse[i].setDefaults()
+	}
+	for i := range c.TProxy {
+		c.TProxy[i].setDefaults()
+	}
 	if c.TUN != nil {
 		c.TUN.setDefaults()
 	}
+	if c.Route != nil {
+		c.Route.setDefaults()
+	}
+	if c.DNS != nil {
+		c.DNS.setDefaults()
+	}
 	c.Network.setDefaults(c.Role)
 	c.Server.setDefaults()
 	c.Transport.setDefaults(c.Role)
+	if c.SPA != nil {
+		c.SPA.setDefaults()
+	}
+	if c.Egress != nil {
+		c.Egress.setDefaults()
+	}
 
 	// Optimize MTU based on configured IP version if not explicitly set
 	c.optimizeMTU()
@@ -99,8 +127,8 @@ func (c *Conf) validate() error {
 	var allErrors []error
 
 	allErrors = append(allErrors, c.Log.validate()...)
-	if c.Role == "client" && len(c.SOCKS5) == 0 && len(c.Forward) == 0 && c.TUN == nil {
-		flog.Warnf("warning: client mode enabled but no SOCKS5, forward, or TUN configurations found")
+	if c.Role == "client" && len(c.SOCKS5) == 0 && len(c.HTTPProxy) == 0 && len(c.Forward) == 0 && len(c.Reverse) == 0 && len(c.TProxy) == 0 && c.TUN == nil && (c.DNS == nil || c.DNS.Listen_ == "") {
+		flog.Warnf("warning: client mode enabled but no SOCKS5, HTTP proxy, forward, reverse, tproxy, TUN, or DNS listener configurations found")
 	}
 	if c.TUN != nil {
 		errs := c.TUN.validate()
@@ -114,6 +142,13 @@ func (c *Conf) validate() error {
 			allErrors = append(allErrors, fmt.Errorf("socks5[%d] %v", i, err))
 		}
 	}
+	for i := range c.HTTPProxy {
+		errs := c.HTTPProxy[i].validate()
+		for _, err := range errs {
+			allErrors = append(allErrors, fmt.Errorf("http_proxy[%d] %v", i, err))
+		}
+	}
+	allErrors = append(allErrors, c.pairMixed()...)
 
 	for i := range c.Forward {
 		errs := c.Forward[i].validate()
@@ -122,8 +157,34 @@ func (c *Conf) validate() error {
 		}
 	}
 
+	for i := range c.Reverse {
+		errs := c.Reverse[i].validate()
+		for _, err := range errs {
+			allErrors = append(allErrors, fmt.Errorf("reverse[%d] %v", i, err))
+		}
+	}
+
+	for i := range c.TProxy {
+		errs := c.TProxy[i].validate()
+		for _, err := range errs {
+			allErrors = append(allErrors, fmt.Errorf("tproxy[%d] %v", i, err))
+		}
+	}
+
 	allErrors = append(allErrors, c.Network.validate()...)
 	allErrors = append(allErrors, c.Transport.validate()...)
+	if c.SPA != nil {
+		allErrors = append(allErrors, c.SPA.validate()...)
+	}
+	if c.Egress != nil {
+		allErrors = append(allErrors, c.Egress.validate()...)
+	}
+	if c.Route != nil {
+		allErrors = append(allErrors, c.Route.validate()...)
+	}
+	if c.DNS != nil {
+		allErrors = append(allErrors, c.DNS.validate()...)
+	}
 	if c.Role == "server" {
 		allErrors = append(allErrors, c.Listen.validate()...)
 	} else {
@@ -0,0 +1,111 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS is the client's built-in resolver. It forwards queries through the
+// tunnel as DNS-over-TCP, caches the answers and serves TUN DNS traffic
+// plus, when Listen_ is set, a UDP and TCP listener of its own.
+type DNS struct {
+	Listen_   string        `yaml:"listen"`     // optional standalone listener
+	Upstream  string        `yaml:"upstream"`   // default server, host or host:port
+	Servers   []DNSServer   `yaml:"servers"`    // per-domain upstream overrides
+	CacheSize int           `yaml:"cache_size"` // cached answers
+	MaxTTL    time.Duration `yaml:"max_ttl"`    // upper bound for cached TTLs
+	Listen    *net.UDPAddr  `yaml:"-"`
+}
+
+// DNSServer sends queries for Domain and its subdomains to Upstream.
+type DNSServer struct {
+	Domain   []string `yaml:"domain"`
+	Upstream string   `yaml:"upstream"`
+}
+
+func (d *DNS) setDefaults() {
+	if d.Upstream == "" {
+		d.Upstream = "8.8.8.8:53"
+	}
+	if d.CacheSize == 0 {
+		d.CacheSize = 4096
+	}
+	if d.MaxTTL == 0 {
+		d.MaxTTL = time.Hour
+	}
+}
+
+func (d *DNS) validate() []error {
+	var errors []error
+	if d.Listen_ != "" {
+		addr, err := validateAddr(d.Listen_, true)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("dns.listen: %v", err))
+		}
+		d.Listen = addr
+	}
+	up, err := dnsUpstream(d.Upstream)
+	if err != nil {
+		errors = append(errors, fmt.Errorf("dns.upstream: %v", err))
+	}
+	d.Upstream = up
+	if d.CacheSize < 0 {
+		errors = append(errors, fmt.Errorf("dns.cache_size: must not be negative"))
+	}
+	if d.MaxTTL < time.Second {
+		errors = append(errors, fmt.Errorf("dns.max_ttl: must be at least 1s"))
+	}
+	for i := range d.Servers {
+		s := &d.Servers[i]
+		up, err := dnsUpstream(s.Upstream)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("dns.servers[%d].upstream: %v", i, err))
+		}
+		s.Upstream = up
+		if len(s.Domain) == 0 {
+			errors = append(errors, fmt.Errorf("dns.servers[%d].domain: at least one domain is required", i))
+		}
+		for j, dom := range s.Domain {
+			dom = strings.TrimSuffix(strings.ToLower(strings.TrimPrefix(strings.TrimSpace(dom), "*.")), ".")
+			if dom == "" || strings.ContainsAny(dom, "/: ") {
+				errors = append(errors, fmt.Errorf("dns.servers[%d].domain: invalid domain %q", i, s.Domain[j]))
+			}
+			s.Domain[j] = dom
+		}
+	}
+	return errors
+}
+
+// dnsUpstream adds the default port to a server address.
+func dnsUpstream(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", fmt.Errorf("address is required")
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = strings.Trim(s, "[]"), "53"
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("invalid port in %q", s)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// UpstreamFor returns the server for queries about name: the override
+// with the longest matching domain, or the default upstream.
+func (d *DNS) UpstreamFor(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	best, bestLen := d.Upstream, -1
+	for _, s := range d.Servers {
+		for _, dom := range s.Domain {
+			if (name == dom || strings.HasSuffix(name, "."+dom)) && len(dom) > bestLen {
+				best, bestLen = s.Upstream, len(dom)
+			}
+		}
+	}
+	return best
+}
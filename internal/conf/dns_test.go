@@ -0,0 +1,58 @@
+package conf
+
+import "testing"
+
+func TestDNSValidate(t *testing.T) {
+	d := DNS{
+		Listen_:  "127.0.0.1:5353",
+		Upstream: "1.1.1.1",
+		Servers: []DNSServer{
+			{Domain: []string{"*.Corp.Example."}, Upstream: "10.0.0.53"},
+			{Domain: []string{"dev.corp.example"}, Upstream: "[fd00::53]:5353"},
+		},
+	}
+	d.setDefaults()
+	if errs := d.validate(); len(errs) != 0 {
+		t.Fatalf("validate: %v", errs)
+	}
+	if d.Upstream != "1.1.1.1:53" || d.Servers[0].Upstream != "10.0.0.53:53" {
+		t.Errorf("default port not added: %q, %q", d.Upstream, d.Servers[0].Upstream)
+	}
+	if d.Servers[0].Domain[0] != "corp.example" {
+		t.Errorf("domain not normalized: %q", d.Servers[0].Domain[0])
+	}
+	if d.Listen == nil || d.Listen.Port != 5353 {
+		t.Errorf("listen = %v", d.Listen)
+	}
+
+	bad := DNS{Upstream: "8.8.8.8:x", Servers: []DNSServer{{Upstream: "10.0.0.53"}}}
+	bad.setDefaults()
+	if errs := bad.validate(); len(errs) != 2 {
+		t.Errorf("bad port and missing domain: got %v", errs)
+	}
+}
+
+func TestDNSUpstreamFor(t *testing.T) {
+	d := DNS{
+		Upstream: "8.8.8.8:53",
+		Servers: []DNSServer{
+			{Domain: []string{"corp.example"}, Upstream: "10.0.0.53:53"},
+			{Domain: []string{"dev.corp.example"}, Upstream: "10.0.1.53:53"},
+		},
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com.", "8.8.8.8:53"},
+		{"corp.example", "10.0.0.53:53"},
+		{"WWW.Corp.Example.", "10.0.0.53:53"},
+		{"a.dev.corp.example", "10.0.1.53:53"},
+		{"notcorp.example", "8.8.8.8:53"},
+	}
+	for _, tt := range tests {
+		if got := d.UpstreamFor(tt.name); got != tt.want {
+			t.Errorf("UpstreamFor(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Egress sends the server's outbound traffic through upstream proxies
+// instead of dialing targets from the server's own address.
+type Egress struct {
+	Upstreams map[string]*Upstream `yaml:"upstreams"`
+	Rules     []EgressRule         `yaml:"rules"`
+	Default   string               `yaml:"default"` // upstream name or "direct"
+}
+
+// Upstream is one egress hop.
+type Upstream struct {
+	Type     string `yaml:"type"` // socks5, http or paqet
+	Addr     string `yaml:"addr"` // socks5 and http: proxy address
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Config   string `yaml:"config"` // paqet: client configuration of the next server
+}
+
+// EgressRule routes the destinations it matches through Via. The first
+// matching rule wins.
+type EgressRule struct {
+	Dest []string `yaml:"dest"` // domains (with their subdomains), IPs or CIDRs
+	Via  string   `yaml:"via"`  // upstream name or "direct"
+
+	domains  []string
+	prefixes []netip.Prefix
+}
+
+func (e *Egress) setDefaults() {
+	if e.Default == "" {
+		e.Default = "direct"
+	}
+}
+
+func (e *Egress) validate() []error {
+	var errors []error
+	for name, u := range e.Upstreams {
+		if name == "direct" {
+			errors = append(errors, fmt.Errorf("egress.upstreams: \"direct\" is reserved"))
+		}
+		if u == nil {
+			errors = append(errors, fmt.Errorf("egress.upstreams.%s: empty upstream", name))
+			continue
+		}
+		errors = append(errors, u.validate("egress.upstreams."+name)...)
+	}
+	if !e.known(e.Default) {
+		errors = append(errors, fmt.Errorf("egress.default: unknown upstream %q", e.Default))
+	}
+	for i := range e.Rules {
+		r := &e.Rules[i]
+		if !e.known(r.Via) {
+			errors = append(errors, fmt.Errorf("egress.rules[%d].via: unknown upstream %q", i, r.Via))
+		}
+		if len(r.Dest) == 0 {
+			errors = append(errors, fmt.Errorf("egress.rules[%d].dest: at least one destination is required", i))
+		}
+		if err := r.parse(); err != nil {
+			errors = append(errors, fmt.Errorf("egress.rules[%d].dest: %v", i, err))
+		}
+	}
+	return errors
+}
+
+func (e *Egress) known(name string) bool {
+	_, ok := e.Upstreams[name]
+	return ok || name == "direct"
+}
+
+func (u *Upstream) validate(name string) []error {
+	var errors []error
+	switch u.Type {
+	case "socks5", "http":
+		if _, _, err := net.SplitHostPort(u.Addr); err != nil {
+			errors = append(errors, fmt.Errorf("%s.addr: %v", name, err))
+		}
+	case "paqet":
+		if u.Config == "" {
+			errors = append(errors, fmt.Errorf("%s.config is required for paqet upstreams", name))
+		} else if _, err := os.Stat(u.Config); err != nil {
+			errors = append(errors, fmt.Errorf("%s.config: %v", name, err))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("%s.type must be 'socks5', 'http' or 'paqet'", name))
+	}
+	return errors
+}
+
+func (r *EgressRule) parse() error {
+	r.domains, r.prefixes = nil, nil
+	for _, d := range r.Dest {
+		d = strings.TrimSpace(d)
+		if p, err := netip.ParsePrefix(d); err == nil {
+			r.prefixes = append(r.prefixes, p.Masked())
+			continue
+		}
+		if a, err := netip.ParseAddr(d); err == nil {
+			r.prefixes = append(r.prefixes, netip.PrefixFrom(a, a.BitLen()))
+			continue
+		}
+		d = strings.ToLower(strings.TrimPrefix(d, "*."))
+		if d == "" || strings.ContainsAny(d, "/: ") {
+			return fmt.Errorf("invalid destination %q", d)
+		}
+		r.domains = append(r.domains, strings.TrimSuffix(d, "."))
+	}
+	return nil
+}
+
+// Match reports whether host, a domain name or an IP address, is one of
+// the rule's destinations. IP ranges only match IP destinations; names
+// are not resolved.
+func (r *EgressRule) Match(host string) bool {
+	if a, err := netip.ParseAddr(host); err == nil {
+		a = a.Unmap()
+		for _, p := range r.prefixes {
+			if p.Contains(a) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range r.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Route returns the upstream name for host.
+func (e *Egress) Route(host string) string {
+	for i := range e.Rules {
+		if e.Rules[i].Match(host) {
+			return e.Rules[i].Via
+		}
+	}
+	return e.Default
+}
@@ -0,0 +1,43 @@
+package conf
+
+import "testing"
+
+func TestEgressRoute(t *testing.T) {
+	e := Egress{
+		Upstreams: map[string]*Upstream{
+			"resi": {Type: "socks5", Addr: "192.0.2.1:1080"},
+			"corp": {Type: "http", Addr: "proxy.example:3128"},
+		},
+		Rules: []EgressRule{
+			{Dest: []string{"netflix.com", "*.hulu.com"}, Via: "resi"},
+			{Dest: []string{"10.0.0.0/8", "2001:db8::1"}, Via: "corp"},
+		},
+	}
+	e.setDefaults()
+	if errs := e.validate(); len(errs) != 0 {
+		t.Fatalf("validate: %v", errs)
+	}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"netflix.com", "resi"},
+		{"www.Netflix.com.", "resi"},
+		{"notnetflix.com", "direct"},
+		{"hulu.com", "resi"},
+		{"10.1.2.3", "corp"},
+		{"2001:db8::1", "corp"},
+		{"11.0.0.1", "direct"},
+	}
+	for _, tt := range tests {
+		if got := e.Route(tt.host); got != tt.want {
+			t.Errorf("Route(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+
+	bad := Egress{Rules: []EgressRule{{Dest: []string{"x.com"}, Via: "nowhere"}}}
+	bad.setDefaults()
+	if errs := bad.validate(); len(errs) == 0 {
+		t.Errorf("unknown upstream should fail validation")
+	}
+}
@@ -6,6 +6,7 @@ import (
 )
 
 type Forward struct {
+	Name     string       `yaml:"name"` // inbound name for routing rules
 	Listen_  string       `yaml:"listen"`
 	Target_  string       `yaml:"target"`
 	Protocol string       `yaml:"protocol"`
@@ -15,6 +16,9 @@ type Forward struct {
 }
 
 func (c *Forward) setDefaults() {
+	if c.Name == "" {
+		c.Name = "forward"
+	}
 	if c.Streams == 0 {
 		c.Streams = 8 // Default to 8 parallel streams
 	}
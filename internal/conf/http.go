@@ -0,0 +1,63 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+)
+
+// HTTPProxy is an HTTP proxy inbound. When its listen address is also a
+// SOCKS5 listen address, both share one port and each connection is served
+// by the protocol it starts with.
+type HTTPProxy struct {
+	Name     string       `yaml:"name"` // inbound name for routing rules
+	Listen_  string       `yaml:"listen"`
+	Username string       `yaml:"username"`
+	Password string       `yaml:"password"`
+	Listen   *net.UDPAddr `yaml:"-"`
+	Mixed    bool         `yaml:"-"` // served by the SOCKS5 listener on the same address
+}
+
+func (c *HTTPProxy) setDefaults() {
+	if c.Name == "" {
+		c.Name = "http"
+	}
+}
+func (c *HTTPProxy) validate() []error {
+	var errors []error
+
+	addr, err := validateAddr(c.Listen_, true)
+	if err != nil {
+		errors = append(errors, err)
+	}
+	c.Listen = addr
+	if c.Password != "" && c.Username == "" {
+		errors = append(errors, fmt.Errorf("username is required when a password is set"))
+	}
+	return errors
+}
+
+// pairMixed attaches every HTTP proxy to the SOCKS5 inbound listening on
+// the same address, if any.
+func (c *Conf) pairMixed() []error {
+	var errors []error
+	for i := range c.HTTPProxy {
+		h := &c.HTTPProxy[i]
+		if h.Listen == nil {
+			continue
+		}
+		for j := range c.SOCKS5 {
+			s := &c.SOCKS5[j]
+			if s.Listen == nil || s.Listen.String() != h.Listen.String() {
+				continue
+			}
+			if s.HTTP != nil {
+				errors = append(errors, fmt.Errorf("http_proxy[%d] listen %s is already shared with another HTTP proxy", i, h.Listen))
+				break
+			}
+			s.HTTP = h
+			h.Mixed = true
+			break
+		}
+	}
+	return errors
+}
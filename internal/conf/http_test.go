@@ -0,0 +1,39 @@
+package conf
+
+import "testing"
+
+func TestPairMixed(t *testing.T) {
+	c := Conf{
+		SOCKS5:    []SOCKS5{{Listen_: "127.0.0.1:1080"}, {Listen_: "127.0.0.1:1081"}},
+		HTTPProxy: []HTTPProxy{{Listen_: "127.0.0.1:1080"}, {Listen_: "127.0.0.1:8080"}},
+	}
+	for i := range c.SOCKS5 {
+		c.SOCKS5[i].validate()
+	}
+	for i := range c.HTTPProxy {
+		c.HTTPProxy[i].validate()
+	}
+	if errs := c.pairMixed(); len(errs) != 0 {
+		t.Fatalf("pairMixed: %v", errs)
+	}
+	if c.SOCKS5[0].HTTP != &c.HTTPProxy[0] || !c.HTTPProxy[0].Mixed {
+		t.Errorf("http_proxy[0] should share socks5[0]'s listener")
+	}
+	if c.SOCKS5[1].HTTP != nil || c.HTTPProxy[1].Mixed {
+		t.Errorf("http_proxy[1] should listen on its own")
+	}
+
+	c.HTTPProxy = append(c.HTTPProxy, HTTPProxy{Listen_: "127.0.0.1:1080"})
+	c.HTTPProxy[2].validate()
+	c.SOCKS5[0].HTTP = nil
+	if errs := c.pairMixed(); len(errs) != 1 {
+		t.Errorf("two HTTP proxies on one SOCKS5 port: got %d errors, want 1", len(errs))
+	}
+}
+
+func TestHTTPProxyValidate(t *testing.T) {
+	h := HTTPProxy{Listen_: "127.0.0.1:8080", Password: "secret"}
+	if errs := h.validate(); len(errs) != 1 {
+		t.Errorf("password without username: got %v", errs)
+	}
+}
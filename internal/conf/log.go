@@ -2,37 +2,124 @@ package conf
 
 import (
 	"fmt"
+	"slices"
+	"time"
 )
 
+// LogSubsystems are the names accepted under log.levels.
+var LogSubsystems = []string{"socket", "transport", "socks", "tun", "http", "tproxy", "dns"}
+
 type Log struct {
-	Level_ string `yaml:"level"`
+	Level_  string            `yaml:"level"`
+	Format  string            `yaml:"format"` // text or json
+	Levels_ map[string]string `yaml:"levels"` // per-subsystem level overrides
+
+	// File output, stdout when File is empty.
+	File           string        `yaml:"file"`
+	MaxSize_       string        `yaml:"max_size"`        // rotate at this size, e.g. "100MB"
+	RotateInterval time.Duration `yaml:"rotate_interval"` // rotate files older than this
+	MaxBackups     int           `yaml:"max_backups"`
+	Compress       bool          `yaml:"compress"`
+
+	// Per-stream access log, off when nil.
+	Access *AccessLog `yaml:"access"`
 
-	Level int `yaml:"-"`
+	Level   int            `yaml:"-"`
+	Levels  map[string]int `yaml:"-"`
+	MaxSize int64          `yaml:"-"`
+}
+
+// AccessLog writes one record per finished stream. It shares the rotation
+// settings of the main log.
+type AccessLog struct {
+	File   string `yaml:"file"`   // path, or "stdout"
+	Format string `yaml:"format"` // json or clf
 }
 
 func (l *Log) setDefaults() {
 	if l.Level_ == "" {
 		l.Level_ = "none"
 	}
+	if l.Format == "" {
+		l.Format = "text"
+	}
+	if l.Access != nil && l.Access.Format == "" {
+		l.Access.Format = "clf"
+	}
+	if l.File != "" || l.Access != nil {
+		if l.MaxSize_ == "" {
+			l.MaxSize_ = "100MB"
+		}
+		if l.MaxBackups == 0 {
+			l.MaxBackups = 5
+		}
+	}
 }
 
 func (l *Log) validate() []error {
 	var errors []error
-	switch l.Level_ {
+	level, err := parseLogLevel(l.Level_)
+	if err != nil {
+		errors = append(errors, err)
+	}
+	l.Level = level
+
+	if l.Format != "text" && l.Format != "json" {
+		errors = append(errors, fmt.Errorf("invalid log format '%s': must be text or json", l.Format))
+	}
+
+	l.Levels = make(map[string]int, len(l.Levels_))
+	for name, lvl := range l.Levels_ {
+		if !slices.Contains(LogSubsystems, name) {
+			errors = append(errors, fmt.Errorf("unknown log subsystem '%s': must be one of %v", name, LogSubsystems))
+			continue
+		}
+		level, err := parseLogLevel(lvl)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("log.levels.%s: %v", name, err))
+			continue
+		}
+		l.Levels[name] = level
+	}
+
+	if l.Access != nil {
+		if l.Access.File == "" {
+			errors = append(errors, fmt.Errorf("log.access.file is required"))
+		}
+		if l.Access.Format != "json" && l.Access.Format != "clf" {
+			errors = append(errors, fmt.Errorf("invalid access log format '%s': must be json or clf", l.Access.Format))
+		}
+	}
+
+	if l.File != "" || l.Access != nil {
+		if l.MaxSize, err = ParseSize(l.MaxSize_); err != nil {
+			errors = append(errors, fmt.Errorf("log.max_size: %v", err))
+		}
+		if l.RotateInterval < 0 {
+			errors = append(errors, fmt.Errorf("log.rotate_interval must not be negative"))
+		}
+		if l.MaxBackups < 0 {
+			errors = append(errors, fmt.Errorf("log.max_backups must not be negative"))
+		}
+	}
+	return errors
+}
+
+func parseLogLevel(s string) (int, error) {
+	switch s {
 	case "none":
-		l.Level = -1
+		return -1, nil
 	case "debug":
-		l.Level = 0
+		return 0, nil
 	case "info":
-		l.Level = 1
+		return 1, nil
 	case "warn":
-		l.Level = 2
+		return 2, nil
 	case "error":
-		l.Level = 3
+		return 3, nil
 	case "fatal":
-		l.Level = 4
+		return 4, nil
 	default:
-		errors = append(errors, fmt.Errorf("invalid logging level '%s': must be one of none, debug, info, warn, error, fatal", l.Level_))
+		return 0, fmt.Errorf("invalid logging level '%s': must be one of none, debug, info, warn, error, fatal", s)
 	}
-	return errors
 }
@@ -0,0 +1,26 @@
+package conf
+
+import "testing"
+
+func TestLogLevels(t *testing.T) {
+	for _, name := range []string{"http", "tproxy", "dns"} {
+		c := Log{Levels_: map[string]string{name: "debug"}}
+		c.setDefaults()
+		if errs := c.validate(); len(errs) != 0 {
+			t.Errorf("log.levels.%s: %v", name, errs)
+		} else if c.Levels[name] != 0 {
+			t.Errorf("log.levels.%s = %d, want debug", name, c.Levels[name])
+		}
+	}
+
+	for _, bad := range []map[string]string{
+		{"nosuch": "debug"},
+		{"http": "loud"},
+	} {
+		c := Log{Levels_: bad}
+		c.setDefaults()
+		if errs := c.validate(); len(errs) == 0 {
+			t.Errorf("log.levels %v should fail validation", bad)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package conf
+
+import (
+	"fmt"
+	"net/netip"
+	"paqet/internal/tnet"
+	"strconv"
+	"strings"
+)
+
+// Reverse asks the server to listen on Listen and carries every connection
+// accepted there back to the client, which dials Target (like ssh -R).
+type Reverse struct {
+	Listen_  string     `yaml:"listen"` // server-side address, e.g. "0.0.0.0:2222"
+	Target_  string     `yaml:"target"` // dialed on the client's side
+	Protocol string     `yaml:"protocol"`
+	Listen   *tnet.Addr `yaml:"-"`
+	Target   *tnet.Addr `yaml:"-"`
+}
+
+func (c *Reverse) setDefaults() {
+	if c.Protocol == "" {
+		c.Protocol = "tcp"
+	}
+}
+
+func (c *Reverse) validate() []error {
+	var errors []error
+	l, err := tnet.NewAddr(c.Listen_)
+	if err != nil {
+		errors = append(errors, fmt.Errorf("listen: %v", err))
+	} else if l.Port < 1 || l.Port > 65535 {
+		errors = append(errors, fmt.Errorf("listen port must be between 1-65535"))
+	}
+	c.Listen = l
+
+	t, err := tnet.NewAddr(c.Target_)
+	if err != nil {
+		errors = append(errors, fmt.Errorf("target: %v", err))
+	}
+	c.Target = t
+
+	if c.Protocol != "tcp" && c.Protocol != "udp" {
+		errors = append(errors, fmt.Errorf("protocol must be 'tcp' or 'udp'"))
+	}
+	return errors
+}
+
+// ReversePolicy controls which reverse listeners clients may open on the
+// server. Without it in the listen block, or without ports, every request
+// is denied.
+type ReversePolicy struct {
+	Addrs_ []string `yaml:"addrs"` // bind IPs clients may ask for (default: 0.0.0.0); loopback only if listed
+	Ports_ []string `yaml:"ports"` // "2222" or "8000-8100"
+
+	addrs []netip.Addr
+	ports [][2]int
+}
+
+func (r *ReversePolicy) validate() []error {
+	var errors []error
+	r.addrs = nil
+	if len(r.Addrs_) == 0 {
+		r.addrs = []netip.Addr{netip.IPv4Unspecified()}
+	}
+	for _, s := range r.Addrs_ {
+		a, err := netip.ParseAddr(strings.TrimSpace(s))
+		if err != nil {
+			errors = append(errors, fmt.Errorf("reverse.addrs: invalid IP address %q", s))
+			continue
+		}
+		r.addrs = append(r.addrs, a.Unmap())
+	}
+	r.ports = nil
+	for _, s := range r.Ports_ {
+		lo, hi, err := parsePortRange(s)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("reverse.ports: %v", err))
+			continue
+		}
+		r.ports = append(r.ports, [2]int{lo, hi})
+	}
+	return errors
+}
+
+// Allows reports whether a client may listen on host and port. host must
+// be one of the allowed IPs; an empty host binds every address and needs
+// an unspecified one.
+func (r *ReversePolicy) Allows(host string, port int) bool {
+	if !r.allowsAddr(host) {
+		return false
+	}
+	for _, pr := range r.ports {
+		if port >= pr[0] && port <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ReversePolicy) allowsAddr(host string) bool {
+	for _, a := range r.addrs {
+		if host == "" && a.IsUnspecified() {
+			return true
+		}
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	for _, a := range r.addrs {
+		if ip.Unmap() == a {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePortRange(s string) (int, int, error) {
+	loStr, hiStr, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	lo, err := strconv.Atoi(strings.TrimSpace(loStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.Atoi(strings.TrimSpace(hiStr)); err != nil {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return lo, hi, nil
+}
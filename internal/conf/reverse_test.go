@@ -0,0 +1,56 @@
+package conf
+
+import "testing"
+
+func TestReversePolicyAllows(t *testing.T) {
+	p := ReversePolicy{Ports_: []string{"2222", "8000-8100"}}
+	if errs := p.validate(); len(errs) != 0 {
+		t.Fatalf("validate: %v", errs)
+	}
+	tests := []struct {
+		host string
+		port int
+		want bool
+	}{
+		{"0.0.0.0", 2222, true},
+		{"0.0.0.0", 2223, false},
+		{"0.0.0.0", 8000, true},
+		{"0.0.0.0", 8100, true},
+		{"0.0.0.0", 8101, false},
+		{"", 2222, true},
+		{"127.0.0.1", 2222, false},
+		{"::ffff:127.0.0.1", 2222, false},
+		{"localhost", 2222, false},
+		{"10.0.0.100", 2222, false},
+	}
+	for _, tt := range tests {
+		if got := p.Allows(tt.host, tt.port); got != tt.want {
+			t.Errorf("Allows(%q, %d) = %v, want %v", tt.host, tt.port, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"ssh", "0", "9000-8000", "1-70000"} {
+		p := ReversePolicy{Ports_: []string{bad}}
+		if errs := p.validate(); len(errs) == 0 {
+			t.Errorf("ports %q should fail", bad)
+		}
+	}
+	if errs := (&ReversePolicy{Addrs_: []string{"localhost"}}).validate(); len(errs) == 0 {
+		t.Errorf("addrs must be IP addresses")
+	}
+
+	listed := ReversePolicy{Addrs_: []string{"127.0.0.1", "10.0.0.100"}, Ports_: []string{"2222"}}
+	listed.validate()
+	if !listed.Allows("127.0.0.1", 2222) || !listed.Allows("10.0.0.100", 2222) {
+		t.Errorf("listed addresses should be allowed")
+	}
+	if listed.Allows("0.0.0.0", 2222) || listed.Allows("", 2222) {
+		t.Errorf("wildcard binds need an unspecified address in addrs")
+	}
+
+	var empty ReversePolicy
+	empty.validate()
+	if empty.Allows("0.0.0.0", 443) {
+		t.Errorf("policy without ports should deny")
+	}
+}
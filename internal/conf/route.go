@@ -0,0 +1,225 @@
+package conf
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Route actions.
+const (
+	RouteTunnel = "tunnel" // through the paqet server
+	RouteDirect = "direct" // dialed from the client machine
+	RouteBlock  = "block"  // refused
+)
+
+// Route decides per connection whether client inbounds tunnel, dial
+// directly or block.
+type Route struct {
+	GeoIP   string      `yaml:"geoip"` // MaxMind country database (.mmdb) for geoip conditions
+	Rules   []RouteRule `yaml:"rules"`
+	Default string      `yaml:"default"` // action when no rule matches
+}
+
+// RouteRule applies Action to connections that match all the kinds of
+// condition it sets. Within a kind any entry may match, and the
+// destination kinds (cidr, domain, keyword, regex, geoip) count as one:
+// the destination must match at least one of them. The first matching
+// rule wins.
+type RouteRule struct {
+	Action  string   `yaml:"action"`
+	CIDR    []string `yaml:"cidr"`    // IPs or CIDRs
+	Domain  []string `yaml:"domain"`  // domains with their subdomains
+	Keyword []string `yaml:"keyword"` // substrings of the domain
+	Regex   []string `yaml:"regex"`   // regular expressions on the domain
+	GeoIP   []string `yaml:"geoip"`   // ISO country codes of the IP
+	Port    []string `yaml:"port"`    // destination ports or ranges
+	Inbound []string `yaml:"inbound"` // inbound names
+
+	prefixes []netip.Prefix
+	domains  []string
+	keywords []string
+	regexps  []*regexp.Regexp
+	ports    [][2]int
+}
+
+func (r *Route) setDefaults() {
+	if r.Default == "" {
+		r.Default = RouteTunnel
+	}
+}
+
+func (r *Route) validate() []error {
+	var errors []error
+	if !validAction(r.Default) {
+		errors = append(errors, fmt.Errorf("route.default must be 'tunnel', 'direct' or 'block'"))
+	}
+	geo := false
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		for _, err := range rule.parse() {
+			errors = append(errors, fmt.Errorf("route.rules[%d].%v", i, err))
+		}
+		geo = geo || len(rule.GeoIP) > 0
+	}
+	if geo && r.GeoIP == "" {
+		errors = append(errors, fmt.Errorf("route.geoip: a database is required for geoip rules"))
+	} else if r.GeoIP != "" {
+		if _, err := os.Stat(r.GeoIP); err != nil {
+			errors = append(errors, fmt.Errorf("route.geoip: %v", err))
+		}
+	}
+	return errors
+}
+
+func validAction(a string) bool {
+	return a == RouteTunnel || a == RouteDirect || a == RouteBlock
+}
+
+func (r *RouteRule) parse() []error {
+	var errors []error
+	if !validAction(r.Action) {
+		errors = append(errors, fmt.Errorf("action must be 'tunnel', 'direct' or 'block'"))
+	}
+
+	r.prefixes, r.domains, r.keywords, r.regexps, r.ports = nil, nil, nil, nil, nil
+	for _, c := range r.CIDR {
+		c = strings.TrimSpace(c)
+		if p, err := netip.ParsePrefix(c); err == nil {
+			r.prefixes = append(r.prefixes, p.Masked())
+		} else if a, err := netip.ParseAddr(c); err == nil {
+			r.prefixes = append(r.prefixes, netip.PrefixFrom(a, a.BitLen()))
+		} else {
+			errors = append(errors, fmt.Errorf("cidr: invalid CIDR or IP %q", c))
+		}
+	}
+	for _, d := range r.Domain {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "*.")), ".")
+		if d == "" || strings.ContainsAny(d, "/: ") {
+			errors = append(errors, fmt.Errorf("domain: invalid domain %q", d))
+			continue
+		}
+		r.domains = append(r.domains, d)
+	}
+	for _, k := range r.Keyword {
+		if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+			r.keywords = append(r.keywords, k)
+		}
+	}
+	for _, s := range r.Regex {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("regex: %v", err))
+			continue
+		}
+		r.regexps = append(r.regexps, re)
+	}
+	for i, c := range r.GeoIP {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if len(c) != 2 {
+			errors = append(errors, fmt.Errorf("geoip: invalid country code %q", r.GeoIP[i]))
+		}
+		r.GeoIP[i] = c
+	}
+	for _, s := range r.Port {
+		lo, hi, err := parsePortRange(s)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("port: %v", err))
+			continue
+		}
+		r.ports = append(r.ports, [2]int{lo, hi})
+	}
+	return errors
+}
+
+// Match reports whether a connection from inbound to host:port matches
+// the rule. host is a domain name or an IP address; names are not
+// resolved, so IP conditions only match IP destinations and name
+// conditions only names. country is only called for geoip conditions.
+func (r *RouteRule) Match(inbound, host string, port int, country func(netip.Addr) string) bool {
+	if len(r.Inbound) > 0 && !containsFold(r.Inbound, inbound) {
+		return false
+	}
+	if len(r.ports) > 0 {
+		in := false
+		for _, pr := range r.ports {
+			in = in || (port >= pr[0] && port <= pr[1])
+		}
+		if !in {
+			return false
+		}
+	}
+	if len(r.prefixes)+len(r.domains)+len(r.keywords)+len(r.regexps)+len(r.GeoIP) == 0 {
+		return true
+	}
+
+	if a, err := netip.ParseAddr(host); err == nil {
+		a = a.Unmap()
+		for _, p := range r.prefixes {
+			if p.Contains(a) {
+				return true
+			}
+		}
+		if len(r.GeoIP) > 0 && country != nil {
+			if c := country(a); c != "" && containsFold(r.GeoIP, c) {
+				return true
+			}
+		}
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range r.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	for _, k := range r.keywords {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	for _, re := range r.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Action returns the action for a connection from inbound to host:port.
+func (r *Route) Action(inbound, host string, port int, country func(netip.Addr) string) string {
+	for i := range r.Rules {
+		if r.Rules[i].Match(inbound, host, port, country) {
+			return r.Rules[i].Action
+		}
+	}
+	return r.Default
+}
+
+// UsesNames reports whether a rule for inbound has domain, keyword or
+// regex conditions, i.e. whether the name behind an IP destination can
+// change the action.
+func (r *Route) UsesNames(inbound string) bool {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		if len(rule.Inbound) > 0 && !containsFold(rule.Inbound, inbound) {
+			continue
+		}
+		if len(rule.domains)+len(rule.keywords)+len(rule.regexps) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package conf
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRouteAction(t *testing.T) {
+	r := Route{
+		Rules: []RouteRule{
+			{Action: RouteBlock, Keyword: []string{"ads"}},
+			{Action: RouteDirect, Domain: []string{"example.cn"}, CIDR: []string{"10.0.0.0/8"}},
+			{Action: RouteDirect, GeoIP: []string{"cn"}},
+			{Action: RouteBlock, Port: []string{"25", "6881-6889"}, Inbound: []string{"lan"}},
+			{Action: RouteTunnel, Regex: []string{`^api[0-9]+\.`}},
+			{Action: RouteDirect, Inbound: []string{"home"}},
+		},
+	}
+	r.setDefaults()
+	if errs := r.validate(); len(errs) != 1 {
+		t.Fatalf("validate: got %v, want only the missing geoip database", errs)
+	}
+	country := func(a netip.Addr) string {
+		if a == netip.MustParseAddr("1.2.4.8") {
+			return "CN"
+		}
+		return ""
+	}
+
+	tests := []struct {
+		inbound, host string
+		port          int
+		want          string
+	}{
+		{"socks5", "ads.example.com", 443, RouteBlock},
+		{"socks5", "www.example.cn", 443, RouteDirect},
+		{"socks5", "example.cn", 443, RouteDirect},
+		{"socks5", "notexample.cn", 443, RouteTunnel},
+		{"socks5", "10.1.2.3", 80, RouteDirect},
+		{"socks5", "1.2.4.8", 80, RouteDirect},
+		{"socks5", "8.8.8.8", 80, RouteTunnel},
+		{"lan", "8.8.8.8", 25, RouteBlock},
+		{"lan", "8.8.8.8", 6885, RouteBlock},
+		{"socks5", "8.8.8.8", 25, RouteTunnel},
+		{"home", "api1.example.com", 443, RouteTunnel},
+		{"HOME", "www.example.com", 443, RouteDirect},
+	}
+	for _, tt := range tests {
+		if got := r.Action(tt.inbound, tt.host, tt.port, country); got != tt.want {
+			t.Errorf("Action(%s, %s:%d) = %s, want %s", tt.inbound, tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestRouteValidate(t *testing.T) {
+	for _, bad := range []RouteRule{
+		{Action: "proxy"},
+		{Action: RouteBlock, CIDR: []string{"10.0.0.0/33"}},
+		{Action: RouteBlock, Regex: []string{"("}},
+		{Action: RouteBlock, Port: []string{"0"}},
+		{Action: RouteBlock, GeoIP: []string{"CHN"}},
+	} {
+		r := Route{GeoIP: "", Rules: []RouteRule{bad}}
+		r.setDefaults()
+		if errs := r.validate(); len(errs) == 0 {
+			t.Errorf("%+v should fail validation", bad)
+		}
+	}
+	r := Route{Default: "drop"}
+	if errs := r.validate(); len(errs) != 1 {
+		t.Errorf("default 'drop': got %v", errs)
+	}
+}
+
+func TestRouteUsesNames(t *testing.T) {
+	r := Route{
+		Rules: []RouteRule{
+			{Action: RouteDirect, CIDR: []string{"10.0.0.0/8"}},
+			{Action: RouteBlock, Keyword: []string{"ads"}, Inbound: []string{"tun"}},
+		},
+	}
+	r.setDefaults()
+	if errs := r.validate(); len(errs) != 0 {
+		t.Fatalf("validate: %v", errs)
+	}
+	if !r.UsesNames("tun") {
+		t.Error("tun has a keyword rule")
+	}
+	if r.UsesNames("socks5") {
+		t.Error("socks5 only has IP rules")
+	}
+}
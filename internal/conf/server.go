@@ -1,15 +1,51 @@
 package conf
 
 import (
+	"fmt"
 	"net"
+	"time"
 )
 
 type Server struct {
 	Addr_ string       `yaml:"addr"`
 	Addr  *net.UDPAddr `yaml:"-"`
+
+	// Session limits, only used for the server's listen block.
+	MaxSessions      int           `yaml:"max_sessions"`
+	MaxSessionsPerIP int           `yaml:"max_sessions_per_ip"`
+	SessionIdle      time.Duration `yaml:"session_idle_timeout"`
+
+	// Concurrent stream caps, only used for the server's listen block.
+	MaxStreams        int `yaml:"max_streams"`          // all clients together
+	MaxStreamsPerUser int `yaml:"max_streams_per_user"` // all connections of one user; 0 for no cap
+	MaxStreamsPerConn int `yaml:"max_streams_per_conn"` // one transport connection; 0 for no cap
+
+	// Traffic shaping, only used for the server's listen block.
+	Bandwidth *Bandwidth `yaml:"bandwidth"`
+	// Traffic accounting and quotas, only used for the server's listen block.
+	Usage *Usage `yaml:"usage"`
+	// Reverse listeners clients may open, only used for the server's listen block.
+	Reverse *ReversePolicy `yaml:"reverse"`
+}
+
+func (s *Server) setDefaults() {
+	if s.MaxSessions == 0 {
+		s.MaxSessions = 4096
+	}
+	if s.MaxSessionsPerIP == 0 {
+		s.MaxSessionsPerIP = 64
+	}
+	if s.SessionIdle == 0 {
+		s.SessionIdle = 2 * time.Minute
+	}
+	if s.MaxStreams == 0 {
+		s.MaxStreams = 1024
+	}
+	if s.Usage != nil {
+		s.Usage.setDefaults()
+	}
 }
 
-func (s *Server) setDefaults() {}
 func (s *Server) validate() []error {
 	var errors []error
 	addr, err := validateAddr(s.Addr_, true)
@@ -18,6 +54,34 @@ func (s *Server) validate() []error {
 	}
 	s.Addr = addr
 
+	if s.MaxSessions < 1 || s.MaxSessions > 1<<20 {
+		errors = append(errors, fmt.Errorf("max_sessions must be between 1-%d", 1<<20))
+	}
+	if s.MaxSessionsPerIP < 1 || s.MaxSessionsPerIP > s.MaxSessions {
+		errors = append(errors, fmt.Errorf("max_sessions_per_ip must be between 1 and max_sessions"))
+	}
+	if s.SessionIdle < 10*time.Second || s.SessionIdle > time.Hour {
+		errors = append(errors, fmt.Errorf("session_idle_timeout must be between 10s-1h"))
+	}
+	if s.MaxStreams < 1 || s.MaxStreams > 1<<20 {
+		errors = append(errors, fmt.Errorf("max_streams must be between 1-%d", 1<<20))
+	}
+	if s.MaxStreamsPerUser < 0 || s.MaxStreamsPerUser > s.MaxStreams {
+		errors = append(errors, fmt.Errorf("max_streams_per_user must be between 0 and max_streams"))
+	}
+	if s.MaxStreamsPerConn < 0 || (s.MaxStreamsPerUser > 0 && s.MaxStreamsPerConn > s.MaxStreamsPerUser) {
+		errors = append(errors, fmt.Errorf("max_streams_per_conn must be between 0 and max_streams_per_user"))
+	}
+	if s.Bandwidth != nil {
+		errors = append(errors, s.Bandwidth.validate()...)
+	}
+	if s.Usage != nil {
+		errors = append(errors, s.Usage.validate()...)
+	}
+	if s.Reverse != nil {
+		errors = append(errors, s.Reverse.validate()...)
+	}
+
 	// if s.Timeout < 1 || s.Timeout > 3600 {
 	// 	errors = append(errors, fmt.Errorf("server timeout must be between 1-3600 seconds"))
 	// }
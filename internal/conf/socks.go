@@ -5,13 +5,20 @@ import (
 )
 
 type SOCKS5 struct {
+	Name     string       `yaml:"name"` // inbound name for routing rules
 	Listen_  string       `yaml:"listen"`
 	Username string       `yaml:"username"`
 	Password string       `yaml:"password"`
+	Sniff    bool         `yaml:"sniff"` // dial by the TLS/HTTP/QUIC hostname for IP destinations routing needs a name for
 	Listen   *net.UDPAddr `yaml:"-"`
+	HTTP     *HTTPProxy   `yaml:"-"` // HTTP proxy sharing the listener, if any
 }
 
-func (c *SOCKS5) setDefaults() {}
+func (c *SOCKS5) setDefaults() {
+	if c.Name == "" {
+		c.Name = "socks5"
+	}
+}
 func (c *SOCKS5) validate() []error {
 	var errors []error
 
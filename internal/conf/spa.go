@@ -0,0 +1,67 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+)
+
+// SPA configures single-packet authorization. When enabled, the server
+// ignores every source address until it has sent a valid knock, and the
+// client sends one before dialing the transport.
+type SPA struct {
+	Key         string        `yaml:"key"`
+	Window      time.Duration `yaml:"window"`       // Max clock skew accepted for knock timestamps
+	IdleTimeout time.Duration `yaml:"idle_timeout"` // Allow-list entry lifetime without traffic
+	Users       []SPAUser     `yaml:"users"`        // Server only: named per-user knock keys
+
+	Secret []byte `yaml:"-"` // derived HMAC key
+}
+
+// SPAUser is a named knock key. Sources authorized with it are attributed to
+// the user for shaping and accounting.
+type SPAUser struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+
+	Secret []byte `yaml:"-"` // derived HMAC key
+}
+
+func (s *SPA) setDefaults() {
+	if s.Window == 0 {
+		s.Window = 30 * time.Second
+	}
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = 5 * time.Minute
+	}
+}
+
+func (s *SPA) validate() []error {
+	var errors []error
+
+	if len(s.Key) == 0 && len(s.Users) == 0 {
+		errors = append(errors, fmt.Errorf("spa.key or spa.users is required"))
+	} else if len(s.Key) != 0 {
+		s.Secret = DeriveKey("spa:" + s.Key)
+	}
+	names := make(map[string]bool, len(s.Users))
+	for i := range s.Users {
+		u := &s.Users[i]
+		if u.Name == "" || u.Key == "" {
+			errors = append(errors, fmt.Errorf("spa.users[%d] requires name and key", i))
+			continue
+		}
+		if names[u.Name] {
+			errors = append(errors, fmt.Errorf("spa.users[%d] duplicate name '%s'", i, u.Name))
+		}
+		names[u.Name] = true
+		u.Secret = DeriveKey("spa:" + u.Key)
+	}
+	if s.Window < time.Second || s.Window > 10*time.Minute {
+		errors = append(errors, fmt.Errorf("spa.window must be between 1s-10m"))
+	}
+	if s.IdleTimeout < 10*time.Second || s.IdleTimeout > 24*time.Hour {
+		errors = append(errors, fmt.Errorf("spa.idle_timeout must be between 10s-24h"))
+	}
+
+	return errors
+}
@@ -0,0 +1,91 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// TProxy is a Linux transparent proxy inbound for traffic captured by
+// iptables, so a router can tunnel its LAN without a TUN device.
+type TProxy struct {
+	Name    string       `yaml:"name"` // inbound name for routing rules
+	Listen_ string       `yaml:"listen"`
+	Mode    string       `yaml:"mode"`    // redirect (TCP only) or tproxy (TCP and UDP)
+	Rules   bool         `yaml:"rules"`   // install the iptables rules that capture forwarded traffic
+	Mark    int          `yaml:"mark"`    // tproxy: fwmark of captured packets
+	Table   int          `yaml:"table"`   // tproxy: routing table delivering marked packets locally
+	Exclude []string     `yaml:"exclude"` // destinations the rules leave alone
+	Sniff   bool         `yaml:"sniff"`   // dial by the TLS/HTTP/QUIC hostname instead of the IP
+	Listen  *net.UDPAddr `yaml:"-"`
+}
+
+// tproxyExclude keeps LAN, loopback and multicast traffic out of the
+// tunnel unless the rules say otherwise.
+var tproxyExclude = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+}
+
+func (c *TProxy) setDefaults() {
+	if c.Name == "" {
+		c.Name = "tproxy"
+	}
+	if c.Mode == "" {
+		c.Mode = "redirect"
+	}
+	if c.Mark == 0 {
+		c.Mark = 1
+	}
+	if c.Table == 0 {
+		c.Table = 100
+	}
+	if c.Exclude == nil {
+		c.Exclude = append([]string(nil), tproxyExclude...)
+	}
+}
+
+func (c *TProxy) validate() []error {
+	var errors []error
+
+	addr, err := validateAddr(c.Listen_, true)
+	if err != nil {
+		errors = append(errors, err)
+	} else if addr.IP.To4() == nil && !addr.IP.IsUnspecified() {
+		errors = append(errors, fmt.Errorf("listen must be an IPv4 address"))
+	}
+	c.Listen = addr
+
+	if c.Mode != "redirect" && c.Mode != "tproxy" {
+		errors = append(errors, fmt.Errorf("mode must be 'redirect' or 'tproxy'"))
+	}
+	if c.Mark < 1 {
+		errors = append(errors, fmt.Errorf("mark must be positive"))
+	}
+	if c.Table < 1 || c.Table > 0x7fffffff {
+		errors = append(errors, fmt.Errorf("table must be between 1 and %d", 0x7fffffff))
+	}
+	for i, e := range c.Exclude {
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			a, err2 := netip.ParseAddr(e)
+			if err2 != nil {
+				errors = append(errors, fmt.Errorf("exclude[%d]: invalid CIDR or IP %q: %v", i, e, err))
+				continue
+			}
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		if !p.Addr().Is4() {
+			errors = append(errors, fmt.Errorf("exclude[%d]: %q is not IPv4", i, e))
+			continue
+		}
+		c.Exclude[i] = p.Masked().String()
+	}
+	return errors
+}
@@ -0,0 +1,49 @@
+package conf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTProxyDefaults(t *testing.T) {
+	c := TProxy{Listen_: "0.0.0.0:12345"}
+	c.setDefaults()
+	if errs := c.validate(); len(errs) != 0 {
+		t.Fatalf("validate: %v", errs)
+	}
+	if c.Mode != "redirect" || c.Mark != 1 || c.Table != 100 {
+		t.Errorf("defaults = %s/%d/%d, want redirect/1/100", c.Mode, c.Mark, c.Table)
+	}
+	if !slices.Equal(c.Exclude, tproxyExclude) {
+		t.Errorf("exclude = %v, want the private ranges", c.Exclude)
+	}
+
+	c = TProxy{Listen_: "0.0.0.0:12345", Exclude: []string{}}
+	c.setDefaults()
+	if len(c.Exclude) != 0 {
+		t.Errorf("an explicit empty exclude list should stay empty, got %v", c.Exclude)
+	}
+}
+
+func TestTProxyValidate(t *testing.T) {
+	c := TProxy{Listen_: "127.0.0.1:12345", Mode: "tproxy", Exclude: []string{"203.0.113.7", "10.1.2.3/8"}}
+	c.setDefaults()
+	if errs := c.validate(); len(errs) != 0 {
+		t.Fatalf("validate: %v", errs)
+	}
+	if want := []string{"203.0.113.7/32", "10.0.0.0/8"}; !slices.Equal(c.Exclude, want) {
+		t.Errorf("exclude = %v, want %v", c.Exclude, want)
+	}
+
+	for _, bad := range []TProxy{
+		{Listen_: "127.0.0.1:12345", Mode: "nat"},
+		{Listen_: "[::1]:12345"},
+		{Listen_: "127.0.0.1:12345", Exclude: []string{"2001:db8::/32"}},
+		{Listen_: "127.0.0.1:12345", Exclude: []string{"lan"}},
+	} {
+		bad.setDefaults()
+		if errs := bad.validate(); len(errs) == 0 {
+			t.Errorf("%+v should fail validation", bad)
+		}
+	}
+}
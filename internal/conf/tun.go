@@ -2,18 +2,39 @@ package conf
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"net/netip"
 	"runtime"
+	"strings"
 )
 
 type TUN struct {
-	Name_     string   `yaml:"name"`
-	Addr      string   `yaml:"addr"`
-	MTU       int      `yaml:"mtu"`
-	DNS       string   `yaml:"dns"`
-	AutoRoute *bool    `yaml:"auto_route"`
-	Exclude   []string `yaml:"exclude"`
+	Name_      string   `yaml:"name"`
+	Addr       string   `yaml:"addr"`
+	Addr6      string   `yaml:"addr6"` // IPv6 address of the device; empty leaves IPv6 out of the tunnel
+	MTU        int      `yaml:"mtu"`
+	DNS        string   `yaml:"dns"`
+	AutoRoute  *bool    `yaml:"auto_route"`
+	Exclude    []string `yaml:"exclude"`
+	FakeIP     string   `yaml:"fake_ip"`     // address pool for fake-IP DNS; empty disables it
+	Sniff      bool     `yaml:"sniff"`       // dial by the TLS/HTTP/QUIC hostname instead of the IP
+	KillSwitch bool     `yaml:"kill_switch"` // drop egress outside the tunnel until explicitly disabled (Linux)
+	Mark       int      `yaml:"mark"`        // fwmark of direct-route sockets, which the kill switch lets out (Linux)
+	Apps       *TUNApps `yaml:"apps"`        // tunnel only some applications, or all but some (Linux)
+}
+
+// TUNApps selects applications by cgroup, UID or fwmark. Netfilter marks
+// their packets and policy routing rules send them into, or with mode
+// exclude past, a separate table holding the TUN default routes.
+type TUNApps struct {
+	Mode     string   `yaml:"mode"`     // include: only matching apps use the tunnel; exclude: all others do
+	Cgroups  []string `yaml:"cgroups"`  // cgroup v2 paths under /sys/fs/cgroup, e.g. "user.slice/user-1000.slice"
+	UIDs     []int    `yaml:"uids"`     // socket owners
+	Marks    []int    `yaml:"marks"`    // fwmarks the applications or other rules already set
+	Mark     int      `yaml:"mark"`     // fwmark paqet gives matching packets
+	Table    int      `yaml:"table"`    // routing table for the TUN default routes
+	Priority int      `yaml:"priority"` // preference of the first of the two ip rules
 }
 
 func (c *TUN) setDefaults() {
@@ -33,17 +54,51 @@ func (c *TUN) setDefaults() {
 	if c.DNS == "" {
 		c.DNS = "8.8.8.8"
 	}
+	if c.Mark == 0 {
+		c.Mark = 0x71
+	}
 	if c.AutoRoute == nil {
 		v := true
 		c.AutoRoute = &v
 	}
+	if c.Apps != nil {
+		c.Apps.setDefaults()
+	}
+}
+
+func (a *TUNApps) setDefaults() {
+	if a.Mode == "" {
+		a.Mode = "include"
+	}
+	if a.Mark == 0 {
+		a.Mark = 0x72
+	}
+	if a.Table == 0 {
+		a.Table = 85
+	}
+	if a.Priority == 0 {
+		a.Priority = 5270
+	}
 }
 
 func (c *TUN) validate() []error {
 	var errors []error
 
-	if _, err := netip.ParsePrefix(c.Addr); err != nil {
+	if p, err := netip.ParsePrefix(c.Addr); err != nil {
 		errors = append(errors, fmt.Errorf("tun.addr: invalid CIDR %q: %v", c.Addr, err))
+	} else if !p.Addr().Is4() {
+		errors = append(errors, fmt.Errorf("tun.addr: must be an IPv4 CIDR, got %q; use tun.addr6 for IPv6", c.Addr))
+	}
+
+	if c.Addr6 != "" {
+		if p, err := netip.ParsePrefix(c.Addr6); err != nil {
+			errors = append(errors, fmt.Errorf("tun.addr6: invalid CIDR %q: %v", c.Addr6, err))
+		} else if !p.Addr().Is6() || p.Addr().Is4In6() {
+			errors = append(errors, fmt.Errorf("tun.addr6: must be an IPv6 CIDR, got %q", c.Addr6))
+		}
+		if c.MTU < 1280 {
+			errors = append(errors, fmt.Errorf("tun.mtu: IPv6 needs at least 1280, got %d", c.MTU))
+		}
 	}
 
 	if c.MTU < 576 || c.MTU > 65535 {
@@ -54,6 +109,29 @@ func (c *TUN) validate() []error {
 		errors = append(errors, fmt.Errorf("tun.dns: invalid IP address %q", c.DNS))
 	}
 
+	if c.FakeIP != "" {
+		if p, err := netip.ParsePrefix(c.FakeIP); err != nil {
+			errors = append(errors, fmt.Errorf("tun.fake_ip: invalid CIDR %q: %v", c.FakeIP, err))
+		} else if !p.Addr().Is4() || p.Bits() < 8 || p.Bits() > 24 {
+			errors = append(errors, fmt.Errorf("tun.fake_ip: must be an IPv4 prefix between /8 and /24, got %q", c.FakeIP))
+		} else if tun, err := netip.ParsePrefix(c.Addr); err == nil && p.Overlaps(tun) {
+			errors = append(errors, fmt.Errorf("tun.fake_ip: %s overlaps tun.addr %s", c.FakeIP, c.Addr))
+		} else if dns, err := netip.ParseAddr(c.DNS); err == nil && p.Contains(dns) {
+			errors = append(errors, fmt.Errorf("tun.fake_ip: %s contains tun.dns %s", c.FakeIP, c.DNS))
+		}
+	}
+
+	if c.KillSwitch && runtime.GOOS != "linux" {
+		errors = append(errors, fmt.Errorf("tun.kill_switch: only available on Linux"))
+	}
+	if c.Mark < 0 {
+		errors = append(errors, fmt.Errorf("tun.mark: must not be negative, got %d", c.Mark))
+	}
+
+	if c.Apps != nil {
+		errors = append(errors, c.Apps.validate(c)...)
+	}
+
 	for i, e := range c.Exclude {
 		if _, err := netip.ParsePrefix(e); err != nil {
 			// Try as bare IP and normalize to /32 or /128.
@@ -67,3 +145,60 @@ func (c *TUN) validate() []error {
 
 	return errors
 }
+
+func (a *TUNApps) validate(tun *TUN) []error {
+	var errors []error
+
+	if runtime.GOOS != "linux" {
+		errors = append(errors, fmt.Errorf("tun.apps: only available on Linux"))
+	}
+	if !*tun.AutoRoute {
+		errors = append(errors, fmt.Errorf("tun.apps: needs tun.auto_route"))
+	}
+
+	switch a.Mode {
+	case "include":
+		if tun.KillSwitch {
+			errors = append(errors, fmt.Errorf("tun.apps: mode include sends other traffic past the tunnel, which tun.kill_switch blocks"))
+		}
+	case "exclude":
+	default:
+		errors = append(errors, fmt.Errorf("tun.apps.mode: must be 'include' or 'exclude', got %q", a.Mode))
+	}
+
+	if len(a.Cgroups)+len(a.UIDs)+len(a.Marks) == 0 {
+		errors = append(errors, fmt.Errorf("tun.apps: at least one of cgroups, uids or marks is required"))
+	}
+	for i, cg := range a.Cgroups {
+		a.Cgroups[i] = strings.Trim(cg, "/")
+		if a.Cgroups[i] == "" || strings.Contains(cg, "..") {
+			errors = append(errors, fmt.Errorf("tun.apps.cgroups[%d]: invalid cgroup path %q", i, cg))
+		}
+	}
+	for i, uid := range a.UIDs {
+		if uid < 0 {
+			errors = append(errors, fmt.Errorf("tun.apps.uids[%d]: must not be negative, got %d", i, uid))
+		}
+	}
+	for i, m := range a.Marks {
+		if m <= 0 || m > math.MaxUint32 {
+			errors = append(errors, fmt.Errorf("tun.apps.marks[%d]: must be between 1 and %d, got %d", i, uint32(math.MaxUint32), m))
+		}
+	}
+
+	if a.Mark <= 0 || a.Mark > math.MaxUint32 {
+		errors = append(errors, fmt.Errorf("tun.apps.mark: must be between 1 and %d, got %d", uint32(math.MaxUint32), a.Mark))
+	} else if a.Mark == tun.Mark {
+		errors = append(errors, fmt.Errorf("tun.apps.mark: must differ from tun.mark 0x%x", tun.Mark))
+	}
+	// 253 to 255 are the kernel's default, main and local tables.
+	if a.Table <= 0 || a.Table > math.MaxUint32 || (a.Table >= 253 && a.Table <= 255) {
+		errors = append(errors, fmt.Errorf("tun.apps.table: must be between 1 and %d other than 253-255, got %d", uint32(math.MaxUint32), a.Table))
+	}
+	// The rules go before the main table's at 32766.
+	if a.Priority <= 0 || a.Priority > 32764 {
+		errors = append(errors, fmt.Errorf("tun.apps.priority: must be between 1 and 32764, got %d", a.Priority))
+	}
+
+	return errors
+}
@@ -0,0 +1,88 @@
+package conf
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestTUNAddr6(t *testing.T) {
+	c := TUN{Addr6: "fd00:0:85::1/64"}
+	c.setDefaults()
+	if errs := c.validate(); len(errs) != 0 {
+		t.Fatalf("validate: %v", errs)
+	}
+
+	for _, bad := range []TUN{
+		{Addr: "fd00::1/64"},
+		{Addr6: "10.0.86.1/24"},
+		{Addr6: "::ffff:10.0.86.1/120"},
+		{Addr6: "fd00::1"},
+		{Addr6: "fd00::1/64", MTU: 1200},
+	} {
+		bad.setDefaults()
+		if errs := bad.validate(); len(errs) == 0 {
+			t.Errorf("%+v should fail validation", bad)
+		}
+	}
+}
+
+func TestTUNFakeIP(t *testing.T) {
+	c := TUN{FakeIP: "198.18.0.0/15"}
+	c.setDefaults()
+	if errs := c.validate(); len(errs) != 0 {
+		t.Fatalf("validate: %v", errs)
+	}
+
+	for _, bad := range []TUN{
+		{FakeIP: "198.18.0.0"},
+		{FakeIP: "fd00::/64"},
+		{FakeIP: "0.0.0.0/0"},
+		{FakeIP: "198.18.0.0/30"},
+		{FakeIP: "10.0.0.0/16"},
+		{FakeIP: "8.0.0.0/8"},
+	} {
+		bad.setDefaults()
+		if errs := bad.validate(); len(errs) == 0 {
+			t.Errorf("fake_ip %q should fail validation", bad.FakeIP)
+		}
+	}
+}
+
+func TestTUNApps(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("tun.apps is Linux only")
+	}
+	c := TUN{Apps: &TUNApps{Cgroups: []string{"/user.slice/app.scope/"}, UIDs: []int{1000}}}
+	c.setDefaults()
+	if errs := c.validate(); len(errs) != 0 {
+		t.Fatalf("validate: %v", errs)
+	}
+	if c.Apps.Mode != "include" || c.Apps.Mark != 0x72 || c.Apps.Table != 85 {
+		t.Errorf("defaults = %+v", c.Apps)
+	}
+	if c.Apps.Cgroups[0] != "user.slice/app.scope" {
+		t.Errorf("cgroup = %q, want slashes trimmed", c.Apps.Cgroups[0])
+	}
+
+	for _, bad := range []TUN{
+		{Apps: &TUNApps{}},
+		{Apps: &TUNApps{Mode: "only", UIDs: []int{0}}},
+		{Apps: &TUNApps{UIDs: []int{-1}}},
+		{Apps: &TUNApps{Cgroups: []string{"/"}}},
+		{Apps: &TUNApps{UIDs: []int{0}, Mark: 0x71}},
+		{Apps: &TUNApps{UIDs: []int{0}, Table: 254}},
+		{Apps: &TUNApps{UIDs: []int{0}, Priority: 32766}},
+		{KillSwitch: true, Apps: &TUNApps{UIDs: []int{0}}},
+	} {
+		bad.setDefaults()
+		if errs := bad.validate(); len(errs) == 0 {
+			t.Errorf("%+v should fail validation", bad.Apps)
+		}
+	}
+
+	c = TUN{KillSwitch: true, Apps: &TUNApps{Mode: "exclude", Marks: []int{0x10}}}
+	c.setDefaults()
+	if errs := c.validate(); len(errs) != 0 {
+		t.Errorf("kill switch with mode exclude: %v", errs)
+	}
+}
@@ -0,0 +1,85 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+)
+
+// Usage configures server-side traffic accounting. Byte counters are kept per
+// user (spa.users name, or source IP without one) and persisted to File.
+type Usage struct {
+	File          string                `yaml:"file"`
+	FlushInterval time.Duration         `yaml:"flush_interval"`
+	Daily_        string                `yaml:"daily"`   // default daily quota, e.g. "10GB"
+	Monthly_      string                `yaml:"monthly"` // default monthly quota
+	Users         map[string]*UserQuota `yaml:"users"`   // per-user quota overrides
+
+	Daily   int64 `yaml:"-"`
+	Monthly int64 `yaml:"-"`
+}
+
+// UserQuota overrides the default quotas for one user. "0" removes a limit.
+type UserQuota struct {
+	Daily_   string `yaml:"daily"`
+	Monthly_ string `yaml:"monthly"`
+
+	Daily   int64 `yaml:"-"` // -1 when unset, inheriting the default
+	Monthly int64 `yaml:"-"`
+}
+
+func (u *Usage) setDefaults() {
+	if u.File == "" {
+		u.File = "usage.json"
+	}
+	if u.FlushInterval == 0 {
+		u.FlushInterval = 30 * time.Second
+	}
+}
+
+func (u *Usage) validate() []error {
+	var errors []error
+	var err error
+
+	if u.FlushInterval < time.Second || u.FlushInterval > time.Hour {
+		errors = append(errors, fmt.Errorf("usage.flush_interval must be between 1s-1h"))
+	}
+	if u.Daily, err = ParseSize(u.Daily_); err != nil {
+		errors = append(errors, fmt.Errorf("usage.daily: %v", err))
+	}
+	if u.Monthly, err = ParseSize(u.Monthly_); err != nil {
+		errors = append(errors, fmt.Errorf("usage.monthly: %v", err))
+	}
+	for name, q := range u.Users {
+		if q == nil {
+			errors = append(errors, fmt.Errorf("usage.users.%s is empty", name))
+			continue
+		}
+		q.Daily, q.Monthly = -1, -1
+		if q.Daily_ != "" {
+			if q.Daily, err = ParseSize(q.Daily_); err != nil {
+				errors = append(errors, fmt.Errorf("usage.users.%s.daily: %v", name, err))
+			}
+		}
+		if q.Monthly_ != "" {
+			if q.Monthly, err = ParseSize(q.Monthly_); err != nil {
+				errors = append(errors, fmt.Errorf("usage.users.%s.monthly: %v", name, err))
+			}
+		}
+	}
+	return errors
+}
+
+// Limits returns the daily and monthly quota in bytes for user. Zero means
+// unlimited.
+func (u *Usage) Limits(user string) (daily, monthly int64) {
+	daily, monthly = u.Daily, u.Monthly
+	if q, ok := u.Users[user]; ok {
+		if q.Daily >= 0 {
+			daily = q.Daily
+		}
+		if q.Monthly >= 0 {
+			monthly = q.Monthly
+		}
+	}
+	return daily, monthly
+}
@@ -0,0 +1,192 @@
+package dns
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type cacheKey struct {
+	name  string
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+	cd    bool // checking disabled: the upstream may return unvalidated data
+	do    bool // DNSSEC OK: the answer carries signature records
+}
+
+func keyOf(q dnsmessage.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name.String()), typ: q.Type, class: q.Class}
+}
+
+// parseQuery reads the header and question of a query and the cache key
+// for it, which includes the CD bit and the EDNS DO bit since both change
+// the answer.
+func parseQuery(query []byte) (dnsmessage.Header, dnsmessage.Question, cacheKey, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return h, dnsmessage.Question{}, cacheKey{}, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return h, q, cacheKey{}, err
+	}
+	key := keyOf(q)
+	key.cd = h.CheckingDisabled
+	if p.SkipAllQuestions() == nil && p.SkipAllAnswers() == nil && p.SkipAllAuthorities() == nil {
+		for {
+			rh, err := p.AdditionalHeader()
+			if err != nil {
+				break
+			}
+			if rh.Type == dnsmessage.TypeOPT {
+				key.do = rh.DNSSECAllowed()
+				break
+			}
+			if err := p.SkipAdditional(); err != nil {
+				break
+			}
+		}
+	}
+	return h, q, key, nil
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// cache is an LRU of answers that expire with their smallest TTL. Hits
+// come back with the TTLs lowered by the time spent in the cache.
+type cache struct {
+	size   int
+	maxTTL time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List // front is most recently used
+	items map[cacheKey]*list.Element
+}
+
+func newCache(size int, maxTTL time.Duration) *cache {
+	return &cache{
+		size:   size,
+		maxTTL: maxTTL,
+		ll:     list.New(),
+		items:  make(map[cacheKey]*list.Element),
+	}
+}
+
+// get returns the cached answer for key with id as its message ID, or nil.
+// The question q is echoed as asked, keeping the case of the name.
+func (c *cache) get(key cacheKey, q dnsmessage.Question, id uint16, now time.Time) []byte {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.mu.Unlock()
+		return nil
+	}
+	c.ll.MoveToFront(el)
+	msg := e.msg
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	c.mu.Unlock()
+
+	msg.ID = id
+	msg.Questions = []dnsmessage.Question{q}
+	msg.Answers = ageRecords(msg.Answers, elapsed)
+	msg.Authorities = ageRecords(msg.Authorities, elapsed)
+	msg.Additionals = ageRecords(msg.Additionals, elapsed)
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// put stores resp under key. Truncated answers, failures and answers
+// without a TTL are not cached.
+func (c *cache) put(key cacheKey, resp []byte, now time.Time) {
+	if c.size <= 0 {
+		return
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || msg.Truncated {
+		return
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+	ttl, ok := minTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+	d := time.Duration(ttl) * time.Second
+	if d > c.maxTTL {
+		d = c.maxTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &cacheEntry{key: key, msg: msg, stored: now, expires: now.Add(d)}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+	for c.ll.Len() > c.size {
+		old := c.ll.Back()
+		c.ll.Remove(old)
+		delete(c.items, old.Value.(*cacheEntry).key)
+	}
+}
+
+// minTTL is the smallest TTL of the records in msg. The OPT pseudo-record
+// keeps flags in its TTL field and does not count.
+func minTTL(msg dnsmessage.Message) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, rr := range rrs {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || rr.Header.TTL < ttl {
+				ttl, found = rr.Header.TTL, true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// ageRecords returns a copy of rrs with elapsed seconds taken off every
+// TTL.
+func ageRecords(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	if len(rrs) == 0 {
+		return rrs
+	}
+	out := make([]dnsmessage.Resource, len(rrs))
+	copy(out, rrs)
+	for i := range out {
+		if out[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if out[i].Header.TTL > elapsed {
+			out[i].Header.TTL -= elapsed
+		} else {
+			out[i].Header.TTL = 0
+		}
+	}
+	return out
+}
@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func question(name string) dnsmessage.Question {
+	return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+}
+
+func answerMsg(t *testing.T, q dnsmessage.Question, ttl uint32) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, Response: true},
+		Questions: []dnsmessage.Question{q},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newCache(8, time.Hour)
+	q := question("example.com.")
+	now := time.Now()
+	c.put(keyOf(q), answerMsg(t, q, 60), now)
+
+	upper := question("EXAMPLE.com.")
+	b := c.get(keyOf(upper), upper, 42, now.Add(20*time.Second))
+	if b == nil {
+		t.Fatal("cache miss before expiry")
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 42 {
+		t.Errorf("ID = %d, want 42", msg.ID)
+	}
+	if got := msg.Questions[0].Name.String(); got != "EXAMPLE.com." {
+		t.Errorf("question = %q, want the name as asked", got)
+	}
+	if ttl := msg.Answers[0].Header.TTL; ttl != 40 {
+		t.Errorf("TTL = %d, want 40", ttl)
+	}
+
+	if c.get(keyOf(q), q, 1, now.Add(60*time.Second)) != nil {
+		t.Error("entry served after its TTL")
+	}
+}
+
+func TestCacheMaxTTLAndSkips(t *testing.T) {
+	c := newCache(8, 10*time.Second)
+	q := question("example.com.")
+	now := time.Now()
+	c.put(keyOf(q), answerMsg(t, q, 3600), now)
+	if c.get(keyOf(q), q, 1, now.Add(11*time.Second)) != nil {
+		t.Error("max_ttl not applied")
+	}
+
+	q0 := question("zero.example.")
+	c.put(keyOf(q0), answerMsg(t, q0, 0), now)
+	if c.get(keyOf(q0), q0, 1, now) != nil {
+		t.Error("zero TTL answer cached")
+	}
+
+	fail := dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure},
+		Questions: []dnsmessage.Question{q},
+	}
+	b, _ := fail.Pack()
+	qf := question("fail.example.")
+	c.put(keyOf(qf), b, now)
+	if c.get(keyOf(qf), qf, 1, now) != nil {
+		t.Error("SERVFAIL cached")
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := newCache(2, time.Hour)
+	now := time.Now()
+	a, b, d := question("a.example."), question("b.example."), question("d.example.")
+	c.put(keyOf(a), answerMsg(t, a, 60), now)
+	c.put(keyOf(b), answerMsg(t, b, 60), now)
+	c.get(keyOf(a), a, 1, now) // a is now more recent than b
+	c.put(keyOf(d), answerMsg(t, d, 60), now)
+
+	if c.get(keyOf(b), b, 1, now) != nil {
+		t.Error("least recently used entry not evicted")
+	}
+	if c.get(keyOf(a), a, 1, now) == nil || c.get(keyOf(d), d, 1, now) == nil {
+		t.Error("recent entries evicted")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	q := question("example.com.")
+	big := dnsmessage.Message{Header: dnsmessage.Header{ID: 5, Response: true}, Questions: []dnsmessage.Question{q}}
+	for i := 0; i < 40; i++ {
+		big.Answers = append(big.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}},
+		})
+	}
+	resp, _ := big.Pack()
+	query, _ := (&dnsmessage.Message{Header: dnsmessage.Header{ID: 5}, Questions: []dnsmessage.Question{q}}).Pack()
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(Truncate(query, resp)); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Truncated || len(msg.Answers) != 0 {
+		t.Errorf("answer over 512 bytes not truncated")
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 5})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	edns, _ := b.Finish()
+	if got := Truncate(edns, resp); len(got) != len(resp) {
+		t.Errorf("answer truncated despite a 4096-byte EDNS size")
+	}
+}
+
+func TestParseQueryKey(t *testing.T) {
+	build := func(cd, do bool) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, RecursionDesired: true, CheckingDisabled: cd})
+		b.EnableCompression()
+		if err := b.StartQuestions(); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Question(question("example.com.")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.StartAdditionals(); err != nil {
+			t.Fatal(err)
+		}
+		var rh dnsmessage.ResourceHeader
+		if err := rh.SetEDNS0(1232, 0, do); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.OPTResource(rh, dnsmessage.OPTResource{}); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := b.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	keys := make(map[cacheKey]bool)
+	for _, flags := range [][2]bool{{false, false}, {true, false}, {false, true}, {true, true}} {
+		h, q, key, err := parseQuery(build(flags[0], flags[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.ID != 7 || q.Name.String() != "example.com." {
+			t.Errorf("parsed %+v %+v", h, q)
+		}
+		if key.cd != flags[0] || key.do != flags[1] {
+			t.Errorf("key = %+v, want cd=%v do=%v", key, flags[0], flags[1])
+		}
+		keys[key] = true
+	}
+	if len(keys) != 4 {
+		t.Errorf("%d distinct keys, want 4", len(keys))
+	}
+}
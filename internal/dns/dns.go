@@ -0,0 +1,204 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/tnet"
+	"sync"
+	"time"
+)
+
+var log = flog.Sub("dns")
+
+const (
+	// inbound is the name routing rules match upstream connections by.
+	inbound = "dns"
+	// queryTimeout bounds one exchange with an upstream.
+	queryTimeout = 5 * time.Second
+	// maxIdle is how many idle connections are kept per upstream.
+	maxIdle = 4
+	// idleTimeout drops idle connections the server has likely closed.
+	idleTimeout = 30 * time.Second
+)
+
+// Resolver answers queries from its cache or by sending them as
+// DNS-over-TCP through the tunnel, so the upstream sees the paqet server
+// as the client.
+type Resolver struct {
+	client *client.Client
+	cfg    *conf.DNS
+	cache  *cache
+
+	mu        sync.Mutex
+	upstreams map[string]*upstream
+}
+
+func New(client *client.Client, cfg *conf.DNS) *Resolver {
+	return &Resolver{
+		client:    client,
+		cfg:       cfg,
+		cache:     newCache(cfg.CacheSize, cfg.MaxTTL),
+		upstreams: make(map[string]*upstream),
+	}
+}
+
+// Start serves the standalone listener, if one is configured.
+func (r *Resolver) Start(ctx context.Context) error {
+	if r.cfg.Listen == nil {
+		return nil
+	}
+	return r.listen(ctx, r.cfg.Listen)
+}
+
+// Exchange answers a query in wire format.
+func (r *Resolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	h, q, key, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if resp := r.cache.get(key, q, h.ID, now); resp != nil {
+		log.Debugf("%s %s: cached", q.Name, q.Type)
+		return resp, nil
+	}
+
+	addr := r.cfg.UpstreamFor(q.Name.String())
+	resp, err := r.upstream(addr).exchange(ctx, r.client, query)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s via %s: %w", q.Name, q.Type, addr, err)
+	}
+	log.Debugf("%s %s: answered by %s", q.Name, q.Type, addr)
+	r.cache.put(key, resp, now)
+	return resp, nil
+}
+
+func (r *Resolver) upstream(addr string) *upstream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.upstreams[addr]
+	if !ok {
+		u = &upstream{addr: addr}
+		r.upstreams[addr] = u
+	}
+	return u
+}
+
+// upstream keeps idle DNS-over-TCP connections to one server for reuse.
+type upstream struct {
+	addr string
+	mu   sync.Mutex
+	idle []idleConn
+}
+
+type idleConn struct {
+	strm  tnet.Strm
+	since time.Time
+}
+
+func (u *upstream) get() tnet.Strm {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for len(u.idle) > 0 {
+		c := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+		if time.Since(c.since) < idleTimeout {
+			return c.strm
+		}
+		c.strm.Close()
+	}
+	return nil
+}
+
+func (u *upstream) put(strm tnet.Strm) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idle) >= maxIdle {
+		strm.Close()
+		return
+	}
+	u.idle = append(u.idle, idleConn{strm: strm, since: time.Now()})
+}
+
+// exchange sends query over an idle connection or a new one. A reused
+// connection the server has closed in the meantime is retried once on a
+// fresh one.
+func (u *upstream) exchange(ctx context.Context, c *client.Client, query []byte) ([]byte, error) {
+	for {
+		strm := u.get()
+		reused := strm != nil
+		if !reused {
+			s, err := c.DialTCP(inbound, u.addr)
+			if err != nil {
+				return nil, err
+			}
+			strm = s
+		}
+		resp, err := roundTrip(ctx, strm, query)
+		if err == nil {
+			u.put(strm)
+			return resp, nil
+		}
+		strm.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// roundTrip writes one length-prefixed query and reads the answer with the
+// same ID.
+func roundTrip(ctx context.Context, strm tnet.Strm, query []byte) ([]byte, error) {
+	deadline := time.Now().Add(queryTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	strm.SetDeadline(deadline)
+	defer strm.SetDeadline(time.Time{})
+
+	if err := writeMsg(strm, query); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := readMsg(strm)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) >= 2 && resp[0] == query[0] && resp[1] == query[1] {
+			return resp, nil
+		}
+	}
+}
+
+// readMsg reads one message in the TCP framing of RFC 1035 4.2.2.
+func readMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(l[:])
+	if n == 0 {
+		return nil, errors.New("empty DNS message")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func writeMsg(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return errors.New("DNS message too long")
+	}
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,190 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Handler answers a query in wire format.
+type Handler func(ctx context.Context, query []byte) ([]byte, error)
+
+// listen serves UDP and TCP on addr until ctx is done.
+func (r *Resolver) listen(ctx context.Context, addr *net.UDPAddr) error {
+	pc, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("DNS failed to listen on %s/udp: %w", addr, err)
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("DNS failed to listen on %s/tcp: %w", addr, err)
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		ln.Close()
+	}()
+	go r.servePacket(ctx, pc)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+					log.Errorf("DNS stopped accepting on %s: %v", ln.Addr(), err)
+				}
+				return
+			}
+			go ServeStream(ctx, conn, r.Exchange)
+		}
+	}()
+	log.Infof("DNS resolver listening on %s (UDP and TCP)", addr)
+	return nil
+}
+
+func (r *Resolver) servePacket(ctx context.Context, pc *net.UDPConn) {
+	for {
+		b := make([]byte, 65535)
+		n, from, err := pc.ReadFromUDP(b)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Errorf("DNS stopped reading on %s: %v", pc.LocalAddr(), err)
+			}
+			return
+		}
+		go func(query []byte) {
+			resp := Answer(ctx, r.Exchange, query)
+			if resp == nil {
+				return
+			}
+			if _, err := pc.WriteToUDP(Truncate(query, resp), from); err != nil {
+				log.Debugf("DNS failed to answer %s: %v", from, err)
+			}
+		}(b[:n])
+	}
+}
+
+// ServeStream answers the length-prefixed queries on a TCP connection
+// until the client stops sending them. Queries are answered concurrently
+// and may be answered out of order, as RFC 7766 allows.
+func ServeStream(ctx context.Context, conn net.Conn, h Handler) {
+	defer conn.Close()
+	sem := make(chan struct{}, 16)
+	out := make(chan []byte, 16)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case resp := <-out:
+				if err := writeMsg(conn, resp); err != nil {
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		query, err := readMsg(conn)
+		if err != nil {
+			return
+		}
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			if resp := Answer(ctx, h, query); resp != nil {
+				select {
+				case out <- resp:
+				case <-done:
+				}
+			}
+		}()
+	}
+}
+
+// Answer runs h, turning a failure into SERVFAIL. It returns nil for
+// messages too broken to answer.
+func Answer(ctx context.Context, h Handler, query []byte) []byte {
+	ctx, cancel := context.WithTimeout(ctx, 2*queryTimeout)
+	defer cancel()
+	resp, err := h(ctx, query)
+	if err == nil {
+		return resp
+	}
+	log.Debugf("query failed: %v", err)
+	return reply(query, dnsmessage.RCodeServerFailure)
+}
+
+// reply is an answer with rcode and no records.
+func reply(query []byte, rcode dnsmessage.RCode) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	qs, _ := p.AllQuestions()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: qs,
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Truncate fits an answer fetched over TCP into the UDP payload size the
+// query allows: 512 bytes, or the size its EDNS record advertises. An
+// answer that does not fit is replaced by one with the TC bit set, telling
+// the client to retry over TCP.
+func Truncate(query, resp []byte) []byte {
+	limit := 512
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err == nil {
+		if p.SkipAllQuestions() == nil && p.SkipAllAnswers() == nil && p.SkipAllAuthorities() == nil {
+			for {
+				h, err := p.AdditionalHeader()
+				if err != nil {
+					break
+				}
+				if h.Type == dnsmessage.TypeOPT && int(h.Class) > limit {
+					limit = int(h.Class)
+				}
+				if p.SkipAdditional() != nil {
+					break
+				}
+			}
+		}
+	}
+	if len(resp) <= limit {
+		return resp
+	}
+	var rp dnsmessage.Parser
+	h, err := rp.Start(resp)
+	if err != nil {
+		return resp[:limit]
+	}
+	qs, _ := rp.AllQuestions()
+	h.Truncated = true
+	msg := dnsmessage.Message{Header: h, Questions: qs}
+	b, err := msg.Pack()
+	if err != nil {
+		return resp[:limit]
+	}
+	return b
+}
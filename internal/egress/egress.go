@@ -0,0 +1,147 @@
+// Package egress dials the server's outbound connections, either directly
+// or through the upstream proxy that the egress rules pick for a target.
+// Reverse listeners are not outbound and always listen on the server
+// itself; ICMP cannot be proxied and is refused for upstream targets.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"time"
+)
+
+// ErrUDPUnsupported is returned by DialUDP when the chosen upstream cannot
+// carry UDP.
+var ErrUDPUnsupported = errors.New("upstream does not support UDP")
+
+// ErrForbiddenDest is returned by CheckICMP for destinations on or local
+// to the server.
+var ErrForbiddenDest = errors.New("destination not allowed")
+
+// dialTimeout bounds TCP dials, including the proxy handshake.
+const dialTimeout = 10 * time.Second
+
+type upstream interface {
+	dialTCP(ctx context.Context, addr string) (net.Conn, error)
+	dialUDP(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// Dialer picks the upstream for every outbound connection.
+type Dialer struct {
+	cfg       *conf.Egress // nil dials everything directly
+	upstreams map[string]upstream
+}
+
+// New starts the upstreams of cfg. With a nil cfg the Dialer only dials
+// directly.
+func New(ctx context.Context, cfg *conf.Egress) (*Dialer, error) {
+	d := &Dialer{cfg: cfg, upstreams: map[string]upstream{"direct": direct{}}}
+	if cfg == nil {
+		return d, nil
+	}
+	for name, u := range cfg.Upstreams {
+		var up upstream
+		switch u.Type {
+		case "socks5":
+			up = &socks{addr: u.Addr, username: u.Username, password: u.Password}
+		case "http":
+			up = &httpConnect{addr: u.Addr, username: u.Username, password: u.Password}
+		case "paqet":
+			p, err := newPaqet(ctx, u.Config)
+			if err != nil {
+				return nil, fmt.Errorf("egress upstream %s: %w", name, err)
+			}
+			up = p
+		}
+		d.upstreams[name] = up
+		flog.Infof("egress upstream %s: %s %s%s", name, u.Type, u.Addr, u.Config)
+	}
+	return d, nil
+}
+
+func (d *Dialer) route(addr string) (string, upstream) {
+	if d.cfg == nil {
+		return "direct", d.upstreams["direct"]
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	name := d.cfg.Route(host)
+	return name, d.upstreams[name]
+}
+
+// DialTCP connects to addr through the upstream its rules select.
+func (d *Dialer) DialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	name, up := d.route(addr)
+	conn, err := up.dialTCP(ctx, addr)
+	if err != nil && name != "direct" {
+		return nil, fmt.Errorf("via %s: %w", name, err)
+	}
+	return conn, err
+}
+
+// DialUDP returns a connected UDP socket, or an equivalent packet conn of
+// the upstream, for addr. Every Read and Write is one datagram.
+func (d *Dialer) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	name, up := d.route(addr)
+	conn, err := up.dialUDP(ctx, addr)
+	if err != nil && name != "direct" {
+		return nil, fmt.Errorf("via %s: %w", name, err)
+	}
+	return conn, err
+}
+
+// CheckICMP reports whether echo requests may be sent to ip. ICMP always
+// leaves from the server itself, so it is refused for loopback, link-local,
+// multicast, unspecified and the server's own addresses, and for targets
+// the rules send through an upstream, which cannot carry it.
+func (d *Dialer) CheckICMP(ip net.IP) error {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() || ip.IsLinkLocalUnicast() || isLocal(ip) {
+		return fmt.Errorf("ICMP to %s: %w", ip, ErrForbiddenDest)
+	}
+	if name, _ := d.route(ip.String()); name != "direct" {
+		return fmt.Errorf("ICMP to %s: upstream %s cannot carry ICMP", ip, name)
+	}
+	return nil
+}
+
+func isLocal(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// direct dials from the server's own address.
+type direct struct{}
+
+func (direct) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (direct) dialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	// Increase socket buffers for high throughput
+	conn.SetReadBuffer(8 * 1024 * 1024)
+	conn.SetWriteBuffer(8 * 1024 * 1024)
+	return conn, nil
+}
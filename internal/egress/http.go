@@ -0,0 +1,75 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// httpConnect dials TCP through an HTTP proxy with CONNECT. It cannot
+// carry UDP.
+type httpConnect struct {
+	addr     string
+	username string
+	password string
+}
+
+func (h *httpConnect) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", h.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if h.username != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(h.username + ":" + h.password))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy answered CONNECT with %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func (h *httpConnect) dialUDP(context.Context, string) (net.Conn, error) {
+	return nil, ErrUDPUnsupported
+}
+
+// bufferedConn returns the bytes the proxy sent right after its CONNECT
+// answer before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return c.Conn.(*net.TCPConn).CloseWrite()
+}
@@ -0,0 +1,110 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/tnet"
+	"sync/atomic"
+)
+
+// paqet dials through another paqet server, with this server acting as
+// its client.
+type paqet struct {
+	client *client.Client
+	flows  atomic.Uint64
+}
+
+func newPaqet(ctx context.Context, path string) (*paqet, error) {
+	cfg, err := conf.LoadFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Role != "client" {
+		return nil, fmt.Errorf("%s: role must be 'client'", path)
+	}
+	c, err := client.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(ctx); err != nil {
+		return nil, err
+	}
+	return &paqet{client: c}, nil
+}
+
+func (p *paqet) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	return openStrm(ctx, func() (tnet.Strm, error) {
+		return p.client.TCP(addr)
+	})
+}
+
+// dialUDP opens a UDP stream with its own flow ID, so the next server
+// gives every flow its own socket.
+func (p *paqet) dialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	strm, err := openStrm(ctx, func() (tnet.Strm, error) {
+		strm, _, err := p.client.UDPNew(addr, p.flows.Add(1))
+		return strm, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &packetStrm{Strm: strm}, nil
+}
+
+// openStrm runs open, which waits for a connection to the next hop and
+// cannot be cancelled, until ctx is done or dialTimeout passes. A stream
+// that arrives after that is closed.
+func openStrm(ctx context.Context, open func() (tnet.Strm, error)) (tnet.Strm, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	type result struct {
+		strm tnet.Strm
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		strm, err := open()
+		done <- result{strm, err}
+	}()
+	select {
+	case r := <-done:
+		return r.strm, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.strm != nil {
+				r.strm.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// packetStrm turns the length-prefixed frames of a UDP stream back into
+// one datagram per Read and Write.
+type packetStrm struct {
+	tnet.Strm
+}
+
+func (s *packetStrm) Read(b []byte) (int, error) {
+	for {
+		n, err := buffer.ReadUDPFrame(s.Strm, b)
+		var unreach *buffer.Unreachable
+		if errors.As(err, &unreach) {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (s *packetStrm) Write(b []byte) (int, error) {
+	if err := buffer.WriteUDPFrame(s.Strm, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
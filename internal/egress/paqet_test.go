@@ -0,0 +1,59 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"net"
+	"paqet/internal/tnet"
+	"testing"
+	"time"
+)
+
+type pipeStrm struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (s *pipeStrm) SID() int          { return 1 }
+func (s *pipeStrm) CloseWrite() error { return nil }
+func (s *pipeStrm) Close() error {
+	close(s.closed)
+	return s.Conn.Close()
+}
+
+func TestOpenStrmCancel(t *testing.T) {
+	c, _ := net.Pipe()
+	strm := &pipeStrm{Conn: c, closed: make(chan struct{})}
+	release := make(chan struct{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := openStrm(ctx, func() (tnet.Strm, error) {
+		<-release // a next hop that never answers in time
+		return strm, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("openStrm = %v, want deadline exceeded", err)
+	}
+
+	close(release)
+	select {
+	case <-strm.closed:
+	case <-time.After(time.Second):
+		t.Fatal("stream opened after cancellation was not closed")
+	}
+}
+
+func TestOpenStrmResult(t *testing.T) {
+	c, _ := net.Pipe()
+	want := &pipeStrm{Conn: c, closed: make(chan struct{})}
+	got, err := openStrm(context.Background(), func() (tnet.Strm, error) { return want, nil })
+	if err != nil || got != want {
+		t.Fatalf("openStrm = %v, %v", got, err)
+	}
+
+	fail := errors.New("no connection")
+	if _, err := openStrm(context.Background(), func() (tnet.Strm, error) { return nil, fail }); !errors.Is(err, fail) {
+		t.Fatalf("openStrm error = %v, want %v", err, fail)
+	}
+}
@@ -0,0 +1,180 @@
+package egress
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+// socks dials through a SOCKS5 proxy, using UDP ASSOCIATE for UDP.
+type socks struct {
+	addr     string
+	username string
+	password string
+}
+
+// request connects to the proxy, authenticates and sends cmd for addr. The
+// returned connection has no deadline left.
+func (s *socks) request(ctx context.Context, cmd byte, addr string) (net.Conn, *socks5.Reply, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	rp, err := s.handshake(conn, cmd, addr)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rp, nil
+}
+
+func (s *socks) handshake(conn net.Conn, cmd byte, addr string) (*socks5.Reply, error) {
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	method := socks5.MethodNone
+	if s.username != "" {
+		method = socks5.MethodUsernamePassword
+	}
+	if _, err := socks5.NewNegotiationRequest([]byte{method}).WriteTo(conn); err != nil {
+		return nil, err
+	}
+	nrp, err := socks5.NewNegotiationReplyFrom(conn)
+	if err != nil {
+		return nil, err
+	}
+	if nrp.Method != method {
+		return nil, fmt.Errorf("socks5 proxy refused auth method %d", method)
+	}
+	if method == socks5.MethodUsernamePassword {
+		if _, err := socks5.NewUserPassNegotiationRequest([]byte(s.username), []byte(s.password)).WriteTo(conn); err != nil {
+			return nil, err
+		}
+		urp, err := socks5.NewUserPassNegotiationReplyFrom(conn)
+		if err != nil {
+			return nil, err
+		}
+		if urp.Status != socks5.UserPassStatusSuccess {
+			return nil, socks5.ErrUserPassAuth
+		}
+	}
+
+	a, h, p, err := socks5.ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if a == socks5.ATYPDomain {
+		h = h[1:]
+	}
+	if _, err := socks5.NewRequest(cmd, a, h, p).WriteTo(conn); err != nil {
+		return nil, err
+	}
+	rp, err := socks5.NewReplyFrom(conn)
+	if err != nil {
+		return nil, err
+	}
+	if rp.Rep != socks5.RepSuccess {
+		return nil, replyError(rp.Rep)
+	}
+	return rp, nil
+}
+
+// replyError wraps the errno matching a SOCKS5 failure reply, so dial
+// errors map to the same PREPLY codes as direct dials.
+func replyError(rep byte) error {
+	var errno error
+	switch rep {
+	case socks5.RepConnectionRefused:
+		errno = syscall.ECONNREFUSED
+	case socks5.RepNetworkUnreachable:
+		errno = syscall.ENETUNREACH
+	case socks5.RepHostUnreachable:
+		errno = syscall.EHOSTUNREACH
+	case socks5.RepNotAllowed:
+		errno = syscall.EACCES
+	case socks5.RepTTLExpired:
+		errno = syscall.ETIMEDOUT
+	default:
+		return fmt.Errorf("socks5 proxy failure (reply %d)", rep)
+	}
+	return fmt.Errorf("socks5 proxy: %w", errno)
+}
+
+func (s *socks) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	conn, _, err := s.request(ctx, socks5.CmdConnect, addr)
+	return conn, err
+}
+
+func (s *socks) dialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	ctrl, rp, err := s.request(ctx, socks5.CmdUDP, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	relay, err := net.ResolveUDPAddr("udp", rp.Address())
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		// The relay is on the proxy host itself.
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	a, h, p, err := socks5.ParseAddress(addr)
+	if err != nil {
+		ctrl.Close()
+		conn.Close()
+		return nil, err
+	}
+	if a == socks5.ATYPDomain {
+		h = h[1:]
+	}
+	header := socks5.NewDatagram(a, h, p, nil).Bytes()
+	return &socksUDP{UDPConn: conn, ctrl: ctrl, header: header}, nil
+}
+
+// socksUDP adds and strips the SOCKS5 UDP request header. The association
+// lasts as long as the control connection.
+type socksUDP struct {
+	*net.UDPConn
+	ctrl   net.Conn
+	header []byte
+}
+
+func (c *socksUDP) Read(b []byte) (int, error) {
+	for {
+		n, err := c.UDPConn.Read(b)
+		if err != nil {
+			return 0, err
+		}
+		d, err := socks5.NewDatagramFromBytes(b[:n])
+		if err != nil || d.Frag != 0x00 {
+			continue // fragments are not supported
+		}
+		return copy(b, d.Data), nil
+	}
+}
+
+func (c *socksUDP) Write(b []byte) (int, error) {
+	pkt := make([]byte, 0, len(c.header)+len(b))
+	pkt = append(append(pkt, c.header...), b...)
+	if _, err := c.UDPConn.Write(pkt); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksUDP) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
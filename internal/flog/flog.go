@@ -1,8 +1,13 @@
 package flog
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -20,8 +25,15 @@ const (
 
 var (
 	minLevel = Info
-	logCh    = make(chan string, 1024)
+	logCh    = make(chan entry, 1024)
 	dropped  atomic.Uint64
+
+	format              = "text"
+	output    io.Writer = os.Stdout
+	subLevels atomic.Pointer[map[string]Level]
+	startOnce sync.Once
+	started   atomic.Bool
+	done      = make(chan struct{})
 )
 
 // Dropped returns the number of log messages dropped due to channel full.
@@ -35,23 +47,164 @@ var levelStrings = [...]string{
 	Fatal: "FATAL",
 }
 
+// droppedReportInterval is how often the writer checks Dropped and warns
+// about messages lost since the last check.
+const droppedReportInterval = 30 * time.Second
+
+// Options configures log output. The zero value of each field keeps the
+// default: text lines on stdout, no per-subsystem overrides.
+type Options struct {
+	Level  int
+	Format string         // "text" or "json"
+	Output io.Writer      // nil means stdout
+	Levels map[string]int // per-subsystem level overrides
+}
+
+// entry is a formatted message on its way to the writer goroutine.
+type entry struct {
+	time   time.Time
+	level  Level
+	sub    string
+	msg    string
+	fields []field
+}
+
+type field struct {
+	key   string
+	value any // string, bool or a number
+}
+
 func init() {
 
 }
 
-func SetLevel(l int) {
-	minLevel = Level(l)
-	if l != -1 {
-		go func() {
-			for msg := range logCh {
-				fmt.Fprint(os.Stdout, msg)
+// Setup applies opts and starts the writer. It must be called once, before
+// logging starts in earnest; messages logged earlier are queued.
+func Setup(opts Options) {
+	minLevel = Level(opts.Level)
+	if opts.Format != "" {
+		format = opts.Format
+	}
+	if opts.Output != nil {
+		output = opts.Output
+	}
+	levels := make(map[string]Level, len(opts.Levels))
+	for name, l := range opts.Levels {
+		levels[name] = Level(l)
+	}
+	subLevels.Store(&levels)
+
+	if !enabled() {
+		return
+	}
+	startOnce.Do(func() {
+		started.Store(true)
+		go writeLoop()
+	})
+}
+
+func SetLevel(l int) { Setup(Options{Level: l}) }
+
+// enabled reports whether anything can be logged at all.
+func enabled() bool {
+	if minLevel != None {
+		return true
+	}
+	if p := subLevels.Load(); p != nil {
+		for _, l := range *p {
+			if l != None {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeLoop() {
+	defer close(done)
+	ticker := time.NewTicker(droppedReportInterval)
+	defer ticker.Stop()
+	var reported uint64
+
+	for {
+		select {
+		case e, ok := <-logCh:
+			if !ok {
+				return
+			}
+			output.Write(encode(e))
+		case now := <-ticker.C:
+			if n := dropped.Load(); n > reported {
+				output.Write(encode(entry{
+					time:   now,
+					level:  Warn,
+					sub:    "log",
+					msg:    fmt.Sprintf("dropped %d log messages, output cannot keep up", n-reported),
+					fields: []field{{"dropped_total", n}},
+				}))
+				reported = n
+			}
+		}
+	}
+}
+
+func encode(e entry) []byte {
+	if format == "json" {
+		m := make(map[string]any, len(e.fields)+4)
+		for _, f := range e.fields {
+			m[f.key] = f.value
+		}
+		m["time"] = e.time.Format(time.RFC3339Nano)
+		m["level"] = strings.ToLower(e.level.String())
+		m["msg"] = e.msg
+		if e.sub != "" {
+			m["subsystem"] = e.sub
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			b = []byte(strconv.Quote(e.msg))
+		}
+		return append(b, '\n')
+	}
+
+	var b strings.Builder
+	b.WriteString(e.time.Format("2006-01-02 15:04:05.000"))
+	b.WriteString(" [")
+	b.WriteString(e.level.String())
+	b.WriteString("] ")
+	if e.sub != "" {
+		b.WriteString(e.sub)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.msg)
+	for _, f := range e.fields {
+		b.WriteByte(' ')
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		if s, ok := f.value.(string); ok && strings.ContainsAny(s, " \"=") {
+			b.WriteString(strconv.Quote(s))
+		} else {
+			fmt.Fprint(&b, f.value)
+		}
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func levelFor(sub string) Level {
+	if sub != "" {
+		if p := subLevels.Load(); p != nil {
+			if l, ok := (*p)[sub]; ok {
+				return l
 			}
-		}()
+		}
 	}
+	return minLevel
 }
 
-func logf(level Level, format string, args ...any) {
-	if level < minLevel || minLevel == None {
+func logf(sub string, fields []field, level Level, format string, args ...any) {
+	min := levelFor(sub)
+	if level < min || min == None {
 		return
 	}
 
@@ -70,18 +223,16 @@ func logf(level Level, format string, args ...any) {
 		}
 	}
 
-	var levelStr string
-	if int(level) < len(levelStrings) {
-		levelStr = levelStrings[level]
-	} else {
-		levelStr = "UNKNOWN"
+	e := entry{
+		time:   time.Now(),
+		level:  level,
+		sub:    sub,
+		msg:    fmt.Sprintf(format, args...),
+		fields: fields,
 	}
 
-	now := time.Now().Format("2006-01-02 15:04:05.000")
-	line := fmt.Sprintf("%s [%s] %s\n", now, levelStr, fmt.Sprintf(format, args...))
-
 	select {
-	case logCh <- line:
+	case logCh <- e:
 	default:
 		dropped.Add(1)
 	}
@@ -97,15 +248,24 @@ func (l Level) String() string {
 	return "UNKNOWN"
 }
 
-func Debugf(format string, args ...any) { logf(Debug, format, args...) }
-func Infof(format string, args ...any)  { logf(Info, format, args...) }
-func Warnf(format string, args ...any)  { logf(Warn, format, args...) }
-func Errorf(format string, args ...any) { logf(Error, format, args...) }
+func Debugf(format string, args ...any) { logf("", nil, Debug, format, args...) }
+func Infof(format string, args ...any)  { logf("", nil, Info, format, args...) }
+func Warnf(format string, args ...any)  { logf("", nil, Warn, format, args...) }
+func Errorf(format string, args ...any) { logf("", nil, Error, format, args...) }
 func Fatalf(format string, args ...any) {
-	logf(Fatal, format, args...)
+	logf("", nil, Fatal, format, args...)
 	// flush logs (optional: small sleep to let goroutine write)
 	time.Sleep(10 * time.Millisecond)
 	os.Exit(1)
 }
 
-func Close() { close(logCh) }
+// Close stops the writer after it has written every queued message.
+func Close() {
+	close(logCh)
+	if started.Load() {
+		<-done
+	}
+	if c, ok := output.(io.Closer); ok && output != os.Stdout {
+		c.Close()
+	}
+}
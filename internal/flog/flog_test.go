@@ -0,0 +1,105 @@
+package flog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeText(t *testing.T) {
+	format = "text"
+	e := entry{
+		time:   time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		level:  Info,
+		sub:    "socks",
+		msg:    "accepted",
+		fields: []field{{"stream", 7}, {"dest", "example.com:443"}, {"reason", "peer closed"}},
+	}
+	got := string(encode(e))
+	want := `2026-01-02 03:04:05.000 [INFO] socks: accepted stream=7 dest=example.com:443 reason="peer closed"` + "\n"
+	if got != want {
+		t.Fatalf("got  %q\nwant %q", got, want)
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	format = "json"
+	defer func() { format = "text" }()
+
+	l := Sub("tun").With("stream", 3, "remote", "10.0.0.1:5000")
+	e := entry{time: time.Now(), level: Warn, sub: l.sub, msg: "slow", fields: l.fields}
+	var m map[string]any
+	if err := json.Unmarshal(encode(e), &m); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if m["level"] != "warn" || m["subsystem"] != "tun" || m["msg"] != "slow" || m["stream"] != float64(3) || m["remote"] != "10.0.0.1:5000" {
+		t.Fatalf("unexpected record: %v", m)
+	}
+}
+
+func TestSubsystemLevel(t *testing.T) {
+	levels := map[string]Level{"socket": Debug, "tun": None}
+	subLevels.Store(&levels)
+	defer subLevels.Store(nil)
+	minLevel = Warn
+	defer func() { minLevel = Info }()
+
+	if levelFor("socket") != Debug || levelFor("tun") != None || levelFor("socks") != Warn {
+		t.Fatal("per-subsystem levels not applied")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "paqet.log")
+	w, err := OpenFile(path, RotateOptions{MaxSize: 64, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	line := []byte(strings.Repeat("x", 40) + "\n")
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write(line); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond) // distinct backup timestamps
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	backups, _ := filepath.Glob(path + ".*.gz")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 compressed backups, got %v", backups)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != int64(len(line)) {
+		t.Fatalf("expected current file with one line, got %v (%v)", info, err)
+	}
+}
+
+func TestRotatePruneOnlyBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "paqet.log")
+	keep := []string{"paqet.log.conf", "paqet.log.20240101", "paqet.log.20240101-000000.000.bak", "paqet.log.20240101-000000.000.gz.tmp"}
+	for _, name := range append(keep, "paqet.log.20240101-000000.000.gz", "paqet.log.20240102-000000.000") {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := &rotatingFile{path: path, opts: RotateOptions{MaxBackups: 1}}
+	r.prune()
+	for _, name := range keep {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("unrelated file %s was removed", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "paqet.log.20240101-000000.000.gz")); !os.IsNotExist(err) {
+		t.Error("oldest backup was kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "paqet.log.20240102-000000.000")); err != nil {
+		t.Error("newest backup was removed")
+	}
+}
@@ -0,0 +1,61 @@
+package flog
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Logger logs on behalf of a subsystem and/or with structured fields.
+// Subsystem loggers honour the per-subsystem level from Options.Levels.
+type Logger struct {
+	sub    string
+	fields []field
+}
+
+// Sub returns a logger for a subsystem such as "socks" or "tun". It is meant
+// for package-level variables; the subsystem's level is looked up per call,
+// so it can be created before Setup runs.
+func Sub(name string) *Logger { return &Logger{sub: name} }
+
+// With returns a logger that attaches key/value pairs to every message, e.g.
+// flog.With("stream", strm.SID(), "dest", addr).
+func With(kv ...any) *Logger { return (&Logger{}).With(kv...) }
+
+// With returns a copy of l with additional key/value pairs.
+func (l *Logger) With(kv ...any) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+len(kv)/2)
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields = append(fields, field{key: fmt.Sprint(kv[i]), value: fieldValue(kv[i+1])})
+	}
+	return &Logger{sub: l.sub, fields: fields}
+}
+
+// fieldValue snapshots v so the writer never touches caller-owned data.
+func fieldValue(v any) any {
+	switch v := v.(type) {
+	case string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case nil:
+		return "<nil>"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (l *Logger) Debugf(format string, args ...any) { logf(l.sub, l.fields, Debug, format, args...) }
+func (l *Logger) Infof(format string, args ...any)  { logf(l.sub, l.fields, Info, format, args...) }
+func (l *Logger) Warnf(format string, args ...any)  { logf(l.sub, l.fields, Warn, format, args...) }
+func (l *Logger) Errorf(format string, args ...any) { logf(l.sub, l.fields, Error, format, args...) }
+func (l *Logger) Fatalf(format string, args ...any) {
+	logf(l.sub, l.fields, Fatal, format, args...)
+	time.Sleep(10 * time.Millisecond)
+	os.Exit(1)
+}
@@ -0,0 +1,190 @@
+package flog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions controls when a log file is rotated and how many old files
+// are kept. Zero values disable the corresponding behaviour.
+type RotateOptions struct {
+	MaxSize    int64         // rotate once the file would exceed this many bytes
+	Interval   time.Duration // rotate when the file is older than this
+	MaxBackups int           // rotated files to keep
+	Compress   bool          // gzip rotated files
+}
+
+// backupLayout is the timestamp suffix of a rotated file.
+const backupLayout = "20060102-150405.000"
+
+// rotatingFile is an io.WriteCloser that rotates the file at path by size
+// and age. Rotated files are renamed to path.YYYYMMDD-HHMMSS.mmm[.gz].
+type rotatingFile struct {
+	path string
+	opts RotateOptions
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	wg     sync.WaitGroup // pending compressions
+}
+
+// OpenFile opens path for appending with rotation.
+func OpenFile(path string, opts RotateOptions) (io.WriteCloser, error) {
+	r := &rotatingFile{path: path, opts: opts}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.due(len(p)) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) due(n int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.opts.MaxSize > 0 && r.size+int64(n) > r.opts.MaxSize {
+		return true
+	}
+	return r.opts.Interval > 0 && time.Since(r.opened) >= r.opts.Interval
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	backup := r.path + "." + time.Now().Format(backupLayout)
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if r.opts.Compress {
+			if err := compressFile(backup); err != nil {
+				dropped.Add(1) // nowhere safe to report it
+			}
+		}
+		r.prune()
+	}()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond MaxBackups.
+func (r *rotatingFile) prune() {
+	if r.opts.MaxBackups <= 0 {
+		return
+	}
+	matches := r.backups()
+	for len(matches) > r.opts.MaxBackups {
+		os.Remove(matches[0])
+		matches = matches[1:]
+	}
+}
+
+// backups lists the files rotate wrote for r.path, oldest first. Only names
+// of the form path.TIMESTAMP[.gz] count, so unrelated files sharing the
+// prefix and in-progress compressions are left alone.
+func (r *rotatingFile) backups() []string {
+	dir := filepath.Dir(r.path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	prefix := filepath.Base(r.path) + "."
+	var matches []string
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		if _, err := time.Parse(backupLayout, strings.TrimSuffix(stamp, ".gz")); err != nil {
+			continue
+		}
+		matches = append(matches, filepath.Join(dir, e.Name()))
+	}
+	// Timestamps are fixed width, so they sort lexically.
+	slices.Sort(matches)
+	return matches
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wg.Wait()
+	return r.f.Close()
+}
@@ -10,18 +10,20 @@ import (
 
 type Forward struct {
 	client     *client.Client
+	name       string // inbound name for routing rules
 	listenAddr string
 	targetAddr string
 	streams    int // Number of parallel streams for UDP forwarding
 	wg         sync.WaitGroup
 }
 
-func New(client *client.Client, listenAddr, targetAddr string, streams int) (*Forward, error) {
+func New(client *client.Client, name, listenAddr, targetAddr string, streams int) (*Forward, error) {
 	if streams < 1 {
 		streams = 8 // default
 	}
 	return &Forward{
 		client:     client,
+		name:       name,
 		listenAddr: listenAddr,
 		targetAddr: targetAddr,
 		streams:    streams,
@@ -0,0 +1,164 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"paqet/internal/accesslog"
+	"paqet/internal/client"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"sync"
+	"time"
+)
+
+// Reverse keeps a listener open on the server and dials targetAddr on this
+// side for every peer accepted there.
+type Reverse struct {
+	client     *client.Client
+	listenAddr string // on the server
+	targetAddr string // on the client
+	protocol   string
+	wg         sync.WaitGroup
+}
+
+func NewReverse(client *client.Client, listenAddr, targetAddr, protocol string) *Reverse {
+	return &Reverse{
+		client:     client,
+		listenAddr: listenAddr,
+		targetAddr: targetAddr,
+		protocol:   protocol,
+	}
+}
+
+// Start registers the listener in the background and registers it again
+// whenever the connection carrying it is lost.
+func (r *Reverse) Start(ctx context.Context) error {
+	flog.Debugf("starting reverse %s forwarder: server %s -> %s", r.protocol, r.listenAddr, r.targetAddr)
+	r.wg.Go(func() {
+		r.run(ctx)
+	})
+	return nil
+}
+
+func (r *Reverse) run(ctx context.Context) {
+	handler := r.handleTCP
+	if r.protocol == "udp" {
+		handler = r.handleUDP
+	}
+	for attempt := 0; ctx.Err() == nil; attempt++ {
+		l, err := r.client.Reverse(r.protocol, r.listenAddr, func(strm tnet.Strm, from string) {
+			r.wg.Go(func() {
+				defer strm.Close()
+				handler(ctx, strm, from)
+			})
+		})
+		var re *protocol.ReplyError
+		switch {
+		case errors.Is(err, client.ErrReverseUnsupported), errors.As(err, &re) && re.Code == protocol.ReplyDenied:
+			flog.Errorf("reverse %s listener on server %s refused: %v", r.protocol, r.listenAddr, err)
+			return
+		case err != nil:
+			flog.Warnf("reverse %s listener on server %s failed, retrying: %v", r.protocol, r.listenAddr, err)
+			if !sleep(ctx, min(time.Duration(attempt+1)*time.Second, 30*time.Second)) {
+				return
+			}
+			continue
+		}
+
+		attempt = 0
+		flog.Infof("reverse %s forwarder listening on server %s -> %s", r.protocol, r.listenAddr, r.targetAddr)
+		stop := context.AfterFunc(ctx, func() { l.Close() })
+		l.Wait()
+		stop()
+		l.Close()
+		if ctx.Err() == nil {
+			flog.Warnf("reverse %s listener on server %s lost, registering again", r.protocol, r.listenAddr)
+			sleep(ctx, time.Second)
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (r *Reverse) handleTCP(ctx context.Context, tstrm tnet.Strm, from string) {
+	start := time.Now()
+	strm := accesslog.Count(tstrm)
+	var result error
+	defer func() {
+		accesslog.Stream(strm, "client", from, "", "PRCONN", r.targetAddr, start, accesslog.Reason(ctx, result))
+	}()
+
+	conn, err := net.DialTimeout("tcp", r.targetAddr, 10*time.Second)
+	if err != nil {
+		result = err
+		flog.Errorf("reverse TCP: failed to dial %s for %s: %v", r.targetAddr, from, err)
+		return
+	}
+	defer conn.Close()
+	flog.Infof("accepted reverse TCP connection %s -> %s on stream %d", from, r.targetAddr, strm.SID())
+
+	if result = buffer.Relay(ctx, conn, strm); result != nil {
+		flog.Errorf("reverse TCP stream %d failed for %s -> %s: %v", strm.SID(), from, r.targetAddr, result)
+	}
+}
+
+func (r *Reverse) handleUDP(ctx context.Context, tstrm tnet.Strm, from string) {
+	start := time.Now()
+	strm := accesslog.Count(tstrm)
+	var result error
+	defer func() {
+		accesslog.Stream(strm, "client", from, "", "PRCONN", r.targetAddr, start, accesslog.Reason(ctx, result))
+	}()
+
+	conn, err := net.Dial("udp", r.targetAddr)
+	if err != nil {
+		result = err
+		flog.Errorf("reverse UDP: failed to dial %s for %s: %v", r.targetAddr, from, err)
+		return
+	}
+	defer conn.Close()
+	flog.Debugf("reverse UDP session %s -> %s on stream %d", from, r.targetAddr, strm.SID())
+
+	// The server closes the stream when the session idles out.
+	go func() {
+		bufp := buffer.UPool.Get().(*[]byte)
+		defer buffer.UPool.Put(bufp)
+		buf := *bufp
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				strm.Close()
+				return
+			}
+			if err := buffer.WriteUDPFrame(strm, buf[:n]); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	bufp := buffer.UPool.Get().(*[]byte)
+	defer buffer.UPool.Put(bufp)
+	buf := *bufp
+	for {
+		n, err := buffer.ReadUDPFrame(strm, buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			flog.Debugf("reverse UDP: write to %s failed: %v", r.targetAddr, err)
+		}
+	}
+}
@@ -3,8 +3,11 @@ package forward
 import (
 	"context"
 	"net"
+	"paqet/internal/accesslog"
+	"paqet/internal/client"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
+	"time"
 )
 
 func (f *Forward) listenTCP(ctx context.Context) error {
@@ -43,35 +46,25 @@ func (f *Forward) listenTCP(ctx context.Context) error {
 	}
 }
 
-func (f *Forward) handleTCPConn(ctx context.Context, conn net.Conn) error {
-	strm, err := f.client.TCP(f.targetAddr)
+func (f *Forward) handleTCPConn(ctx context.Context, conn net.Conn) (result error) {
+	start := time.Now()
+	tstrm, err := f.client.DialTCP(f.name, f.targetAddr)
 	if err != nil {
 		flog.Errorf("failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), f.targetAddr, err)
 		return err
 	}
+	typ := client.LogType(tstrm, "PTCP")
+	strm := accesslog.Count(tstrm)
 	defer func() {
 		flog.Debugf("TCP stream closed for %s -> %s", conn.RemoteAddr(), f.targetAddr)
 		defer strm.Close()
+		accesslog.Stream(strm, "client", conn.RemoteAddr().String(), "", typ, f.targetAddr, start, accesslog.Reason(ctx, result))
 	}()
 	flog.Infof("accepted TCP connection %s -> %s", conn.RemoteAddr(), f.targetAddr)
 
-	errCh := make(chan error, 2)
-	go func() {
-		err := buffer.CopyT(conn, strm)
-		errCh <- err
-	}()
-	go func() {
-		err := buffer.CopyT(strm, conn)
-		errCh <- err
-	}()
-
-	select {
-	case err := <-errCh:
-		if err != nil {
-			flog.Errorf("TCP stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), f.targetAddr, err)
-			return err
-		}
-	case <-ctx.Done():
+	if err := buffer.Relay(ctx, conn, strm); err != nil {
+		flog.Errorf("TCP stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), f.targetAddr, err)
+		return err
 	}
 
 	return nil
@@ -2,7 +2,11 @@ package forward
 
 import (
 	"context"
+	"errors"
 	"net"
+	"paqet/internal/accesslog"
+	"paqet/internal/client"
+	"paqet/internal/conf"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
 	"paqet/internal/pkg/hash"
@@ -24,6 +28,7 @@ type udpSession struct {
 	numStreams int
 	nextIdx    uint64 // atomic for round-robin
 	cancel     context.CancelFunc
+	start      time.Time
 }
 
 func (f *Forward) listenUDP(ctx context.Context) {
@@ -48,6 +53,9 @@ func (f *Forward) listenUDP(ctx context.Context) {
 		conn.Close()
 	}()
 
+	// The target is fixed, so the routing decision is the same for
+	// every session.
+	route := f.client.Route(f.name, f.targetAddr)
 	streamCount := f.streams
 	flog.Infof("UDP forwarder listening on %s -> %s (%d streams)", laddr, f.targetAddr, streamCount)
 
@@ -74,6 +82,12 @@ func (f *Forward) listenUDP(ctx context.Context) {
 			continue
 		}
 
+		if route != conf.RouteTunnel {
+			f.routeUDP(ctx, conn, caddr, buf[:n])
+			buffer.UPool.Put(bufp)
+			continue
+		}
+
 		key := hash.AddrPair(caddr.String(), f.targetAddr)
 
 		// Check for existing session
@@ -101,11 +115,12 @@ func (f *Forward) listenUDP(ctx context.Context) {
 			streams:    make([]*udpStream, streamCount),
 			numStreams: streamCount,
 			cancel:     sessCancel,
+			start:      time.Now(),
 		}
 
 		success := true
 		for i := 0; i < streamCount; i++ {
-			strm, _, err := f.client.UDPNew(f.targetAddr)
+			strm, _, err := f.client.UDPNew(f.targetAddr, key)
 			if err != nil {
 				flog.Errorf("failed to establish UDP stream %d: %v", i, err)
 				for j := 0; j < i; j++ {
@@ -116,7 +131,7 @@ func (f *Forward) listenUDP(ctx context.Context) {
 				success = false
 				break
 			}
-			sess.streams[i] = &udpStream{strm: strm}
+			sess.streams[i] = &udpStream{strm: accesslog.Count(strm)}
 		}
 		if !success {
 			continue
@@ -154,6 +169,7 @@ func (f *Forward) listenUDP(ctx context.Context) {
 func (f *Forward) udpReadLoop(ctx context.Context, sess *udpSession, stream *udpStream, conn *net.UDPConn, caddr *net.UDPAddr, key uint64, sessions *sync.Map, idx int) {
 	bufp := buffer.UPool.Get().(*[]byte)
 	var pktsRead uint64
+	var result error
 	defer func() {
 		buffer.UPool.Put(bufp)
 		// Only stream 0 cleans up
@@ -164,6 +180,7 @@ func (f *Forward) udpReadLoop(ctx context.Context, sess *udpSession, stream *udp
 				s.strm.Close()
 			}
 			flog.Debugf("UDP session closed for %s -> %s", caddr, f.targetAddr)
+			f.logUDPSession(sess, caddr, accesslog.Reason(ctx, result))
 		}
 	}()
 	buf := *bufp
@@ -177,17 +194,96 @@ func (f *Forward) udpReadLoop(ctx context.Context, sess *udpSession, stream *udp
 
 		stream.strm.SetReadDeadline(time.Now().Add(60 * time.Second))
 		n, err := buffer.ReadUDPFrame(stream.strm, buf)
+		var unreach *buffer.Unreachable
+		if errors.As(err, &unreach) {
+			// A plain UDP socket has no way to pass this on to the sender.
+			continue
+		}
 		if err != nil {
 			if idx == 0 {
 				flog.Debugf("UDP stream %d read error after %d packets: %v", stream.strm.SID(), pktsRead, err)
 			}
+			result = err
 			return
 		}
 		pktsRead++
 
 		if _, err := conn.WriteToUDP(buf[:n], caddr); err != nil {
 			flog.Debugf("UDP write to %s failed: %v", caddr, err)
+			result = err
 			return
 		}
 	}
 }
+
+// routeUDP forwards a packet the routing rules keep out of the tunnel.
+// Direct sessions get a single flow from the client's pool; blocked
+// packets are dropped.
+func (f *Forward) routeUDP(ctx context.Context, conn *net.UDPConn, caddr *net.UDPAddr, data []byte) {
+	flow, isNew, key, err := f.client.DialUDP(f.name, caddr.String(), f.targetAddr)
+	if err != nil {
+		flog.Debugf("UDP packet from %s -> %s dropped: %v", caddr, f.targetAddr, err)
+		return
+	}
+	if err := flow.WritePacket(data); err != nil {
+		flog.Debugf("UDP write to %s failed: %v", f.targetAddr, err)
+		f.client.CloseUDP(key)
+		return
+	}
+	if !isNew {
+		return
+	}
+	flog.Infof("accepted UDP session for %s -> %s (direct)", caddr, f.targetAddr)
+	start := time.Now()
+	go func() {
+		var result error
+		defer func() {
+			f.client.CloseUDP(key)
+			flog.Debugf("UDP session closed for %s -> %s", caddr, f.targetAddr)
+			accesslog.Stream(flow, "client", caddr.String(), "", client.LogType(flow, "PUDP"), f.targetAddr, start, accesslog.Reason(ctx, result))
+		}()
+		bufp := buffer.UPool.Get().(*[]byte)
+		defer buffer.UPool.Put(bufp)
+		buf := *bufp
+		for ctx.Err() == nil {
+			flow.SetReadDeadline(time.Now().Add(60 * time.Second))
+			n, err := flow.ReadPacket(buf)
+			var unreach *buffer.Unreachable
+			if errors.As(err, &unreach) {
+				continue
+			}
+			if err != nil {
+				result = err
+				return
+			}
+			if _, err := conn.WriteToUDP(buf[:n], caddr); err != nil {
+				result = err
+				return
+			}
+		}
+	}()
+}
+
+// logUDPSession writes one access record covering all streams of a session.
+func (f *Forward) logUDPSession(sess *udpSession, caddr *net.UDPAddr, reason string) {
+	if !accesslog.Enabled() {
+		return
+	}
+	var up, down uint64
+	for _, s := range sess.streams {
+		c := s.strm.(*accesslog.Strm)
+		up += c.Tx()
+		down += c.Rx()
+	}
+	accesslog.Log(accesslog.Record{
+		Time:     sess.start,
+		Side:     "client",
+		Client:   caddr.String(),
+		Type:     "PUDP",
+		Dest:     f.targetAddr,
+		Up:       up,
+		Down:     down,
+		Duration: time.Since(sess.start),
+		Reason:   reason,
+	})
+}
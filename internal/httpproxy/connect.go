@@ -0,0 +1,49 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"paqet/internal/accesslog"
+	"paqet/internal/client"
+	"paqet/internal/pkg/buffer"
+	"time"
+)
+
+// connect opens a tunnel stream to the CONNECT authority and relays the
+// rest of the connection over it.
+func (p *Proxy) connect(ctx context.Context, conn net.Conn, br *bufio.Reader, req *http.Request) {
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		log.Debugf("HTTP CONNECT from %s has no port: %s", conn.RemoteAddr(), addr)
+		writeStatus(conn, http.StatusBadRequest)
+		return
+	}
+	log.Infof("HTTP CONNECT accepted %s -> %s", conn.RemoteAddr(), addr)
+
+	start := time.Now()
+	tstrm, err := p.client.DialTCP(p.inbound, addr)
+	if err != nil {
+		log.Errorf("HTTP CONNECT failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), addr, err)
+		writeStatus(conn, statusCode(err))
+		return
+	}
+	defer tstrm.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	typ := client.LogType(tstrm, "PTCP")
+	strm := accesslog.Count(tstrm)
+	var result error
+	defer func() {
+		accesslog.Stream(strm, "client", conn.RemoteAddr().String(), "", typ, addr, start, accesslog.Reason(ctx, result))
+	}()
+	result = buffer.Relay(ctx, buffered(conn, br), strm)
+	if result != nil {
+		log.Errorf("HTTP CONNECT stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), addr, result)
+	}
+	log.Debugf("HTTP CONNECT %s -> %s closed", conn.RemoteAddr(), addr)
+}
@@ -0,0 +1,151 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"paqet/internal/accesslog"
+	"paqet/internal/client"
+	"paqet/internal/pkg/buffer"
+	"strings"
+	"time"
+)
+
+// upstream is the tunnel stream to the origin of the last plain request.
+// A client that keeps talking to the same origin reuses it.
+type upstream struct {
+	addr  string
+	typ   string
+	strm  *accesslog.Strm
+	r     *bufio.Reader
+	from  string
+	start time.Time
+}
+
+func (u *upstream) close(ctx context.Context, err error) {
+	if u == nil {
+		return
+	}
+	u.strm.Close()
+	accesslog.Stream(u.strm, "client", u.from, "", u.typ, u.addr, u.start, accesslog.Reason(ctx, err))
+}
+
+// hopHeaders only apply to one connection and are not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// isUpgrade reports whether h asks to switch protocols, as WebSocket does.
+func isUpgrade(h http.Header) bool {
+	if h.Get("Upgrade") == "" {
+		return false
+	}
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forward sends a request with an absolute URI to its origin and copies
+// the response back. It reports whether the client connection can carry
+// another request.
+func (p *Proxy) forward(ctx context.Context, conn net.Conn, br *bufio.Reader, req *http.Request, up **upstream) bool {
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	if *up != nil && (*up).addr != addr {
+		(*up).close(ctx, nil)
+		*up = nil
+	}
+	if *up == nil {
+		start := time.Now()
+		tstrm, err := p.client.DialTCP(p.inbound, addr)
+		if err != nil {
+			log.Errorf("HTTP proxy failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), addr, err)
+			writeStatus(conn, statusCode(err))
+			return false
+		}
+		strm := accesslog.Count(tstrm)
+		*up = &upstream{addr: addr, typ: client.LogType(tstrm, "PTCP"), strm: strm, r: bufio.NewReader(strm), from: conn.RemoteAddr().String(), start: start}
+		log.Infof("HTTP proxy accepted %s -> %s on stream %d", conn.RemoteAddr(), addr, strm.SID())
+	}
+	u := *up
+
+	upgrade := isUpgrade(req.Header)
+	protocol := req.Header.Get("Upgrade")
+	removeHopHeaders(req.Header)
+	if upgrade {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", protocol)
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "") // keep Write from adding Go's
+	}
+	log.Debugf("HTTP proxy %s %s for %s", req.Method, req.URL, conn.RemoteAddr())
+
+	if err := req.Write(u.strm); err != nil {
+		log.Debugf("HTTP proxy stream %d write failed for %s: %v", u.strm.SID(), addr, err)
+		u.close(ctx, err)
+		*up = nil
+		writeStatus(conn, http.StatusBadGateway)
+		return false
+	}
+	resp, err := http.ReadResponse(u.r, req)
+	if err != nil {
+		log.Debugf("HTTP proxy stream %d bad response from %s: %v", u.strm.SID(), addr, err)
+		u.close(ctx, err)
+		*up = nil
+		writeStatus(conn, http.StatusBadGateway)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if upgrade && resp.StatusCode == http.StatusSwitchingProtocols {
+		if err := resp.Write(conn); err != nil {
+			return false
+		}
+		err := buffer.Relay(ctx, buffered(conn, br), buffered(u.strm, u.r))
+		u.close(ctx, err)
+		*up = nil
+		return false
+	}
+
+	removeHopHeaders(resp.Header)
+	if err := resp.Write(conn); err != nil {
+		log.Debugf("HTTP proxy response to %s failed: %v", conn.RemoteAddr(), err)
+		return false
+	}
+	if req.Close || resp.Close {
+		u.close(ctx, nil)
+		*up = nil
+		return false
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+// Package httpproxy is an HTTP proxy inbound: CONNECT requests become
+// tunnel streams, and plain requests with an absolute URI are forwarded to
+// their origin over the tunnel.
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"strings"
+	"time"
+)
+
+var log = flog.Sub("http")
+
+// requestTimeout bounds the wait for each request, from the end of the
+// previous one to the last header line, so idle keep-alive and slow
+// clients do not hold a connection forever.
+const requestTimeout = 60 * time.Second
+
+type Proxy struct {
+	client   *client.Client
+	inbound  string // inbound name for routing rules
+	username string
+	password string
+}
+
+func New(client *client.Client, cfg conf.HTTPProxy) (*Proxy, error) {
+	return &Proxy{
+		client:   client,
+		inbound:  cfg.Name,
+		username: cfg.Username,
+		password: cfg.Password,
+	}, nil
+}
+
+// Start listens on addr in the background. HTTP proxies that share a
+// SOCKS5 port are served through ServeConn instead.
+func (p *Proxy) Start(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("HTTP proxy failed to listen on %s: %w", addr, err)
+	}
+	log.Infof("HTTP proxy listening on %s", addr)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("HTTP proxy stopped accepting on %s: %v", addr, err)
+				}
+				return
+			}
+			go func() {
+				defer conn.Close()
+				p.ServeConn(ctx, conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// ServeConn serves the requests of one proxy client until it closes the
+// connection, switches to a tunnel or a request fails. The caller closes
+// conn.
+func (p *Proxy) ServeConn(ctx context.Context, conn net.Conn) {
+	br := bufio.NewReader(conn)
+	var up *upstream
+	defer func() { up.close(ctx, nil) }()
+	for ctx.Err() == nil {
+		conn.SetReadDeadline(time.Now().Add(requestTimeout))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		if !p.authorized(req) {
+			log.Warnf("HTTP proxy authentication failed for %s", conn.RemoteAddr())
+			writeStatus(conn, http.StatusProxyAuthRequired)
+			return
+		}
+		if req.Method == http.MethodConnect {
+			up.close(ctx, nil)
+			up = nil
+			p.connect(ctx, conn, br, req)
+			return
+		}
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			log.Debugf("HTTP proxy rejected %s %s from %s: not an absolute http URI", req.Method, req.RequestURI, conn.RemoteAddr())
+			writeStatus(conn, http.StatusBadRequest)
+			return
+		}
+		if !p.forward(ctx, conn, br, req, &up) {
+			return
+		}
+	}
+}
+
+// authorized checks the Basic credentials of req when the proxy has any.
+func (p *Proxy) authorized(req *http.Request) bool {
+	if p.username == "" {
+		return true
+	}
+	scheme, cred, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(raw), ":")
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(p.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(p.password)) == 1
+}
+
+// writeStatus answers with an empty response and asks the client to close
+// the connection.
+func writeStatus(conn net.Conn, code int) error {
+	extra := ""
+	if code == http.StatusProxyAuthRequired {
+		extra = "Proxy-Authenticate: Basic realm=\"paqet\"\r\n"
+	}
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), extra)
+	return err
+}
+
+// statusCode maps a stream setup error to the status sent to the
+// application.
+func statusCode(err error) int {
+	if errors.Is(err, client.ErrBlocked) {
+		return http.StatusForbidden
+	}
+	var re *protocol.ReplyError
+	if errors.As(err, &re) {
+		switch re.Code {
+		case protocol.ReplyDenied:
+			return http.StatusForbidden
+		case protocol.ReplyTimeout:
+			return http.StatusGatewayTimeout
+		}
+	}
+	return http.StatusBadGateway
+}
+
+// bufferedConn reads the bytes a bufio.Reader already took off c first.
+// The embedded interface keeps WriteTo of the concrete type from being
+// promoted past the buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func buffered(c net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() == 0 {
+		return c
+	}
+	return &bufferedConn{Conn: c, r: r}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *bufferedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
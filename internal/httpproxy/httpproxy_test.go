@@ -0,0 +1,45 @@
+package httpproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// deadlineConn records the read deadline in force at every Read.
+type deadlineConn struct {
+	net.Conn
+	deadline time.Time
+	reads    []time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.reads = append(c.reads, c.deadline)
+	return c.Conn.Read(b)
+}
+
+func TestServeConnRequestDeadline(t *testing.T) {
+	c, peer := net.Pipe()
+	conn := &deadlineConn{Conn: c}
+	go func() {
+		// Headers that never finish.
+		peer.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: exam"))
+		peer.Close()
+	}()
+	(&Proxy{}).ServeConn(context.Background(), conn)
+
+	if len(conn.reads) == 0 {
+		t.Fatal("no reads")
+	}
+	for i, d := range conn.reads {
+		if d.IsZero() {
+			t.Errorf("read %d waited without a deadline", i)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package buffer
 
 import (
+	"context"
+	"errors"
 	"io"
 )
 
@@ -8,7 +10,51 @@ func CopyT(dst io.Writer, src io.Reader) error {
 	bufp := TPool.Get().(*[]byte)
 	defer TPool.Put(bufp)
 	buf := *bufp
-
 	_, err := io.CopyBuffer(dst, src, buf)
 	return err
 }
+
+// halfCloser is implemented by *net.TCPConn, gonet.TCPConn and tunnel
+// streams.
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// errNoHalfClose ends a relay whose side could not be half-closed.
+var errNoHalfClose = errors.New("no half-close")
+
+// Relay copies between a and b in both directions. When one side reaches
+// EOF only the write half of the other side is closed, so the FIN travels
+// on while the reply keeps flowing; Relay returns once both directions are
+// done. A side that cannot half-close ends the relay like before. The
+// first copy error, or ctx ending, stops the relay at once; the caller
+// closes a and b.
+func Relay(ctx context.Context, a, b io.ReadWriter) error {
+	errCh := make(chan error, 2)
+	pipe := func(dst, src io.ReadWriter) {
+		err := CopyT(dst, src)
+		if err == nil {
+			if hc, ok := dst.(halfCloser); !ok || hc.CloseWrite() != nil {
+				err = errNoHalfClose
+			}
+		}
+		errCh <- err
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+
+	for range 2 {
+		select {
+		case err := <-errCh:
+			if err == errNoHalfClose {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
@@ -2,10 +2,26 @@ package buffer
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 )
 
+// udpControl is a frame length no UDP payload can have (the UDP header
+// alone takes 8 of the 65535 bytes). It marks an in-band control frame.
+const udpControl = 0xFFFF
+
+// Unreachable is returned by ReadUDPFrame when the peer reports that the
+// target answered with an ICMP destination unreachable. The stream stays
+// usable.
+type Unreachable struct {
+	Code byte // ICMPv4 destination unreachable code
+}
+
+func (e *Unreachable) Error() string {
+	return fmt.Sprintf("destination unreachable (code %d)", e.Code)
+}
+
 // CopyU copies data from src to dst using a pooled buffer.
 // Note: This is a byte-stream copy and does NOT preserve UDP datagram boundaries.
 // For UDP forwarding, use WriteUDPFrame/ReadUDPFrame instead.
@@ -25,7 +41,7 @@ func CopyU(dst io.Writer, src io.Reader) error {
 // Uses net.Buffers for scatter-gather I/O (writev) when available,
 // avoiding data copy while minimizing syscalls.
 func WriteUDPFrame(w io.Writer, data []byte) error {
-	if len(data) > 65535 {
+	if len(data) >= udpControl {
 		return io.ErrShortBuffer
 	}
 	var header [2]byte
@@ -48,9 +64,23 @@ func ReadUDPFrame(r io.Reader, buf []byte) (int, error) {
 		return 0, err
 	}
 	length := binary.BigEndian.Uint16(header[:])
+	if length == udpControl {
+		var code [1]byte
+		if _, err := io.ReadFull(r, code[:]); err != nil {
+			return 0, err
+		}
+		return 0, &Unreachable{Code: code[0]}
+	}
 	if int(length) > len(buf) {
 		return 0, io.ErrShortBuffer
 	}
 	// Read exactly length bytes of payload
 	return io.ReadFull(r, buf[:length])
 }
+
+// WriteUDPUnreachable sends an unreachable notice in place of a frame.
+// Only peers that announced protocol.FeatUDPError understand it.
+func WriteUDPUnreachable(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{0xFF, 0xFF, code})
+	return err
+}
@@ -0,0 +1,316 @@
+// Package geoip looks up the country of an IP address in a MaxMind DB
+// (.mmdb) file such as GeoLite2-Country. It implements only the parts of
+// the format that country lookups need.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// metadataMarker precedes the metadata map at the end of the file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errInvalid = errors.New("invalid MaxMind DB")
+
+// DB is a MaxMind DB loaded into memory.
+type DB struct {
+	buf        []byte
+	data       []byte // data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // node reached after the 96 zero bits of ::/96
+}
+
+// Open reads the database at path.
+func Open(path string) (*DB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := New(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// New parses a database held in buf.
+func New(buf []byte) (*DB, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no metadata", errInvalid)
+	}
+	meta := buf[i+len(metadataMarker):]
+	v, _, err := decode(meta, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", errInvalid, err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", errInvalid)
+	}
+	db := &DB{
+		buf:        buf,
+		nodeCount:  uint(toUint(m["node_count"])),
+		recordSize: uint(toUint(m["record_size"])),
+		ipVersion:  uint(toUint(m["ip_version"])),
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", errInvalid, db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%w: search tree exceeds file", errInvalid)
+	}
+	db.data = buf[treeSize+16 : i]
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for range 96 {
+			if node >= db.nodeCount {
+				break
+			}
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *DB) record(node uint, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record an address leads to.
+func (db *DB) lookup(ip netip.Addr) (any, bool) {
+	ip = ip.Unmap()
+	node, bits := uint(0), ip.AsSlice()
+	if ip.Is4() {
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, false
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		return nil, false // not found, or the tree is malformed
+	}
+	v, _, err := decode(db.data, node-db.nodeCount-16)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// Country returns the ISO 3166 code of the country ip is in, or "" if the
+// database does not know.
+func (db *DB) Country(ip netip.Addr) string {
+	v, ok := db.lookup(ip)
+	if !ok {
+		return ""
+	}
+	m, _ := v.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		c, _ := m[key].(map[string]any)
+		if code, _ := c["iso_code"].(string); code != "" {
+			return strings.ToUpper(code)
+		}
+	}
+	return ""
+}
+
+// maxValues bounds the values one decode may produce. Pointers let a few
+// bytes expand into an exponential number of values; real records hold a
+// few dozen.
+const maxValues = 1 << 16
+
+// decode decodes the value at off in section and returns it with the
+// offset after it. Pointers are relative to section.
+func decode(section []byte, off uint) (any, uint, error) {
+	budget := maxValues
+	return decodeAt(section, off, 0, &budget)
+}
+
+func decodeAt(section []byte, off uint, depth int, budget *int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	if *budget--; *budget < 0 {
+		return nil, 0, errors.New("data too large")
+	}
+	next := func(n uint) ([]byte, error) {
+		if off+n > uint(len(section)) {
+			return nil, errors.New("unexpected end of data")
+		}
+		b := section[off : off+n]
+		off += n
+		return b, nil
+	}
+
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	typ := uint(ctrl >> 5)
+
+	if typ == 1 { // pointer
+		ss, vvv := uint(ctrl>>3)&0x3, uint(ctrl&0x7)
+		p, err := next(ss + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ptr uint
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | uint(p[0])
+		case 1:
+			ptr = (vvv<<16 | uint(p[0])<<8 | uint(p[1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | uint(p[0])<<16 | uint(p[1])<<8 | uint(p[2])) + 526336
+		default:
+			ptr = uint(binary.BigEndian.Uint32(p))
+		}
+		v, _, err := decodeAt(section, ptr, depth+1, budget)
+		return v, off, err
+	}
+
+	if typ == 0 { // extended
+		e, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(e[0])
+	}
+
+	size := uint(ctrl & 0x1F)
+	if size >= 29 {
+		s, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch size {
+		case 29:
+			size = 29 + uint(s[0])
+		case 30:
+			size = 285 + (uint(s[0])<<8 | uint(s[1]))
+		default:
+			size = 65821 + (uint(s[0])<<16 | uint(s[1])<<8 | uint(s[2]))
+		}
+	}
+
+	// Every entry takes at least one byte, so a size beyond the rest of the
+	// section is corrupt and must not size an allocation.
+	left := uint(len(section)) - off
+	switch typ {
+	case 7: // map
+		if size > left/2 {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		m := make(map[string]any, size)
+		for range size {
+			k, n, err := decodeAt(section, off, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, n, err := decodeAt(section, n, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], off = v, n
+		}
+		return m, off, nil
+	case 11: // array
+		if size > left {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		a := make([]any, 0, size)
+		for range size {
+			v, n, err := decodeAt(section, off, depth+1, budget)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, off = append(a, v), n
+		}
+		return a, off, nil
+	case 14: // boolean, the value is the size
+		return size != 0, off, nil
+	}
+
+	p, err := next(size)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case 2: // UTF-8 string
+		return string(p), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("bad double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(p)), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("bad float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(p)), off, nil
+	case 4, 10: // bytes, uint128
+		return p, off, nil
+	case 5, 6, 8, 9: // uint16, uint32, int32, uint64
+		if size > 8 {
+			return nil, 0, errors.New("integer too large")
+		}
+		var v uint64
+		for _, c := range p {
+			v = v<<8 | uint64(c)
+		}
+		if typ == 8 {
+			return int64(int32(uint32(v))), off, nil
+		}
+		return v, off, nil
+	case 12, 13: // data cache container, end marker
+		return nil, off, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", typ)
+}
+
+func toUint(v any) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	}
+	return 0
+}
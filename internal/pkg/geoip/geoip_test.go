@@ -0,0 +1,206 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+// The encoders below write the few MaxMind DB types the tests need.
+
+func ctrl(typ, size int) []byte {
+	if typ > 7 {
+		return []byte{byte(size), byte(typ - 7)}
+	}
+	return []byte{byte(typ<<5 | size)}
+}
+
+func str(s string) []byte { return append(ctrl(2, len(s)), s...) }
+
+func uint32v(v uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return append(ctrl(6, len(b)), b...)
+}
+
+func uint16v(v uint16) []byte {
+	b := binary.BigEndian.AppendUint16(nil, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return append(ctrl(5, len(b)), b...)
+}
+
+func pointer(off int) []byte { return []byte{byte(1<<5 | off>>8), byte(off)} }
+
+// kv builds a map from alternating encoded keys and values.
+func kv(pairs ...[]byte) []byte {
+	out := ctrl(7, len(pairs)/2)
+	for _, p := range pairs {
+		out = append(out, p...)
+	}
+	return out
+}
+
+type entry struct {
+	prefix string
+	value  []byte // offset of the value is its position in data
+}
+
+// build writes a database mapping each prefix to its entry's value, which
+// is placed in the data section in order.
+func build(t *testing.T, ipVersion, recordSize int, entries []entry) []byte {
+	t.Helper()
+	type rec struct{ kind, v int } // kind 0 empty, 1 node, 2 data offset
+	nodes := [][2]rec{{}}
+	var data []byte
+	for _, e := range entries {
+		p := netip.MustParsePrefix(e.prefix)
+		bits, n := p.Addr().AsSlice(), p.Bits()
+		if p.Addr().Is4() && ipVersion == 6 {
+			bits, n = append(make([]byte, 12), bits...), n+96
+		}
+		off := len(data)
+		data = append(data, e.value...)
+		node := 0
+		for i := range n {
+			bit := bits[i/8] >> (7 - i%8) & 1
+			if i == n-1 {
+				nodes[node][bit] = rec{2, off}
+				break
+			}
+			if nodes[node][bit].kind != 1 {
+				nodes = append(nodes, [2]rec{})
+				nodes[node][bit] = rec{1, len(nodes) - 1}
+			}
+			node = nodes[node][bit].v
+		}
+	}
+
+	count := len(nodes)
+	value := func(r rec) uint32 {
+		switch r.kind {
+		case 1:
+			return uint32(r.v)
+		case 2:
+			return uint32(count + 16 + r.v)
+		}
+		return uint32(count)
+	}
+	var out []byte
+	for _, nd := range nodes {
+		l, r := value(nd[0]), value(nd[1])
+		switch recordSize {
+		case 24:
+			out = append(out, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			out = append(out, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			out = binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(out, l), r)
+		}
+	}
+	out = append(out, make([]byte, 16)...)
+	out = append(out, data...)
+	out = append(out, metadataMarker...)
+	return append(out, kv(
+		str("node_count"), uint32v(uint32(count)),
+		str("record_size"), uint16v(uint16(recordSize)),
+		str("ip_version"), uint16v(uint16(ipVersion)),
+		str("languages"), append(ctrl(11, 1), str("en")...),
+	)...)
+}
+
+func country(code string) []byte {
+	return kv(str("country"), kv(str("iso_code"), str(code)))
+}
+
+func TestCountry(t *testing.T) {
+	de := country("DE")
+	entries := []entry{
+		{"192.0.2.0/24", de},
+		// Only a registered country, in lower case.
+		{"198.51.100.0/25", kv(str("registered_country"), kv(str("iso_code"), str("jp")))},
+		// Shares the first entry's record through a pointer.
+		{"203.0.113.0/24", pointer(0)},
+	}
+	v6 := append(entries, entry{"2001:db8::/32", country("NL")})
+
+	for _, tc := range []struct {
+		ipVersion, recordSize int
+		entries               []entry
+	}{
+		{4, 24, entries},
+		{4, 28, entries},
+		{6, 32, v6},
+		{6, 28, v6},
+	} {
+		t.Run(fmt.Sprintf("v%d/%d", tc.ipVersion, tc.recordSize), func(t *testing.T) {
+			db, err := New(build(t, tc.ipVersion, tc.recordSize, tc.entries))
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			tests := map[string]string{
+				"192.0.2.77":       "DE",
+				"::ffff:192.0.2.1": "DE",
+				"198.51.100.5":     "JP",
+				"198.51.100.200":   "",
+				"203.0.113.9":      "DE",
+				"8.8.8.8":          "",
+				"2001:db8::1":      "",
+				"2001:db9::1":      "",
+			}
+			if tc.ipVersion == 6 {
+				tests["2001:db8::1"] = "NL"
+			}
+			for ip, want := range tests {
+				if got := db.Country(netip.MustParseAddr(ip)); got != want {
+					t.Errorf("Country(%s) = %q, want %q", ip, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := New([]byte("not a database")); err == nil {
+		t.Errorf("expected an error without metadata")
+	}
+	bad := append(append([]byte{}, metadataMarker...), kv(str("record_size"), uint16v(20))...)
+	if _, err := New(bad); err == nil {
+		t.Errorf("expected an error for record size 20")
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(country("NL"))
+	f.Add(kv(str("a"), uint32v(1), str("b"), pointer(0)))
+	f.Add(append(ctrl(7, 30), 0xFF, 0xFF))
+	f.Add([]byte{0x00, 0x04, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decode(data, 0)
+	})
+}
+
+func TestDecodeFanOut(t *testing.T) {
+	// Twelve levels of maps whose four values all point at the level
+	// below: a few hundred bytes that would decode into 4^12 values.
+	data := str("k")
+	below := 0
+	for range 12 {
+		level := len(data)
+		data = append(data, ctrl(7, 4)...)
+		for range 4 {
+			data = append(data, append(pointer(0), pointer(below)...)...)
+		}
+		below = level
+	}
+	if _, _, err := decode(data, uint(below)); err == nil || err.Error() != "data too large" {
+		t.Errorf("err = %v, want data too large", err)
+	}
+	if _, _, err := decode(append(ctrl(11, 29), 0xFF), 0); err == nil {
+		t.Error("expected an error for an array longer than the data")
+	}
+}
@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// MaxChunk caps a single reservation. Streams sharing a bucket are granted
+// tokens in request order, so a backlogged stream can get at most one chunk
+// ahead of the others before it has to queue behind them.
+const MaxChunk = 16 * 1024
+
+// Bucket is a token bucket measured in bytes. A nil *Bucket never limits.
+type Bucket struct {
+	lim *rate.Limiter
+}
+
+// NewBucket returns a bucket refilling at bytesPerSec with the given burst.
+// It returns nil when bytesPerSec is not positive.
+func NewBucket(bytesPerSec, burst int64) *Bucket {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	if burst < MaxChunk {
+		burst = MaxChunk
+	}
+	return &Bucket{lim: rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))}
+}
+
+// Chain is the set of buckets a transfer has to pass, e.g. global, per-user
+// and per-connection. Nil entries are skipped.
+type Chain []*Bucket
+
+// Wait blocks until n bytes may pass every bucket in c.
+func (c Chain) Wait(ctx context.Context, n int) error {
+	for n > 0 {
+		k := min(n, MaxChunk)
+		if err := c.wait(ctx, k); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
+
+// wait reserves n tokens from every bucket at once and sleeps for the longest
+// delay, so a transfer is charged to all of its buckets in the same instant.
+func (c Chain) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	var delay time.Duration
+	rs := make([]*rate.Reservation, 0, len(c))
+	for _, b := range c {
+		if b == nil {
+			continue
+		}
+		r := b.lim.ReserveN(now, n)
+		rs = append(rs, r)
+		if d := r.DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		for _, r := range rs {
+			r.Cancel()
+		}
+		return ctx.Err()
+	}
+}
+
+// Rate is an upload/download limit in bytes per second. Zero disables a
+// direction. Burst defaults to one second of traffic.
+type Rate struct {
+	Upload   int64
+	Download int64
+	Burst    int64
+}
+
+func (r Rate) buckets() (up, down *Bucket) {
+	burst := func(rate int64) int64 {
+		if r.Burst > 0 {
+			return r.Burst
+		}
+		return rate
+	}
+	return NewBucket(r.Upload, burst(r.Upload)), NewBucket(r.Download, burst(r.Download))
+}
+
+// Pair holds the chains for both directions of one connection. Upload is
+// client to target, Download is target to client.
+type Pair struct {
+	Up   Chain
+	Down Chain
+}
+
+type userBuckets struct {
+	up, down *Bucket
+	refs     int
+}
+
+// Shaper hands out bucket chains for server connections. The global buckets
+// are shared by everyone, user buckets by all connections of one user and
+// connection buckets are fresh for every connection.
+type Shaper struct {
+	up, down *Bucket
+	perUser  Rate
+	perConn  Rate
+
+	mu    sync.Mutex
+	users map[string]*userBuckets
+}
+
+// NewShaper creates a shaper from the global, per-user and per-connection rates.
+func NewShaper(global, perUser, perConn Rate) *Shaper {
+	s := &Shaper{
+		perUser: perUser,
+		perConn: perConn,
+		users:   make(map[string]*userBuckets),
+	}
+	s.up, s.down = global.buckets()
+	return s
+}
+
+// Acquire returns the chains for a new connection owned by user. The returned
+// release func must be called when the connection closes, so idle users do
+// not keep buckets alive.
+func (s *Shaper) Acquire(user string) (*Pair, func()) {
+	s.mu.Lock()
+	ub, ok := s.users[user]
+	if !ok {
+		ub = &userBuckets{}
+		ub.up, ub.down = s.perUser.buckets()
+		s.users[user] = ub
+	}
+	ub.refs++
+	s.mu.Unlock()
+
+	cUp, cDown := s.perConn.buckets()
+	p := &Pair{
+		Up:   Chain{s.up, ub.up, cUp},
+		Down: Chain{s.down, ub.down, cDown},
+	}
+	release := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if ub.refs--; ub.refs == 0 {
+			delete(s.users, user)
+		}
+	}
+	return p, release
+}
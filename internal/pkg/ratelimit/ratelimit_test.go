@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNilBucketUnlimited(t *testing.T) {
+	if b := NewBucket(0, 0); b != nil {
+		t.Fatal("expected nil bucket for zero rate")
+	}
+	start := time.Now()
+	if err := (Chain{nil, nil}).Wait(context.Background(), 1<<20); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("nil chain should not block")
+	}
+}
+
+func TestChainWaitsForSlowestBucket(t *testing.T) {
+	fast := NewBucket(1<<30, MaxChunk)
+	slow := NewBucket(100*1024, MaxChunk) // 100KB/s
+	c := Chain{fast, slow}
+
+	start := time.Now()
+	// The first chunk drains the burst, the next two wait ~160ms each.
+	if err := c.Wait(context.Background(), 3*MaxChunk); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Fatalf("expected shaping delay, finished in %v", d)
+	}
+}
+
+func TestChainWaitCancelled(t *testing.T) {
+	c := Chain{NewBucket(1024, MaxChunk)}
+	c.Wait(context.Background(), MaxChunk) // drain burst
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.Wait(ctx, MaxChunk); err == nil {
+		t.Fatal("expected context error")
+	}
+}
+
+func TestShaperReleasesUserBuckets(t *testing.T) {
+	s := NewShaper(Rate{}, Rate{Upload: 1 << 20}, Rate{})
+	p1, r1 := s.Acquire("alice")
+	p2, r2 := s.Acquire("alice")
+	if p1.Up[1] != p2.Up[1] {
+		t.Fatal("connections of one user should share the user bucket")
+	}
+	r1()
+	r2()
+	if len(s.users) != 0 {
+		t.Fatalf("expected user buckets released, got %d", len(s.users))
+	}
+}
@@ -0,0 +1,220 @@
+package session
+
+import (
+	"net"
+	"net/netip"
+	"paqet/internal/flog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits bounds the per-source state a server listener keeps.
+// Zero values disable the corresponding limit.
+type Limits struct {
+	MaxSessions int
+	MaxPerIP    int
+	IdleTimeout time.Duration
+}
+
+// Stats is a snapshot of a Table's counters.
+type Stats struct {
+	Active       int
+	DroppedFull  uint64 // new sources rejected by MaxSessions
+	DroppedPerIP uint64 // new sources rejected by MaxPerIP
+	DroppedQueue uint64 // packets dropped because a session queue was full
+	Expired      uint64 // sessions removed by idle expiry
+}
+
+type entry struct {
+	ip       netip.Addr
+	value    any
+	onExpire func()
+	last     atomic.Int64 // UnixNano of the last Get
+}
+
+// Table tracks server-side sessions keyed by source address.
+// Lookups are lock-free; the mutex only guards admission accounting.
+// Tables returned by Scope share the limits and counters but not entries.
+type Table struct {
+	*state
+	scope uint8
+}
+
+// tableKey scopes a source key, so listeners for different protocols
+// never find each other's values.
+type tableKey struct {
+	scope uint8
+	key   uint64
+}
+
+type state struct {
+	lim     Limits
+	entries sync.Map // tableKey -> *entry
+
+	mu    sync.Mutex
+	total int
+	perIP map[netip.Addr]int
+
+	droppedFull  atomic.Uint64
+	droppedPerIP atomic.Uint64
+	droppedQueue atomic.Uint64
+	expired      atomic.Uint64
+
+	done chan struct{}
+	once sync.Once
+}
+
+// NewTable creates a table and starts its expiry loop.
+func NewTable(lim Limits) *Table {
+	t := &Table{state: &state{
+		lim:   lim,
+		perIP: make(map[netip.Addr]int),
+		done:  make(chan struct{}),
+	}}
+	go t.gcLoop()
+	return t
+}
+
+// Scope returns a view of t with its own keys, for a listener sharing the
+// table's limits with listeners of other protocols.
+func (t *Table) Scope(scope uint8) *Table {
+	return &Table{state: t.state, scope: scope}
+}
+
+// Get returns the value stored for key and marks the session as active.
+func (t *Table) Get(key uint64) (any, bool) {
+	v, ok := t.entries.Load(tableKey{t.scope, key})
+	if !ok {
+		return nil, false
+	}
+	e := v.(*entry)
+	e.last.Store(time.Now().UnixNano())
+	return e.value, true
+}
+
+// Add admits a new session for addr. It returns false, and counts the drop,
+// when the global or per-IP limit is reached. onExpire is called (without
+// the table lock) if the session is later removed by idle expiry.
+func (t *Table) Add(key uint64, addr *net.UDPAddr, value any, onExpire func()) bool {
+	ip, _ := netip.AddrFromSlice(addr.IP)
+	ip = ip.Unmap()
+
+	t.mu.Lock()
+	if t.lim.MaxSessions > 0 && t.total >= t.lim.MaxSessions {
+		t.mu.Unlock()
+		t.droppedFull.Add(1)
+		return false
+	}
+	if t.lim.MaxPerIP > 0 && t.perIP[ip] >= t.lim.MaxPerIP {
+		t.mu.Unlock()
+		t.droppedPerIP.Add(1)
+		return false
+	}
+	e := &entry{ip: ip, value: value, onExpire: onExpire}
+	e.last.Store(time.Now().UnixNano())
+	if _, loaded := t.entries.LoadOrStore(tableKey{t.scope, key}, e); loaded {
+		t.mu.Unlock()
+		return true
+	}
+	t.total++
+	t.perIP[ip]++
+	t.mu.Unlock()
+	return true
+}
+
+// Remove drops the session for key. It is safe to call more than once.
+func (t *Table) Remove(key uint64) {
+	v, ok := t.entries.LoadAndDelete(tableKey{t.scope, key})
+	if !ok {
+		return
+	}
+	t.release(v.(*entry))
+}
+
+func (t *state) release(e *entry) {
+	t.mu.Lock()
+	t.total--
+	if t.perIP[e.ip] <= 1 {
+		delete(t.perIP, e.ip)
+	} else {
+		t.perIP[e.ip]--
+	}
+	t.mu.Unlock()
+}
+
+// QueueDrop counts a packet dropped because a session's queue was full.
+func (t *state) QueueDrop() { t.droppedQueue.Add(1) }
+
+// Stats returns a snapshot of the table's counters.
+func (t *state) Stats() Stats {
+	t.mu.Lock()
+	active := t.total
+	t.mu.Unlock()
+	return Stats{
+		Active:       active,
+		DroppedFull:  t.droppedFull.Load(),
+		DroppedPerIP: t.droppedPerIP.Load(),
+		DroppedQueue: t.droppedQueue.Load(),
+		Expired:      t.expired.Load(),
+	}
+}
+
+// Close stops the expiry loop. Existing entries are left in place.
+func (t *state) Close() {
+	t.once.Do(func() { close(t.done) })
+}
+
+// expire removes sessions idle since before cutoff and returns how many.
+func (t *state) expire(cutoff time.Time) int {
+	c := cutoff.UnixNano()
+	n := 0
+	t.entries.Range(func(k, v any) bool {
+		e := v.(*entry)
+		if e.last.Load() >= c {
+			return true
+		}
+		if _, ok := t.entries.LoadAndDelete(k); !ok {
+			return true
+		}
+		t.release(e)
+		t.expired.Add(1)
+		n++
+		if e.onExpire != nil {
+			e.onExpire()
+		}
+		return true
+	})
+	return n
+}
+
+// gcLoop expires idle sessions and warns when new drops were recorded
+// since the previous pass, so floods show up without debug logging.
+func (t *state) gcLoop() {
+	interval := 10 * time.Second
+	if t.lim.IdleTimeout > 0 {
+		interval = min(max(t.lim.IdleTimeout/4, time.Second), 30*time.Second)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last Stats
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			if t.lim.IdleTimeout > 0 {
+				if n := t.expire(now.Add(-t.lim.IdleTimeout)); n > 0 {
+					flog.Debugf("session table: expired %d idle sessions", n)
+				}
+			}
+			st := t.Stats()
+			if st.DroppedFull != last.DroppedFull || st.DroppedPerIP != last.DroppedPerIP || st.DroppedQueue != last.DroppedQueue {
+				flog.Warnf("session table: dropped %d new sources at session limit, %d at per-IP limit, %d packets on full queues (active %d)",
+					st.DroppedFull-last.DroppedFull, st.DroppedPerIP-last.DroppedPerIP, st.DroppedQueue-last.DroppedQueue, st.Active)
+			}
+			last = st
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package session
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func addr(ip string, port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestTableMaxSessions(t *testing.T) {
+	tb := NewTable(Limits{MaxSessions: 2})
+	defer tb.Close()
+
+	if !tb.Add(1, addr("192.0.2.1", 1), nil, nil) || !tb.Add(2, addr("192.0.2.2", 1), nil, nil) {
+		t.Fatal("expected first two sessions to be admitted")
+	}
+	if tb.Add(3, addr("192.0.2.3", 1), nil, nil) {
+		t.Fatal("expected third session to be rejected")
+	}
+	tb.Remove(1)
+	if !tb.Add(3, addr("192.0.2.3", 1), nil, nil) {
+		t.Fatal("expected session to be admitted after removal")
+	}
+
+	st := tb.Stats()
+	if st.Active != 2 || st.DroppedFull != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestTablePerIPLimit(t *testing.T) {
+	tb := NewTable(Limits{MaxPerIP: 2})
+	defer tb.Close()
+
+	tb.Add(1, addr("192.0.2.1", 1), nil, nil)
+	tb.Add(2, addr("192.0.2.1", 2), nil, nil)
+	if tb.Add(3, addr("192.0.2.1", 3), nil, nil) {
+		t.Fatal("expected per-IP limit to reject third session")
+	}
+	// IPv4-mapped form of the same address counts against the same IP.
+	if tb.Add(4, addr("::ffff:192.0.2.1", 4), nil, nil) {
+		t.Fatal("expected IPv4-mapped address to share the per-IP limit")
+	}
+	if !tb.Add(5, addr("192.0.2.2", 1), nil, nil) {
+		t.Fatal("expected other IP to be admitted")
+	}
+	if st := tb.Stats(); st.DroppedPerIP != 2 {
+		t.Fatalf("expected 2 per-IP drops, got %d", st.DroppedPerIP)
+	}
+}
+
+func TestTableRemoveIdempotent(t *testing.T) {
+	tb := NewTable(Limits{MaxSessions: 1})
+	defer tb.Close()
+
+	tb.Add(1, addr("192.0.2.1", 1), nil, nil)
+	tb.Remove(1)
+	tb.Remove(1)
+	if st := tb.Stats(); st.Active != 0 {
+		t.Fatalf("expected 0 active sessions, got %d", st.Active)
+	}
+}
+
+func TestTableExpire(t *testing.T) {
+	tb := NewTable(Limits{IdleTimeout: time.Minute})
+	defer tb.Close()
+
+	expired := false
+	tb.Add(1, addr("192.0.2.1", 1), "idle", func() { expired = true })
+	tb.Add(2, addr("192.0.2.2", 1), "busy", nil)
+
+	cutoff := time.Now().Add(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	tb.Get(2) // refresh
+
+	if n := tb.expire(cutoff); n != 1 {
+		t.Fatalf("expected 1 expired session, got %d", n)
+	}
+	if !expired {
+		t.Fatal("expected onExpire to be called")
+	}
+	if _, ok := tb.Get(1); ok {
+		t.Fatal("expired session still present")
+	}
+	if v, ok := tb.Get(2); !ok || v.(string) != "busy" {
+		t.Fatal("active session was removed")
+	}
+	if st := tb.Stats(); st.Active != 1 || st.Expired != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestTableScope(t *testing.T) {
+	tb := NewTable(Limits{MaxPerIP: 2})
+	defer tb.Close()
+	a, b := tb.Scope(1), tb.Scope(2)
+
+	if !a.Add(1, addr("192.0.2.1", 1), "a", nil) || !b.Add(1, addr("192.0.2.1", 1), "b", nil) {
+		t.Fatal("expected the same key to be admitted in each scope")
+	}
+	if v, _ := a.Get(1); v != "a" {
+		t.Fatalf("scope 1 got %v", v)
+	}
+	if v, _ := b.Get(1); v != "b" {
+		t.Fatalf("scope 2 got %v", v)
+	}
+	// Limits are shared across scopes.
+	if a.Add(2, addr("192.0.2.1", 2), nil, nil) {
+		t.Fatal("expected per-IP limit to count both scopes")
+	}
+	b.Remove(1)
+	if _, ok := a.Get(1); !ok {
+		t.Fatal("removing from one scope removed the other's entry")
+	}
+	if st := tb.Stats(); st.Active != 1 {
+		t.Fatalf("expected 1 active session, got %d", st.Active)
+	}
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// Version is the protocol version spoken by this build.
+const Version uint8 = 1
+
+// Features is a bit set of optional protocol capabilities exchanged in
+// PHELLO. Unknown bits from newer peers are ignored.
+type Features uint32
+
+const (
+	FeatReply     Features = 1 << iota // PTCPR requests and PREPLY answers
+	FeatUDPFlow                        // PUDPF per-client UDP sockets
+	FeatDatagram                       // PUDPDGM sessions with ID-prefixed datagrams
+	FeatICMP                           // PICMP echo tunneling
+	FeatUDPError                       // ICMP unreachable notices on UDP streams
+	FeatHalfClose                      // framed TCP streams that carry half-close
+	FeatReverse                        // PRTCP and PRUDP reverse listeners
+)
+
+// Supported is the feature set implemented by this build.
+const Supported = FeatReply | FeatUDPFlow | FeatDatagram | FeatICMP | FeatUDPError | FeatHalfClose | FeatReverse
+
+var featureNames = []struct {
+	f    Features
+	name string
+}{
+	{FeatReply, "reply"},
+	{FeatUDPFlow, "udp-flow"},
+	{FeatDatagram, "datagram"},
+	{FeatICMP, "icmp"},
+	{FeatUDPError, "udp-error"},
+	{FeatHalfClose, "half-close"},
+	{FeatReverse, "reverse"},
+}
+
+// Hello is the capability announcement sent on the first stream of every
+// connection. The server answers with its own Hello.
+type Hello struct {
+	Version  uint8
+	Features Features
+}
+
+// Legacy describes a peer that predates the hello exchange.
+var Legacy = Hello{}
+
+// Local returns the Hello advertised by this build.
+func Local() Hello {
+	return Hello{Version: Version, Features: Supported}
+}
+
+// Has reports whether all bits of x are set.
+func (f Features) Has(x Features) bool {
+	return f&x == x
+}
+
+func (f Features) String() string {
+	var names []string
+	for _, n := range featureNames {
+		if f.Has(n.f) {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// readHello reads a hello body.
+// Wire format: version(1) + features(4)
+func (p *Proto) readHello(r io.Reader) error {
+	var buf [5]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	p.Hello = &Hello{
+		Version:  buf[0],
+		Features: Features(binary.BigEndian.Uint32(buf[1:])),
+	}
+	return nil
+}
+
+// writeHello writes a hello body.
+func (p *Proto) writeHello(w io.Writer) error {
+	h := p.Hello
+	if h == nil {
+		l := Local()
+		h = &l
+	}
+	var buf [5]byte
+	buf[0] = h.Version
+	binary.BigEndian.PutUint32(buf[1:], uint32(h.Features))
+	_, err := w.Write(buf[:])
+	return err
+}
@@ -3,6 +3,7 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"paqet/internal/conf"
@@ -18,19 +19,92 @@ const (
 	PTCP    PType = 0x04
 	PUDP    PType = 0x05
 	PICMP   PType = 0x06
-	PUDPDGM PType = 0x07 // UDP with datagram mode (unreliable, high throughput)
+	PUDPDGM PType = 0x07 // UDP datagram session, Flow is the session ID (unreliable, high throughput)
+	PUDPF   PType = 0x08 // UDP with a client flow ID, for per-client socket sharing
+	PREPLY  PType = 0x09 // Result of a stream request, sent by the server
+	PTCPR   PType = 0x0a // TCP that waits for a PREPLY with the dial result
+	PHELLO  PType = 0x0b // Version and feature announcement, first stream only
+	PRTCP   PType = 0x0c // Reverse TCP listener request, Flow is the client's rule ID
+	PRUDP   PType = 0x0d // Reverse UDP listener request, Flow is the client's rule ID
+	PRCONN  PType = 0x0e // Server-opened stream for a reverse listener, Addr is the remote peer
 )
 
+// ReplyCode is the result carried by a PREPLY frame.
+type ReplyCode = byte
+
+const (
+	ReplyOK          ReplyCode = 0x00
+	ReplyFailure     ReplyCode = 0x01 // General server failure
+	ReplyLimited     ReplyCode = 0x02 // Stream limit reached, retry later
+	ReplyQuota       ReplyCode = 0x03 // Traffic quota exhausted
+	ReplyRefused     ReplyCode = 0x04 // Target refused the connection
+	ReplyUnreachable ReplyCode = 0x05 // No route to the target network or host
+	ReplyTimeout     ReplyCode = 0x06 // Dial to the target timed out
+	ReplyDenied      ReplyCode = 0x07 // Destination not allowed by the server
+)
+
+var replyText = map[ReplyCode]string{
+	ReplyOK:          "ok",
+	ReplyFailure:     "server failure",
+	ReplyLimited:     "stream limit reached",
+	ReplyQuota:       "traffic quota exceeded",
+	ReplyRefused:     "connection refused",
+	ReplyUnreachable: "target unreachable",
+	ReplyTimeout:     "connection timed out",
+	ReplyDenied:      "destination not allowed",
+}
+
+// ReplyError is returned by clients when the server answers a stream
+// request with a non-OK PREPLY.
+type ReplyError struct {
+	Code ReplyCode
+}
+
+func (e *ReplyError) Error() string {
+	if text, ok := replyText[e.Code]; ok {
+		return "server reply: " + text
+	}
+	return fmt.Sprintf("server reply: code 0x%02x", e.Code)
+}
+
 var (
 	ErrUnknownProtoType = errors.New("unknown protocol type")
 	ErrNilAddr          = errors.New("addr is nil")
 )
 
+var typeNames = map[PType]string{
+	PPING:   "PPING",
+	PPONG:   "PPONG",
+	PTCPF:   "PTCPF",
+	PTCP:    "PTCP",
+	PUDP:    "PUDP",
+	PICMP:   "PICMP",
+	PUDPDGM: "PUDPDGM",
+	PUDPF:   "PUDPF",
+	PREPLY:  "PREPLY",
+	PTCPR:   "PTCPR",
+	PHELLO:  "PHELLO",
+	PRTCP:   "PRTCP",
+	PRUDP:   "PRUDP",
+	PRCONN:  "PRCONN",
+}
+
+// TypeName returns the constant name of t, e.g. "PTCP".
+func TypeName(t PType) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", t)
+}
+
 type Proto struct {
-	Type PType
-	Addr *tnet.Addr
-	TCPF []conf.TCPF
-	ICMP *ICMPData // For ICMP packets
+	Type  PType
+	Addr  *tnet.Addr
+	TCPF  []conf.TCPF
+	ICMP  *ICMPData // For ICMP packets
+	Flow  uint64    // Client flow ID (PUDPF), datagram session ID (PUDPDGM) or reverse rule ID
+	Code  ReplyCode // Result code (PREPLY)
+	Hello *Hello    // Peer capabilities (PHELLO)
 }
 
 // ICMPData holds ICMP packet info for tunneling.
@@ -49,8 +123,19 @@ func (p *Proto) Read(r io.Reader) error {
 	switch p.Type {
 	case PPING, PPONG:
 		return nil
-	case PTCP, PUDP, PUDPDGM:
+	case PTCP, PTCPR, PUDP:
 		return p.readAddr(r)
+	case PUDPF, PUDPDGM, PRTCP, PRUDP, PRCONN:
+		return p.readFlow(r)
+	case PREPLY:
+		var codeBuf [1]byte
+		if _, err := io.ReadFull(r, codeBuf[:]); err != nil {
+			return err
+		}
+		p.Code = codeBuf[0]
+		return nil
+	case PHELLO:
+		return p.readHello(r)
 	case PTCPF:
 		return p.readTCPF(r)
 	case PICMP:
@@ -68,8 +153,15 @@ func (p *Proto) Write(w io.Writer) error {
 	switch p.Type {
 	case PPING, PPONG:
 		return nil
-	case PTCP, PUDP, PUDPDGM:
+	case PTCP, PTCPR, PUDP:
 		return p.writeAddr(w)
+	case PUDPF, PUDPDGM, PRTCP, PRUDP, PRCONN:
+		return p.writeFlow(w)
+	case PREPLY:
+		_, err := w.Write([]byte{p.Code})
+		return err
+	case PHELLO:
+		return p.writeHello(w)
 	case PTCPF:
 		return p.writeTCPF(w)
 	case PICMP:
@@ -79,6 +171,31 @@ func (p *Proto) Write(w io.Writer) error {
 	}
 }
 
+// readFlow reads an address followed by the client flow ID.
+// Wire format: address (see readAddr) + flow(8)
+func (p *Proto) readFlow(r io.Reader) error {
+	if err := p.readAddr(r); err != nil {
+		return err
+	}
+	var flowBuf [8]byte
+	if _, err := io.ReadFull(r, flowBuf[:]); err != nil {
+		return err
+	}
+	p.Flow = binary.BigEndian.Uint64(flowBuf[:])
+	return nil
+}
+
+// writeFlow writes an address followed by the client flow ID.
+func (p *Proto) writeFlow(w io.Writer) error {
+	if err := p.writeAddr(w); err != nil {
+		return err
+	}
+	var flowBuf [8]byte
+	binary.BigEndian.PutUint64(flowBuf[:], p.Flow)
+	_, err := w.Write(flowBuf[:])
+	return err
+}
+
 // readTCPF reads TCPF entries using binary encoding.
 // Wire format: uint16 count, then for each entry: 2 bytes of packed flags.
 func (p *Proto) readTCPF(r io.Reader) error {
@@ -65,6 +65,28 @@ func TestUDPRoundTrip(t *testing.T) {
 	}
 }
 
+func TestUDPFlowRoundTrip(t *testing.T) {
+	addr, _ := tnet.NewAddr("example.com:51820")
+	var buf bytes.Buffer
+	w := Proto{Type: PUDPF, Addr: addr, Flow: 0x0123456789abcdef}
+	if err := w.Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var r Proto
+	if err := r.Read(&buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if r.Type != PUDPF {
+		t.Fatalf("expected PUDPF, got 0x%02x", r.Type)
+	}
+	if r.Addr.String() != "example.com:51820" {
+		t.Fatalf("addr mismatch: got %s", r.Addr.String())
+	}
+	if r.Flow != 0x0123456789abcdef {
+		t.Fatalf("flow mismatch: got %x", r.Flow)
+	}
+}
+
 func TestTCPFRoundTrip(t *testing.T) {
 	tcpf := []conf.TCPF{
 		{SYN: true, ACK: true},
@@ -109,3 +131,101 @@ func TestUnknownTypeReturnsError(t *testing.T) {
 		t.Fatal("expected error for unknown type")
 	}
 }
+
+func TestReplyRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := Proto{Type: PREPLY, Code: ReplyLimited}
+	if err := w.Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var r Proto
+	if err := r.Read(&buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if r.Type != PREPLY || r.Code != ReplyLimited {
+		t.Fatalf("expected PREPLY/ReplyLimited, got 0x%02x/%d", r.Type, r.Code)
+	}
+}
+
+func TestTCPRRoundTrip(t *testing.T) {
+	addr, _ := tnet.NewAddr("example.com:80")
+	var buf bytes.Buffer
+	w := Proto{Type: PTCPR, Addr: addr}
+	if err := w.Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var r Proto
+	if err := r.Read(&buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if r.Type != PTCPR || r.Addr.String() != "example.com:80" {
+		t.Fatalf("expected PTCPR example.com:80, got 0x%02x %v", r.Type, r.Addr)
+	}
+}
+
+func TestReplyErrorText(t *testing.T) {
+	if got := (&ReplyError{Code: ReplyRefused}).Error(); got != "server reply: connection refused" {
+		t.Fatalf("unexpected text %q", got)
+	}
+	if got := (&ReplyError{Code: 0x7f}).Error(); got != "server reply: code 0x7f" {
+		t.Fatalf("unexpected text %q", got)
+	}
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := Proto{Type: PHELLO, Hello: &Hello{Version: 7, Features: FeatReply | 1<<31}}
+	if err := w.Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if buf.Len() != 6 {
+		t.Fatalf("expected 6 bytes for hello, got %d", buf.Len())
+	}
+	var r Proto
+	if err := r.Read(&buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if r.Type != PHELLO || r.Hello == nil {
+		t.Fatalf("expected PHELLO with body, got 0x%02x", r.Type)
+	}
+	if r.Hello.Version != 7 || !r.Hello.Features.Has(FeatReply) || r.Hello.Features.Has(FeatUDPFlow) {
+		t.Fatalf("hello mismatch: %+v", *r.Hello)
+	}
+	if got := (r.Hello.Features & Supported).String(); got != "reply" {
+		t.Fatalf("expected unknown bits masked off, got %q", got)
+	}
+}
+
+func TestUDPDatagramRoundTrip(t *testing.T) {
+	addr, _ := tnet.NewAddr("10.0.0.1:51820")
+	var buf bytes.Buffer
+	w := Proto{Type: PUDPDGM, Addr: addr, Flow: 42}
+	if err := w.Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var r Proto
+	if err := r.Read(&buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if r.Type != PUDPDGM || r.Flow != 42 || r.Addr.String() != "10.0.0.1:51820" {
+		t.Fatalf("mismatch: 0x%02x %d %v", r.Type, r.Flow, r.Addr)
+	}
+}
+
+func TestReverseRoundTrip(t *testing.T) {
+	for _, typ := range []PType{PRTCP, PRUDP, PRCONN} {
+		addr, _ := tnet.NewAddr(":2222")
+		var buf bytes.Buffer
+		w := Proto{Type: typ, Addr: addr, Flow: 3}
+		if err := w.Write(&buf); err != nil {
+			t.Fatalf("%s write: %v", TypeName(typ), err)
+		}
+		var r Proto
+		if err := r.Read(&buf); err != nil {
+			t.Fatalf("%s read: %v", TypeName(typ), err)
+		}
+		if r.Type != typ || r.Flow != 3 || r.Addr.String() != ":2222" {
+			t.Fatalf("%s mismatch: 0x%02x %d %v", TypeName(typ), r.Type, r.Flow, r.Addr)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"paqet/internal/accesslog"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"paqet/internal/usage"
+	"sync/atomic"
+	"time"
+)
+
+// datagramSession is one client UDP flow in datagram mode. Datagrams in
+// both directions start with the session ID as a uvarint.
+type datagramSession struct {
+	id   uint64
+	conn net.Conn
+	strm tnet.Strm // closing it ends the session
+	addr string
+
+	// frames is the session stream without shaping or metering. Replies
+	// too large for a datagram go there, as they are charged per packet.
+	frames tnet.Strm
+
+	up, down atomic.Uint64 // bytes forwarded, for the access log
+}
+
+// handleUDPDatagramProtocol runs a datagram session for the lifetime of its
+// PUDPDGM stream. The stream also carries packets too large for a datagram
+// and unreachable notices; closing it ends the session. A PREPLY tells the
+// client once the session is registered: datagrams that arrive before are
+// dropped, so until then the client sends its packets on the stream. raw is
+// strm before shaping and metering.
+func (s *Server) handleUDPDatagramProtocol(ctx context.Context, conn tnet.Conn, strm, raw tnet.Strm, p *protocol.Proto, cs *connState) (err error) {
+	dgConn, ok := conn.(tnet.DatagramConn)
+	if !ok || !dgConn.SupportsDatagrams() {
+		flog.Errorf("connection doesn't support datagrams for PUDPDGM")
+		writeReply(strm, protocol.ReplyFailure)
+		return fmt.Errorf("datagrams not supported")
+	}
+
+	addr := p.Addr.String()
+	udpConn, err := s.egress.DialUDP(ctx, addr)
+	if err != nil {
+		writeReply(strm, dialReply(err))
+		return err
+	}
+	defer udpConn.Close()
+
+	sess := &datagramSession{id: p.Flow, conn: udpConn, strm: strm, addr: addr, frames: raw}
+	if _, loaded := cs.dgram.LoadOrStore(sess.id, sess); loaded {
+		writeReply(strm, protocol.ReplyFailure)
+		return fmt.Errorf("duplicate datagram session %d", sess.id)
+	}
+	defer cs.dgram.Delete(sess.id)
+	if err := writeReply(strm, protocol.ReplyOK); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	l := flog.With("conn", conn.RemoteAddr(), "stream", strm.SID(), "session", sess.id, "dest", addr)
+	l.Infof("established UDP datagram session")
+	defer func() {
+		l.Debugf("datagram session closed")
+		accesslog.Log(accesslog.Record{
+			Time:     start,
+			Side:     "server",
+			Client:   conn.RemoteAddr().String(),
+			User:     cs.identity,
+			Type:     protocol.TypeName(protocol.PUDPDGM),
+			Dest:     addr,
+			Up:       sess.up.Load(),
+			Down:     sess.down.Load(),
+			Duration: time.Since(start),
+			Reason:   accesslog.Reason(ctx, err),
+		})
+	}()
+
+	go s.datagramReplies(ctx, dgConn, strm, sess, cs)
+
+	// Oversized packets from the client arrive as frames on the stream.
+	bufp := buffer.UPool.Get().(*[]byte)
+	defer buffer.UPool.Put(bufp)
+	buf := *bufp
+	for {
+		n, err := buffer.ReadUDPFrame(strm, buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		udpConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := udpConn.Write(buf[:n]); err != nil {
+			flog.Debugf("datagram session %d write to %s failed: %v", sess.id, addr, err)
+		} else {
+			sess.up.Add(uint64(n))
+		}
+		udpConn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// datagramReplies sends target responses to the client until the session
+// socket is closed. Responses that do not fit in a datagram go over the
+// session stream. Each response is shaped and charged before it is sent.
+func (s *Server) datagramReplies(ctx context.Context, dgConn tnet.DatagramConn, strm tnet.Strm, sess *datagramSession, cs *connState) {
+	defer strm.Close()
+	notify := cs.features().Has(protocol.FeatUDPError)
+
+	prefix := binary.AppendUvarint(nil, sess.id)
+	buf := make([]byte, len(prefix)+65535)
+	copy(buf, prefix)
+	for {
+		sess.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		n, err := sess.conn.Read(buf[len(prefix):])
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			if code, ok := unreachableCode(err); ok {
+				if notify {
+					notifyUnreachable(strm, code)
+				}
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				flog.Debugf("datagram session %d read from %s ended: %v", sess.id, sess.addr, err)
+			}
+			return
+		}
+		data := buf[len(prefix) : len(prefix)+n]
+
+		if cs.lim != nil {
+			if err := cs.lim.Down.Wait(ctx, n); err != nil {
+				return
+			}
+		}
+		if s.usage != nil && !s.usage.Add(cs.user, usage.UDP, false, n) {
+			flog.Warnf("closing datagram session to %s: user %s is over quota", sess.addr, cs.user)
+			return
+		}
+
+		err = dgConn.SendDatagram(buf[:len(prefix)+n])
+		if errors.Is(err, tnet.ErrDatagramTooLarge) {
+			if err := buffer.WriteUDPFrame(sess.frames, data); err != nil {
+				return
+			}
+			sess.down.Add(uint64(n))
+			continue
+		}
+		if err != nil {
+			// Don't return on send errors - datagrams are unreliable
+			flog.Debugf("datagram send error: %v", err)
+			continue
+		}
+		sess.down.Add(uint64(n))
+	}
+}
+
+// handleDatagrams processes incoming QUIC datagrams for a connection.
+// Called once per datagram-capable connection.
+func (s *Server) handleDatagrams(ctx context.Context, dgConn tnet.DatagramConn, cs *connState) {
+	flog.Debugf("starting datagram receiver for %s", dgConn.RemoteAddr())
+
+	for {
+		data, err := dgConn.ReceiveDatagram(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			flog.Debugf("datagram receive error: %v", err)
+			return
+		}
+
+		id, n := binary.Uvarint(data)
+		if n <= 0 {
+			continue
+		}
+		v, ok := cs.dgram.Load(id)
+		if !ok {
+			// Session not registered yet or already closed - drop packet
+			continue
+		}
+		sess := v.(*datagramSession)
+		data = data[n:]
+
+		if cs.lim != nil {
+			if err := cs.lim.Up.Wait(ctx, len(data)); err != nil {
+				return
+			}
+		}
+		if s.usage != nil && !s.usage.Add(cs.user, usage.UDP, true, len(data)) {
+			flog.Warnf("closing datagram session to %s: user %s is over quota", sess.addr, cs.user)
+			cs.dgram.Delete(id)
+			sess.strm.Close()
+			continue
+		}
+
+		// Write to target UDP
+		sess.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := sess.conn.Write(data); err != nil {
+			flog.Debugf("datagram forward to %s failed: %v", sess.addr, err)
+		} else {
+			sess.up.Add(uint64(len(data)))
+		}
+		sess.conn.SetWriteDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"paqet/internal/egress"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"testing"
+	"time"
+)
+
+func TestDatagramOverQuotaClosesSession(t *testing.T) {
+	s := &Server{usage: openStore(t, 10)}
+	cs := &connState{user: "alice"}
+	strm, _ := newPipeStrm()
+	target, _ := net.Pipe()
+	sess := &datagramSession{id: 7, conn: target, strm: strm, addr: "192.0.2.53:53"}
+	cs.dgram.Store(sess.id, sess)
+
+	conn := &testConn{dgrams: make(chan []byte, 1)}
+	conn.dgrams <- append(binary.AppendUvarint(nil, sess.id), make([]byte, 16)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.handleDatagrams(ctx, conn, cs)
+
+	waitClosed(t, strm)
+	if _, ok := cs.dgram.Load(sess.id); ok {
+		t.Error("session still registered after going over quota")
+	}
+}
+
+func TestDatagramReplyOverQuota(t *testing.T) {
+	s := &Server{usage: openStore(t, 10)}
+	cs := &connState{user: "alice"}
+	strm, _ := newPipeStrm()
+	target, far := net.Pipe()
+	sess := &datagramSession{id: 7, conn: target, strm: strm, addr: "192.0.2.53:53", frames: strm}
+
+	conn := &testConn{dgrams: make(chan []byte), sent: make(chan []byte, 1)}
+	go s.datagramReplies(context.Background(), conn, strm, sess, cs)
+	go far.Write(make([]byte, 16))
+
+	waitClosed(t, strm)
+	select {
+	case <-conn.sent:
+		t.Error("reply sent after going over quota")
+	default:
+	}
+}
+
+func TestDatagramSessionReply(t *testing.T) {
+	d, err := egress.New(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	s := &Server{egress: d}
+	cs := &connState{}
+	conn := &testConn{dgrams: make(chan []byte)}
+	strm, peer := newPipeStrm()
+	tAddr := target.LocalAddr().(*net.UDPAddr)
+	p := &protocol.Proto{Type: protocol.PUDPDGM, Addr: &tnet.Addr{Host: tAddr.IP.String(), Port: tAddr.Port}, Flow: 9}
+	done := make(chan error, 1)
+	go func() { done <- s.handleUDPDatagramProtocol(context.Background(), conn, strm, strm, p, cs) }()
+
+	if code := readReply(t, peer); code != protocol.ReplyOK {
+		t.Fatalf("reply = %d, want OK", code)
+	}
+	if _, ok := cs.dgram.Load(p.Flow); !ok {
+		t.Fatal("session confirmed before it was registered")
+	}
+
+	// Packets framed on the session stream reach the target.
+	if err := buffer.WriteUDPFrame(peer, []byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	if n, _, err := target.ReadFrom(buf); err != nil || string(buf[:n]) != "query" {
+		t.Fatalf("target read %q, %v", buf[:n], err)
+	}
+	peer.Close()
+	if err := <-done; err != nil {
+		t.Errorf("session ended with %v", err)
+	}
+}
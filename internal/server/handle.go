@@ -3,18 +3,54 @@ package server
 import (
 	"context"
 	"fmt"
+	"paqet/internal/accesslog"
 	"paqet/internal/flog"
+	"paqet/internal/pkg/ratelimit"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
+	"paqet/internal/usage"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// connState is the per-connection state shared by all streams of a client
+// connection.
+type connState struct {
+	user     string
+	identity string                         // spa user name, empty for anonymous clients
+	lim      *ratelimit.Pair                // nil when shaping is disabled
+	streams  int                            // active stream handlers, guarded by streamLimiter.mu
+	peer     atomic.Pointer[protocol.Hello] // nil until the client's hello arrives
+	dgram    sync.Map                       // datagram session ID -> *datagramSession
+}
+
+// features returns what the client announced, or the legacy set if it
+// has not sent a hello.
+func (cs *connState) features() protocol.Features {
+	if h := cs.peer.Load(); h != nil {
+		return h.Features & protocol.Supported
+	}
+	return protocol.Legacy.Features
+}
+
 func (s *Server) handleConn(ctx context.Context, conn tnet.Conn) {
+	cs := &connState{user: s.userOf(conn.RemoteAddr())}
+	if s.guard != nil {
+		cs.identity, _ = s.guard.User(conn.RemoteAddr())
+	}
+	if s.shaper != nil {
+		var release func()
+		cs.lim, release = s.shaper.Acquire(cs.user)
+		defer release()
+	}
+
 	// Check if connection supports datagrams
 	dgConn, supportsDg := conn.(tnet.DatagramConn)
 	if supportsDg && dgConn.SupportsDatagrams() {
 		// Start datagram receiver for this connection
 		s.wg.Go(func() {
-			s.handleDatagrams(ctx, dgConn)
+			s.handleDatagrams(ctx, dgConn, cs)
 		})
 	}
 
@@ -30,49 +66,94 @@ func (s *Server) handleConn(ctx context.Context, conn tnet.Conn) {
 			flog.Errorf("failed to accept stream on %s: %v", conn.RemoteAddr(), err)
 			return
 		}
-		// Acquire semaphore to limit concurrent stream handlers
-		select {
-		case s.sem <- struct{}{}:
-		case <-ctx.Done():
-			strm.Close()
-			return
+		if s.usage != nil && s.usage.Exceeded(cs.user) {
+			flog.Warnf("refusing stream %d from %s: user %s is over quota", strm.SID(), conn.RemoteAddr(), cs.user)
+			go rejectStrm(strm, cs, protocol.ReplyQuota)
+			continue
+		}
+		if limit, ok := s.streams.acquire(cs); !ok {
+			flog.Warnf("refusing stream %d from %s: %s stream limit reached", strm.SID(), conn.RemoteAddr(), limit)
+			go rejectStrm(strm, cs, protocol.ReplyLimited)
+			continue
 		}
 		s.wg.Go(func() {
-			defer func() { <-s.sem }()
+			defer s.streams.release(cs)
 			defer strm.Close()
-			if err := s.handleStrm(ctx, conn, strm); err != nil {
-				flog.Errorf("stream %d from %s closed with error: %v", strm.SID(), strm.RemoteAddr(), err)
+			l := flog.With("conn", conn.RemoteAddr(), "stream", strm.SID(), "user", cs.user)
+			if err := s.handleStrm(ctx, conn, strm, cs); err != nil {
+				l.Errorf("stream closed with error: %v", err)
 			} else {
-				flog.Debugf("stream %d from %s closed", strm.SID(), strm.RemoteAddr())
+				l.Debugf("stream closed")
 			}
 		})
 	}
 }
 
-func (s *Server) handleStrm(ctx context.Context, conn tnet.Conn, strm tnet.Strm) error {
+func (s *Server) handleStrm(ctx context.Context, conn tnet.Conn, strm tnet.Strm, cs *connState) (err error) {
+	raw := strm
+	if cs.lim != nil {
+		shaped := newShapedStrm(ctx, strm, cs.lim)
+		defer shaped.Close()
+		strm = shaped
+	}
+
 	var p protocol.Proto
-	err := p.Read(strm)
-	if err != nil {
+	if err := p.Read(strm); err != nil {
 		flog.Errorf("failed to read protocol message from stream %d: %v", strm.SID(), err)
 		return err
 	}
 
+	if accesslog.Enabled() && (p.Type == protocol.PTCP || p.Type == protocol.PTCPR || p.Type == protocol.PUDP || p.Type == protocol.PUDPF) {
+		counted := accesslog.Count(strm)
+		strm = counted
+		start := time.Now()
+		defer func() {
+			accesslog.Stream(counted, "server", conn.RemoteAddr().String(), cs.identity,
+				protocol.TypeName(p.Type), p.Addr.String(), start, accesslog.Reason(ctx, err))
+		}()
+	}
+
+	if s.usage != nil {
+		switch p.Type {
+		case protocol.PTCP, protocol.PTCPR:
+			strm = &meteredStrm{Strm: strm, store: s.usage, user: cs.user, kind: usage.TCP}
+		case protocol.PUDP, protocol.PUDPF, protocol.PUDPDGM, protocol.PICMP:
+			strm = &meteredStrm{Strm: strm, store: s.usage, user: cs.user, kind: usage.UDP}
+		}
+	}
+
 	switch p.Type {
 	case protocol.PPING:
 		return s.handlePing(strm)
+	case protocol.PHELLO:
+		return s.handleHello(strm, &p, cs)
 	case protocol.PTCPF:
 		if len(p.TCPF) != 0 {
 			s.pConn.SetClientTCPF(strm.RemoteAddr(), p.TCPF)
 		}
 		return nil
-	case protocol.PTCP:
-		return s.handleTCPProtocol(ctx, strm, &p)
-	case protocol.PUDP:
-		return s.handleUDPProtocol(ctx, strm, &p)
+	case protocol.PTCP, protocol.PTCPR:
+		return s.handleTCPProtocol(ctx, strm, &p, cs)
+	case protocol.PUDP, protocol.PUDPF:
+		return s.handleUDPProtocol(ctx, strm, &p, cs)
+	case protocol.PICMP:
+		return s.handleICMPProtocol(ctx, strm, &p)
 	case protocol.PUDPDGM:
-		return s.handleUDPDatagramProtocol(ctx, conn, strm, &p)
+		return s.handleUDPDatagramProtocol(ctx, conn, strm, raw, &p, cs)
+	case protocol.PRTCP, protocol.PRUDP:
+		return s.handleReverseProtocol(ctx, conn, strm, &p, cs)
 	default:
 		flog.Errorf("unknown protocol type %d on stream %d", p.Type, strm.SID())
 		return fmt.Errorf("unknown protocol type: %d", p.Type)
 	}
 }
+
+// handleHello records the client's capabilities and answers with ours.
+func (s *Server) handleHello(strm tnet.Strm, p *protocol.Proto, cs *connState) error {
+	cs.peer.Store(p.Hello)
+	flog.With("stream", strm.SID(), "remote", strm.RemoteAddr()).Debugf("client protocol v%d, features %s", p.Hello.Version, cs.features())
+
+	local := protocol.Local()
+	reply := protocol.Proto{Type: protocol.PHELLO, Hello: &local}
+	return reply.Write(strm)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"io"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"paqet/internal/usage"
+	"testing"
+	"time"
+)
+
+func TestHandleConnOverQuota(t *testing.T) {
+	store := openStore(t, 10)
+	store.Add(testClient.IP.String(), usage.TCP, true, 10)
+	s := &Server{usage: store, streams: newStreamLimiter(8, 0, 0)}
+
+	strm, peer := newPipeStrm()
+	conn := &testConn{strms: make(chan tnet.Strm, 1)}
+	conn.strms <- strm
+	close(conn.strms)
+	s.handleConn(context.Background(), conn)
+
+	// A client without reply support only sees the stream close.
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read = %v, want EOF", err)
+	}
+	if s.streams.global != 0 {
+		t.Errorf("%d stream slots held after rejection", s.streams.global)
+	}
+}
+
+func TestHandleHello(t *testing.T) {
+	s := &Server{}
+	cs := &connState{}
+	if f := cs.features(); f != protocol.Legacy.Features {
+		t.Fatalf("features before hello = %s, want legacy", f)
+	}
+
+	strm, peer := newPipeStrm()
+	done := make(chan error, 1)
+	go func() { done <- s.handleStrm(context.Background(), nil, strm, cs) }()
+
+	// Bits this build does not know are dropped.
+	hello := protocol.Hello{Version: protocol.Version, Features: protocol.FeatReply | 1<<15}
+	req := protocol.Proto{Type: protocol.PHELLO, Hello: &hello}
+	if err := req.Write(peer); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var resp protocol.Proto
+	if err := resp.Read(peer); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Type != protocol.PHELLO || resp.Hello == nil || *resp.Hello != protocol.Local() {
+		t.Fatalf("server hello = %+v, want %+v", resp.Hello, protocol.Local())
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if f := cs.features(); f != protocol.FeatReply {
+		t.Errorf("features = %s, want %s", f, protocol.FeatReply)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+
+	// icmpIdleTimeout closes an echo stream once the client stops pinging.
+	icmpIdleTimeout = 30 * time.Second
+)
+
+// handleICMPProtocol relays echo requests for one client ping flow through
+// an unprivileged ICMP socket. Linux rewrites the echo identifier to the
+// socket's port, so replies get the client's identifier put back.
+func (s *Server) handleICMPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto) error {
+	dst := p.ICMP.DstIP
+	v6 := dst.To4() == nil
+	if err := checkEchoRequest(p.ICMP.Payload, v6); err != nil {
+		return err
+	}
+	if err := s.egress.CheckICMP(dst); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint16(p.ICMP.Payload[4:6])
+	flog.With("stream", strm.SID(), "remote", strm.RemoteAddr(), "dest", dst).Infof("accepted ICMP echo stream")
+
+	network, laddr := "udp4", "0.0.0.0"
+	if v6 {
+		network, laddr = "udp6", "::"
+	}
+	conn, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		flog.Errorf("failed to open ICMP socket for stream %d (check net.ipv4.ping_group_range): %v", strm.SID(), err)
+		return err
+	}
+	defer conn.Close()
+
+	// Replies: ICMP socket -> stream
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			conn.SetReadDeadline(time.Now().Add(icmpIdleTimeout))
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+					flog.Debugf("ICMP stream %d read from %s ended: %v", strm.SID(), dst, err)
+				}
+				strm.Close()
+				return
+			}
+			msg := buf[:n]
+			if n < 8 || (msg[0] != icmpv4EchoReply && msg[0] != icmpv6EchoReply) {
+				continue
+			}
+			binary.BigEndian.PutUint16(msg[4:6], id)
+			reply := protocol.Proto{Type: protocol.PICMP, ICMP: &protocol.ICMPData{
+				DstIP:   peer.(*net.UDPAddr).IP,
+				Payload: msg,
+			}}
+			if err := reply.Write(strm); err != nil {
+				flog.Debugf("ICMP stream %d write to client failed: %v", strm.SID(), err)
+				return
+			}
+		}
+	}()
+
+	// Requests: stream -> ICMP socket
+	for {
+		if _, err := conn.WriteTo(p.ICMP.Payload, &net.UDPAddr{IP: dst}); err != nil {
+			flog.Debugf("ICMP stream %d write to %s failed: %v", strm.SID(), dst, err)
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if err := p.Read(strm); err != nil {
+			flog.Debugf("ICMP stream %d to %s ended: %v", strm.SID(), dst, err)
+			return nil
+		}
+		if p.Type != protocol.PICMP {
+			return fmt.Errorf("unexpected %s on ICMP stream", protocol.TypeName(p.Type))
+		}
+		if err := checkEchoRequest(p.ICMP.Payload, v6); err != nil {
+			return err
+		}
+	}
+}
+
+// checkEchoRequest only lets echo requests through; everything else an
+// unprivileged ICMP socket would refuse anyway.
+func checkEchoRequest(msg []byte, v6 bool) error {
+	want := byte(icmpv4EchoRequest)
+	if v6 {
+		want = icmpv6EchoRequest
+	}
+	if len(msg) < 8 || msg[0] != want {
+		return errors.New("only ICMP echo requests can be tunneled")
+	}
+	return nil
+}
+
+// notifyTimeout bounds an unreachable notice, which is sent from loops
+// that also serve other streams.
+const notifyTimeout = time.Second
+
+// notifyUnreachable sends an unreachable notice on strm, giving up quickly
+// when the client is not reading.
+func notifyUnreachable(strm tnet.Strm, code byte) {
+	strm.SetWriteDeadline(time.Now().Add(notifyTimeout))
+	defer strm.SetWriteDeadline(time.Time{})
+	buffer.WriteUDPUnreachable(strm, code)
+}
+
+// unreachableCode maps the error a connected UDP socket reports after an
+// ICMP destination unreachable back to the ICMPv4 code.
+func unreachableCode(err error) (byte, bool) {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return 3, true // port unreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return 1, true // host unreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return 0, true // network unreachable
+	case errors.Is(err, syscall.EACCES):
+		return 13, true // administratively prohibited
+	}
+	return 0, false
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"paqet/internal/flog"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"sync"
+	"time"
+)
+
+// streamLimiter admits stream handlers against per-connection, per-user and
+// global caps; zero per-connection and per-user caps are unlimited. It
+// never blocks: a stream over any cap is rejected at once, so one client
+// flooding streams cannot stall acceptance for the others.
+type streamLimiter struct {
+	maxGlobal int
+	maxUser   int
+	maxConn   int
+
+	mu     sync.Mutex
+	global int
+	users  map[string]int
+}
+
+func newStreamLimiter(maxGlobal, maxUser, maxConn int) *streamLimiter {
+	return &streamLimiter{
+		maxGlobal: maxGlobal,
+		maxUser:   maxUser,
+		maxConn:   maxConn,
+		users:     make(map[string]int),
+	}
+}
+
+// acquire reserves a handler slot for a stream of cs. It reports which cap
+// was hit when the stream has to be rejected.
+func (l *streamLimiter) acquire(cs *connState) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.maxConn > 0 && cs.streams >= l.maxConn:
+		return "connection", false
+	case l.maxUser > 0 && l.users[cs.user] >= l.maxUser:
+		return "user", false
+	case l.global >= l.maxGlobal:
+		return "global", false
+	}
+	cs.streams++
+	l.users[cs.user]++
+	l.global++
+	return "", true
+}
+
+func (l *streamLimiter) release(cs *connState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cs.streams--
+	if l.users[cs.user] <= 1 {
+		delete(l.users, cs.user)
+	} else {
+		l.users[cs.user]--
+	}
+	l.global--
+}
+
+// rejectStrm answers a stream with an error reply and closes it. The write
+// is bounded so a stalled client cannot pin the goroutine. Clients without
+// reply support only see the close.
+func rejectStrm(strm tnet.Strm, cs *connState, code protocol.ReplyCode) {
+	defer strm.Close()
+	if cs.features().Has(protocol.FeatReply) {
+		writeReply(strm, code)
+	}
+}
+
+// writeReply sends a PREPLY frame with a bounded write deadline.
+func writeReply(strm tnet.Strm, code protocol.ReplyCode) error {
+	strm.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	defer strm.SetWriteDeadline(time.Time{})
+	p := protocol.Proto{Type: protocol.PREPLY, Code: code}
+	if err := p.Write(strm); err != nil {
+		flog.Debugf("failed to send reply %d on stream %d: %v", code, strm.SID(), err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"io"
+	"paqet/internal/protocol"
+	"testing"
+	"time"
+)
+
+func TestStreamLimiter(t *testing.T) {
+	l := newStreamLimiter(3, 0, 0)
+	a, b := &connState{user: "alice"}, &connState{user: "bob"}
+	for range 3 {
+		if _, ok := l.acquire(a); !ok {
+			t.Fatal("zero per-user and per-conn caps should not limit")
+		}
+	}
+	if limit, ok := l.acquire(b); ok || limit != "global" {
+		t.Fatalf("acquire = %q, %v; want global limit", limit, ok)
+	}
+	l.release(a)
+	if _, ok := l.acquire(b); !ok {
+		t.Fatal("released slot was not reusable")
+	}
+
+	l = newStreamLimiter(8, 2, 1)
+	c1, c2 := &connState{user: "alice"}, &connState{user: "alice"}
+	if _, ok := l.acquire(c1); !ok {
+		t.Fatal("first stream rejected")
+	}
+	if limit, _ := l.acquire(c1); limit != "connection" {
+		t.Errorf("limit = %q, want connection", limit)
+	}
+	if _, ok := l.acquire(c2); !ok {
+		t.Fatal("second connection of the user rejected")
+	}
+	if limit, _ := l.acquire(&connState{user: "alice"}); limit != "user" {
+		t.Errorf("limit = %q, want user", limit)
+	}
+}
+
+func TestRejectStrm(t *testing.T) {
+	cs := &connState{}
+	hello := protocol.Local()
+	cs.peer.Store(&hello)
+	strm, peer := newPipeStrm()
+	go rejectStrm(strm, cs, protocol.ReplyLimited)
+	if code := readReply(t, peer); code != protocol.ReplyLimited {
+		t.Errorf("reply = %d, want %d", code, protocol.ReplyLimited)
+	}
+	waitClosed(t, strm)
+
+	// Without FeatReply the client would take a PREPLY for target data.
+	strm, peer = newPipeStrm()
+	go rejectStrm(strm, &connState{}, protocol.ReplyLimited)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("legacy client read %d bytes, %v; want EOF", n, err)
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"paqet/internal/accesslog"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"paqet/internal/usage"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reverseUDPIdle closes a reverse UDP session after this long without
+// packets in either direction.
+const reverseUDPIdle = 2 * time.Minute
+
+// handleReverseProtocol opens the listener a client asked for with PRTCP or
+// PRUDP and serves it until the client closes strm or the connection ends.
+// Every connection accepted there goes back to the client on a stream the
+// server opens on conn.
+func (s *Server) handleReverseProtocol(ctx context.Context, conn tnet.Conn, strm tnet.Strm, p *protocol.Proto, cs *connState) error {
+	network := "tcp"
+	if p.Type == protocol.PRUDP {
+		network = "udp"
+	}
+	addr := p.Addr.String()
+	l := flog.With("stream", strm.SID(), "remote", strm.RemoteAddr(), "listen", addr, "network", network)
+
+	if pol := s.cfg.Listen.Reverse; pol == nil || !pol.Allows(p.Addr.Host, p.Addr.Port) {
+		l.Warnf("reverse listener denied")
+		return writeReply(strm, protocol.ReplyDenied)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var ln io.Closer
+	var serve func()
+	if network == "tcp" {
+		tl, err := net.Listen("tcp", addr)
+		if err != nil {
+			writeReply(strm, dialReply(err))
+			return err
+		}
+		ln = tl
+		serve = func() { s.serveReverseTCP(ctx, conn, tl, p.Flow, cs) }
+	} else {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			writeReply(strm, dialReply(err))
+			return err
+		}
+		ln = pc
+		serve = func() { s.serveReverseUDP(ctx, conn, pc, p.Flow, cs) }
+	}
+	defer ln.Close()
+	if err := writeReply(strm, protocol.ReplyOK); err != nil {
+		return err
+	}
+	l.Infof("reverse listener opened")
+
+	// The client holds strm open for as long as it wants the listener.
+	go func() {
+		io.Copy(io.Discard, strm)
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	serve()
+	l.Infof("reverse listener closed")
+	return nil
+}
+
+// openReverse opens a stream to the client for a peer accepted on a
+// reverse listener and announces it with PRCONN. The stream counts against
+// the stream caps and is shaped and metered like client-opened ones;
+// release closes it and frees its slot.
+func (s *Server) openReverse(ctx context.Context, conn tnet.Conn, cs *connState, id uint64, from net.Addr, kind usage.Kind) (strm tnet.Strm, release func(), err error) {
+	if s.usage != nil && s.usage.Exceeded(cs.user) {
+		return nil, nil, usage.ErrQuotaExceeded
+	}
+	if limit, ok := s.streams.acquire(cs); !ok {
+		return nil, nil, fmt.Errorf("%s stream limit reached", limit)
+	}
+	strm, err = conn.OpenStrm()
+	if err != nil {
+		s.streams.release(cs)
+		return nil, nil, err
+	}
+	release = func() {
+		strm.Close()
+		s.streams.release(cs)
+	}
+
+	fAddr, err := tnet.NewAddr(from.String())
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	p := protocol.Proto{Type: protocol.PRCONN, Addr: fAddr, Flow: id}
+	if err := p.Write(strm); err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	if cs.lim != nil {
+		shaped := newShapedStrm(ctx, strm, cs.lim)
+		release = func() {
+			shaped.Close()
+			s.streams.release(cs)
+		}
+		strm = shaped
+	}
+	if s.usage != nil {
+		strm = &meteredStrm{Strm: strm, store: s.usage, user: cs.user, kind: kind}
+	}
+	return strm, release, nil
+}
+
+func (s *Server) serveReverseTCP(ctx context.Context, conn tnet.Conn, ln net.Listener, id uint64, cs *connState) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Go(func() {
+			defer c.Close()
+			if err := s.reverseTCP(ctx, conn, c, id, cs); err != nil {
+				flog.Debugf("reverse TCP connection %s -> %s closed: %v", c.RemoteAddr(), ln.Addr(), err)
+			}
+		})
+	}
+}
+
+func (s *Server) reverseTCP(ctx context.Context, conn tnet.Conn, c net.Conn, id uint64, cs *connState) (err error) {
+	start := time.Now()
+	strm, release, err := s.openReverse(ctx, conn, cs, id, c.RemoteAddr(), usage.TCP)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if accesslog.Enabled() {
+		counted := accesslog.Count(strm)
+		strm = counted
+		defer func() {
+			accesslog.Stream(counted, "server", conn.RemoteAddr().String(), cs.identity,
+				protocol.TypeName(protocol.PRCONN), c.RemoteAddr().String(), start, accesslog.Reason(ctx, err))
+		}()
+	}
+	if cs.features().Has(protocol.FeatHalfClose) {
+		strm = tnet.Framed(strm)
+	}
+	flog.Debugf("reverse TCP connection %s -> %s on stream %d", c.RemoteAddr(), c.LocalAddr(), strm.SID())
+	return buffer.Relay(ctx, c, strm)
+}
+
+// reverseUDPSession is the stream carrying one remote peer of a reverse
+// UDP listener.
+type reverseUDPSession struct {
+	strm    tnet.Strm
+	release func()
+	last    atomic.Int64 // unix nanoseconds of the last packet
+}
+
+func (s *Server) serveReverseUDP(ctx context.Context, conn tnet.Conn, pc net.PacketConn, id uint64, cs *connState) {
+	var mu sync.Mutex
+	sessions := make(map[string]*reverseUDPSession)
+	defer func() {
+		mu.Lock()
+		for _, sess := range sessions {
+			sess.strm.Close()
+		}
+		mu.Unlock()
+	}()
+
+	bufp := buffer.UPool.Get().(*[]byte)
+	defer buffer.UPool.Put(bufp)
+	buf := *bufp
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := from.String()
+		mu.Lock()
+		sess, ok := sessions[key]
+		mu.Unlock()
+		if !ok {
+			// Only this loop adds sessions, so opening the stream without
+			// the lock cannot race another open for the same peer.
+			strm, release, err := s.openReverse(ctx, conn, cs, id, from, usage.UDP)
+			if err != nil {
+				flog.Debugf("reverse UDP: dropping packet from %s: %v", from, err)
+				continue
+			}
+			sess = &reverseUDPSession{strm: strm, release: release}
+			mu.Lock()
+			sessions[key] = sess
+			mu.Unlock()
+			s.wg.Go(func() {
+				s.reverseUDPReplies(ctx, pc, from, sess)
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			})
+		}
+
+		sess.last.Store(time.Now().UnixNano())
+		if err := buffer.WriteUDPFrame(sess.strm, buf[:n]); err != nil {
+			flog.Debugf("reverse UDP: stream %d write error for %s: %v", sess.strm.SID(), from, err)
+			sess.strm.Close()
+		}
+	}
+}
+
+// reverseUDPReplies sends the client's packets to the peer at from until
+// the stream closes or the session idles out.
+func (s *Server) reverseUDPReplies(ctx context.Context, pc net.PacketConn, from net.Addr, sess *reverseUDPSession) {
+	defer sess.release()
+	bufp := buffer.UPool.Get().(*[]byte)
+	defer buffer.UPool.Put(bufp)
+	buf := *bufp
+	for ctx.Err() == nil {
+		sess.strm.SetReadDeadline(time.Now().Add(reverseUDPIdle))
+		n, err := buffer.ReadUDPFrame(sess.strm, buf)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if time.Since(time.Unix(0, sess.last.Load())) < reverseUDPIdle {
+				continue
+			}
+			flog.Debugf("reverse UDP: session for %s idle, closing stream %d", from, sess.strm.SID())
+			return
+		}
+		if err != nil {
+			return
+		}
+		sess.last.Store(time.Now().UnixNano())
+		if _, err := pc.WriteTo(buf[:n], from); err != nil {
+			flog.Debugf("reverse UDP: write to %s failed: %v", from, err)
+		}
+	}
+}
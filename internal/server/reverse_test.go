@@ -0,0 +1,29 @@
+package server
+
+import (
+	"context"
+	"paqet/internal/conf"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"testing"
+)
+
+func TestReverseDenied(t *testing.T) {
+	// Without a policy, or with one that lists no ports, nothing is allowed;
+	// a handler that opened the listener would not return here.
+	for _, pol := range []*conf.ReversePolicy{nil, {}} {
+		s := &Server{cfg: &conf.Conf{Listen: conf.Server{Reverse: pol}}}
+		for _, typ := range []protocol.PType{protocol.PRTCP, protocol.PRUDP} {
+			strm, peer := newPipeStrm()
+			p := &protocol.Proto{Type: typ, Addr: &tnet.Addr{Host: "127.0.0.1", Port: 2222}, Flow: 1}
+			done := make(chan error, 1)
+			go func() { done <- s.handleReverseProtocol(context.Background(), &testConn{}, strm, p, &connState{}) }()
+			if code := readReply(t, peer); code != protocol.ReplyDenied {
+				t.Errorf("policy %+v, %s: reply = %d, want denied", pol, protocol.TypeName(typ), code)
+			}
+			if err := <-done; err != nil {
+				t.Errorf("handleReverseProtocol = %v", err)
+			}
+		}
+	}
+}
@@ -3,28 +3,53 @@ package server
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"paqet/internal/conf"
+	"paqet/internal/egress"
 	"paqet/internal/flog"
+	"paqet/internal/pkg/ratelimit"
 	"paqet/internal/socket"
+	"paqet/internal/spa"
 	"paqet/internal/tnet"
 	"paqet/internal/transport"
+	"paqet/internal/usage"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type Server struct {
-	cfg   *conf.Conf
-	pConn *socket.PacketConn
-	wg    sync.WaitGroup
-	sem   chan struct{}
+	cfg     *conf.Conf
+	pConn   *socket.PacketConn
+	wg      sync.WaitGroup
+	streams *streamLimiter
+	udpPool *udpConnPool
+	guard   *spa.Guard
+	shaper  *ratelimit.Shaper
+	usage   *usage.Store
+	egress  *egress.Dialer
 }
 
 func New(cfg *conf.Conf) (*Server, error) {
 	s := &Server{
-		cfg: cfg,
-		sem: make(chan struct{}, 1024), // max concurrent handlers
+		cfg:     cfg,
+		streams: newStreamLimiter(cfg.Listen.MaxStreams, cfg.Listen.MaxStreamsPerUser, cfg.Listen.MaxStreamsPerConn),
+		udpPool: &udpConnPool{},
+	}
+	if bw := cfg.Listen.Bandwidth; bw != nil {
+		s.shaper = ratelimit.NewShaper(shapingRate(bw.Global), shapingRate(bw.PerUser), shapingRate(bw.PerConn))
+	}
+	if u := cfg.Listen.Usage; u != nil {
+		store, err := usage.Open(u.File, func(user string) usage.Limit {
+			daily, monthly := u.Limits(user)
+			return usage.Limit{Daily: uint64(daily), Monthly: uint64(monthly)}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not open usage file: %w", err)
+		}
+		s.usage = store
 	}
 
 	return s, nil
@@ -41,13 +66,26 @@ func (s *Server) Start() error {
 		cancel()
 	}()
 
+	dialer, err := egress.New(ctx, s.cfg.Egress)
+	if err != nil {
+		return fmt.Errorf("could not start egress upstreams: %w", err)
+	}
+	s.egress = dialer
+
 	pConn, err := socket.New(ctx, &s.cfg.Network)
 	if err != nil {
 		return fmt.Errorf("could not create raw packet conn: %w", err)
 	}
 	s.pConn = pConn
 
-	listener, err := transport.Listen(&s.cfg.Transport, pConn)
+	var lConn net.PacketConn = pConn
+	if s.cfg.SPA != nil {
+		s.guard = spa.NewGuard(pConn, s.cfg.SPA)
+		lConn = s.guard
+		flog.Infof("single-packet authorization enabled (window %v, idle timeout %v)", s.cfg.SPA.Window, s.cfg.SPA.IdleTimeout)
+	}
+
+	listener, err := transport.Listen(&s.cfg.Transport, &s.cfg.Listen, lConn)
 	if err != nil {
 		return fmt.Errorf("could not start %s listener: %w", s.cfg.Transport.Protocol, err)
 	}
@@ -57,6 +95,11 @@ func (s *Server) Start() error {
 	s.wg.Go(func() {
 		s.listen(ctx, listener)
 	})
+	if s.usage != nil {
+		s.wg.Go(func() {
+			s.flushUsage(ctx)
+		})
+	}
 
 	s.wg.Wait()
 	flog.Infof("Server shutdown completed")
@@ -79,7 +122,7 @@ func (s *Server) listen(ctx context.Context, listener tnet.Listener) {
 			flog.Errorf("failed to accept connection: %v", err)
 			return
 		}
-		flog.Infof("accepted new connection from %s (local: %s)", conn.RemoteAddr(), conn.LocalAddr())
+		flog.With("conn", conn.RemoteAddr(), "local", conn.LocalAddr()).Infof("accepted new connection")
 
 		s.wg.Go(func() {
 			defer conn.Close()
@@ -87,3 +130,26 @@ func (s *Server) listen(ctx context.Context, listener tnet.Listener) {
 		})
 	}
 }
+
+// flushUsage persists the usage counters periodically and once more on shutdown.
+func (s *Server) flushUsage(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Listen.Usage.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.usage.Flush(); err != nil {
+				flog.Errorf("failed to write usage file: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.usage.Flush(); err != nil {
+				flog.Errorf("failed to write usage file: %v", err)
+			}
+		}
+	}
+}
+
+func shapingRate(r conf.RateLimit) ratelimit.Rate {
+	return ratelimit.Rate{Upload: r.Upload, Download: r.Download, Burst: r.Burst}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"paqet/internal/usage"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeStrm is an in-memory tnet.Strm; the test holds the other end.
+type pipeStrm struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeStrm() (*pipeStrm, net.Conn) {
+	c, peer := net.Pipe()
+	return &pipeStrm{Conn: c, closed: make(chan struct{})}, peer
+}
+
+func (s *pipeStrm) SID() int          { return 1 }
+func (s *pipeStrm) CloseWrite() error { return tnet.ErrHalfClose }
+func (s *pipeStrm) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return s.Conn.Close()
+}
+
+// testConn is an in-memory client connection. It hands out the streams
+// queued in strms and, when dgrams is set, supports datagrams. Datagrams
+// sent to the client are queued in sent when it is set.
+type testConn struct {
+	strms  chan tnet.Strm
+	dgrams chan []byte
+	sent   chan []byte
+}
+
+var testClient = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+
+func (c *testConn) OpenStrm() (tnet.Strm, error) { return nil, errors.New("not supported") }
+func (c *testConn) AcceptStrm() (tnet.Strm, error) {
+	strm, ok := <-c.strms
+	if !ok {
+		return nil, io.EOF
+	}
+	return strm, nil
+}
+func (c *testConn) Ping(bool) error                  { return nil }
+func (c *testConn) Close() error                     { return nil }
+func (c *testConn) LocalAddr() net.Addr              { return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443} }
+func (c *testConn) RemoteAddr() net.Addr             { return testClient }
+func (c *testConn) SetDeadline(time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *testConn) SupportsDatagrams() bool          { return c.dgrams != nil }
+func (c *testConn) SendDatagram(b []byte) error {
+	if c.sent != nil {
+		c.sent <- append([]byte(nil), b...)
+	}
+	return nil
+}
+func (c *testConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case d, ok := <-c.dgrams:
+		if !ok {
+			return nil, io.EOF
+		}
+		return d, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// openStore returns a usage store with a daily quota of daily bytes for
+// every user.
+func openStore(t *testing.T, daily uint64) *usage.Store {
+	t.Helper()
+	store, err := usage.Open(filepath.Join(t.TempDir(), "usage.json"), func(string) usage.Limit {
+		return usage.Limit{Daily: daily}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// waitClosed fails the test unless strm is closed within a second.
+func waitClosed(t *testing.T, strm *pipeStrm) {
+	t.Helper()
+	select {
+	case <-strm.closed:
+	case <-time.After(time.Second):
+		t.Fatal("stream was not closed")
+	}
+}
+
+// readReply reads the PREPLY the server sent on the other end of a stream.
+func readReply(t *testing.T, peer net.Conn) protocol.ReplyCode {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var p protocol.Proto
+	if err := p.Read(peer); err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	if p.Type != protocol.PREPLY {
+		t.Fatalf("got %s, want PREPLY", protocol.TypeName(p.Type))
+	}
+	return p.Code
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"net"
+	"paqet/internal/pkg/ratelimit"
+	"paqet/internal/tnet"
+	"paqet/internal/usage"
+)
+
+// userOf names the owner of a client connection: the spa user whose knock
+// authorized it, or the client IP when there is none.
+func (s *Server) userOf(addr net.Addr) string {
+	if s.guard != nil {
+		if user, ok := s.guard.User(addr); ok {
+			return user
+		}
+	}
+	if uAddr, ok := addr.(*net.UDPAddr); ok {
+		return uAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// shapedStrm charges stream traffic to the connection's rate limits. Reads
+// carry client uploads, writes carry target downloads; every copy path in
+// the server goes through one of them. Waits end when the stream closes,
+// not only when the connection does.
+type shapedStrm struct {
+	tnet.Strm
+	ctx    context.Context
+	cancel context.CancelFunc
+	lim    *ratelimit.Pair
+}
+
+func newShapedStrm(ctx context.Context, strm tnet.Strm, lim *ratelimit.Pair) *shapedStrm {
+	ctx, cancel := context.WithCancel(ctx)
+	return &shapedStrm{Strm: strm, ctx: ctx, cancel: cancel, lim: lim}
+}
+
+func (s *shapedStrm) Close() error {
+	s.cancel()
+	return s.Strm.Close()
+}
+
+func (s *shapedStrm) Read(p []byte) (int, error) {
+	n, err := s.Strm.Read(p)
+	if n > 0 {
+		if werr := s.lim.Up.Wait(s.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (s *shapedStrm) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		k := min(len(p), ratelimit.MaxChunk)
+		if err := s.lim.Down.Wait(s.ctx, k); err != nil {
+			return written, err
+		}
+		n, err := s.Strm.Write(p[:k])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[k:]
+	}
+	return written, nil
+}
+
+// meteredStrm charges stream traffic to the user's usage counters and fails
+// once the user runs out of quota, which tears down the stream's copy loops.
+type meteredStrm struct {
+	tnet.Strm
+	store *usage.Store
+	user  string
+	kind  usage.Kind
+}
+
+func (m *meteredStrm) Read(p []byte) (int, error) {
+	n, err := m.Strm.Read(p)
+	if n > 0 && !m.store.Add(m.user, m.kind, true, n) && err == nil {
+		err = usage.ErrQuotaExceeded
+	}
+	return n, err
+}
+
+func (m *meteredStrm) Write(p []byte) (int, error) {
+	n, err := m.Strm.Write(p)
+	if n > 0 && !m.store.Add(m.user, m.kind, false, n) && err == nil {
+		err = usage.ErrQuotaExceeded
+	}
+	return n, err
+}
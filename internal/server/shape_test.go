@@ -0,0 +1,21 @@
+package server
+
+import (
+	"errors"
+	"paqet/internal/usage"
+	"testing"
+)
+
+func TestMeteredStrmQuota(t *testing.T) {
+	strm, peer := newPipeStrm()
+	m := &meteredStrm{Strm: strm, store: openStore(t, 10), user: "alice", kind: usage.TCP}
+
+	go peer.Write(make([]byte, 16))
+	n, err := m.Read(make([]byte, 16))
+	if n != 16 || !errors.Is(err, usage.ErrQuotaExceeded) {
+		t.Fatalf("Read = %d, %v; want 16, quota exceeded", n, err)
+	}
+	if m.store.Exceeded("bob") {
+		t.Error("another user was charged")
+	}
+}
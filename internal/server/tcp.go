@@ -2,24 +2,31 @@ package server
 
 import (
 	"context"
+	"errors"
 	"net"
+	"paqet/internal/egress"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
-	"time"
+	"syscall"
 )
 
-func (s *Server) handleTCPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto) error {
-	flog.Infof("accepted TCP stream %d: %s -> %s", strm.SID(), strm.RemoteAddr(), p.Addr.String())
-	return s.handleTCP(ctx, strm, p.Addr.String())
+func (s *Server) handleTCPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto, cs *connState) error {
+	flog.With("stream", strm.SID(), "remote", strm.RemoteAddr(), "dest", p.Addr).Infof("accepted TCP stream")
+	return s.handleTCP(ctx, strm, p.Addr.String(), p.Type == protocol.PTCPR, cs.features().Has(protocol.FeatHalfClose))
 }
 
-func (s *Server) handleTCP(ctx context.Context, strm tnet.Strm, addr string) error {
-	dialer := &net.Dialer{Timeout: 10 * time.Second}
-	conn, err := dialer.DialContext(ctx, "tcp", addr)
+// handleTCP dials addr and relays it over strm. With reply set the client
+// is waiting for the dial result and gets a PREPLY before any data. With
+// framed set the data after that is framed so half-closes get through.
+func (s *Server) handleTCP(ctx context.Context, strm tnet.Strm, addr string, reply, framed bool) error {
+	conn, err := s.egress.DialTCP(ctx, addr)
 	if err != nil {
 		flog.Errorf("failed to establish TCP connection to %s for stream %d: %v", addr, strm.SID(), err)
+		if reply {
+			writeReply(strm, dialReply(err))
+		}
 		return err
 	}
 	defer func() {
@@ -27,24 +34,43 @@ func (s *Server) handleTCP(ctx context.Context, strm tnet.Strm, addr string) err
 		flog.Debugf("closed TCP connection %s for stream %d", addr, strm.SID())
 	}()
 	flog.Debugf("TCP connection established to %s for stream %d", addr, strm.SID())
-
-	errChan := make(chan error, 2)
-	go func() {
-		err := buffer.CopyT(conn, strm)
-		errChan <- err
-	}()
-	go func() {
-		err := buffer.CopyT(strm, conn)
-		errChan <- err
-	}()
-
-	select {
-	case err := <-errChan:
-		if err != nil {
-			flog.Errorf("TCP stream %d to %s failed: %v", strm.SID(), addr, err)
+	if reply {
+		if err := writeReply(strm, protocol.ReplyOK); err != nil {
 			return err
 		}
-	case <-ctx.Done():
+	}
+
+	if framed {
+		strm = tnet.Framed(strm)
+	}
+	if err := buffer.Relay(ctx, conn, strm); err != nil {
+		flog.Errorf("TCP stream %d to %s failed: %v", strm.SID(), addr, err)
+		return err
 	}
 	return nil
 }
+
+// dialReply maps a dial error to the reply code reported to the client.
+func dialReply(err error) protocol.ReplyCode {
+	var netErr net.Error
+	var replyErr *protocol.ReplyError
+	switch {
+	case errors.As(err, &replyErr):
+		return replyErr.Code
+	case errors.Is(err, egress.ErrUDPUnsupported):
+		return protocol.ReplyDenied
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return protocol.ReplyRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return protocol.ReplyUnreachable
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return protocol.ReplyDenied
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return protocol.ReplyTimeout
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return protocol.ReplyUnreachable
+	}
+	return protocol.ReplyFailure
+}
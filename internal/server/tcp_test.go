@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"paqet/internal/egress"
+	"paqet/internal/protocol"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialReply(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	tests := []struct {
+		err  error
+		want protocol.ReplyCode
+	}{
+		{opErr(syscall.ECONNREFUSED), protocol.ReplyRefused},
+		{opErr(syscall.ENETUNREACH), protocol.ReplyUnreachable},
+		{opErr(syscall.EHOSTUNREACH), protocol.ReplyUnreachable},
+		{opErr(syscall.EACCES), protocol.ReplyDenied},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, protocol.ReplyTimeout},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, protocol.ReplyUnreachable},
+		{fmt.Errorf("via corp: %w", &protocol.ReplyError{Code: protocol.ReplyQuota}), protocol.ReplyQuota},
+		{egress.ErrUDPUnsupported, protocol.ReplyDenied},
+		{errors.New("something else"), protocol.ReplyFailure},
+	}
+	for _, tt := range tests {
+		if got := dialReply(tt.err); got != tt.want {
+			t.Errorf("dialReply(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestHandleTCPReply(t *testing.T) {
+	d, err := egress.New(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{egress: d}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	strm, peer := newPipeStrm()
+	go s.handleTCP(context.Background(), strm, ln.Addr().String(), true, false)
+	if code := readReply(t, peer); code != protocol.ReplyOK {
+		t.Fatalf("reply = %d, want OK", code)
+	}
+	target, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go peer.Write([]byte("ping"))
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(target, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("target read %q, %v", buf, err)
+	}
+	peer.Close()
+
+	// A port nobody listens on any more.
+	closed := ln.Addr().String()
+	ln.Close()
+	strm, peer = newPipeStrm()
+	go s.handleTCP(context.Background(), strm, closed, true, false)
+	if code := readReply(t, peer); code != protocol.ReplyRefused {
+		t.Errorf("reply = %d, want refused", code)
+	}
+}
@@ -2,8 +2,8 @@ package server
 
 import (
 	"context"
-	"fmt"
 	"net"
+	"paqet/internal/egress"
 	"paqet/internal/flog"
 	"paqet/internal/pkg/buffer"
 	"paqet/internal/protocol"
@@ -13,22 +13,13 @@ import (
 	"time"
 )
 
-// datagramSession tracks a datagram-based UDP session.
-type datagramSession struct {
-	conn   *net.UDPConn
-	addr   string
-	dgConn tnet.DatagramConn
-	cancel context.CancelFunc
-}
-
-// datagramSessionMap manages datagram sessions per connection.
-var datagramSessions sync.Map // dgConn -> *datagramSession
-
 // sharedUDPConn manages a shared UDP connection with multiple stream writers.
 // Critical for protocols like WireGuard that expect one source port per peer.
 // Design inspired by udp2raw: single connection, multiplexed streams.
+// A connection is only ever shared by streams of the same client flow.
 type sharedUDPConn struct {
-	conn     *net.UDPConn
+	conn     net.Conn
+	key      udpPoolKey
 	addr     string
 	refCount int32 // atomic reference count
 	cancel   context.CancelFunc
@@ -37,19 +28,33 @@ type sharedUDPConn struct {
 	// Uses copy-on-write for stream list updates (rare operation)
 	streams atomic.Value // *[]tnet.Strm
 	nextIdx uint64       // atomic counter for round-robin
+
+	notify sync.Map // tnet.Strm -> struct{}, streams that take unreachable notices
+}
+
+// udpPoolKey identifies a shared UDP connection. Replies read from the
+// socket are only handed to streams that opened it with the same key, so
+// two clients talking to the same target never see each other's traffic.
+// Sockets are never shared across connections: clients behind one NAT
+// share an IP, and nothing stops them from sending the same flow ID.
+type udpPoolKey struct {
+	client string     // client IP, for logging
+	conn   *connState // connection the streams arrived on
+	flow   uint64     // client flow ID (0 for legacy PUDP streams)
+	addr   string     // target address
 }
 
-// udpConnPool manages shared UDP connections by target address.
+// udpConnPool manages shared UDP connections by client flow and target address.
 type udpConnPool struct {
-	conns sync.Map   // addr -> *sharedUDPConn
+	conns sync.Map   // udpPoolKey -> *sharedUDPConn
 	mu    sync.Mutex // protects creation
 }
 
-var serverUDPPool = &udpConnPool{}
+func (p *udpConnPool) getOrCreate(ctx context.Context, key udpPoolKey, dialer *egress.Dialer) (*sharedUDPConn, error) {
+	addr := key.addr
 
-func (p *udpConnPool) getOrCreate(ctx context.Context, addr string) (*sharedUDPConn, error) {
 	// Fast path: connection exists
-	if v, ok := p.conns.Load(addr); ok {
+	if v, ok := p.conns.Load(key); ok {
 		shared := v.(*sharedUDPConn)
 		atomic.AddInt32(&shared.refCount, 1)
 		return shared, nil
@@ -60,29 +65,21 @@ func (p *udpConnPool) getOrCreate(ctx context.Context, addr string) (*sharedUDPC
 	defer p.mu.Unlock()
 
 	// Double-check after acquiring lock
-	if v, ok := p.conns.Load(addr); ok {
+	if v, ok := p.conns.Load(key); ok {
 		shared := v.(*sharedUDPConn)
 		atomic.AddInt32(&shared.refCount, 1)
 		return shared, nil
 	}
 
-	raddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return nil, err
-	}
-
-	conn, err := net.DialUDP("udp", nil, raddr)
+	conn, err := dialer.DialUDP(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
 
-	// Increase socket buffers for high throughput
-	conn.SetReadBuffer(8 * 1024 * 1024)
-	conn.SetWriteBuffer(8 * 1024 * 1024)
-
 	connCtx, cancel := context.WithCancel(ctx)
 	shared := &sharedUDPConn{
 		conn:     conn,
+		key:      key,
 		addr:     addr,
 		refCount: 1,
 		cancel:   cancel,
@@ -91,21 +88,21 @@ func (p *udpConnPool) getOrCreate(ctx context.Context, addr string) (*sharedUDPC
 	emptyStreams := make([]tnet.Strm, 0, 16)
 	shared.streams.Store(&emptyStreams)
 
-	p.conns.Store(addr, shared)
+	p.conns.Store(key, shared)
 
 	// Start the shared reader goroutine
 	go shared.readLoop(connCtx)
 
-	flog.Debugf("created shared UDP connection to %s", addr)
+	flog.Debugf("created shared UDP connection %s -> %s (flow %x)", key.client, addr, key.flow)
 	return shared, nil
 }
 
 func (p *udpConnPool) release(shared *sharedUDPConn) {
 	if atomic.AddInt32(&shared.refCount, -1) == 0 {
-		p.conns.Delete(shared.addr)
+		p.conns.Delete(shared.key)
 		shared.cancel()
 		shared.conn.Close()
-		flog.Debugf("closed shared UDP connection to %s", shared.addr)
+		flog.Debugf("closed shared UDP connection %s -> %s (flow %x)", shared.key.client, shared.addr, shared.key.flow)
 	}
 }
 
@@ -133,6 +130,13 @@ func (s *sharedUDPConn) readLoop(ctx context.Context) {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
 			}
+			if code, ok := unreachableCode(err); ok {
+				s.notify.Range(func(k, _ any) bool {
+					notifyUnreachable(k.(tnet.Strm), code)
+					return true
+				})
+				continue
+			}
 			flog.Debugf("shared UDP read error for %s: %v", s.addr, err)
 			return
 		}
@@ -194,29 +198,30 @@ func (s *sharedUDPConn) removeStream(strm tnet.Strm) {
 	}
 }
 
-func (s *Server) handleUDPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto) error {
-	flog.Infof("accepted UDP stream %d: %s -> %s", strm.SID(), strm.RemoteAddr(), p.Addr.String())
+func (s *Server) handleUDPProtocol(ctx context.Context, strm tnet.Strm, p *protocol.Proto, cs *connState) error {
+	flog.With("stream", strm.SID(), "remote", strm.RemoteAddr(), "dest", p.Addr).Infof("accepted UDP stream")
 	addr := p.Addr.String()
 
 	// DNS (port 53) requires per-stream connections because responses must be
 	// correlated with requests by Transaction ID. Shared connections cause
 	// responses to be delivered to wrong clients (ID mismatch errors).
+	notify := cs.features().Has(protocol.FeatUDPError)
 	if p.Addr.Port == 53 {
-		return s.handleUDPDirect(ctx, strm, addr)
+		return s.handleUDPDirect(ctx, strm, addr, notify)
 	}
 
-	return s.handleUDP(ctx, strm, addr)
+	client := strm.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	key := udpPoolKey{client: client, conn: cs, flow: p.Flow, addr: addr}
+	return s.handleUDP(ctx, strm, key, notify)
 }
 
 // handleUDPDirect handles UDP with a dedicated connection per stream.
 // Used for protocols like DNS where request-response correlation matters.
-func (s *Server) handleUDPDirect(ctx context.Context, strm tnet.Strm, addr string) error {
-	raddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return err
-	}
-
-	conn, err := net.DialUDP("udp", nil, raddr)
+func (s *Server) handleUDPDirect(ctx context.Context, strm tnet.Strm, addr string, notify bool) error {
+	conn, err := s.egress.DialUDP(ctx, addr)
 	if err != nil {
 		flog.Errorf("failed to dial UDP to %s for stream %d: %v", addr, strm.SID(), err)
 		return err
@@ -241,6 +246,12 @@ func (s *Server) handleUDPDirect(ctx context.Context, strm tnet.Strm, addr strin
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
+				if code, ok := unreachableCode(err); ok {
+					if notify {
+						notifyUnreachable(strm, code)
+					}
+					continue
+				}
 				flog.Debugf("UDP stream %d read from %s ended: %v", strm.SID(), addr, err)
 				return
 			}
@@ -279,18 +290,24 @@ func (s *Server) handleUDPDirect(ctx context.Context, strm tnet.Strm, addr strin
 	}
 }
 
-func (s *Server) handleUDP(ctx context.Context, strm tnet.Strm, addr string) error {
-	// Get or create shared connection for this target
-	shared, err := serverUDPPool.getOrCreate(ctx, addr)
+func (s *Server) handleUDP(ctx context.Context, strm tnet.Strm, key udpPoolKey, notify bool) error {
+	addr := key.addr
+
+	// Get or create shared connection for this client flow and target
+	shared, err := s.udpPool.getOrCreate(ctx, key, s.egress)
 	if err != nil {
 		flog.Errorf("failed to get shared UDP connection to %s for stream %d: %v", addr, strm.SID(), err)
 		return err
 	}
-	defer serverUDPPool.release(shared)
+	defer s.udpPool.release(shared)
 
 	// Register this stream for receiving responses
 	shared.addStream(strm)
 	defer shared.removeStream(strm)
+	if notify {
+		shared.notify.Store(strm, struct{}{})
+		defer shared.notify.Delete(strm)
+	}
 
 	flog.Debugf("UDP stream %d joined shared connection to %s (refs: %d)", strm.SID(), addr, atomic.LoadInt32(&shared.refCount))
 
@@ -322,121 +339,3 @@ func (s *Server) handleUDP(ctx context.Context, strm tnet.Strm, addr string) err
 		shared.conn.SetWriteDeadline(time.Time{})
 	}
 }
-
-// handleUDPDatagramProtocol sets up datagram mode for UDP forwarding.
-// This registers the target address and enables datagram-based data transfer.
-func (s *Server) handleUDPDatagramProtocol(ctx context.Context, conn tnet.Conn, strm tnet.Strm, p *protocol.Proto) error {
-	dgConn, ok := conn.(tnet.DatagramConn)
-	if !ok || !dgConn.SupportsDatagrams() {
-		flog.Errorf("connection doesn't support datagrams for PUDPDGM")
-		return fmt.Errorf("datagrams not supported")
-	}
-
-	addr := p.Addr.String()
-
-	// Check if session already exists for this connection
-	if _, loaded := datagramSessions.Load(dgConn); loaded {
-		flog.Debugf("datagram session already exists for %s, reusing", conn.RemoteAddr())
-		return nil // Already set up
-	}
-
-	// Create UDP connection to target
-	raddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return err
-	}
-
-	udpConn, err := net.DialUDP("udp", nil, raddr)
-	if err != nil {
-		return err
-	}
-
-	// Increase socket buffers
-	udpConn.SetReadBuffer(8 * 1024 * 1024)
-	udpConn.SetWriteBuffer(8 * 1024 * 1024)
-
-	sessCtx, cancel := context.WithCancel(ctx)
-	sess := &datagramSession{
-		conn:   udpConn,
-		addr:   addr,
-		dgConn: dgConn,
-		cancel: cancel,
-	}
-
-	datagramSessions.Store(dgConn, sess)
-
-	flog.Infof("established UDP datagram session %s -> %s", conn.RemoteAddr(), addr)
-
-	// Start UDP -> datagram goroutine (target responses -> client)
-	go func() {
-		defer func() {
-			datagramSessions.Delete(dgConn)
-			udpConn.Close()
-			cancel()
-			flog.Debugf("datagram session to %s closed", addr)
-		}()
-
-		buf := make([]byte, 65535)
-		for {
-			select {
-			case <-sessCtx.Done():
-				return
-			default:
-			}
-
-			udpConn.SetReadDeadline(time.Now().Add(60 * time.Second))
-			n, err := udpConn.Read(buf)
-			if err != nil {
-				if sessCtx.Err() != nil {
-					return
-				}
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue
-				}
-				flog.Debugf("datagram session UDP read error: %v", err)
-				return
-			}
-
-			// Send response via QUIC datagram
-			if err := dgConn.SendDatagram(buf[:n]); err != nil {
-				flog.Debugf("datagram send error: %v", err)
-				// Don't return on send errors - datagrams are unreliable
-			}
-		}
-	}()
-
-	return nil // Stream handler returns immediately - datagrams are handled separately
-}
-
-// handleDatagrams processes incoming QUIC datagrams for a connection.
-// Called once per datagram-capable connection.
-func (s *Server) handleDatagrams(ctx context.Context, dgConn tnet.DatagramConn) {
-	flog.Debugf("starting datagram receiver for %s", dgConn.RemoteAddr())
-
-	for {
-		data, err := dgConn.ReceiveDatagram(ctx)
-		if err != nil {
-			if ctx.Err() != nil {
-				return
-			}
-			flog.Debugf("datagram receive error: %v", err)
-			return
-		}
-
-		// Find the session for this connection
-		v, ok := datagramSessions.Load(dgConn)
-		if !ok {
-			// No session registered yet - drop packet
-			continue
-		}
-
-		sess := v.(*datagramSession)
-
-		// Write to target UDP
-		sess.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-		if _, err := sess.conn.Write(data); err != nil {
-			flog.Debugf("datagram forward to %s failed: %v", sess.addr, err)
-		}
-		sess.conn.SetWriteDeadline(time.Time{})
-	}
-}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"net"
+	"paqet/internal/egress"
+	"testing"
+)
+
+func TestUDPPoolPerConnection(t *testing.T) {
+	d, err := egress.New(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	// Two clients behind one NAT, sending the same flow ID.
+	var pool udpConnPool
+	a, b := &connState{}, &connState{}
+	key := udpPoolKey{client: "192.0.2.1", conn: a, flow: 42, addr: target.LocalAddr().String()}
+	sa, err := pool.getOrCreate(context.Background(), key, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.release(sa)
+	again, err := pool.getOrCreate(context.Background(), key, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.release(again)
+	if again != sa {
+		t.Error("streams of one connection and flow did not share a socket")
+	}
+
+	key.conn = b
+	sb, err := pool.getOrCreate(context.Background(), key, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.release(sb)
+	if sb == sa {
+		t.Error("two connections share a socket")
+	}
+}
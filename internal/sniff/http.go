@@ -0,0 +1,60 @@
+package sniff
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+var methods = []string{"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE", "CONNECT"}
+
+// HTTP returns the Host header of the HTTP/1 request that starts b.
+func HTTP(b []byte) (string, error) {
+	sp := bytes.IndexByte(b, ' ')
+	if sp < 0 {
+		// Could still be the start of a method.
+		for _, m := range methods {
+			if len(b) < len(m) && strings.HasPrefix(m, string(b)) {
+				return "", errShort
+			}
+		}
+		return "", errNoHost
+	}
+	known := false
+	for _, m := range methods {
+		known = known || string(b[:sp]) == m
+	}
+	if !known {
+		return "", errNoHost
+	}
+
+	eol := bytes.Index(b, []byte("\r\n"))
+	if eol < 0 {
+		return "", errShort
+	}
+	rest := b[eol+2:]
+	for {
+		eol := bytes.Index(rest, []byte("\r\n"))
+		if eol < 0 {
+			return "", errShort
+		}
+		if eol == 0 {
+			return "", errNoHost // end of headers
+		}
+		line := rest[:eol]
+		rest = rest[eol+2:]
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(name), "host") {
+			continue
+		}
+		h := strings.TrimSpace(string(value))
+		if host, _, err := net.SplitHostPort(h); err == nil {
+			h = host
+		}
+		h = strings.TrimSuffix(h, ".")
+		if !validHost(h) {
+			return "", errNoHost
+		}
+		return strings.ToLower(h), nil
+	}
+}
@@ -0,0 +1,280 @@
+package sniff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+const (
+	quicV1 = 0x00000001
+	quicV2 = 0x6b3343cf
+)
+
+var (
+	quicV1Salt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	quicV2Salt = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+)
+
+// maxHelloDatagrams bounds how many datagrams a ClientHello may span.
+const maxHelloDatagrams = 4
+
+// QUICHello collects the ClientHello from a client's first QUIC
+// datagrams. Initial packets are encrypted with keys derived from the
+// connection ID, so anyone can read them (RFC 9001 5.2). Large hellos,
+// e.g. with post-quantum key shares, span datagrams, and clients shuffle
+// the pieces.
+type QUICHello struct {
+	frames    []cryptoFrame
+	datagrams int
+}
+
+// Add feeds the next datagram of the flow and returns the SNI once it is
+// known. more is true while further datagrams may complete the hello.
+func (q *QUICHello) Add(b []byte) (host string, more bool) {
+	q.datagrams++
+	opened := false
+	for len(b) > 0 {
+		rest, frames, err := openInitial(b)
+		if err != nil {
+			break // coalesced packets of other types
+		}
+		opened = true
+		for _, f := range frames {
+			q.frames = append(q.frames, cryptoFrame{off: f.off, data: slices.Clone(f.data)})
+		}
+		b = rest
+	}
+	if !opened && len(q.frames) == 0 {
+		return "", false
+	}
+	h, err := clientHelloSNI(assemble(q.frames))
+	if err == errShort {
+		return "", q.datagrams < maxHelloDatagrams
+	}
+	return h, false
+}
+
+// IsQUICInitial reports whether b starts with a QUIC Initial packet,
+// without decrypting it.
+func IsQUICInitial(b []byte) bool {
+	if len(b) < 5 || b[0]&0xc0 != 0xc0 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(b[1:5]) {
+	case quicV1:
+		return b[0]&0x30 == 0x00
+	case quicV2:
+		return b[0]&0x30 == 0x10
+	}
+	return false
+}
+
+type cryptoFrame struct {
+	off  uint64
+	data []byte
+}
+
+var errNotInitial = errors.New("sniff: not a QUIC Initial packet")
+
+// openInitial decrypts the Initial packet at the start of b and returns
+// its CRYPTO frames along with the bytes after the packet.
+func openInitial(b []byte) ([]byte, []cryptoFrame, error) {
+	if !IsQUICInitial(b) {
+		return nil, nil, errNotInitial
+	}
+	version := binary.BigEndian.Uint32(b[1:5])
+	p := 5
+	if p >= len(b) {
+		return nil, nil, errNotInitial
+	}
+	dcidLen := int(b[p])
+	p++
+	if dcidLen > 20 || p+dcidLen >= len(b) {
+		return nil, nil, errNotInitial
+	}
+	dcid := b[p : p+dcidLen]
+	p += dcidLen
+	scidLen := int(b[p])
+	p++
+	if scidLen > 20 || p+scidLen > len(b) {
+		return nil, nil, errNotInitial
+	}
+	p += scidLen
+	tokenLen, n := varint(b[p:])
+	if n == 0 || uint64(len(b)-p-n) < tokenLen {
+		return nil, nil, errNotInitial
+	}
+	p += n + int(tokenLen)
+	length, n := varint(b[p:])
+	if n == 0 {
+		return nil, nil, errNotInitial
+	}
+	p += n
+	if uint64(len(b)-p) < length || length < 20 {
+		return nil, nil, errNotInitial
+	}
+	end := p + int(length)
+
+	key, iv, hp := initialKeys(version, dcid)
+
+	// Remove header protection: the sample starts 4 bytes after the start
+	// of the packet number.
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, b[p+4:p+4+aes.BlockSize])
+	header := slices.Clone(b[:p+4])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[p+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[p+i])
+	}
+	header = header[:p+pnLen]
+
+	block, err = aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := slices.Clone(iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err := aead.Open(nil, nonce, b[p+pnLen:end], header)
+	if err != nil {
+		return nil, nil, errNotInitial
+	}
+	frames, err := cryptoFrames(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b[end:], frames, nil
+}
+
+// cryptoFrames returns the CRYPTO frames in a decrypted Initial payload,
+// skipping the other frames a client may send there.
+func cryptoFrames(b []byte) ([]cryptoFrame, error) {
+	var frames []cryptoFrame
+	for len(b) > 0 {
+		typ, n := varint(b)
+		if n == 0 {
+			return nil, errNoHost
+		}
+		b = b[n:]
+		switch typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			// largest, delay, range count, first range
+			var vals [4]uint64
+			for i := range vals {
+				v, n := varint(b)
+				if n == 0 {
+					return nil, errNoHost
+				}
+				vals[i], b = v, b[n:]
+			}
+			ranges := vals[2] * 2
+			if typ == 0x03 {
+				ranges += 3 // ECN counts
+			}
+			for i := uint64(0); i < ranges; i++ {
+				_, n := varint(b)
+				if n == 0 {
+					return nil, errNoHost
+				}
+				b = b[n:]
+			}
+		case 0x06: // CRYPTO
+			off, n := varint(b)
+			if n == 0 {
+				return nil, errNoHost
+			}
+			b = b[n:]
+			l, n := varint(b)
+			if n == 0 || uint64(len(b)-n) < l {
+				return nil, errNoHost
+			}
+			b = b[n:]
+			frames = append(frames, cryptoFrame{off: off, data: b[:l]})
+			b = b[l:]
+		default:
+			return frames, nil
+		}
+	}
+	return frames, nil
+}
+
+// assemble joins the CRYPTO data that is contiguous from offset 0.
+// Clients may send the frames out of order.
+func assemble(frames []cryptoFrame) []byte {
+	slices.SortFunc(frames, func(a, b cryptoFrame) int {
+		switch {
+		case a.off < b.off:
+			return -1
+		case a.off > b.off:
+			return 1
+		}
+		return 0
+	})
+	var out []byte
+	for _, f := range frames {
+		if f.off > uint64(len(out)) {
+			break
+		}
+		if end := f.off + uint64(len(f.data)); end > uint64(len(out)) {
+			out = append(out, f.data[uint64(len(out))-f.off:]...)
+		}
+	}
+	return out
+}
+
+// initialKeys derives the client Initial packet protection keys.
+func initialKeys(version uint32, dcid []byte) (key, iv, hp []byte) {
+	salt, prefix := quicV1Salt, "quic "
+	if version == quicV2 {
+		salt, prefix = quicV2Salt, "quicv2 "
+	}
+	initial, _ := hkdf.Extract(sha256.New, dcid, salt)
+	client := expandLabel(initial, "client in", 32)
+	return expandLabel(client, prefix+"key", 16), expandLabel(client, prefix+"iv", 12), expandLabel(client, prefix+"hp", 16)
+}
+
+// expandLabel is HKDF-Expand-Label from TLS 1.3 with an empty context.
+func expandLabel(secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := make([]byte, 0, 4+len(full))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(full)))
+	info = append(info, full...)
+	info = append(info, 0)
+	out, _ := hkdf.Expand(sha256.New, secret, string(info), length)
+	return out
+}
+
+// varint decodes a QUIC variable-length integer; n is 0 if b is too short.
+func varint(b []byte) (v uint64, n int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n = 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v = uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n
+}
@@ -0,0 +1,116 @@
+// Package sniff recovers the hostname a connection is for from its first
+// bytes: the SNI of a TLS or QUIC ClientHello, or the Host header of an
+// HTTP request.
+package sniff
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+)
+
+// Timeout bounds the wait for a client to send its first bytes. Protocols
+// where the server speaks first send nothing and are not sniffed.
+const Timeout = 300 * time.Millisecond
+
+// maxPeek caps the bytes held back while sniffing; it fits a TLS record.
+const maxPeek = 16*1024 + 5
+
+// errShort means the data ends before the hostname could be found.
+var errShort = errors.New("sniff: need more data")
+
+// errNoHost means the data is not a protocol this package knows, or has
+// no hostname.
+var errNoHost = errors.New("sniff: no hostname")
+
+// Stream returns the TLS SNI or HTTP Host in b. more is true when b is a
+// prefix of a message that may carry one.
+func Stream(b []byte) (host string, more bool) {
+	for _, f := range []func([]byte) (string, error){TLS, HTTP} {
+		h, err := f(b)
+		if err == nil {
+			return h, false
+		}
+		if err == errShort {
+			more = true
+		}
+	}
+	return "", more
+}
+
+// Peek reads the first bytes conn sends, for up to Timeout, and returns
+// the hostname they carry. The returned conn reads the peeked bytes again
+// before the rest, so nothing is consumed.
+func Peek(conn net.Conn) (string, net.Conn) {
+	var buf []byte
+	b := make([]byte, 4096)
+	deadline := time.Now().Add(Timeout)
+	host := ""
+	for len(buf) < maxPeek {
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(b)
+		buf = append(buf, b[:n]...)
+		if n > 0 {
+			h, more := Stream(buf)
+			if h != "" || !more {
+				host = h
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	if len(buf) == 0 {
+		return host, conn
+	}
+	return host, &peekedConn{Conn: conn, buf: bytes.NewReader(buf)}
+}
+
+// peekedConn reads the sniffed bytes first. It embeds the interface so the
+// WriteTo of a *net.TCPConn is not promoted past them.
+type peekedConn struct {
+	net.Conn
+	buf *bytes.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if c.buf.Len() > 0 {
+		return c.buf.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// Override replaces the host of addr with a sniffed one, if any.
+func Override(addr, host string) string {
+	if host == "" {
+		return addr
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	return addr
+}
+
+// validHost keeps sniffed names that could be dialed.
+func validHost(h string) bool {
+	if h == "" || len(h) > 253 {
+		return false
+	}
+	for i := 0; i < len(h); i++ {
+		c := h[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package sniff
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// clientHello captures the first flight of a TLS client for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	go func() {
+		tls.Client(c, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+	defer s.Close()
+	defer c.Close()
+	var buf bytes.Buffer
+	hdr := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(s, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(s, body); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(hdr)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func TestTLS(t *testing.T) {
+	hello := clientHello(t, "Example.COM")
+	if h, err := TLS(hello); err != nil || h != "example.com" {
+		t.Fatalf("TLS = %q, %v; want example.com", h, err)
+	}
+	if _, err := TLS(hello[:40]); err != errShort {
+		t.Errorf("TLS(prefix) error = %v, want errShort", err)
+	}
+	if _, err := TLS([]byte("SSH-2.0-OpenSSH\r\n")); err != errNoHost {
+		t.Errorf("TLS(ssh) error = %v, want errNoHost", err)
+	}
+
+	// The same hello split over two records.
+	body := hello[recordHeaderLen:]
+	var split []byte
+	split = append(split, 22, 3, 1, 0, 50)
+	split = append(split, body[:50]...)
+	split = append(split, 22, 3, 1, byte((len(body)-50)>>8), byte(len(body)-50))
+	split = append(split, body[50:]...)
+	if h, err := TLS(split); err != nil || h != "example.com" {
+		t.Errorf("TLS(split records) = %q, %v", h, err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	req := []byte("GET / HTTP/1.1\r\nUser-Agent: x\r\nhost: www.Example.org:8080\r\n\r\n")
+	if h, err := HTTP(req); err != nil || h != "www.example.org" {
+		t.Fatalf("HTTP = %q, %v", h, err)
+	}
+	if _, err := HTTP(req[:20]); err != errShort {
+		t.Errorf("HTTP(prefix) error = %v, want errShort", err)
+	}
+	if _, err := HTTP([]byte("GE")); err != errShort {
+		t.Errorf("HTTP(partial method) error = %v, want errShort", err)
+	}
+	if _, err := HTTP([]byte("GET / HTTP/1.0\r\n\r\n")); err != errNoHost {
+		t.Errorf("HTTP without Host error = %v, want errNoHost", err)
+	}
+	if _, err := HTTP([]byte("HELLO there\r\n")); err != errNoHost {
+		t.Errorf("HTTP(unknown method) error = %v, want errNoHost", err)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	c, s := net.Pipe()
+	req := []byte("GET / HTTP/1.1\r\nHost: example.net\r\n\r\nbody")
+	go func() {
+		c.Write(req[:10])
+		c.Write(req[10:])
+	}()
+	host, conn := Peek(s)
+	if host != "example.net" {
+		t.Errorf("Peek host = %q", host)
+	}
+	got := make([]byte, len(req))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, req) {
+		t.Errorf("peeked bytes not replayed: %q, %v", got, err)
+	}
+
+	// A server-first protocol sends nothing; Peek gives up after Timeout.
+	c2, s2 := net.Pipe()
+	defer c2.Close()
+	start := time.Now()
+	if host, _ := Peek(s2); host != "" || time.Since(start) < Timeout {
+		t.Errorf("Peek on a silent client = %q after %v", host, time.Since(start))
+	}
+}
+
+// RFC 9001 Appendix A.1.
+func TestInitialKeys(t *testing.T) {
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	key, iv, hp := initialKeys(quicV1, dcid)
+	for _, tt := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"key", key, "1f369613dd76d5467730efcbe3b1a22d"},
+		{"iv", iv, "fa044b2f42a3fd3b46fb255c"},
+		{"hp", hp, "9f50449e04a0e810283a1e9933adedd2"},
+	} {
+		if hex.EncodeToString(tt.got) != tt.want {
+			t.Errorf("client %s = %x, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestQUIC(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go quic.DialAddr(ctx, pc.LocalAddr().String(), &tls.Config{ServerName: "quic.example.com", NextProtos: []string{"h3"}}, nil)
+
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var hello QUICHello
+	var u UDP
+	for i := 0; ; i++ {
+		b := make([]byte, 2048)
+		n, _, err := pc.ReadFromUDP(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && !IsQUICInitial(b[:n]) {
+			t.Fatal("first datagram is not a QUIC Initial")
+		}
+		h, more := hello.Add(b[:n])
+		uh, pkts, ok := u.Sniff(1, b[:n])
+		if ok != !more {
+			t.Fatalf("datagram %d: UDP.Sniff ok = %v with more = %v", i, ok, more)
+		}
+		if !more {
+			if h != "quic.example.com" || uh != h {
+				t.Errorf("QUIC SNI = %q, UDP.Sniff = %q", h, uh)
+			}
+			if len(pkts) != i+1 {
+				t.Errorf("UDP.Sniff released %d datagrams, want %d", len(pkts), i+1)
+			}
+			break
+		}
+	}
+
+	var garbage QUICHello
+	if h, more := garbage.Add([]byte("not quic")); h != "" || more {
+		t.Error("QUICHello accepted garbage")
+	}
+	if _, pkts, ok := u.Sniff(2, []byte("plain")); !ok || len(pkts) != 1 {
+		t.Error("non-QUIC datagram held back")
+	}
+}
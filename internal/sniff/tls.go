@@ -0,0 +1,142 @@
+package sniff
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	recordHandshake    = 22
+	typeClientHello    = 1
+	extServerName      = 0
+	serverNameHost     = 0
+	recordHeaderLen    = 5
+	handshakeHeaderLen = 4
+)
+
+// TLS returns the SNI of the ClientHello that starts b, a stream of TLS
+// records.
+func TLS(b []byte) (string, error) {
+	if len(b) < recordHeaderLen {
+		if len(b) > 0 && b[0] != recordHandshake {
+			return "", errNoHost
+		}
+		return "", errShort
+	}
+	// The handshake message may span records; gather its bytes.
+	var hs []byte
+	for len(b) >= recordHeaderLen {
+		if b[0] != recordHandshake || b[1] != 3 {
+			return "", errNoHost
+		}
+		n := int(binary.BigEndian.Uint16(b[3:5]))
+		if n == 0 {
+			return "", errNoHost
+		}
+		b = b[recordHeaderLen:]
+		if n > len(b) {
+			hs = append(hs, b...)
+			break
+		}
+		hs = append(hs, b[:n]...)
+		b = b[n:]
+		if len(hs) >= handshakeHeaderLen && len(hs)-handshakeHeaderLen >= hsLen(hs) {
+			break
+		}
+	}
+	return clientHelloSNI(hs)
+}
+
+// clientHelloSNI finds the server name in a ClientHello handshake message.
+// A truncated message is read as far as it goes, which is enough when the
+// extension comes early.
+func clientHelloSNI(hs []byte) (string, error) {
+	if len(hs) < handshakeHeaderLen {
+		return "", errShort
+	}
+	if hs[0] != typeClientHello {
+		return "", errNoHost
+	}
+	b := hs[handshakeHeaderLen:]
+	if full := hsLen(hs); len(b) > full {
+		b = b[:full]
+	}
+
+	// legacy_version, random
+	if len(b) < 2+32 {
+		return "", errShort
+	}
+	b = b[2+32:]
+	// session ID, cipher suites, compression methods
+	for _, lenBytes := range []int{1, 2, 1} {
+		if len(b) < lenBytes {
+			return "", errShort
+		}
+		n := int(b[0])
+		if lenBytes == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < lenBytes+n {
+			return "", errShort
+		}
+		b = b[lenBytes+n:]
+	}
+	if len(b) < 2 {
+		return "", errShortOrNone(hs)
+	}
+	exts := b[2:]
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		n := int(binary.BigEndian.Uint16(exts[2:]))
+		exts = exts[4:]
+		if typ != extServerName {
+			if len(exts) < n {
+				return "", errShort
+			}
+			exts = exts[n:]
+			continue
+		}
+		if len(exts) < n {
+			return "", errShort
+		}
+		return serverName(exts[:n])
+	}
+	return "", errShortOrNone(hs)
+}
+
+// errShortOrNone tells a ClientHello without SNI from a truncated one.
+func errShortOrNone(hs []byte) error {
+	if len(hs)-handshakeHeaderLen < hsLen(hs) {
+		return errShort
+	}
+	return errNoHost
+}
+
+// hsLen is the body length in a handshake message header.
+func hsLen(hs []byte) int {
+	return int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+}
+
+func serverName(ext []byte) (string, error) {
+	if len(ext) < 2 {
+		return "", errNoHost
+	}
+	list := ext[2:]
+	for len(list) >= 3 {
+		typ := list[0]
+		n := int(binary.BigEndian.Uint16(list[1:]))
+		list = list[3:]
+		if len(list) < n {
+			return "", errNoHost
+		}
+		if typ == serverNameHost {
+			h := strings.TrimSuffix(string(list[:n]), ".")
+			if !validHost(h) {
+				return "", errNoHost
+			}
+			return strings.ToLower(h), nil
+		}
+		list = list[n:]
+	}
+	return "", errNoHost
+}
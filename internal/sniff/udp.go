@@ -0,0 +1,58 @@
+package sniff
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// UDP holds back the first datagrams of new flows that start with a QUIC
+// Initial until the ClientHello is complete, so its SNI can pick the
+// destination before the flow is opened. Inbounds that see each datagram
+// separately share one UDP across flows.
+type UDP struct {
+	mu      sync.Mutex
+	pending map[uint64]*pendingHello
+}
+
+type pendingHello struct {
+	hello QUICHello
+	held  [][]byte
+	start time.Time
+}
+
+// Sniff feeds a datagram of a flow that is not open yet. It returns
+// ok=false while the datagram is held back; otherwise the sniffed host,
+// which may be empty, and the datagrams to send in order, ending with b.
+func (u *UDP) Sniff(key uint64, b []byte) (host string, pkts [][]byte, ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	p := u.pending[key]
+	if p == nil {
+		if !IsQUICInitial(b) {
+			return "", [][]byte{b}, true
+		}
+		u.sweep()
+		p = &pendingHello{start: time.Now()}
+	}
+	host, more := p.hello.Add(b)
+	if more && time.Since(p.start) < Timeout {
+		p.held = append(p.held, slices.Clone(b))
+		if u.pending == nil {
+			u.pending = make(map[uint64]*pendingHello)
+		}
+		u.pending[key] = p
+		return "", nil, false
+	}
+	delete(u.pending, key)
+	return host, append(p.held, b), true
+}
+
+// sweep drops flows whose client went quiet mid-hello; it retransmits.
+func (u *UDP) sweep() {
+	for k, p := range u.pending {
+		if time.Since(p.start) > 10*Timeout {
+			delete(u.pending, k)
+		}
+	}
+}
@@ -5,7 +5,6 @@ package socket
 import (
 	"fmt"
 	"paqet/internal/conf"
-	"paqet/internal/flog"
 	"time"
 
 	"github.com/gopacket/gopacket"
@@ -56,7 +55,7 @@ func newAfpacketHandle(cfg *conf.Network) (RawHandle, error) {
 		return nil, fmt.Errorf("failed to create AF_PACKET handle on %s: %v", ifaceName, err)
 	}
 
-	flog.Infof("AF_PACKET: created handle on %s with %d blocks (%d MB buffer)",
+	log.Infof("AF_PACKET: created handle on %s with %d blocks (%d MB buffer)",
 		ifaceName, numBlocks, (numBlocks*afpacketBlockSize)/(1024*1024))
 
 	return &afpacketHandle{
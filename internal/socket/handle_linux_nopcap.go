@@ -5,7 +5,6 @@ package socket
 import (
 	"fmt"
 	"paqet/internal/conf"
-	"paqet/internal/flog"
 )
 
 // newHandle creates a RawHandle using AF_PACKET only (no libpcap dependency).
@@ -18,7 +17,7 @@ func newHandle(cfg *conf.Network) (RawHandle, error) {
 
 	switch backend {
 	case "auto", "afpacket":
-		flog.Debugf("Using AF_PACKET backend (nopcap build)")
+		log.Debugf("Using AF_PACKET backend (nopcap build)")
 		return newAfpacketHandle(cfg)
 
 	case "pcap":
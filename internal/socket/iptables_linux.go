@@ -5,7 +5,6 @@ package socket
 import (
 	"fmt"
 	"os/exec"
-	"paqet/internal/flog"
 )
 
 // iptablesGuard manages iptables rules that prevent the kernel from
@@ -44,14 +43,14 @@ func (g *iptablesGuard) Install() {
 	for _, r := range g.rules {
 		args := append([]string{"-t", r.table, "-C", r.chain}, r.args...)
 		if exec.Command("iptables", args...).Run() == nil {
-			flog.Infof("iptables: %s/%s rule for port %d already exists", r.table, r.chain, g.port)
+			log.Infof("iptables: %s/%s rule for port %d already exists", r.table, r.chain, g.port)
 			continue
 		}
 		args[2] = "-I" // insert at top
 		if err := exec.Command("iptables", args...).Run(); err != nil {
-			flog.Warnf("iptables: failed to add %s/%s rule for port %d: %v", r.table, r.chain, g.port, err)
+			log.Warnf("iptables: failed to add %s/%s rule for port %d: %v", r.table, r.chain, g.port, err)
 		} else {
-			flog.Infof("iptables: added %s/%s rule for port %d", r.table, r.chain, g.port)
+			log.Infof("iptables: added %s/%s rule for port %d", r.table, r.chain, g.port)
 		}
 	}
 }
@@ -8,11 +8,14 @@ import (
 	"net"
 	"os"
 	"paqet/internal/conf"
+	"paqet/internal/flog"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+var log = flog.Sub("socket")
+
 // errPollTimeout is returned by AF_PACKET handles when the poll timeout expires.
 // PacketConn.ReadFrom retries on this error, checking for context cancellation
 // between attempts. This enables graceful shutdown: Close cancels the context,
@@ -3,6 +3,7 @@ package socks
 import (
 	"context"
 	"paqet/internal/client"
+	"paqet/internal/sniff"
 	"sync"
 )
 
@@ -14,6 +15,9 @@ var rPool = sync.Pool{
 }
 
 type Handler struct {
-	client *client.Client
-	ctx    context.Context
+	client  *client.Client
+	ctx     context.Context
+	inbound string // inbound name for routing rules
+	sniff   bool   // dial by the sniffed hostname for IP destinations
+	hellos  sniff.UDP
 }
@@ -1,17 +1,28 @@
 package socks
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"net"
 	"paqet/internal/client"
 	"paqet/internal/conf"
 	"paqet/internal/flog"
+	"paqet/internal/httpproxy"
+	"time"
 
 	"github.com/txthinking/socks5"
 )
 
+var log = flog.Sub("socks")
+
+// handshakeTimeout bounds the time a client may take to pick a protocol
+// and send its request; it does not apply to the relayed connection.
+const handshakeTimeout = 10 * time.Second
+
 type SOCKS5 struct {
 	handle *Handler
+	http   *httpproxy.Proxy // serves connections that do not start as SOCKS5; nil for SOCKS5 only
 }
 
 func New(client *client.Client) (*SOCKS5, error) {
@@ -20,8 +31,16 @@ func New(client *client.Client) (*SOCKS5, error) {
 	}, nil
 }
 
+// Mixed makes the listener serve HTTP proxy requests as well. A SOCKS5
+// connection starts with the version byte 0x05, which no HTTP method does.
+func (s *SOCKS5) Mixed(p *httpproxy.Proxy) {
+	s.http = p
+}
+
 func (s *SOCKS5) Start(ctx context.Context, cfg conf.SOCKS5) error {
 	s.handle.ctx = ctx
+	s.handle.inbound = cfg.Name
+	s.handle.sniff = cfg.Sniff
 	go s.listen(ctx, cfg)
 	return nil
 }
@@ -30,19 +49,113 @@ func (s *SOCKS5) listen(ctx context.Context, cfg conf.SOCKS5) error {
 	listenAddr, _ := net.ResolveTCPAddr("tcp", cfg.Listen.String())
 	server, err := socks5.NewClassicServer(listenAddr.String(), listenAddr.IP.String(), cfg.Username, cfg.Password, 10, 10)
 	if err != nil {
-		flog.Fatalf("SOCKS5 server failed to create on %s: %v", listenAddr.String(), err)
+		log.Fatalf("SOCKS5 server failed to create on %s: %v", listenAddr.String(), err)
 	}
 
-	go func() {
-		if err := server.ListenAndServe(s.handle); err != nil {
-			flog.Debugf("SOCKS5 server failed to listen on %s: %v", listenAddr.String(), err)
-		}
-	}()
-	flog.Infof("SOCKS5 server listening on %s", listenAddr.String())
+	ln, err := net.ListenTCP("tcp", listenAddr)
+	if err != nil {
+		log.Errorf("SOCKS5 server failed to listen on %s: %v", listenAddr.String(), err)
+		return err
+	}
+	defer ln.Close()
+	server.UDPConn, err = net.ListenUDP("udp", cfg.Listen)
+	if err != nil {
+		log.Errorf("SOCKS5 server failed to listen on %s/udp: %v", listenAddr.String(), err)
+		return err
+	}
+	defer server.UDPConn.Close()
 
-	<-ctx.Done()
-	if err := server.Shutdown(); err != nil {
-		flog.Debugf("SOCKS5 server shutdown with: %v", err)
+	go s.serveTCP(ctx, server, ln)
+	go s.serveUDP(server)
+	if s.http != nil {
+		log.Infof("SOCKS5 and HTTP proxy server listening on %s", listenAddr.String())
+	} else {
+		log.Infof("SOCKS5 server listening on %s", listenAddr.String())
 	}
+
+	<-ctx.Done()
 	return nil
 }
+
+func (s *SOCKS5) serveTCP(ctx context.Context, server *socks5.Server, ln *net.TCPListener) {
+	for {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Errorf("SOCKS5 server stopped accepting on %s: %v", ln.Addr(), err)
+			}
+			return
+		}
+		go func() {
+			defer c.Close()
+			s.serveConn(ctx, server, c)
+		}()
+	}
+}
+
+func (s *SOCKS5) serveConn(ctx context.Context, server *socks5.Server, c *net.TCPConn) {
+	var conn net.Conn = c
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if s.http != nil {
+		br := bufio.NewReader(c)
+		first, err := br.Peek(1)
+		if err != nil {
+			return
+		}
+		conn = &peekedConn{Conn: c, r: br}
+		if first[0] != socks5.Ver {
+			// ServeConn bounds the wait for each request itself.
+			c.SetDeadline(time.Time{})
+			s.http.ServeConn(ctx, conn)
+			return
+		}
+	}
+
+	if err := server.Negotiate(conn); err != nil {
+		log.Debugf("SOCKS5 negotiation with %s failed: %v", c.RemoteAddr(), err)
+		return
+	}
+	r, err := server.GetRequest(conn)
+	if err != nil {
+		log.Debugf("SOCKS5 request from %s failed: %v", c.RemoteAddr(), err)
+		return
+	}
+	c.SetDeadline(time.Time{})
+	if err := s.handle.TCPHandle(conn, r); err != nil {
+		log.Debugf("SOCKS5 connection from %s ended: %v", c.RemoteAddr(), err)
+	}
+}
+
+func (s *SOCKS5) serveUDP(server *socks5.Server) {
+	for {
+		b := make([]byte, 65507)
+		n, addr, err := server.UDPConn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		go func() {
+			d, err := socks5.NewDatagramFromBytes(b[:n])
+			if err != nil {
+				log.Debugf("SOCKS5 bad UDP datagram from %s: %v", addr, err)
+				return
+			}
+			if d.Frag != 0x00 {
+				log.Debugf("SOCKS5 ignoring UDP fragment %d from %s", d.Frag, addr)
+				return
+			}
+			s.handle.UDPHandle(server, addr, d)
+		}()
+	}
+}
+
+// peekedConn reads the bytes taken off the connection while sniffing its
+// protocol first. The embedded interface keeps TCPConn.WriteTo from being
+// promoted past the buffer.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *peekedConn) CloseWrite() error { return c.Conn.(*net.TCPConn).CloseWrite() }
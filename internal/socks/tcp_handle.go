@@ -1,37 +1,97 @@
 package socks
 
 import (
+	"errors"
 	"net"
-	"paqet/internal/flog"
+	"paqet/internal/accesslog"
+	"paqet/internal/client"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/protocol"
+	"paqet/internal/sniff"
+	"syscall"
+	"time"
 
 	"github.com/txthinking/socks5"
 )
 
-func (h *Handler) TCPHandle(server *socks5.Server, conn *net.TCPConn, r *socks5.Request) error {
+// TCPHandle serves a negotiated SOCKS5 request.
+func (h *Handler) TCPHandle(conn net.Conn, r *socks5.Request) error {
 	if r.Cmd == socks5.CmdUDP {
-		flog.Debugf("SOCKS5 UDP_ASSOCIATE from %s", conn.RemoteAddr())
+		log.Debugf("SOCKS5 UDP_ASSOCIATE from %s", conn.RemoteAddr())
 		return h.handleUDPAssociate(conn)
 	}
 
 	if r.Cmd == socks5.CmdConnect {
-		flog.Debugf("SOCKS5 CONNECT from %s to %s", conn.RemoteAddr(), r.Address())
+		log.Debugf("SOCKS5 CONNECT from %s to %s", conn.RemoteAddr(), r.Address())
 		return h.handleTCPConnect(conn, r)
 	}
 
-	flog.Debugf("unsupported SOCKS5 command %d from %s", r.Cmd, conn.RemoteAddr())
+	log.Debugf("unsupported SOCKS5 command %d from %s", r.Cmd, conn.RemoteAddr())
 	return nil
 }
 
-func (h *Handler) handleTCPConnect(conn *net.TCPConn, r *socks5.Request) error {
-	flog.Infof("SOCKS5 accepted TCP connection %s -> %s", conn.RemoteAddr(), r.Address())
+func (h *Handler) handleTCPConnect(conn net.Conn, r *socks5.Request) error {
+	log.Infof("SOCKS5 accepted TCP connection %s -> %s", conn.RemoteAddr(), r.Address())
 
+	start := time.Now()
+	addr := r.Address()
+	replied := false
+	if h.sniff && r.Atyp != socks5.ATYPDomain && h.client.NeedsHost(h.inbound, addr) {
+		// The client only sends once the request succeeds, so sniffing
+		// means replying before the stream is up and losing the error
+		// reply; only worth it when the name decides where to go.
+		if err := writeReply(conn, socks5.RepSuccess); err != nil {
+			return err
+		}
+		replied = true
+		var host string
+		host, conn = sniff.Peek(conn)
+		addr = sniff.Override(addr, host)
+	}
+	tstrm, err := h.client.DialTCP(h.inbound, addr)
+	if err != nil {
+		log.Errorf("SOCKS5 failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), addr, err)
+		if !replied {
+			writeReply(conn, replyCode(err))
+		}
+		return err
+	}
+	defer tstrm.Close()
+	log.Debugf("SOCKS5 stream %d established for %s -> %s", tstrm.SID(), conn.RemoteAddr(), addr)
+
+	if !replied {
+		if err := writeReply(conn, socks5.RepSuccess); err != nil {
+			return err
+		}
+	}
+
+	typ := client.LogType(tstrm, "PTCP")
+	strm := accesslog.Count(tstrm)
+	var result error
+	defer func() {
+		accesslog.Stream(strm, "client", conn.RemoteAddr().String(), "", typ, addr, start, accesslog.Reason(h.ctx, result))
+	}()
+
+	result = buffer.Relay(h.ctx, conn, strm)
+	if result != nil {
+		log.Errorf("SOCKS5 stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), addr, result)
+	} else if h.ctx.Err() != nil {
+		log.Debugf("SOCKS5 connection %s -> %s closed due to shutdown", conn.RemoteAddr(), addr)
+	}
+
+	log.Debugf("SOCKS5 connection %s -> %s closed", conn.RemoteAddr(), addr)
+	return nil
+}
+
+// writeReply answers a CONNECT request with rep and the local address as
+// BND.ADDR.
+func writeReply(conn net.Conn, rep byte) error {
 	addr := conn.LocalAddr().(*net.TCPAddr)
 	bufp := rPool.Get().(*[]byte)
 	defer rPool.Put(bufp)
 	buf := *bufp
 	buf = append(buf, socks5.Ver)
-	buf = append(buf, socks5.RepSuccess)
+	buf = append(buf, rep)
 	buf = append(buf, 0x00)
 	if ip4 := addr.IP.To4(); ip4 != nil {
 		buf = append(buf, socks5.ATYPIPv4)
@@ -46,37 +106,37 @@ func (h *Handler) handleTCPConnect(conn *net.TCPConn, r *socks5.Request) error {
 		buf = append(buf, host...)
 	}
 	buf = append(buf, byte(addr.Port>>8), byte(addr.Port&0xff))
-	if _, err := conn.Write(buf); err != nil {
-		return err
-	}
+	_, err := conn.Write(buf)
+	return err
+}
 
-	strm, err := h.client.TCP(r.Address())
-	if err != nil {
-		flog.Errorf("SOCKS5 failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), r.Address(), err)
-		return err
+// replyCode maps a stream setup error to the SOCKS5 reply sent to the
+// application.
+func replyCode(err error) byte {
+	switch {
+	case errors.Is(err, client.ErrBlocked):
+		return socks5.RepNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5.RepConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5.RepHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5.RepNetworkUnreachable
 	}
-	defer strm.Close()
-	flog.Debugf("SOCKS5 stream %d established for %s -> %s", strm.SID(), conn.RemoteAddr(), r.Address())
-
-	errCh := make(chan error, 2)
-	go func() {
-		err := buffer.CopyT(conn, strm)
-		errCh <- err
-	}()
-	go func() {
-		err := buffer.CopyT(strm, conn)
-		errCh <- err
-	}()
-
-	select {
-	case err := <-errCh:
-		if err != nil {
-			flog.Errorf("SOCKS5 stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), r.Address(), err)
-		}
-	case <-h.ctx.Done():
-		flog.Debugf("SOCKS5 connection %s -> %s closed due to shutdown", conn.RemoteAddr(), r.Address())
+	var re *protocol.ReplyError
+	if !errors.As(err, &re) {
+		return socks5.RepServerFailure
+	}
+	switch re.Code {
+	case protocol.ReplyRefused:
+		return socks5.RepConnectionRefused
+	case protocol.ReplyUnreachable:
+		return socks5.RepHostUnreachable
+	case protocol.ReplyTimeout:
+		return socks5.RepTTLExpired
+	case protocol.ReplyDenied:
+		return socks5.RepNotAllowed
+	default:
+		return socks5.RepServerFailure
 	}
-
-	flog.Debugf("SOCKS5 connection %s -> %s closed", conn.RemoteAddr(), r.Address())
-	return nil
 }
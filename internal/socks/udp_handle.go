@@ -1,56 +1,79 @@
 package socks
 
 import (
+	"errors"
 	"io"
 	"net"
-	"paqet/internal/flog"
+	"paqet/internal/accesslog"
+	"paqet/internal/client"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/hash"
+	"paqet/internal/sniff"
 	"time"
 
 	"github.com/txthinking/socks5"
 )
 
 func (h *Handler) UDPHandle(server *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram) error {
-	bufp := buffer.UPool.Get().(*[]byte)
-	defer buffer.UPool.Put(bufp)
-	buf := *bufp
-	strm, new, k, err := h.client.UDP(addr.String(), d.Address())
-	if err != nil {
-		flog.Errorf("SOCKS5 failed to establish UDP stream for %s -> %s: %v", addr, d.Address(), err)
-		return err
+	dest := d.Address()
+	host, pkts := "", [][]byte{d.Data}
+	if h.sniff && d.Atyp != socks5.ATYPDomain && !h.client.HasUDP(addr.String(), dest) {
+		var ok bool
+		host, pkts, ok = h.hellos.Sniff(hash.AddrPair(addr.String(), dest), d.Data)
+		if !ok {
+			return nil
+		}
 	}
-	strm.SetWriteDeadline(time.Now().Add(8 * time.Second))
-	_, err = strm.Write(d.Data)
-	strm.SetWriteDeadline(time.Time{})
+	flow, new, k, err := h.client.DialUDPHost(h.inbound, addr.String(), dest, host)
 	if err != nil {
-		flog.Errorf("SOCKS5 failed to forward %d bytes from %s -> %s: %v", len(d.Data), addr, d.Address(), err)
-		h.client.CloseUDP(k)
+		log.Errorf("SOCKS5 failed to establish UDP flow for %s -> %s: %v", addr, dest, err)
 		return err
 	}
+	for _, p := range pkts {
+		if err := flow.WritePacket(p); err != nil {
+			log.Errorf("SOCKS5 failed to forward %d bytes from %s -> %s: %v", len(p), addr, dest, err)
+			h.client.CloseUDP(k)
+			return err
+		}
+	}
+	dest = sniff.Override(dest, host)
 
 	if new {
-		flog.Infof("SOCKS5 accepted UDP connection %s -> %s", addr, d.Address())
+		log.Infof("SOCKS5 accepted UDP connection %s -> %s", addr, dest)
+		start := time.Now()
 		go func() {
+			var result error
 			defer func() {
-				flog.Debugf("SOCKS5 UDP stream %d closed for %s -> %s", strm.SID(), addr, d.Address())
+				log.Debugf("SOCKS5 UDP flow %d closed for %s -> %s", flow.SID(), addr, dest)
 				h.client.CloseUDP(k)
+				accesslog.Stream(flow, "client", addr.String(), "", client.LogType(flow, "PUDP"), dest, start, accesslog.Reason(h.ctx, result))
 			}()
+			bufp := buffer.UPool.Get().(*[]byte)
+			defer buffer.UPool.Put(bufp)
+			buf := *bufp
 			for {
 				select {
 				case <-h.ctx.Done():
 					return
 				default:
-					strm.SetDeadline(time.Now().Add(8 * time.Second))
-					n, err := strm.Read(buf)
-					strm.SetDeadline(time.Time{})
+					flow.SetReadDeadline(time.Now().Add(8 * time.Second))
+					n, err := flow.ReadPacket(buf)
+					flow.SetReadDeadline(time.Time{})
+					var unreach *buffer.Unreachable
+					if errors.As(err, &unreach) {
+						// SOCKS5 has no way to report ICMP errors for UDP.
+						continue
+					}
 					if err != nil {
-						flog.Debugf("SOCKS5 UDP stream %d read error for %s -> %s: %v", strm.SID(), addr, d.Address(), err)
+						log.Debugf("SOCKS5 UDP flow %d read error for %s -> %s: %v", flow.SID(), addr, dest, err)
+						result = err
 						return
 					}
 					dd := socks5.NewDatagram(d.Atyp, d.DstAddr, d.DstPort, buf[:n])
 					_, err = server.UDPConn.WriteToUDP(dd.Bytes(), addr)
 					if err != nil {
-						flog.Errorf("SOCKS5 failed to write UDP response %d bytes to %s: %v", len(dd.Bytes()), addr, err)
+						log.Errorf("SOCKS5 failed to write UDP response %d bytes to %s: %v", len(dd.Bytes()), addr, err)
+						result = err
 						return
 					}
 				}
@@ -60,7 +83,7 @@ func (h *Handler) UDPHandle(server *socks5.Server, addr *net.UDPAddr, d *socks5.
 	return nil
 }
 
-func (h *Handler) handleUDPAssociate(conn *net.TCPConn) error {
+func (h *Handler) handleUDPAssociate(conn net.Conn) error {
 	addr := conn.LocalAddr().(*net.TCPAddr)
 
 	bufp := rPool.Get().(*[]byte)
@@ -89,7 +112,7 @@ func (h *Handler) handleUDPAssociate(conn *net.TCPConn) error {
 	if _, err := conn.Write(buf); err != nil {
 		return err
 	}
-	flog.Debugf("SOCKS5 accepted UDP_ASSOCIATE from %s, waiting for TCP connection to close", conn.RemoteAddr())
+	log.Debugf("SOCKS5 accepted UDP_ASSOCIATE from %s, waiting for TCP connection to close", conn.RemoteAddr())
 
 	done := make(chan error, 1)
 	go func() {
@@ -100,14 +123,14 @@ func (h *Handler) handleUDPAssociate(conn *net.TCPConn) error {
 	select {
 	case err := <-done:
 		if err != nil && h.ctx.Err() == nil {
-			flog.Errorf("SOCKS5 TCP connection for UDP associate closed with: %v", err)
+			log.Errorf("SOCKS5 TCP connection for UDP associate closed with: %v", err)
 		}
 	case <-h.ctx.Done():
 		conn.Close() // Force close the connection to unblock io.Copy
 		<-done       // Wait for the goroutine to finish
-		flog.Debugf("SOCKS5 UDP_ASSOCIATE connection %s closed due to shutdown", conn.RemoteAddr())
+		log.Debugf("SOCKS5 UDP_ASSOCIATE connection %s closed due to shutdown", conn.RemoteAddr())
 	}
 
-	flog.Debugf("SOCKS5 UDP_ASSOCIATE TCP connection %s closed", conn.RemoteAddr())
+	log.Debugf("SOCKS5 UDP_ASSOCIATE TCP connection %s closed", conn.RemoteAddr())
 	return nil
 }
@@ -0,0 +1,161 @@
+package spa
+
+import (
+	"net"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/hash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Guard wraps the server's raw PacketConn and only delivers packets from
+// source addresses that have sent a valid knock. Everything else is dropped
+// before any transport sees it, so unauthorized sources cannot allocate
+// session state or fingerprint the listener.
+//
+// Allow-list entries are refreshed by every delivered packet and expire after
+// the configured idle timeout.
+type Guard struct {
+	net.PacketConn
+	verifier *Verifier
+	idle     time.Duration
+	allowed  sync.Map // uint64 -> *allowEntry
+	dropped  atomic.Uint64
+	done     chan struct{}
+	once     sync.Once
+}
+
+type allowEntry struct {
+	user string
+	last atomic.Int64 // UnixNano of the last delivered packet
+}
+
+// NewGuard wraps pConn with knock verification and starts the expiry loop.
+func NewGuard(pConn net.PacketConn, cfg *conf.SPA) *Guard {
+	g := &Guard{
+		PacketConn: pConn,
+		verifier:   NewVerifier(cfg.Secret, cfg.Window),
+		idle:       cfg.IdleTimeout,
+		done:       make(chan struct{}),
+	}
+	for _, u := range cfg.Users {
+		g.verifier.AddUser(u.Name, u.Secret)
+	}
+	go g.expireLoop()
+	return g
+}
+
+// Dropped returns the number of packets dropped from unauthorized sources.
+func (g *Guard) Dropped() uint64 { return g.dropped.Load() }
+
+// User returns the user whose knock authorized addr. It reports false for
+// unknown sources and for sources authorized with the shared key.
+func (g *Guard) User(addr net.Addr) (string, bool) {
+	uAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return "", false
+	}
+	v, ok := g.allowed.Load(hash.IPAddr(uAddr.IP, uint16(uAddr.Port)))
+	if !ok {
+		return "", false
+	}
+	user := v.(*allowEntry).user
+	return user, user != ""
+}
+
+func (g *Guard) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := g.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		uAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		key := hash.IPAddr(uAddr.IP, uint16(uAddr.Port))
+		now := time.Now()
+
+		if v, ok := g.allowed.Load(key); ok {
+			// Clients repeat their knock; swallow duplicates that arrive
+			// after the source was already authorized.
+			if n == KnockSize && g.verifier.Verify(p[:n], now) {
+				continue
+			}
+			v.(*allowEntry).last.Store(now.UnixNano())
+			return n, addr, nil
+		}
+
+		if n == KnockSize {
+			if user, ok := g.verifier.Match(p[:n], now); ok {
+				e := &allowEntry{user: user}
+				e.last.Store(now.UnixNano())
+				g.allowed.Store(key, e)
+				if user != "" {
+					flog.Infof("spa: authorized source %s as user %s", addr, user)
+				} else {
+					flog.Infof("spa: authorized source %s", addr)
+				}
+				continue
+			}
+		}
+		g.dropped.Add(1)
+	}
+}
+
+func (g *Guard) expireLoop() {
+	interval := g.idle / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.done:
+			return
+		case now := <-ticker.C:
+			cutoff := now.Add(-g.idle).UnixNano()
+			g.allowed.Range(func(k, v any) bool {
+				if v.(*allowEntry).last.Load() < cutoff {
+					g.allowed.Delete(k)
+					flog.Debugf("spa: allow-list entry expired after %v idle", g.idle)
+				}
+				return true
+			})
+			g.verifier.prune(now)
+		}
+	}
+}
+
+func (g *Guard) Close() error {
+	g.once.Do(func() { close(g.done) })
+	return g.PacketConn.Close()
+}
+
+func (g *Guard) SetDSCP(dscp int) error        { return nil }
+func (g *Guard) SetReadBuffer(bytes int) error { return nil }
+
+// SendKnock writes knockRepeat fresh knocks to addr over pConn. It must be
+// called on the same PacketConn that the transport will use, since the server
+// authorizes the exact source address the knock arrives from.
+func SendKnock(pConn net.PacketConn, addr net.Addr, cfg *conf.SPA) error {
+	for range knockRepeat {
+		k, err := NewKnock(cfg.Secret, time.Now())
+		if err != nil {
+			return err
+		}
+		if _, err := pConn.WriteTo(k, addr); err != nil {
+			return err
+		}
+	}
+	flog.Debugf("spa: sent knock to %s", addr)
+	return nil
+}
+
+// knockRepeat is the number of knocks sent per connection attempt, since raw
+// packets can be lost and the server stays silent until one arrives.
+const knockRepeat = 3
@@ -0,0 +1,124 @@
+package spa
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Knock wire format: nonce(16) + timestamp(8, unix nanoseconds) + HMAC-SHA256(32).
+// The MAC covers a fixed domain label, the nonce and the timestamp.
+const (
+	nonceSize = 16
+	tsSize    = 8
+	macSize   = sha256.Size
+	KnockSize = nonceSize + tsSize + macSize
+)
+
+var macLabel = []byte("paqet-spa-v1")
+
+// NewKnock builds a fresh knock packet authenticated with secret.
+func NewKnock(secret []byte, now time.Time) ([]byte, error) {
+	b := make([]byte, KnockSize)
+	if _, err := rand.Read(b[:nonceSize]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint64(b[nonceSize:nonceSize+tsSize], uint64(now.UnixNano()))
+	copy(b[nonceSize+tsSize:], knockMAC(secret, b[:nonceSize+tsSize]))
+	return b, nil
+}
+
+func knockMAC(secret, body []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write(macLabel)
+	m.Write(body)
+	return m.Sum(nil)
+}
+
+// Verifier validates knocks and rejects replays. A nonce is remembered for
+// twice the timestamp window, after which its timestamp alone rejects it.
+type Verifier struct {
+	keys   []verifierKey
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[[nonceSize]byte]time.Time // nonce -> forget after
+}
+
+type verifierKey struct {
+	user   string
+	secret []byte
+}
+
+// NewVerifier creates a verifier for the shared secret. A nil secret accepts
+// only the keys added with AddUser.
+func NewVerifier(secret []byte, window time.Duration) *Verifier {
+	v := &Verifier{
+		window: window,
+		seen:   make(map[[nonceSize]byte]time.Time),
+	}
+	if secret != nil {
+		v.keys = append(v.keys, verifierKey{secret: secret})
+	}
+	return v
+}
+
+// AddUser accepts knocks made with secret and attributes them to user.
+func (v *Verifier) AddUser(user string, secret []byte) {
+	v.keys = append(v.keys, verifierKey{user: user, secret: secret})
+}
+
+// Verify reports whether data is a valid, fresh, not yet seen knock.
+func (v *Verifier) Verify(data []byte, now time.Time) bool {
+	_, ok := v.Match(data, now)
+	return ok
+}
+
+// Match is Verify that also returns the user whose key signed the knock,
+// or "" for the shared key.
+func (v *Verifier) Match(data []byte, now time.Time) (string, bool) {
+	if len(data) != KnockSize {
+		return "", false
+	}
+	body := data[:nonceSize+tsSize]
+	mac := data[nonceSize+tsSize:]
+	user, found := "", false
+	for _, k := range v.keys {
+		if hmac.Equal(mac, knockMAC(k.secret, body)) {
+			user, found = k.user, true
+			break
+		}
+	}
+	if !found {
+		return "", false
+	}
+
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(data[nonceSize:nonceSize+tsSize])))
+	if d := now.Sub(ts); d > v.window || d < -v.window {
+		return "", false
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], data[:nonceSize])
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.seen[nonce]; ok {
+		return "", false
+	}
+	v.seen[nonce] = now.Add(2 * v.window)
+	return user, true
+}
+
+// prune forgets nonces whose timestamps can no longer pass the window check.
+func (v *Verifier) prune(now time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for n, exp := range v.seen {
+		if now.After(exp) {
+			delete(v.seen, n)
+		}
+	}
+}
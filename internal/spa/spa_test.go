@@ -0,0 +1,172 @@
+package spa
+
+import (
+	"net"
+	"paqet/internal/conf"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestKnockRoundTrip(t *testing.T) {
+	now := time.Now()
+	k, err := NewKnock(testSecret, now)
+	if err != nil {
+		t.Fatalf("NewKnock failed: %v", err)
+	}
+	if len(k) != KnockSize {
+		t.Fatalf("expected %d bytes, got %d", KnockSize, len(k))
+	}
+	v := NewVerifier(testSecret, 30*time.Second)
+	if !v.Verify(k, now) {
+		t.Fatal("valid knock rejected")
+	}
+}
+
+func TestKnockReplayRejected(t *testing.T) {
+	now := time.Now()
+	k, _ := NewKnock(testSecret, now)
+	v := NewVerifier(testSecret, 30*time.Second)
+	if !v.Verify(k, now) {
+		t.Fatal("valid knock rejected")
+	}
+	if v.Verify(k, now.Add(time.Second)) {
+		t.Fatal("replayed knock accepted")
+	}
+}
+
+func TestKnockWrongKey(t *testing.T) {
+	now := time.Now()
+	k, _ := NewKnock(testSecret, now)
+	v := NewVerifier([]byte("another-secret"), 30*time.Second)
+	if v.Verify(k, now) {
+		t.Fatal("knock with wrong key accepted")
+	}
+}
+
+func TestKnockTampered(t *testing.T) {
+	now := time.Now()
+	k, _ := NewKnock(testSecret, now)
+	k[nonceSize] ^= 0x01 // shift the timestamp
+	v := NewVerifier(testSecret, 30*time.Second)
+	if v.Verify(k, now) {
+		t.Fatal("tampered knock accepted")
+	}
+}
+
+func TestKnockOutsideWindow(t *testing.T) {
+	now := time.Now()
+	v := NewVerifier(testSecret, 30*time.Second)
+
+	old, _ := NewKnock(testSecret, now.Add(-time.Minute))
+	if v.Verify(old, now) {
+		t.Fatal("stale knock accepted")
+	}
+	future, _ := NewKnock(testSecret, now.Add(time.Minute))
+	if v.Verify(future, now) {
+		t.Fatal("future knock accepted")
+	}
+}
+
+func TestVerifierPrune(t *testing.T) {
+	now := time.Now()
+	v := NewVerifier(testSecret, time.Second)
+	k, _ := NewKnock(testSecret, now)
+	v.Verify(k, now)
+	v.prune(now.Add(3 * time.Second))
+	if len(v.seen) != 0 {
+		t.Fatalf("expected empty replay cache after prune, got %d entries", len(v.seen))
+	}
+}
+
+// chanPacketConn delivers injected packets to ReadFrom.
+type chanPacketConn struct {
+	ch chan chanPkt
+}
+
+type chanPkt struct {
+	data []byte
+	addr net.Addr
+}
+
+func (c *chanPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	pkt, ok := <-c.ch
+	if !ok {
+		return 0, nil, net.ErrClosed
+	}
+	return copy(p, pkt.data), pkt.addr, nil
+}
+
+func (c *chanPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) { return len(p), nil }
+func (c *chanPacketConn) Close() error                                 { return nil }
+func (c *chanPacketConn) LocalAddr() net.Addr                          { return &net.UDPAddr{} }
+func (c *chanPacketConn) SetDeadline(t time.Time) error                { return nil }
+func (c *chanPacketConn) SetReadDeadline(t time.Time) error            { return nil }
+func (c *chanPacketConn) SetWriteDeadline(t time.Time) error           { return nil }
+
+func TestGuardDropsUntilKnock(t *testing.T) {
+	inner := &chanPacketConn{ch: make(chan chanPkt, 8)}
+	g := NewGuard(inner, &conf.SPA{Secret: testSecret, Window: 30 * time.Second, IdleTimeout: time.Minute})
+	defer g.Close()
+
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 40000}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2).To4(), Port: 40000}
+	k, _ := NewKnock(testSecret, time.Now())
+	k2, _ := NewKnock(testSecret, time.Now())
+
+	inner.ch <- chanPkt{[]byte("early"), client}
+	inner.ch <- chanPkt{k, client}
+	inner.ch <- chanPkt{k2, client} // repeated knock after authorization
+	inner.ch <- chanPkt{[]byte("spoofed"), other}
+	inner.ch <- chanPkt{[]byte("hello"), client}
+	close(inner.ch)
+
+	buf := make([]byte, 1500)
+	n, addr, err := g.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if string(buf[:n]) != "hello" || addr.String() != client.String() {
+		t.Fatalf("expected 'hello' from %s, got %q from %s", client, buf[:n], addr)
+	}
+	if _, _, err := g.ReadFrom(buf); err != net.ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if g.Dropped() != 2 {
+		t.Fatalf("expected 2 dropped packets, got %d", g.Dropped())
+	}
+}
+
+func TestGuardAttributesUser(t *testing.T) {
+	inner := &chanPacketConn{ch: make(chan chanPkt, 8)}
+	aliceKey := []byte("alice-secret-0123456789abcdef012")
+	g := NewGuard(inner, &conf.SPA{
+		Secret:      testSecret,
+		Window:      30 * time.Second,
+		IdleTimeout: time.Minute,
+		Users:       []conf.SPAUser{{Name: "alice", Secret: aliceKey}},
+	})
+	defer g.Close()
+
+	alice := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 40000}
+	shared := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2).To4(), Port: 40000}
+	ka, _ := NewKnock(aliceKey, time.Now())
+	ks, _ := NewKnock(testSecret, time.Now())
+
+	inner.ch <- chanPkt{ka, alice}
+	inner.ch <- chanPkt{ks, shared}
+	inner.ch <- chanPkt{[]byte("hello"), alice}
+	close(inner.ch)
+
+	buf := make([]byte, 1500)
+	if _, _, err := g.ReadFrom(buf); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if user, ok := g.User(alice); !ok || user != "alice" {
+		t.Fatalf("expected alice, got %q (%v)", user, ok)
+	}
+	if user, ok := g.User(shared); ok {
+		t.Fatalf("shared-key source attributed to %q", user)
+	}
+}
@@ -2,10 +2,15 @@ package tnet
 
 import (
 	"context"
+	"errors"
 	"net"
 	"time"
 )
 
+// ErrDatagramTooLarge is returned by SendDatagram when the payload does not
+// fit in one datagram. Callers fall back to a stream for that packet.
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
 type Conn interface {
 	OpenStrm() (Strm, error)
 	AcceptStrm() (Strm, error)
@@ -23,6 +28,6 @@ type Conn interface {
 type DatagramConn interface {
 	Conn
 	SupportsDatagrams() bool
-	SendDatagram(data []byte) error
+	SendDatagram(data []byte) error // ErrDatagramTooLarge if data exceeds the path MTU
 	ReceiveDatagram(ctx context.Context) ([]byte, error)
 }
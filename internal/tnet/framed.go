@@ -0,0 +1,70 @@
+package tnet
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// maxChunk is the largest chunk a framed stream writes at once.
+const maxChunk = 0xFFFF
+
+// framedStrm carries stream data in chunks so that the end of one
+// direction can be sent in band: every chunk is a 2-byte big-endian length
+// followed by the data, and a zero length marks CloseWrite. Reads and
+// writes may run concurrently, but not two of either.
+type framedStrm struct {
+	Strm
+	left int  // unread bytes of the current chunk
+	eof  bool // the peer closed its write side
+	wbuf []byte
+}
+
+// Framed wraps s so that CloseWrite works on any transport. Both ends must
+// switch to framing at the same point of the stream.
+func Framed(s Strm) Strm {
+	return &framedStrm{Strm: s}
+}
+
+func (f *framedStrm) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for f.left == 0 {
+		if f.eof {
+			return 0, io.EOF
+		}
+		var hdr [2]byte
+		if _, err := io.ReadFull(f.Strm, hdr[:]); err != nil {
+			return 0, err
+		}
+		f.left = int(binary.BigEndian.Uint16(hdr[:]))
+		f.eof = f.left == 0
+	}
+	n, err := f.Strm.Read(p[:min(len(p), f.left)])
+	f.left -= n
+	return n, err
+}
+
+func (f *framedStrm) Write(p []byte) (int, error) {
+	if f.wbuf == nil {
+		f.wbuf = make([]byte, 2+maxChunk)
+	}
+	var written int
+	for len(p) > 0 {
+		k := min(len(p), maxChunk)
+		binary.BigEndian.PutUint16(f.wbuf, uint16(k))
+		copy(f.wbuf[2:], p[:k])
+		if _, err := f.Strm.Write(f.wbuf[:2+k]); err != nil {
+			return written, err
+		}
+		written += k
+		p = p[k:]
+	}
+	return written, nil
+}
+
+// CloseWrite sends the empty chunk that ends this direction.
+func (f *framedStrm) CloseWrite() error {
+	_, err := f.Strm.Write([]byte{0, 0})
+	return err
+}
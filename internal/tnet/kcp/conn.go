@@ -5,6 +5,7 @@ import (
 	"net"
 	"paqet/internal/protocol"
 	"paqet/internal/tnet"
+	"sync"
 	"time"
 
 	"github.com/xtaci/kcp-go/v5"
@@ -15,6 +16,9 @@ type Conn struct {
 	PacketConn net.PacketConn
 	UDPSession *kcp.UDPSession
 	Session    *smux.Session
+
+	release func() // frees the listener's session table slot, server side only
+	once    sync.Once
 }
 
 func (c *Conn) OpenStrm() (tnet.Strm, error) {
@@ -67,6 +71,9 @@ func (c *Conn) Close() error {
 	if c.PacketConn != nil {
 		c.PacketConn.Close()
 	}
+	if c.release != nil {
+		c.once.Do(c.release)
+	}
 	return err
 }
 
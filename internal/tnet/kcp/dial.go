@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net"
 	"paqet/internal/conf"
-	"paqet/internal/flog"
 	"paqet/internal/tnet"
 
 	"github.com/xtaci/kcp-go/v5"
@@ -17,13 +16,13 @@ func Dial(addr *net.UDPAddr, cfg *conf.KCP, pConn net.PacketConn) (tnet.Conn, er
 		return nil, fmt.Errorf("connection attempt failed: %v", err)
 	}
 	aplConf(conn, cfg)
-	flog.Debugf("KCP connection established, creating smux session")
+	log.Debugf("KCP connection established, creating smux session")
 
 	sess, err := smux.Client(conn, smuxConf(cfg))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create smux session: %w", err)
 	}
 
-	flog.Debugf("smux session established successfully")
-	return &Conn{pConn, conn, sess}, nil
+	log.Debugf("smux session established successfully")
+	return &Conn{PacketConn: pConn, UDPSession: conn, Session: sess}, nil
 }
@@ -0,0 +1,124 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"paqet/internal/pkg/hash"
+	"paqet/internal/pkg/session"
+	"sync/atomic"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// Header sizes kcp-go uses for non-AEAD block ciphers.
+const (
+	nonceSize = 16
+	crcSize   = 4
+)
+
+// aead matches kcp-go's unexported AEAD block, which authenticates packets
+// with Open instead of a CRC.
+type aead interface {
+	NonceSize() int
+	Overhead() int
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// sourceFilter sits between the raw PacketConn and kcp.ServeConn. kcp-go
+// creates a session for any decryptable packet from an unknown address, so
+// new sources are admitted through the session table first and packets from
+// rejected sources never reach the KCP listener. A source is only admitted
+// once one of its packets passes the same check kcp-go applies, so spoofed
+// junk cannot fill the table.
+type sourceFilter struct {
+	net.PacketConn
+	table *session.Table
+	block kcp.BlockCrypt
+	// scratch holds the decrypted copy of a packet from an unknown source.
+	// kcp-go reads from a single goroutine, so it is never shared.
+	scratch []byte
+}
+
+// kcpSource is the table value for an admitted source. conn is set once the
+// session has been accepted, so idle expiry can close it.
+type kcpSource struct {
+	conn atomic.Pointer[Conn]
+}
+
+func (s *kcpSource) close() {
+	if c := s.conn.Load(); c != nil {
+		c.Close()
+	}
+}
+
+func (f *sourceFilter) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := f.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		uAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		key := hash.IPAddr(uAddr.IP, uint16(uAddr.Port))
+		if _, ok := f.table.Get(key); ok {
+			return n, addr, nil
+		}
+		if !f.authentic(p[:n]) {
+			continue
+		}
+		src := &kcpSource{}
+		if !f.table.Add(key, uAddr, src, src.close) {
+			continue
+		}
+		return n, addr, nil
+	}
+}
+
+// authentic reports whether p decrypts and passes kcp-go's integrity check.
+// p itself is left intact for kcp-go to decrypt again.
+func (f *sourceFilter) authentic(p []byte) bool {
+	switch block := f.block.(type) {
+	case nil:
+		return true
+	case aead:
+		n := block.NonceSize()
+		if len(p) < n+block.Overhead() {
+			return false
+		}
+		_, err := block.Open(nil, p[:n], p[n:], nil)
+		return err == nil
+	default:
+		if len(p) < nonceSize+crcSize {
+			return false
+		}
+		if cap(f.scratch) < len(p) {
+			f.scratch = make([]byte, len(p))
+		}
+		buf := f.scratch[:len(p)]
+		block.Decrypt(buf, p)
+		data := buf[nonceSize:]
+		return crc32.ChecksumIEEE(data[crcSize:]) == binary.LittleEndian.Uint32(data)
+	}
+}
+
+// attach records the accepted conn for its source and returns the release
+// func the conn calls on Close.
+func (f *sourceFilter) attach(c *Conn) func() {
+	uAddr, ok := c.UDPSession.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	key := hash.IPAddr(uAddr.IP, uint16(uAddr.Port))
+	if v, ok := f.table.Get(key); ok {
+		if src, ok := v.(*kcpSource); ok {
+			src.conn.Store(c)
+		}
+	}
+	return func() { f.table.Remove(key) }
+}
+
+func (f *sourceFilter) SetDSCP(dscp int) error        { return nil }
+func (f *sourceFilter) SetReadBuffer(bytes int) error { return nil }
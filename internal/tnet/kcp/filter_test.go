@@ -0,0 +1,87 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"paqet/internal/pkg/session"
+	"testing"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// queueConn is a net.PacketConn that returns queued packets, then an error.
+type queueConn struct {
+	net.PacketConn
+	pkts [][]byte
+	addr net.Addr
+}
+
+func (c *queueConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if len(c.pkts) == 0 {
+		return 0, nil, net.ErrClosed
+	}
+	n := copy(p, c.pkts[0])
+	c.pkts = c.pkts[1:]
+	return n, c.addr, nil
+}
+
+// seal frames payload the way kcp-go does for a non-AEAD block.
+func seal(block kcp.BlockCrypt, payload []byte) []byte {
+	pkt := make([]byte, nonceSize+crcSize+len(payload))
+	rand.Read(pkt[:nonceSize])
+	copy(pkt[nonceSize+crcSize:], payload)
+	binary.LittleEndian.PutUint32(pkt[nonceSize:], crc32.ChecksumIEEE(pkt[nonceSize+crcSize:]))
+	block.Encrypt(pkt, pkt)
+	return pkt
+}
+
+func TestSourceFilterRejectsUnauthenticated(t *testing.T) {
+	block, err := kcp.NewAESBlockCrypt(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := seal(block, make([]byte, 24))
+	conn := &queueConn{
+		pkts: [][]byte{make([]byte, 8), make([]byte, 48), valid},
+		addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000},
+	}
+	table := session.NewTable(session.Limits{MaxSessions: 1})
+	defer table.Close()
+	f := &sourceFilter{PacketConn: conn, table: table, block: block}
+
+	buf := make([]byte, 64)
+	n, _, err := f.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if string(buf[:n]) != string(valid) {
+		t.Fatal("filter returned an unauthenticated packet")
+	}
+	if s := table.Stats(); s.Active != 1 || s.DroppedFull != 0 {
+		t.Errorf("stats = %+v, want only the authenticated source admitted", s)
+	}
+}
+
+func TestSourceFilterAEAD(t *testing.T) {
+	block, err := kcp.NewAESGCMCrypt(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := block.(interface {
+		aead
+		Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	})
+	nonce := make([]byte, a.NonceSize())
+	rand.Read(nonce)
+	valid := a.Seal(append(make([]byte, 0, 64), nonce...), nonce, make([]byte, 24), nil)
+
+	f := &sourceFilter{block: block}
+	if !f.authentic(valid) {
+		t.Error("sealed AEAD packet rejected")
+	}
+	if f.authentic(make([]byte, 64)) {
+		t.Error("forged AEAD packet accepted")
+	}
+}
@@ -2,12 +2,15 @@ package kcp
 
 import (
 	"paqet/internal/conf"
+	"paqet/internal/flog"
 	"time"
 
 	"github.com/xtaci/kcp-go/v5"
 	"github.com/xtaci/smux"
 )
 
+var log = flog.Sub("transport")
+
 func aplConf(conn *kcp.UDPSession, cfg *conf.KCP) {
 	var noDelay, interval, resend, noCongestion int
 	var wDelay, ackNoDelay bool
@@ -3,6 +3,7 @@ package kcp
 import (
 	"net"
 	"paqet/internal/conf"
+	"paqet/internal/pkg/session"
 	"paqet/internal/tnet"
 
 	"github.com/xtaci/kcp-go/v5"
@@ -13,15 +14,22 @@ type Listener struct {
 	packetConn net.PacketConn
 	cfg        *conf.KCP
 	listener   *kcp.Listener
+	filter     *sourceFilter
 }
 
-func Listen(cfg *conf.KCP, pConn net.PacketConn) (tnet.Listener, error) {
-	l, err := kcp.ServeConn(cfg.Block, cfg.Dshard, cfg.Pshard, pConn)
+// Listen starts a KCP listener. New sources are admitted through table;
+// a nil table means no limits.
+func Listen(cfg *conf.KCP, pConn net.PacketConn, table *session.Table) (tnet.Listener, error) {
+	if table == nil {
+		table = session.NewTable(session.Limits{})
+	}
+	filter := &sourceFilter{PacketConn: pConn, table: table, block: cfg.Block}
+	l, err := kcp.ServeConn(cfg.Block, cfg.Dshard, cfg.Pshard, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Listener{packetConn: pConn, cfg: cfg, listener: l}, nil
+	return &Listener{packetConn: pConn, cfg: cfg, listener: l, filter: filter}, nil
 }
 
 func (l *Listener) Accept() (tnet.Conn, error) {
@@ -34,13 +42,16 @@ func (l *Listener) Accept() (tnet.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Conn{nil, conn, sess}, nil
+	c := &Conn{UDPSession: conn, Session: sess}
+	c.release = l.filter.attach(c)
+	return c, nil
 }
 
 func (l *Listener) Close() error {
 	if l.listener != nil {
 		l.listener.Close()
 	}
+	l.filter.table.Close()
 	if l.packetConn != nil {
 		l.packetConn.Close()
 	}
@@ -1,6 +1,8 @@
 package kcp
 
 import (
+	"paqet/internal/tnet"
+
 	"github.com/xtaci/smux"
 )
 
@@ -11,3 +13,8 @@ type Strm struct {
 func (s *Strm) SID() int {
 	return int(s.ID())
 }
+
+// CloseWrite is not available: a smux FIN closes both directions.
+func (s *Strm) CloseWrite() error {
+	return tnet.ErrHalfClose
+}
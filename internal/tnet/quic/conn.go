@@ -2,6 +2,7 @@ package quic
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"paqet/internal/protocol"
@@ -96,7 +97,12 @@ func (c *Conn) SupportsDatagrams() bool {
 // SendDatagram sends an unreliable datagram over QUIC.
 // Returns error if datagrams not supported or payload too large.
 func (c *Conn) SendDatagram(data []byte) error {
-	return c.QConn.SendDatagram(data)
+	err := c.QConn.SendDatagram(data)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return fmt.Errorf("%w (max %d bytes)", tnet.ErrDatagramTooLarge, tooLarge.MaxDatagramPayloadSize)
+	}
+	return err
 }
 
 // ReceiveDatagram receives an unreliable datagram from QUIC.
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"paqet/internal/conf"
-	"paqet/internal/flog"
 	"paqet/internal/tnet"
 	"time"
 
@@ -33,6 +32,6 @@ func Dial(addr *net.UDPAddr, cfg *conf.QUIC, pConn net.PacketConn) (tnet.Conn, e
 		return nil, fmt.Errorf("QUIC dial failed: %w", err)
 	}
 
-	flog.Debugf("QUIC connection established to %s", addr)
+	log.Debugf("QUIC connection established to %s", addr)
 	return &Conn{pConn, qConn}, nil
 }
@@ -10,11 +10,14 @@ import (
 	"io"
 	"math/big"
 	"paqet/internal/conf"
+	"paqet/internal/flog"
 	"time"
 
 	"github.com/quic-go/quic-go"
 )
 
+var log = flog.Sub("transport")
+
 // buildTLSConfig creates a TLS configuration for QUIC.
 // If cert_file and key_file are provided, they are used directly.
 // Otherwise, a deterministic self-signed certificate is derived from the shared key.
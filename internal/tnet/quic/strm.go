@@ -16,7 +16,16 @@ type Strm struct {
 
 func (s *Strm) Read(b []byte) (int, error)  { return s.stream.Read(b) }
 func (s *Strm) Write(b []byte) (int, error) { return s.stream.Write(b) }
-func (s *Strm) Close() error                { return s.stream.Close() }
+
+// Close ends both directions. Closing the quic.Stream alone only ends the
+// send side.
+func (s *Strm) Close() error {
+	s.stream.CancelRead(0)
+	return s.stream.Close()
+}
+
+// CloseWrite sends a FIN while the receive side stays open.
+func (s *Strm) CloseWrite() error { return s.stream.Close() }
 
 func (s *Strm) LocalAddr() net.Addr  { return s.localAddr }
 func (s *Strm) RemoteAddr() net.Addr { return s.remoteAddr }
@@ -1,10 +1,19 @@
 package tnet
 
 import (
+	"errors"
 	"net"
 )
 
+// ErrHalfClose is returned by CloseWrite on streams whose transport cannot
+// end one direction alone.
+var ErrHalfClose = errors.New("stream does not support half-close")
+
 type Strm interface {
 	net.Conn
 	SID() int
+	// CloseWrite ends the write side; the peer reads io.EOF while this
+	// side keeps reading. smux streams return ErrHalfClose unless wrapped
+	// with Framed.
+	CloseWrite() error
 }
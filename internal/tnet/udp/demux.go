@@ -3,6 +3,7 @@ package udp
 import (
 	"net"
 	"paqet/internal/pkg/hash"
+	"paqet/internal/pkg/session"
 	"sync"
 	"time"
 )
@@ -12,10 +13,17 @@ const clientChanSize = 256
 // clientConn holds a per-client channel of received packets.
 type clientConn struct {
 	ch     chan packet
+	done   chan struct{} // closed when the session is removed
+	once   sync.Once
+	key    uint64
 	addr   net.Addr
 	cipher *Cipher
 }
 
+func (cc *clientConn) close() {
+	cc.once.Do(func() { close(cc.done) })
+}
+
 type packet struct {
 	data []byte
 	n    int // valid bytes in data
@@ -53,19 +61,24 @@ func getPacketBuf(n int) (*sync.Pool, []byte) {
 }
 
 // Demux reads from a single PacketConn and routes packets to per-client channels by source address.
+// Sessions are admitted through a session.Table, which bounds their number and expires idle ones.
 type Demux struct {
 	pConn   net.PacketConn
 	cipher  *Cipher
-	clients sync.Map // uint64 -> *clientConn
+	clients *session.Table // uint64 -> *clientConn
 	newConn chan *clientConn
 	done    chan struct{}
 }
 
-// NewDemux creates a new packet demultiplexer.
-func NewDemux(pConn net.PacketConn, cipher *Cipher) *Demux {
+// NewDemux creates a new packet demultiplexer. A nil table means no limits.
+func NewDemux(pConn net.PacketConn, cipher *Cipher, table *session.Table) *Demux {
+	if table == nil {
+		table = session.NewTable(session.Limits{})
+	}
 	d := &Demux{
 		pConn:   pConn,
 		cipher:  cipher,
+		clients: table,
 		newConn: make(chan *clientConn, 64),
 		done:    make(chan struct{}),
 	}
@@ -109,27 +122,54 @@ func (d *Demux) readLoop() {
 		}
 
 		key := hash.IPAddr(udpAddr.IP, uint16(udpAddr.Port))
-
 		pkt := packet{data: data, n: len(data), pool: pool}
-		if cc, ok := d.clients.Load(key); ok {
-			select {
-			case cc.(*clientConn).ch <- pkt:
-			default: // drop if channel full
+		if v, ok := d.clients.Get(key); ok {
+			cc, ok := v.(*clientConn)
+			if !ok {
 				pkt.putBack()
+				continue
 			}
-		} else {
-			// New client
-			cc := &clientConn{
-				ch:     make(chan packet, clientChanSize),
-				addr:   addr,
-				cipher: d.cipher,
-			}
-			cc.ch <- pkt
-			d.clients.Store(key, cc)
 			select {
-			case d.newConn <- cc:
-			default:
+			case cc.ch <- pkt:
+			default: // drop if channel full
+				d.clients.QueueDrop()
+				pkt.putBack()
 			}
+			continue
+		}
+
+		// New client
+		cc := &clientConn{
+			ch:     make(chan packet, clientChanSize),
+			done:   make(chan struct{}),
+			key:    key,
+			addr:   addr,
+			cipher: d.cipher,
+		}
+		if !d.clients.Add(key, udpAddr, cc, cc.close) {
+			pkt.putBack()
+			continue
+		}
+		cc.ch <- pkt
+		select {
+		case d.newConn <- cc:
+		default:
+			// Accept backlog is full; forget the client so it can retry.
+			d.clients.Remove(key)
+			cc.close()
+			drain(cc.ch)
+		}
+	}
+}
+
+// drain returns the buffers of packets nobody will read.
+func drain(ch chan packet) {
+	for {
+		select {
+		case pkt := <-ch:
+			pkt.putBack()
+		default:
+			return
 		}
 	}
 }
@@ -146,20 +186,28 @@ func (d *Demux) Accept() (*clientConn, error) {
 // Close shuts down the demuxer.
 func (d *Demux) Close() {
 	d.pConn.Close()
+	d.clients.Close()
 	close(d.newConn)
 }
 
+// remove forgets a client whose smux session has been closed.
+func (d *Demux) remove(cc *clientConn) {
+	d.clients.Remove(cc.key)
+	cc.close()
+}
+
 // clientConnReader wraps a clientConn into an io.Reader-compatible net.Conn for smux.
 type clientConnReader struct {
 	cc     *clientConn
+	demux  *Demux
 	pConn  net.PacketConn
 	cipher *Cipher
 	buf    []byte  // leftover from previous read
 	curPkt *packet // current packet for putBack
 }
 
-func newClientConnReader(cc *clientConn, pConn net.PacketConn, cipher *Cipher) *clientConnReader {
-	return &clientConnReader{cc: cc, pConn: pConn, cipher: cipher}
+func newClientConnReader(cc *clientConn, demux *Demux, pConn net.PacketConn, cipher *Cipher) *clientConnReader {
+	return &clientConnReader{cc: cc, demux: demux, pConn: pConn, cipher: cipher}
 }
 
 func (r *clientConnReader) Read(b []byte) (int, error) {
@@ -172,8 +220,10 @@ func (r *clientConnReader) Read(b []byte) (int, error) {
 		}
 		return n, nil
 	}
-	pkt, ok := <-r.cc.ch
-	if !ok {
+	var pkt packet
+	select {
+	case pkt = <-r.cc.ch:
+	case <-r.cc.done:
 		return 0, net.ErrClosed
 	}
 	n := copy(b, pkt.data[:pkt.n])
@@ -198,9 +248,13 @@ func (r *clientConnReader) Write(b []byte) (int, error) {
 	return r.pConn.WriteTo(data, r.cc.addr)
 }
 
-func (r *clientConnReader) Close() error                        { return nil }
-func (r *clientConnReader) LocalAddr() net.Addr                 { return r.pConn.LocalAddr() }
-func (r *clientConnReader) RemoteAddr() net.Addr                { return r.cc.addr }
-func (r *clientConnReader) SetDeadline(_ time.Time) error       { return nil }
-func (r *clientConnReader) SetReadDeadline(_ time.Time) error   { return nil }
-func (r *clientConnReader) SetWriteDeadline(_ time.Time) error  { return nil }
+func (r *clientConnReader) Close() error {
+	r.demux.remove(r.cc)
+	return nil
+}
+
+func (r *clientConnReader) LocalAddr() net.Addr                { return r.pConn.LocalAddr() }
+func (r *clientConnReader) RemoteAddr() net.Addr               { return r.cc.addr }
+func (r *clientConnReader) SetDeadline(_ time.Time) error      { return nil }
+func (r *clientConnReader) SetReadDeadline(_ time.Time) error  { return nil }
+func (r *clientConnReader) SetWriteDeadline(_ time.Time) error { return nil }
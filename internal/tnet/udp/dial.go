@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net"
 	"paqet/internal/conf"
-	"paqet/internal/flog"
 	"paqet/internal/tnet"
 
 	"github.com/xtaci/smux"
@@ -24,6 +23,6 @@ func Dial(addr *net.UDPAddr, cfg *conf.UDP, pConn net.PacketConn) (tnet.Conn, er
 		return nil, fmt.Errorf("failed to create smux session over UDP: %w", err)
 	}
 
-	flog.Debugf("UDP connection established to %s with smux", addr)
+	log.Debugf("UDP connection established to %s with smux", addr)
 	return &Conn{pConn, sess}, nil
 }
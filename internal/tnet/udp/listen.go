@@ -3,7 +3,7 @@ package udp
 import (
 	"net"
 	"paqet/internal/conf"
-	"paqet/internal/flog"
+	"paqet/internal/pkg/session"
 	"paqet/internal/tnet"
 
 	"github.com/xtaci/smux"
@@ -17,14 +17,15 @@ type Listener struct {
 }
 
 // Listen creates a UDP listener that demuxes incoming packets by source address.
-func Listen(cfg *conf.UDP, pConn net.PacketConn) (tnet.Listener, error) {
+// New sources are admitted through table; a nil table means no limits.
+func Listen(cfg *conf.UDP, pConn net.PacketConn, table *session.Table) (tnet.Listener, error) {
 	cipher, err := NewCipher(cfg.Block)
 	if err != nil {
 		return nil, err
 	}
 
-	demux := NewDemux(pConn, cipher)
-	flog.Debugf("UDP listener started with packet demuxing")
+	demux := NewDemux(pConn, cipher, table)
+	log.Debugf("UDP listener started with packet demuxing")
 
 	return &Listener{packetConn: pConn, cfg: cfg, demux: demux}, nil
 }
@@ -35,7 +36,7 @@ func (l *Listener) Accept() (tnet.Conn, error) {
 		return nil, err
 	}
 
-	reader := newClientConnReader(cc, l.packetConn, l.demux.cipher)
+	reader := newClientConnReader(cc, l.demux, l.packetConn, l.demux.cipher)
 
 	sess, err := smux.Server(reader, smuxConf(l.cfg))
 	if err != nil {
@@ -2,11 +2,14 @@ package udp
 
 import (
 	"paqet/internal/conf"
+	"paqet/internal/flog"
 	"time"
 
 	"github.com/xtaci/smux"
 )
 
+var log = flog.Sub("transport")
+
 func smuxConf(cfg *conf.UDP) *smux.Config {
 	sconf := smux.DefaultConfig()
 	sconf.Version = 2
@@ -0,0 +1,97 @@
+//go:build linux
+
+package tproxy
+
+import (
+	"fmt"
+	"os/exec"
+	"paqet/internal/conf"
+)
+
+// iptablesRules capture forwarded IPv4 traffic into the listener:
+//   - redirect: nat PREROUTING REDIRECT of TCP to the listen port
+//   - tproxy: mangle PREROUTING TPROXY of TCP and UDP, plus a policy route
+//     that delivers the marked packets to the local stack
+//
+// Excluded destinations and the router's own addresses are left alone.
+type iptablesRules struct {
+	port  int
+	rules []iptRule
+	ip    [][]string // ip(8) commands, without the add/del verb
+}
+
+type iptRule struct {
+	table string
+	chain string
+	args  []string
+}
+
+func newIptablesRules(cfg *conf.TProxy) *iptablesRules {
+	p := fmt.Sprint(cfg.Listen.Port)
+	g := &iptablesRules{port: cfg.Listen.Port}
+
+	// Every rule is inserted at the top, so the capture rules come first
+	// and the RETURN rules for excluded destinations end up above them.
+	local := []string{"-m", "addrtype", "!", "--dst-type", "LOCAL"}
+	table := "nat"
+	if cfg.Mode == "redirect" {
+		g.rules = append(g.rules, iptRule{table: table, chain: "PREROUTING",
+			args: append([]string{"-p", "tcp"}, append(local, "-j", "REDIRECT", "--to-ports", p)...)})
+	} else {
+		table = "mangle"
+		mark := fmt.Sprintf("0x%x/0x%x", cfg.Mark, cfg.Mark)
+		for _, proto := range []string{"tcp", "udp"} {
+			g.rules = append(g.rules, iptRule{table: table, chain: "PREROUTING",
+				args: append([]string{"-p", proto}, append(local, "-j", "TPROXY", "--on-port", p, "--tproxy-mark", mark)...)})
+		}
+		t := fmt.Sprint(cfg.Table)
+		g.ip = [][]string{
+			{"rule", "fwmark", mark, "lookup", t},
+			{"route", "local", "0.0.0.0/0", "dev", "lo", "table", t},
+		}
+	}
+	for _, e := range cfg.Exclude {
+		g.rules = append(g.rules, iptRule{table: table, chain: "PREROUTING", args: []string{"-d", e, "-j", "RETURN"}})
+	}
+	return g
+}
+
+func (g *iptablesRules) Install() {
+	for _, r := range g.rules {
+		args := append([]string{"-t", r.table, "-C", r.chain}, r.args...)
+		if exec.Command("iptables", args...).Run() == nil {
+			log.Infof("iptables: %s/%s rule for port %d already exists", r.table, r.chain, g.port)
+			continue
+		}
+		args[2] = "-I" // insert at top
+		if err := exec.Command("iptables", args...).Run(); err != nil {
+			log.Warnf("iptables: failed to add %s/%s rule for port %d: %v", r.table, r.chain, g.port, err)
+		} else {
+			log.Infof("iptables: added %s/%s rule for port %d", r.table, r.chain, g.port)
+		}
+	}
+	for _, c := range g.ip {
+		// Delete first so restarts do not stack duplicate policy rules.
+		_ = exec.Command("ip", ipArgs(c, "del")...).Run()
+		if err := exec.Command("ip", ipArgs(c, "add")...).Run(); err != nil {
+			log.Warnf("ip %s: failed to add for port %d: %v", c[0], g.port, err)
+		} else {
+			log.Infof("ip %s: added for port %d", c[0], g.port)
+		}
+	}
+}
+
+func (g *iptablesRules) Remove() {
+	for _, r := range g.rules {
+		args := append([]string{"-t", r.table, "-D", r.chain}, r.args...)
+		_ = exec.Command("iptables", args...).Run()
+	}
+	for _, c := range g.ip {
+		_ = exec.Command("ip", ipArgs(c, "del")...).Run()
+	}
+}
+
+// ipArgs puts verb after the object, as in "ip rule add fwmark ...".
+func ipArgs(c []string, verb string) []string {
+	return append([]string{c[0], verb}, c[1:]...)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tproxy
+
+import "paqet/internal/conf"
+
+type iptablesRules struct{}
+
+func newIptablesRules(_ *conf.TProxy) *iptablesRules { return &iptablesRules{} }
+func (g *iptablesRules) Install()                    {}
+func (g *iptablesRules) Remove()                     {}
@@ -0,0 +1,111 @@
+//go:build linux
+
+package tproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h.
+const soOriginalDst = 80
+
+func transparentControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); serr != nil {
+				serr = fmt.Errorf("IP_TRANSPARENT (needs CAP_NET_ADMIN): %w", serr)
+				return
+			}
+			if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); serr != nil {
+				return
+			}
+			if recvOrigDst {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+func listenTCP(ctx context.Context, addr string, transparent bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if transparent {
+		lc.Control = transparentControl(false)
+	}
+	return lc.Listen(ctx, "tcp4", addr)
+}
+
+// listenUDP opens the TPROXY UDP socket, which learns the original
+// destination of every packet from its control message.
+func listenUDP(ctx context.Context, addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	pc, err := lc.ListenPacket(ctx, "udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// listenReply binds a socket to the non-local address dst.
+func listenReply(ctx context.Context, dst *net.UDPAddr) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	return lc.ListenPacket(ctx, "udp4", dst.String())
+}
+
+// originalDst returns the destination a REDIRECT rule rewrote.
+func originalDst(conn *net.TCPConn) (string, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var mreq *syscall.IPv6Mreq
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		// The 16 bytes of a sockaddr_in come back in the Multiaddr field.
+		mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+	})
+	if err != nil {
+		return "", err
+	}
+	if serr != nil {
+		return "", fmt.Errorf("SO_ORIGINAL_DST: %w", serr)
+	}
+	b := mreq.Multiaddr
+	ip := net.IPv4(b[4], b[5], b[6], b[7])
+	port := binary.BigEndian.Uint16(b[2:4])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
+
+// readFromUDP reads one packet and its original destination, which is nil
+// if the kernel did not report one.
+func readFromUDP(pc *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	oob := make([]byte, 64)
+	n, oobn, _, src, err := pc.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, src, nil, nil
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_IP || m.Header.Type != syscall.IP_ORIGDSTADDR || len(m.Data) < 8 {
+			continue
+		}
+		// struct sockaddr_in: family, port (big endian), address.
+		return n, src, &net.UDPAddr{
+			IP:   net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7]),
+			Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+		}, nil
+	}
+	return n, src, nil, nil
+}
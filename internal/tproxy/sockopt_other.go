@@ -0,0 +1,21 @@
+//go:build !linux
+
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+func listenTCP(context.Context, string, bool) (net.Listener, error) { return nil, errUnsupported }
+func listenUDP(context.Context, string) (*net.UDPConn, error)       { return nil, errUnsupported }
+func listenReply(context.Context, *net.UDPAddr) (net.PacketConn, error) {
+	return nil, errUnsupported
+}
+func originalDst(*net.TCPConn) (string, error) { return "", errUnsupported }
+func readFromUDP(*net.UDPConn, []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errUnsupported
+}
@@ -0,0 +1,287 @@
+// Package tproxy accepts the connections that iptables REDIRECT or TPROXY
+// rules capture on a Linux router and forwards them through the tunnel.
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"paqet/internal/accesslog"
+	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/buffer"
+	"paqet/internal/pkg/hash"
+	"paqet/internal/sniff"
+	"sync"
+	"time"
+)
+
+var log = flog.Sub("tproxy")
+
+const (
+	// udpQueue is how many packets of one UDP flow wait for its writer;
+	// more are dropped.
+	udpQueue = 64
+	// udpIdle ends the writer of a UDP flow that sent nothing for this long.
+	udpIdle = 60 * time.Second
+)
+
+type TProxy struct {
+	client *client.Client
+	cfg    conf.TProxy
+	rules  *iptablesRules
+	ctx    context.Context
+	hellos sniff.UDP
+
+	mu    sync.Mutex
+	flows map[uint64]chan []byte // queued packets of each UDP flow, by address pair
+}
+
+func New(client *client.Client, cfg conf.TProxy) (*TProxy, error) {
+	return &TProxy{
+		client: client,
+		cfg:    cfg,
+		flows:  make(map[uint64]chan []byte),
+	}, nil
+}
+
+// Start opens the listeners and, if configured, installs the capture
+// rules. Call Close to remove the rules again.
+func (t *TProxy) Start(ctx context.Context) error {
+	t.ctx = ctx
+	addr := t.cfg.Listen.String()
+	transparent := t.cfg.Mode == "tproxy"
+
+	ln, err := listenTCP(ctx, addr, transparent)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go t.serveTCP(ln)
+
+	if transparent {
+		pc, err := listenUDP(ctx, addr)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("failed to listen on %s/udp: %w", addr, err)
+		}
+		go func() {
+			<-ctx.Done()
+			pc.Close()
+		}()
+		go t.serveUDP(pc)
+	}
+
+	if t.cfg.Rules {
+		t.rules = newIptablesRules(&t.cfg)
+		t.rules.Install()
+	}
+	log.Infof("transparent proxy (%s) listening on %s", t.cfg.Mode, addr)
+	return nil
+}
+
+// Close removes the capture rules installed by Start.
+func (t *TProxy) Close() {
+	if t.rules != nil {
+		t.rules.Remove()
+	}
+}
+
+func (t *TProxy) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if t.ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Errorf("stopped accepting on %s: %v", ln.Addr(), err)
+			}
+			return
+		}
+		go t.handleTCP(conn.(*net.TCPConn))
+	}
+}
+
+func (t *TProxy) handleTCP(conn *net.TCPConn) {
+	defer conn.Close()
+
+	// TPROXY keeps the original destination as the local address; REDIRECT
+	// rewrites it and conntrack remembers the original.
+	dst := conn.LocalAddr().String()
+	if t.cfg.Mode == "redirect" {
+		orig, err := originalDst(conn)
+		if err != nil {
+			log.Errorf("no original destination for %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if orig == dst {
+			log.Warnf("rejected direct connection from %s to the listener", conn.RemoteAddr())
+			return
+		}
+		dst = orig
+	}
+	var c net.Conn = conn
+	if t.cfg.Sniff {
+		var host string
+		host, c = sniff.Peek(conn)
+		dst = sniff.Override(dst, host)
+	}
+	log.Infof("accepted TCP connection %s -> %s", conn.RemoteAddr(), dst)
+
+	start := time.Now()
+	tstrm, err := t.client.DialTCP(t.cfg.Name, dst)
+	if err != nil {
+		log.Errorf("failed to establish stream for %s -> %s: %v", conn.RemoteAddr(), dst, err)
+		return
+	}
+	defer tstrm.Close()
+
+	typ := client.LogType(tstrm, "PTCP")
+	strm := accesslog.Count(tstrm)
+	var result error
+	defer func() {
+		accesslog.Stream(strm, "client", conn.RemoteAddr().String(), "", typ, dst, start, accesslog.Reason(t.ctx, result))
+	}()
+	if result = buffer.Relay(t.ctx, c, strm); result != nil {
+		log.Errorf("stream %d failed for %s -> %s: %v", strm.SID(), conn.RemoteAddr(), dst, result)
+	}
+	log.Debugf("TCP connection %s -> %s closed", conn.RemoteAddr(), dst)
+}
+
+func (t *TProxy) serveUDP(pc *net.UDPConn) {
+	for {
+		b := make([]byte, 65507)
+		n, src, dst, err := readFromUDP(pc, b)
+		if err != nil {
+			if t.ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Errorf("stopped reading UDP on %s: %v", pc.LocalAddr(), err)
+			}
+			return
+		}
+		if dst == nil {
+			log.Debugf("dropping UDP packet from %s without an original destination", src)
+			continue
+		}
+		t.dispatchUDP(src, dst, b[:n])
+	}
+}
+
+// dispatchUDP queues a packet for the goroutine writing its flow, starting
+// one for a new flow, so the packets of a flow go out in order. Packets
+// beyond the queue are dropped, as a congested link would.
+func (t *TProxy) dispatchUDP(src, dst *net.UDPAddr, data []byte) {
+	pair := hash.AddrPair(src.String(), dst.String())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch, ok := t.flows[pair]
+	if !ok {
+		ch = make(chan []byte, udpQueue)
+		t.flows[pair] = ch
+		go t.serveFlow(pair, src, dst, ch)
+	}
+	select {
+	case ch <- data:
+	default:
+		log.Debugf("dropping UDP packet from %s -> %s: queue full", src, dst)
+	}
+}
+
+// serveFlow forwards the queued packets of one flow until it goes idle.
+func (t *TProxy) serveFlow(pair uint64, src, dst *net.UDPAddr, ch chan []byte) {
+	idle := time.NewTimer(udpIdle)
+	defer idle.Stop()
+	for {
+		select {
+		case data := <-ch:
+			t.handleUDP(pair, src, dst, data)
+			idle.Reset(udpIdle)
+		case <-idle.C:
+			t.mu.Lock()
+			if len(ch) > 0 {
+				t.mu.Unlock()
+				idle.Reset(udpIdle)
+				continue
+			}
+			delete(t.flows, pair)
+			t.mu.Unlock()
+			return
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *TProxy) handleUDP(pair uint64, src, dst *net.UDPAddr, data []byte) {
+	host, pkts := "", [][]byte{data}
+	if t.cfg.Sniff && !t.client.HasUDP(src.String(), dst.String()) {
+		var ok bool
+		host, pkts, ok = t.hellos.Sniff(pair, data)
+		if !ok {
+			return
+		}
+	}
+	flow, isNew, key, err := t.client.DialUDPHost(t.cfg.Name, src.String(), dst.String(), host)
+	if err != nil {
+		log.Errorf("failed to establish UDP flow for %s -> %s: %v", src, dst, err)
+		return
+	}
+	for _, p := range pkts {
+		if err := flow.WritePacket(p); err != nil {
+			log.Errorf("failed to forward %d bytes from %s -> %s: %v", len(p), src, dst, err)
+			t.client.CloseUDP(key)
+			return
+		}
+	}
+	if isNew {
+		target := sniff.Override(dst.String(), host)
+		log.Infof("accepted UDP connection %s -> %s", src, target)
+		go t.udpReplies(flow, key, src, dst, target)
+	}
+}
+
+// udpReplies sends the packets of flow to src from a socket bound to dst,
+// so they look like they came from the original destination. target is
+// the destination as dialed, for logging.
+func (t *TProxy) udpReplies(flow client.UDPFlow, key uint64, src, dst *net.UDPAddr, target string) {
+	start := time.Now()
+	var result error
+	defer func() {
+		log.Debugf("UDP flow %d closed for %s -> %s", flow.SID(), src, target)
+		t.client.CloseUDP(key)
+		accesslog.Stream(flow, "client", src.String(), "", client.LogType(flow, "PUDP"), target, start, accesslog.Reason(t.ctx, result))
+	}()
+
+	reply, err := listenReply(t.ctx, dst)
+	if err != nil {
+		log.Errorf("failed to bind reply socket %s for %s: %v", dst, src, err)
+		result = err
+		return
+	}
+	defer reply.Close()
+
+	bufp := buffer.UPool.Get().(*[]byte)
+	defer buffer.UPool.Put(bufp)
+	buf := *bufp
+	for t.ctx.Err() == nil {
+		flow.SetReadDeadline(time.Now().Add(8 * time.Second))
+		n, err := flow.ReadPacket(buf)
+		flow.SetReadDeadline(time.Time{})
+		var unreach *buffer.Unreachable
+		if errors.As(err, &unreach) {
+			continue
+		}
+		if err != nil {
+			log.Debugf("UDP flow %d read error for %s -> %s: %v", flow.SID(), src, dst, err)
+			result = err
+			return
+		}
+		if _, err := reply.WriteTo(buf[:n], src); err != nil {
+			log.Errorf("failed to write UDP response %d bytes to %s: %v", n, src, err)
+			result = err
+			return
+		}
+	}
+}
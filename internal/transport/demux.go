@@ -2,7 +2,6 @@ package transport
 
 import (
 	"net"
-	"paqet/internal/flog"
 )
 
 // ProtoDemux reads from a single PacketConn and routes packets to
@@ -66,7 +65,7 @@ func (d *ProtoDemux) readLoop() {
 			dc = d.lookup[idx]
 		}
 		if dc == nil {
-			flog.Debugf("demux: unknown protocol tag 0x%02x from %s, dropping", tag, addr)
+			log.Debugf("demux: unknown protocol tag 0x%02x from %s, dropping", tag, addr)
 			continue
 		}
 		dc.deliver(buf[1:n], addr)
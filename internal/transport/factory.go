@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"net"
 	"paqet/internal/conf"
+	"paqet/internal/flog"
+	"paqet/internal/pkg/session"
 	"paqet/internal/tnet"
 	"paqet/internal/tnet/kcp"
 	pquic "paqet/internal/tnet/quic"
 	"paqet/internal/tnet/udp"
 )
 
+var log = flog.Sub("transport")
+
 // Dial creates a transport connection based on the configured protocol.
 // For "auto" mode, the caller should use Probe() first to select the best protocol,
 // then call DialProto() with the chosen protocol name.
@@ -50,17 +54,27 @@ func DialProto(proto string, addr *net.UDPAddr, cfg *conf.Transport, pConn net.P
 
 // Listen creates a transport listener based on the configured protocol.
 // For "auto" mode, use ListenMulti() instead.
-func Listen(cfg *conf.Transport, pConn net.PacketConn) (tnet.Listener, error) {
+// KCP and UDP sessions are bounded by the session limits in listen.
+func Listen(cfg *conf.Transport, listen *conf.Server, pConn net.PacketConn) (tnet.Listener, error) {
 	switch cfg.Protocol {
 	case "kcp":
-		return kcp.Listen(cfg.KCP, pConn)
+		return kcp.Listen(cfg.KCP, pConn, newSessionTable(listen))
 	case "quic":
 		return pquic.Listen(cfg.QUIC, pConn)
 	case "udp":
-		return udp.Listen(cfg.UDP, pConn)
+		return udp.Listen(cfg.UDP, pConn, newSessionTable(listen))
 	case "auto":
-		return ListenMulti(cfg, pConn)
+		return ListenMulti(cfg, listen, pConn)
 	default:
 		return nil, fmt.Errorf("unsupported transport protocol: %s", cfg.Protocol)
 	}
 }
+
+// newSessionTable creates the session table shared by a server's listeners.
+func newSessionTable(listen *conf.Server) *session.Table {
+	return session.NewTable(session.Limits{
+		MaxSessions: listen.MaxSessions,
+		MaxPerIP:    listen.MaxSessionsPerIP,
+		IdleTimeout: listen.SessionIdle,
+	})
+}
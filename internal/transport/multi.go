@@ -3,7 +3,6 @@ package transport
 import (
 	"net"
 	"paqet/internal/conf"
-	"paqet/internal/flog"
 	"paqet/internal/tnet"
 	"paqet/internal/tnet/kcp"
 	pquic "paqet/internal/tnet/quic"
@@ -27,9 +26,12 @@ type acceptResult struct {
 }
 
 // ListenMulti creates listeners for all protocols on the same PacketConn
-// using a protocol demuxer.
-func ListenMulti(cfg *conf.Transport, pConn net.PacketConn) (*MultiListener, error) {
+// using a protocol demuxer. KCP and UDP share one session table, so the
+// configured limits apply across both protocols; each listener gets its
+// own scope of it, as a source may speak both while auto mode probes.
+func ListenMulti(cfg *conf.Transport, listen *conf.Server, pConn net.PacketConn) (*MultiListener, error) {
 	demux := NewProtoDemux(pConn, TagKCP, TagQUIC, TagUDP)
+	table := newSessionTable(listen)
 
 	ml := &MultiListener{
 		acceptCh: make(chan acceptResult, 16),
@@ -40,13 +42,13 @@ func ListenMulti(cfg *conf.Transport, pConn net.PacketConn) (*MultiListener, err
 	// Start KCP listener.
 	if cfg.KCP != nil {
 		kcpConn := demux.Conn(TagKCP)
-		l, err := kcp.Listen(cfg.KCP, kcpConn)
+		l, err := kcp.Listen(cfg.KCP, kcpConn, table.Scope(TagKCP))
 		if err != nil {
 			demux.Close()
 			return nil, err
 		}
 		ml.listeners = append(ml.listeners, l)
-		flog.Infof("multi-protocol: KCP listener started")
+		log.Infof("multi-protocol: KCP listener started")
 	}
 
 	// Start QUIC listener.
@@ -59,20 +61,20 @@ func ListenMulti(cfg *conf.Transport, pConn net.PacketConn) (*MultiListener, err
 			return nil, err
 		}
 		ml.listeners = append(ml.listeners, l)
-		flog.Infof("multi-protocol: QUIC listener started")
+		log.Infof("multi-protocol: QUIC listener started")
 	}
 
 	// Start UDP listener.
 	if cfg.UDP != nil {
 		udpConn := demux.Conn(TagUDP)
-		l, err := udp.Listen(cfg.UDP, udpConn)
+		l, err := udp.Listen(cfg.UDP, udpConn, table.Scope(TagUDP))
 		if err != nil {
 			ml.closeListeners()
 			demux.Close()
 			return nil, err
 		}
 		ml.listeners = append(ml.listeners, l)
-		flog.Infof("multi-protocol: UDP listener started")
+		log.Infof("multi-protocol: UDP listener started")
 	}
 
 	// Start accept goroutines for each listener.
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net"
 	"paqet/internal/conf"
-	"paqet/internal/flog"
 	"paqet/internal/tnet"
 	"paqet/internal/tnet/kcp"
 	pquic "paqet/internal/tnet/quic"
@@ -35,13 +34,13 @@ func Probe(addr *net.UDPAddr, cfg *conf.Transport, newConn func() (net.PacketCon
 
 	results := make([]ProbeResult, 0, len(protocols))
 	for _, proto := range protocols {
-		flog.Infof("probing protocol: %s", proto)
+		log.Infof("probing protocol: %s", proto)
 		result := probeOne(proto, addr, cfg, newConn)
 		results = append(results, result)
 		if result.Success {
-			flog.Infof("  %s: RTT=%v", proto, result.RTT)
+			log.Infof("  %s: RTT=%v", proto, result.RTT)
 		} else {
-			flog.Infof("  %s: failed (%v)", proto, result.Error)
+			log.Infof("  %s: failed (%v)", proto, result.Error)
 		}
 	}
 
@@ -136,11 +135,11 @@ func probeOne(proto string, addr *net.UDPAddr, cfg *conf.Transport, newConn func
 		select {
 		case err := <-pingErr:
 			if err != nil {
-				flog.Debugf("  %s: ping %d failed: %v", proto, i+1, err)
+				log.Debugf("  %s: ping %d failed: %v", proto, i+1, err)
 				continue
 			}
 		case <-time.After(pingTimeout):
-			flog.Debugf("  %s: ping %d timed out", proto, i+1)
+			log.Debugf("  %s: ping %d timed out", proto, i+1)
 			continue
 		}
 		totalRTT += time.Since(start)
@@ -3,6 +3,8 @@ package transport
 import (
 	"bytes"
 	"net"
+	"paqet/internal/conf"
+	"paqet/internal/tnet"
 	"sync"
 	"testing"
 	"time"
@@ -602,3 +604,41 @@ func TestDemuxedPacketConnWriteLargePayload(t *testing.T) {
 		t.Error("payload corrupted")
 	}
 }
+
+// --- Multi-protocol session table ---
+
+func TestListenMultiSameSourceBothProtocols(t *testing.T) {
+	mock := newMockPacketConn()
+	cfg := &conf.Transport{
+		KCP: &conf.KCP{Smuxbuf: 1 << 20, Streambuf: 1 << 16},
+		UDP: &conf.UDP{Smuxbuf: 1 << 20, Streambuf: 1 << 16},
+	}
+	ml, err := ListenMulti(cfg, &conf.Server{MaxSessionsPerIP: 2}, mock)
+	if err != nil {
+		t.Fatalf("ListenMulti: %v", err)
+	}
+	defer ml.Close()
+
+	// The KCP source filter admits the source before KCP parses anything,
+	// so the UDP listener must not find that entry for the same address.
+	mock.inject(append([]byte{TagKCP}, make([]byte, 32)...), testAddr)
+	mock.inject(append([]byte{TagUDP}, []byte("hello")...), testAddr)
+
+	accepted := make(chan tnet.Conn, 2)
+	go func() {
+		for {
+			c, err := ml.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+	for range 2 {
+		select {
+		case <-accepted:
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected a session per protocol from the same source")
+		}
+	}
+}
@@ -0,0 +1,185 @@
+//go:build linux
+
+package tun
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"paqet/internal/conf"
+	"strings"
+)
+
+// srcValidMark makes reverse path filtering honor packet marks.
+const srcValidMark = "/proc/sys/net/ipv4/conf/all/src_valid_mark"
+
+const (
+	appsTable    = "paqet_apps"     // nftables table
+	appsChain    = "PAQET_APPS"     // iptables mangle chain, jumped to from OUTPUT
+	appsChainPre = "PAQET_APPS_PRE" // iptables mangle chain, jumped to from PREROUTING
+	mainTable    = 254
+)
+
+// appMarker marks the packets of the applications in tun.apps for the
+// policy rules. The mark is saved to the connection and restored on
+// replies, so reverse path filtering checks them against the same table.
+// Sockets carrying tun.mark are paqet's own direct routes and never match.
+type appMarker struct {
+	apps   *conf.TUNApps
+	direct int
+}
+
+// appRules sends marked packets, or with mode exclude all others, to the
+// table with the TUN default routes. Routes more specific than a default
+// route in the main table, such as the server, tun.exclude and local
+// networks, go first.
+func appRules(apps *conf.TUNApps, ipv6 bool) []policyRule {
+	return []policyRule{
+		{IPv6: ipv6, Priority: apps.Priority, Table: mainTable, Suppress: 1},
+		{IPv6: ipv6, Priority: apps.Priority + 1, Mark: apps.Mark, Invert: apps.Mode == "exclude", Table: apps.Table},
+	}
+}
+
+// install applies the marking rules with nftables, or iptables and
+// ip6tables where nft is missing, replacing any previous ones.
+func (m *appMarker) install() error {
+	// Reverse path filtering only looks at the restored mark with this set.
+	if err := os.WriteFile(srcValidMark, []byte("1"), 0o644); err != nil {
+		return fmt.Errorf("failed to enable src_valid_mark: %w", err)
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		return m.installNft()
+	}
+	return m.installIptables()
+}
+
+func (m *appMarker) installNft() error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", appsTable, appsTable)
+	fmt.Fprintf(&b, "table inet %s {\n\tchain output {\n\t\ttype route hook output priority -150; policy accept;\n", appsTable)
+	if m.direct != 0 {
+		fmt.Fprintf(&b, "\t\tmeta mark 0x%x return\n", m.direct)
+	}
+	for _, match := range m.nftMatches() {
+		fmt.Fprintf(&b, "\t\t%s meta mark set 0x%x\n", match, m.apps.Mark)
+	}
+	fmt.Fprintf(&b, "\t\tmeta mark 0x%x ct mark set meta mark\n\t}\n", m.apps.Mark)
+	fmt.Fprintf(&b, "\tchain prerouting {\n\t\ttype filter hook prerouting priority -150; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tct mark 0x%x meta mark set ct mark\n\t}\n}\n", m.apps.Mark)
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(b.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+func (m *appMarker) nftMatches() []string {
+	var matches []string
+	for _, cg := range m.apps.Cgroups {
+		// The level is the depth of the path below the cgroup v2 root.
+		matches = append(matches, fmt.Sprintf("socket cgroupv2 level %d %q", strings.Count(cg, "/")+1, cg))
+	}
+	for _, uid := range m.apps.UIDs {
+		matches = append(matches, fmt.Sprintf("meta skuid %d", uid))
+	}
+	for _, mark := range m.apps.Marks {
+		matches = append(matches, fmt.Sprintf("meta mark 0x%x", mark))
+	}
+	return matches
+}
+
+func (m *appMarker) installIptables() error {
+	for _, ipt := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(ipt); err != nil {
+			if ipt == "ip6tables" {
+				log.Warnf("TUN apps: ip6tables not found, IPv6 packets are not marked")
+				continue
+			}
+			return fmt.Errorf("tun.apps needs nft or iptables: %w", err)
+		}
+		for _, chain := range []string{appsChain, appsChainPre} {
+			_ = exec.Command(ipt, "-t", "mangle", "-N", chain).Run() // exists after a previous install
+			if err := run(ipt, "-t", "mangle", "-F", chain); err != nil {
+				return err
+			}
+		}
+
+		mark := fmt.Sprintf("0x%x", m.apps.Mark)
+		var rules [][]string
+		if m.direct != 0 {
+			rules = append(rules, []string{"-m", "mark", "--mark", fmt.Sprintf("0x%x", m.direct), "-j", "RETURN"})
+		}
+		for _, match := range m.iptMatches() {
+			rules = append(rules, append(match, "-j", "MARK", "--set-mark", mark))
+		}
+		rules = append(rules, []string{"-m", "mark", "--mark", mark, "-j", "CONNMARK", "--save-mark"})
+		for _, r := range rules {
+			if err := run(ipt, append([]string{"-t", "mangle", "-A", appsChain}, r...)...); err != nil {
+				return err
+			}
+		}
+		if err := run(ipt, "-t", "mangle", "-A", appsChainPre, "-m", "connmark", "--mark", mark, "-j", "CONNMARK", "--restore-mark"); err != nil {
+			return err
+		}
+
+		for hook, chain := range map[string]string{"OUTPUT": appsChain, "PREROUTING": appsChainPre} {
+			if exec.Command(ipt, "-t", "mangle", "-C", hook, "-j", chain).Run() != nil {
+				if err := run(ipt, "-t", "mangle", "-I", hook, "1", "-j", chain); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m *appMarker) iptMatches() [][]string {
+	var matches [][]string
+	for _, cg := range m.apps.Cgroups {
+		matches = append(matches, []string{"-m", "cgroup", "--path", cg})
+	}
+	for _, uid := range m.apps.UIDs {
+		matches = append(matches, []string{"-m", "owner", "--uid-owner", fmt.Sprint(uid)})
+	}
+	for _, mark := range m.apps.Marks {
+		matches = append(matches, []string{"-m", "mark", "--mark", fmt.Sprintf("0x%x", mark)})
+	}
+	return matches
+}
+
+// readSrcValidMark returns the current src_valid_mark setting, for the
+// state file.
+func readSrcValidMark() (string, error) {
+	b, err := os.ReadFile(srcValidMark)
+	if err != nil {
+		return "", fmt.Errorf("failed to read src_valid_mark: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// restoreSrcValidMark sets src_valid_mark back to the value install found.
+func restoreSrcValidMark(v string) error {
+	if err := os.WriteFile(srcValidMark, []byte(v), 0o644); err != nil {
+		return fmt.Errorf("failed to restore src_valid_mark: %w", err)
+	}
+	return nil
+}
+
+// removeAppMarks deletes whichever of the marking rule sets is installed.
+func removeAppMarks() {
+	if _, err := exec.LookPath("nft"); err == nil {
+		_ = exec.Command("nft", "delete", "table", "inet", appsTable).Run()
+	}
+	for _, ipt := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(ipt); err != nil {
+			continue
+		}
+		for hook, chain := range map[string]string{"OUTPUT": appsChain, "PREROUTING": appsChainPre} {
+			_ = exec.Command(ipt, "-t", "mangle", "-D", hook, "-j", chain).Run()
+			_ = exec.Command(ipt, "-t", "mangle", "-F", chain).Run()
+			_ = exec.Command(ipt, "-t", "mangle", "-X", chain).Run()
+		}
+	}
+}
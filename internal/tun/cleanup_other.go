@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tun
+
+import "errors"
+
+// Cleanup undoes the route and DNS changes of a TUN client that did not
+// exit cleanly. Only Linux keeps the state to do so.
+func Cleanup() error {
+	return errors.New("tun cleanup is only available on Linux")
+}
@@ -0,0 +1,23 @@
+package tun
+
+import (
+	"context"
+	"paqet/internal/dns"
+)
+
+// SetResolver answers TUN DNS traffic, over UDP and TCP, with r instead
+// of passing it to the configured DNS server.
+func (t *TUN) SetResolver(r *dns.Resolver) {
+	t.resolver = r
+}
+
+// answerDNS is the dns.Handler for TUN queries: fake IPs first, then the
+// resolver.
+func (t *TUN) answerDNS(ctx context.Context, query []byte) ([]byte, error) {
+	if t.fake != nil {
+		if resp := t.fake.answer(query); resp != nil {
+			return resp, nil
+		}
+	}
+	return t.resolver.Exchange(ctx, query)
+}
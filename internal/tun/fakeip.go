@@ -0,0 +1,169 @@
+package tun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeTTL keeps applications from caching fake answers past a pool
+// wrap-around.
+const fakeTTL = 1
+
+// fakeDNS answers A queries with addresses from a reserved pool and
+// remembers the name behind each one, so connections to them can be
+// tunneled by name and resolved by the server.
+type fakeDNS struct {
+	prefix netip.Prefix
+	base   uint32 // first address of the pool
+	size   uint32 // usable addresses, without network and broadcast
+
+	mu     sync.Mutex
+	next   uint32
+	byName map[string]netip.Addr
+	byAddr map[netip.Addr]string
+}
+
+func newFakeDNS(pool string) (*fakeDNS, error) {
+	prefix, err := netip.ParsePrefix(pool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fake IP pool: %w", err)
+	}
+	prefix = prefix.Masked()
+	a := prefix.Addr().As4()
+	return &fakeDNS{
+		prefix: prefix,
+		base:   binary.BigEndian.Uint32(a[:]),
+		size:   1<<(32-prefix.Bits()) - 2,
+		byName: make(map[string]netip.Addr),
+		byAddr: make(map[netip.Addr]string),
+	}, nil
+}
+
+// contains reports whether addr belongs to the pool.
+func (f *fakeDNS) contains(addr netip.Addr) bool {
+	return f.prefix.Contains(addr.Unmap())
+}
+
+// lookup returns the name addr was handed out for.
+func (f *fakeDNS) lookup(addr netip.Addr) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name, ok := f.byAddr[addr.Unmap()]
+	return name, ok
+}
+
+// assign returns the address for name, handing out the next one in the
+// pool if it has none. Once the pool is used up the oldest names lose
+// their addresses.
+func (f *fakeDNS) assign(name string) netip.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if addr, ok := f.byName[name]; ok {
+		return addr
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], f.base+1+f.next)
+	addr := netip.AddrFrom4(b)
+	f.next = (f.next + 1) % f.size
+	if old, ok := f.byAddr[addr]; ok {
+		delete(f.byName, old)
+	}
+	f.byName[name] = addr
+	f.byAddr[addr] = name
+	return addr
+}
+
+// answer builds the response to a query the pool can answer: A records
+// with fake addresses, PTR records for them, and empty answers for AAAA
+// and HTTPS/SVCB so applications stick to the fake IPv4 address. It
+// returns nil for anything else, which goes to the real DNS server.
+func (f *fakeDNS) answer(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response || h.OpCode != 0 {
+		return nil
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 || qs[0].Class != dnsmessage.ClassINET {
+		return nil
+	}
+	q := qs[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	if err := b.Question(q); err != nil {
+		return nil
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: fakeTTL}
+	switch q.Type {
+	case dnsmessage.TypeA:
+		// Single-label names are local; leave them to the real server.
+		if !strings.Contains(name, ".") {
+			return nil
+		}
+		addr := f.assign(name)
+		log.Debugf("TUN DNS: %s -> %s (fake)", name, addr)
+		if err := b.AResource(rh, dnsmessage.AResource{A: addr.As4()}); err != nil {
+			return nil
+		}
+	case dnsmessage.TypeAAAA, dnsmessage.TypeHTTPS, dnsmessage.TypeSVCB:
+		if !strings.Contains(name, ".") {
+			return nil
+		}
+	case dnsmessage.TypePTR:
+		addr, ok := ptrAddr(name)
+		if !ok || !f.contains(addr) {
+			return nil
+		}
+		target, ok := f.lookup(addr)
+		if !ok {
+			return nil
+		}
+		ptr, err := dnsmessage.NewName(target + ".")
+		if err != nil {
+			return nil
+		}
+		if err := b.PTRResource(rh, dnsmessage.PTRResource{PTR: ptr}); err != nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// ptrAddr parses an IPv4 reverse lookup name such as
+// "4.3.2.1.in-addr.arpa".
+func ptrAddr(name string) (netip.Addr, bool) {
+	rev, ok := strings.CutSuffix(name, ".in-addr.arpa")
+	if !ok {
+		return netip.Addr{}, false
+	}
+	parts := strings.Split(rev, ".")
+	if len(parts) != 4 {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(parts[3] + "." + parts[2] + "." + parts[1] + "." + parts[0])
+	return addr, err == nil
+}
@@ -14,6 +14,14 @@ type filter struct {
 	dnsIP    netip.Addr
 }
 
+// nonGlobal6 are IPv6 ranges that no server could reach either, beyond
+// the loopback, link-local, multicast and unique local checks.
+var nonGlobal6 = []netip.Prefix{
+	netip.MustParsePrefix("fec0::/10"),     // site-local, deprecated
+	netip.MustParsePrefix("100::/64"),      // discard-only
+	netip.MustParsePrefix("2001:db8::/32"), // documentation
+}
+
 func newFilter(serverIP, dnsIP string) *filter {
 	sAddr, _ := netip.ParseAddr(serverIP)
 	dAddr, _ := netip.ParseAddr(dnsIP)
@@ -53,10 +61,16 @@ func (f *filter) shouldForward(ip net.IP) bool {
 		return false
 	}
 
-	// Drop private/reserved networks (but DNS is handled separately).
+	// Drop private networks, including IPv6 unique local fc00::/7 (but DNS
+	// is handled separately).
 	if addr.IsPrivate() {
 		return false
 	}
+	for _, p := range nonGlobal6 {
+		if p.Contains(addr) {
+			return false
+		}
+	}
 
 	// Drop unspecified (0.0.0.0, ::).
 	if addr.IsUnspecified() {
@@ -0,0 +1,277 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/protocol"
+	"paqet/internal/tnet"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	// icmpIdleTimeout closes an echo flow once the application stops pinging.
+	icmpIdleTimeout = 10 * time.Second
+	// icmpQueueLen is how many echo requests may wait for a flow's stream.
+	icmpQueueLen = 16
+)
+
+// icmpKey identifies one ping flow: an application pinging one host with
+// one echo identifier.
+type icmpKey struct {
+	src, dst netip.Addr
+	id       uint16
+}
+
+type icmpFlow struct {
+	key  icmpKey
+	reqs chan []byte // ICMP messages waiting to be sent
+}
+
+// interceptICMP takes echo requests off the device before gVisor sees them
+// and sends them through the tunnel. Everything else goes to the stack.
+func (t *TUN) interceptICMP(pkt []byte) bool {
+	src, dst, msg, ok := parseEchoRequest(pkt)
+	if !ok || !t.filter.shouldForward(dst.AsSlice()) {
+		return false
+	}
+	if t.icmpOff.Load() {
+		return true
+	}
+	// Fake IPs stand for names, which echo requests cannot carry.
+	if t.fake != nil && t.fake.contains(dst) {
+		return true
+	}
+
+	key := icmpKey{src: src, dst: dst, id: binary.BigEndian.Uint16(msg[4:6])}
+	t.icmpMu.Lock()
+	f, ok := t.icmpFlows[key]
+	if !ok {
+		// Echo requests have no direct path, so only blocking applies.
+		if t.client.Route(inbound, dst.String()) == conf.RouteBlock {
+			t.icmpMu.Unlock()
+			return true
+		}
+		f = &icmpFlow{key: key, reqs: make(chan []byte, icmpQueueLen)}
+		t.icmpFlows[key] = f
+		go t.runICMPFlow(f)
+	}
+	t.icmpMu.Unlock()
+
+	select {
+	case f.reqs <- append([]byte(nil), msg...):
+	default:
+		// The flow is still waiting for its stream; drop like a lossy link.
+	}
+	return true
+}
+
+// runICMPFlow owns the tunnel stream of one ping flow and closes it after
+// icmpIdleTimeout without requests.
+func (t *TUN) runICMPFlow(f *icmpFlow) {
+	var strm tnet.Strm
+	defer func() {
+		t.icmpMu.Lock()
+		delete(t.icmpFlows, f.key)
+		t.icmpMu.Unlock()
+		if strm != nil {
+			strm.Close()
+		}
+	}()
+
+	idle := time.NewTimer(icmpIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-idle.C:
+			log.Debugf("TUN ICMP: flow %s -> %s (id %d) idle, closing", f.key.src, f.key.dst, f.key.id)
+			return
+		case msg := <-f.reqs:
+			idle.Reset(icmpIdleTimeout)
+			if strm == nil {
+				s, err := t.client.ICMP()
+				if err != nil {
+					if errors.Is(err, client.ErrICMPUnsupported) {
+						log.Warnf("TUN ICMP: server does not support ICMP, dropping echo requests")
+						t.icmpOff.Store(true)
+					} else {
+						log.Errorf("TUN ICMP: failed to establish stream for %s: %v", f.key.dst, err)
+					}
+					return
+				}
+				strm = s
+				log.Debugf("TUN ICMP: stream %d established for %s -> %s", strm.SID(), f.key.src, f.key.dst)
+				go t.icmpReplies(f, strm)
+			}
+			p := protocol.Proto{Type: protocol.PICMP, ICMP: &protocol.ICMPData{DstIP: net.IP(f.key.dst.AsSlice()), Payload: msg}}
+			if err := p.Write(strm); err != nil {
+				log.Debugf("TUN ICMP: stream %d write error for %s: %v", strm.SID(), f.key.dst, err)
+				return
+			}
+		}
+	}
+}
+
+// icmpReplies writes the echo replies of a flow back to the application.
+func (t *TUN) icmpReplies(f *icmpFlow, strm tnet.Strm) {
+	for {
+		var p protocol.Proto
+		if err := p.Read(strm); err != nil {
+			return
+		}
+		if p.Type != protocol.PICMP || p.ICMP == nil {
+			return
+		}
+		from, ok := netip.AddrFromSlice(p.ICMP.DstIP)
+		if !ok {
+			continue
+		}
+		pkt := buildICMP(from.Unmap(), f.key.src, p.ICMP.Payload)
+		if err := t.ns.writePacket(pkt); err != nil {
+			log.Debugf("TUN ICMP: write error for %s: %v", f.key.src, err)
+		}
+	}
+}
+
+// udpUnreachable tells the application behind localAddr that targetAddr
+// answered its UDP datagram with a destination unreachable. code is the
+// ICMPv4 code; it is translated for IPv6.
+func (t *TUN) udpUnreachable(localAddr, targetAddr string, code byte) {
+	local, err := netip.ParseAddrPort(localAddr)
+	if err != nil {
+		return
+	}
+	target, err := netip.ParseAddrPort(targetAddr)
+	if err != nil {
+		return
+	}
+	lip, tip := local.Addr().Unmap(), target.Addr().Unmap()
+	if lip.Is4() != tip.Is4() {
+		return
+	}
+
+	// The quoted datagram is the original IP header plus the UDP header.
+	orig := buildIP(lip, tip, header.UDPProtocolNumber, header.UDPMinimumSize)
+	udp := header.UDP(orig[len(orig)-header.UDPMinimumSize:])
+	udp.Encode(&header.UDPFields{SrcPort: local.Port(), DstPort: target.Port(), Length: header.UDPMinimumSize})
+
+	msg := make([]byte, 8+len(orig))
+	if tip.Is4() {
+		msg[0], msg[1] = byte(header.ICMPv4DstUnreachable), code
+	} else {
+		msg[0], msg[1] = byte(header.ICMPv6DstUnreachable), icmpv6UnreachableCode(code)
+	}
+	copy(msg[8:], orig)
+	if err := t.ns.writePacket(buildICMP(tip, lip, msg)); err != nil {
+		log.Debugf("TUN UDP: failed to deliver unreachable for %s -> %s: %v", localAddr, targetAddr, err)
+	}
+}
+
+// icmpv6UnreachableCode maps an ICMPv4 destination unreachable code to
+// its ICMPv6 counterpart.
+func icmpv6UnreachableCode(code byte) byte {
+	switch code {
+	case 3: // port
+		return byte(header.ICMPv6PortUnreachable)
+	case 13: // administratively prohibited
+		return byte(header.ICMPv6Prohibited)
+	case 0: // network
+		return byte(header.ICMPv6NetworkUnreachable)
+	default:
+		return byte(header.ICMPv6AddressUnreachable)
+	}
+}
+
+// parseEchoRequest returns the addresses and ICMP message of an
+// unfragmented ICMP or ICMPv6 echo request.
+func parseEchoRequest(pkt []byte) (src, dst netip.Addr, msg []byte, ok bool) {
+	if len(pkt) == 0 {
+		return
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		ip := header.IPv4(pkt)
+		if !ip.IsValid(len(pkt)) || ip.TransportProtocol() != header.ICMPv4ProtocolNumber || ip.More() || ip.FragmentOffset() != 0 {
+			return
+		}
+		msg = pkt[ip.HeaderLength():ip.TotalLength()]
+		if len(msg) < header.ICMPv4MinimumSize || header.ICMPv4(msg).Type() != header.ICMPv4Echo {
+			return
+		}
+		src, dst = netip.AddrFrom4(ip.SourceAddress().As4()), netip.AddrFrom4(ip.DestinationAddress().As4())
+	case 6:
+		ip := header.IPv6(pkt)
+		if !ip.IsValid(len(pkt)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return
+		}
+		msg = pkt[header.IPv6MinimumSize : header.IPv6MinimumSize+int(ip.PayloadLength())]
+		if len(msg) < header.ICMPv6EchoMinimumSize || header.ICMPv6(msg).Type() != header.ICMPv6EchoRequest {
+			return
+		}
+		src, dst = netip.AddrFrom16(ip.SourceAddress().As16()), netip.AddrFrom16(ip.DestinationAddress().As16())
+	default:
+		return
+	}
+	return src, dst, msg, true
+}
+
+// buildICMP wraps an ICMP or ICMPv6 message in an IP header and fills in
+// the checksums.
+func buildICMP(src, dst netip.Addr, msg []byte) []byte {
+	proto := header.ICMPv4ProtocolNumber
+	if !src.Is4() {
+		proto = header.ICMPv6ProtocolNumber
+	}
+	pkt := buildIP(src, dst, proto, len(msg))
+	icmp := pkt[len(pkt)-len(msg):]
+	copy(icmp, msg)
+	icmp[2], icmp[3] = 0, 0
+	var sum uint16
+	if src.Is4() {
+		sum = ^checksum.Checksum(icmp, 0)
+	} else {
+		sum = header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: header.ICMPv6(icmp),
+			Src:    tcpip.AddrFrom16(src.As16()),
+			Dst:    tcpip.AddrFrom16(dst.As16()),
+		})
+	}
+	binary.BigEndian.PutUint16(icmp[2:4], sum)
+	return pkt
+}
+
+// buildIP returns a packet with an IP header for proto and payloadLen
+// zeroed payload bytes.
+func buildIP(src, dst netip.Addr, proto tcpip.TransportProtocolNumber, payloadLen int) []byte {
+	if src.Is4() {
+		pkt := make([]byte, header.IPv4MinimumSize+payloadLen)
+		ip := header.IPv4(pkt)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(pkt)),
+			TTL:         64,
+			Protocol:    uint8(proto),
+			SrcAddr:     tcpip.AddrFrom4(src.As4()),
+			DstAddr:     tcpip.AddrFrom4(dst.As4()),
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		return pkt
+	}
+	pkt := make([]byte, header.IPv6MinimumSize+payloadLen)
+	header.IPv6(pkt).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(payloadLen),
+		TransportProtocol: proto,
+		HopLimit:          64,
+		SrcAddr:           tcpip.AddrFrom16(src.As16()),
+		DstAddr:           tcpip.AddrFrom16(dst.As16()),
+	})
+	return pkt
+}
@@ -0,0 +1,54 @@
+package tun
+
+import (
+	"errors"
+	"net/netip"
+	"paqet/internal/conf"
+)
+
+// killSwitch drops egress that leaves neither through the TUN device nor
+// for the paqet server, so nothing goes out in the clear while every
+// connection is reconnecting or after paqet exits or crashes. Loopback,
+// DHCP and IPv6 neighbor discovery, tun.exclude and sockets carrying
+// tun.mark are let out too, as are the applications tun.apps excludes.
+// The rules stay until DisableKillSwitch.
+type killSwitch struct {
+	dev      string
+	server   netip.AddrPort
+	excludes []netip.Prefix
+	marks    []int
+}
+
+func newKillSwitch(cfg *conf.TUN, dev string, server netip.AddrPort) *killSwitch {
+	k := &killSwitch{
+		dev:    dev,
+		server: netip.AddrPortFrom(server.Addr().Unmap(), server.Port()),
+	}
+	if cfg.Mark != 0 {
+		k.marks = append(k.marks, cfg.Mark)
+	}
+	if cfg.Apps != nil && cfg.Apps.Mode == "exclude" {
+		k.marks = append(k.marks, cfg.Apps.Mark)
+	}
+	for _, e := range cfg.Exclude {
+		if p, err := netip.ParsePrefix(e); err == nil {
+			k.excludes = append(k.excludes, p)
+		}
+	}
+	return k
+}
+
+// EnableKillSwitch installs the kill switch for the TUN device and server
+// in cfg without starting the tunnel, e.g. at boot before paqet runs.
+func EnableKillSwitch(cfg *conf.Conf) error {
+	if cfg.TUN == nil {
+		return errors.New("configuration has no tun section")
+	}
+	return newKillSwitch(cfg.TUN, cfg.TUN.Name_, cfg.Server.Addr.AddrPort()).install()
+}
+
+// DisableKillSwitch removes the kill switch, letting traffic out without
+// the tunnel again.
+func DisableKillSwitch() error {
+	return removeKillSwitch()
+}
@@ -0,0 +1,165 @@
+//go:build linux
+
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+const (
+	ksTable = "paqet_killswitch" // nftables table
+	ksChain = "PAQET_KILLSWITCH" // iptables chain, jumped to from OUTPUT
+)
+
+// install applies the rules with nftables, or iptables and ip6tables where
+// nft is missing. Installing again replaces the rules without a window in
+// which traffic gets out.
+func (k *killSwitch) install() error {
+	if _, err := exec.LookPath("nft"); err == nil {
+		if err := k.installNft(); err != nil {
+			return err
+		}
+		log.Infof("kill switch: nftables table inet %s active for %s and server %s", ksTable, k.dev, k.server)
+		return nil
+	}
+	if err := k.installIptables(); err != nil {
+		return err
+	}
+	log.Infof("kill switch: iptables chain %s active for %s and server %s", ksChain, k.dev, k.server)
+	return nil
+}
+
+func (k *killSwitch) installNft() error {
+	var b strings.Builder
+	// Declaring the table first lets the delete succeed on a first install;
+	// nft applies the whole script as one transaction.
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", ksTable, ksTable)
+	fmt.Fprintf(&b, "table inet %s {\n\tchain output {\n\t\ttype filter hook output priority 0; policy drop;\n", ksTable)
+	for _, r := range k.nftRules() {
+		fmt.Fprintf(&b, "\t\t%s\n", r)
+	}
+	b.WriteString("\t}\n}\n")
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(b.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+func (k *killSwitch) nftRules() []string {
+	rules := []string{
+		`oifname "lo" accept`,
+		fmt.Sprintf("oifname %q accept", k.dev),
+	}
+	for _, m := range k.marks {
+		rules = append(rules, fmt.Sprintf("meta mark 0x%x accept", m))
+	}
+	rules = append(rules,
+		fmt.Sprintf("%s daddr %s th dport %d accept", nftFamily(k.server.Addr()), k.server.Addr(), k.server.Port()),
+		"udp sport 68 udp dport 67 accept",
+		"icmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept",
+	)
+	for _, p := range k.excludes {
+		rules = append(rules, fmt.Sprintf("%s daddr %s accept", nftFamily(p.Addr()), p))
+	}
+	return rules
+}
+
+func nftFamily(a netip.Addr) string {
+	if a.Is4() {
+		return "ip"
+	}
+	return "ip6"
+}
+
+func (k *killSwitch) installIptables() error {
+	for _, v6 := range []bool{false, true} {
+		ipt := "iptables"
+		if v6 {
+			ipt = "ip6tables"
+		}
+		if _, err := exec.LookPath(ipt); err != nil {
+			if v6 {
+				log.Warnf("kill switch: ip6tables not found, IPv6 egress is not blocked")
+				continue
+			}
+			return fmt.Errorf("kill switch needs nft or iptables: %w", err)
+		}
+		_ = exec.Command(ipt, "-N", ksChain).Run() // exists after a previous install
+
+		// Flush down to a lone DROP and insert the exceptions above it, so
+		// a reinstall only ever blocks too much.
+		if err := run(ipt, "-F", ksChain); err != nil {
+			return err
+		}
+		if err := run(ipt, "-A", ksChain, "-j", "DROP"); err != nil {
+			return err
+		}
+		for _, r := range k.iptRules(v6) {
+			args := append([]string{"-I", ksChain, "1"}, r...)
+			if err := run(ipt, append(args, "-j", "ACCEPT")...); err != nil {
+				return err
+			}
+		}
+		if exec.Command(ipt, "-C", "OUTPUT", "-j", ksChain).Run() != nil {
+			if err := run(ipt, "-I", "OUTPUT", "1", "-j", ksChain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (k *killSwitch) iptRules(v6 bool) [][]string {
+	rules := [][]string{{"-o", "lo"}, {"-o", k.dev}}
+	for _, m := range k.marks {
+		rules = append(rules, []string{"-m", "mark", "--mark", fmt.Sprintf("0x%x", m)})
+	}
+	if k.server.Addr().Is6() == v6 {
+		for _, proto := range []string{"tcp", "udp"} {
+			rules = append(rules, []string{"-d", k.server.Addr().String(), "-p", proto, "--dport", fmt.Sprint(k.server.Port())})
+		}
+	}
+	if v6 {
+		for _, t := range []string{"router-solicitation", "neighbour-solicitation", "neighbour-advertisement"} {
+			rules = append(rules, []string{"-p", "ipv6-icmp", "--icmpv6-type", t})
+		}
+	} else {
+		rules = append(rules, []string{"-p", "udp", "--sport", "68", "--dport", "67"})
+	}
+	for _, p := range k.excludes {
+		if p.Addr().Is6() == v6 {
+			rules = append(rules, []string{"-d", p.String()})
+		}
+	}
+	return rules
+}
+
+// removeKillSwitch deletes whichever of the rule sets is installed.
+func removeKillSwitch() error {
+	removed := false
+	if _, err := exec.LookPath("nft"); err == nil {
+		removed = exec.Command("nft", "delete", "table", "inet", ksTable).Run() == nil
+	}
+	for _, ipt := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(ipt); err != nil {
+			continue
+		}
+		if exec.Command(ipt, "-D", "OUTPUT", "-j", ksChain).Run() == nil {
+			removed = true
+		}
+		_ = exec.Command(ipt, "-F", ksChain).Run()
+		_ = exec.Command(ipt, "-X", ksChain).Run()
+	}
+	if removed {
+		log.Infof("kill switch: disabled")
+	} else {
+		log.Infof("kill switch: no rules installed")
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tun
+
+import "errors"
+
+var errKillSwitch = errors.New("kill switch is only available on Linux")
+
+func (k *killSwitch) install() error { return errKillSwitch }
+func removeKillSwitch() error        { return errKillSwitch }
@@ -0,0 +1,257 @@
+//go:build linux
+
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+)
+
+// nlRequest sends one rtnetlink request and waits for the kernel's ack.
+func nlRequest(typ, flags uint16, body []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return err
+	}
+
+	msg := make([]byte, syscall.SizeofNlMsghdr, syscall.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(syscall.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:], typ)
+	binary.NativeEndian.PutUint16(msg[6:], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:], 1) // sequence number
+	msg = append(msg, body...)
+	if err := syscall.Sendto(fd, msg, 0, sa); err != nil {
+		return err
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("netlink: short error message")
+			}
+			if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// appendAttr appends a route attribute, padded to 4 bytes. Every message
+// header before the attributes is a multiple of 4 long.
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	b = binary.NativeEndian.AppendUint16(b, uint16(syscall.SizeofRtAttr+len(data)))
+	b = binary.NativeEndian.AppendUint16(b, typ)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func nlFamily(a netip.Addr) byte {
+	if a.Is4() {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+// setLinkUp is "ip link set dev <index> up".
+func setLinkUp(index int) error {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(b[4:], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:], syscall.IFF_UP)  // flags
+	binary.NativeEndian.PutUint32(b[12:], syscall.IFF_UP) // change mask
+	return nlRequest(syscall.RTM_NEWLINK, 0, b)
+}
+
+// addAddr is "ip addr replace <p> dev <index>"; the kernel adds the route
+// to the prefix.
+func addAddr(index int, p netip.Prefix) error {
+	b := []byte{nlFamily(p.Addr()), byte(p.Bits()), 0, 0}
+	b = binary.NativeEndian.AppendUint32(b, uint32(index))
+	b = appendAttr(b, syscall.IFA_LOCAL, p.Addr().AsSlice())
+	b = appendAttr(b, syscall.IFA_ADDRESS, p.Addr().AsSlice())
+	return nlRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, b)
+}
+
+// addRoute is "ip route add <dst> [via <gw>] dev <oif> table <table>".
+func addRoute(dst netip.Prefix, gw netip.Addr, oif, table int) error {
+	scope := byte(syscall.RT_SCOPE_UNIVERSE)
+	if !gw.IsValid() && dst.Addr().Is4() {
+		scope = syscall.RT_SCOPE_LINK
+	}
+	b := []byte{nlFamily(dst.Addr()), byte(dst.Bits()), 0, 0, rtmTable(table), syscall.RTPROT_BOOT, scope, syscall.RTN_UNICAST, 0, 0, 0, 0}
+	return nlRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, routeAttrs(b, dst, gw, oif, table))
+}
+
+// delRoute is "ip route del <dst> [dev <oif>] table <table>".
+func delRoute(dst netip.Prefix, oif, table int) error {
+	b := []byte{nlFamily(dst.Addr()), byte(dst.Bits()), 0, 0, rtmTable(table), 0, syscall.RT_SCOPE_NOWHERE, 0, 0, 0, 0, 0}
+	return nlRequest(syscall.RTM_DELROUTE, 0, routeAttrs(b, dst, netip.Addr{}, oif, table))
+}
+
+// rtmTable is the table for the 8-bit header field; larger IDs only fit
+// the RTA_TABLE attribute.
+func rtmTable(table int) byte {
+	if table > 255 {
+		return syscall.RT_TABLE_UNSPEC
+	}
+	return byte(table)
+}
+
+func routeAttrs(b []byte, dst netip.Prefix, gw netip.Addr, oif, table int) []byte {
+	b = appendAttr(b, syscall.RTA_TABLE, binary.NativeEndian.AppendUint32(nil, uint32(table)))
+	if dst.Bits() > 0 {
+		b = appendAttr(b, syscall.RTA_DST, dst.Masked().Addr().AsSlice())
+	}
+	if gw.IsValid() {
+		b = appendAttr(b, syscall.RTA_GATEWAY, gw.AsSlice())
+	}
+	if oif != 0 {
+		b = appendAttr(b, syscall.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(oif)))
+	}
+	return b
+}
+
+// Routing rule attributes and flags from linux/fib_rules.h.
+const (
+	fraPriority       = 6
+	fraFwmark         = 10
+	fraSuppressPrefix = 14
+	fraTable          = 15
+	fraFwmask         = 16
+	frActToTbl        = 1
+	fibRuleInvert     = 0x2
+)
+
+// policyRule is an ip rule that sends traffic to a routing table. It is
+// saved in the state file to be deleted again.
+type policyRule struct {
+	IPv6     bool `json:"ipv6"`
+	Priority int  `json:"priority"`
+	Mark     int  `json:"mark,omitempty"`     // fwmark to match, 0 for any
+	Invert   bool `json:"invert,omitempty"`   // match packets without Mark
+	Table    int  `json:"table"`              // table to look up
+	Suppress int  `json:"suppress,omitempty"` // suppress_prefixlength + 1, so 0 is unset
+}
+
+func (r policyRule) msg() []byte {
+	family := byte(syscall.AF_INET)
+	if r.IPv6 {
+		family = syscall.AF_INET6
+	}
+	var flags uint32
+	if r.Invert {
+		flags |= fibRuleInvert
+	}
+	// fib_rule_hdr: family, dst_len, src_len, tos, table, res1, res2, action, flags
+	b := []byte{family, 0, 0, 0, rtmTable(r.Table), 0, 0, frActToTbl}
+	b = binary.NativeEndian.AppendUint32(b, flags)
+	b = appendAttr(b, fraPriority, binary.NativeEndian.AppendUint32(nil, uint32(r.Priority)))
+	b = appendAttr(b, fraTable, binary.NativeEndian.AppendUint32(nil, uint32(r.Table)))
+	if r.Mark != 0 {
+		b = appendAttr(b, fraFwmark, binary.NativeEndian.AppendUint32(nil, uint32(r.Mark)))
+		b = appendAttr(b, fraFwmask, binary.NativeEndian.AppendUint32(nil, math.MaxUint32))
+	}
+	if r.Suppress > 0 {
+		b = appendAttr(b, fraSuppressPrefix, binary.NativeEndian.AppendUint32(nil, uint32(r.Suppress-1)))
+	}
+	return b
+}
+
+// addRule is "ip rule add"; delRule is "ip rule del" for the same rule.
+func addRule(r policyRule) error {
+	return nlRequest(syscall.RTM_NEWRULE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, r.msg())
+}
+
+func delRule(r policyRule) error {
+	return nlRequest(syscall.RTM_DELRULE, 0, r.msg())
+}
+
+// defaultRoute returns the gateway, which may be unset for point-to-point
+// links, and device of the preferred default route of the main table for
+// the family of a. Routes out of the device named skip are ignored.
+func defaultRoute(a netip.Addr, skip string) (netip.Addr, *net.Interface, error) {
+	family := int(nlFamily(a))
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
+	if err != nil {
+		return netip.Addr{}, nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return netip.Addr{}, nil, err
+	}
+	var (
+		bestGW   netip.Addr
+		best     *net.Interface
+		bestPrio uint32 = math.MaxUint32
+	)
+	for _, m := range msgs {
+		// rtmsg: family, dst_len, src_len, tos, table, ...
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		if m.Data[1] != 0 || m.Data[4] != syscall.RT_TABLE_MAIN {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			continue
+		}
+		var gw netip.Addr
+		var oif int
+		var prio uint32
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				gw, _ = netip.AddrFromSlice(attr.Value)
+			case syscall.RTA_OIF:
+				if len(attr.Value) >= 4 {
+					oif = int(binary.NativeEndian.Uint32(attr.Value))
+				}
+			case syscall.RTA_PRIORITY:
+				if len(attr.Value) >= 4 {
+					prio = binary.NativeEndian.Uint32(attr.Value)
+				}
+			}
+		}
+		if oif == 0 {
+			continue
+		}
+		ifc, err := net.InterfaceByIndex(oif)
+		if err != nil || ifc.Name == skip {
+			continue
+		}
+		if best == nil || prio < bestPrio {
+			bestGW, best, bestPrio = gw, ifc, prio
+		}
+	}
+	if best == nil {
+		return netip.Addr{}, nil, fmt.Errorf("no default route for %s", a)
+	}
+	return bestGW, best, nil
+}
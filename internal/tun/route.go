@@ -1,8 +1,15 @@
 package tun
 
-import wgtun "golang.zx2c4.com/wireguard/tun"
+import (
+	"paqet/internal/conf"
+
+	wgtun "golang.zx2c4.com/wireguard/tun"
+)
 
 type routeManager interface {
-	addRoutes(dev wgtun.Device, tunName, tunAddr, serverIP, dnsIP string, excludes []string) error
+	// addRoutes sends default traffic into the device; tunAddr6 is empty
+	// when IPv6 stays out of the tunnel. apps, if set, limits that to
+	// some applications, leaving sockets with the direct mark alone (Linux).
+	addRoutes(dev wgtun.Device, tunName, tunAddr, tunAddr6, serverIP, dnsIP string, excludes []string, mark int, apps *conf.TUNApps) error
 	removeRoutes() error
 }
@@ -6,7 +6,8 @@ import (
 	"fmt"
 	"net/netip"
 	"os/exec"
-	"paqet/internal/flog"
+	"paqet/internal/conf"
+	"strconv"
 	"strings"
 
 	wgtun "golang.zx2c4.com/wireguard/tun"
@@ -20,13 +21,15 @@ type darwinRouteManager struct {
 	networkService string   // e.g., "Wi-Fi", "Ethernet"
 	origDNS        []string // original DNS servers
 	excludes       []string
+	origGateway6   string // IPv6 default gateway, looked up when needed
+	tunName6       string // set once IPv6 default traffic is routed into the TUN
 }
 
 func newRouteManager() routeManager {
 	return &darwinRouteManager{}
 }
 
-func (r *darwinRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, serverIP, dnsIP string, excludes []string) error {
+func (r *darwinRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, tunAddr6, serverIP, dnsIP string, excludes []string, _ int, _ *conf.TUNApps) error {
 	r.serverIP = serverIP
 	r.tunAddr = tunAddr
 	r.excludes = excludes
@@ -38,13 +41,13 @@ func (r *darwinRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, serverI
 	ip := prefix.Addr().String()
 
 	// Get the current default gateway.
-	gw, iface, err := r.getDefaultGateway()
+	gw, iface, err := r.getDefaultGateway(false)
 	if err != nil {
 		return fmt.Errorf("failed to get default gateway: %w", err)
 	}
 	r.origGateway = gw
 	r.origIface = iface
-	flog.Infof("TUN route: original default gateway %s via %s", gw, iface)
+	log.Infof("TUN route: original default gateway %s via %s", gw, iface)
 
 	// Assign address to TUN interface.
 	if err := run("ifconfig", tunName, ip, ip, "up"); err != nil {
@@ -52,22 +55,19 @@ func (r *darwinRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, serverI
 	}
 
 	// Route server IP through original gateway to prevent loop.
-	if err := run("route", "add", "-host", serverIP, gw); err != nil {
-		return fmt.Errorf("failed to add server route: %w", err)
+	if addr, err := netip.ParseAddr(serverIP); err == nil {
+		if err := r.addGatewayRoute(netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())); err != nil {
+			return fmt.Errorf("failed to add server route: %w", err)
+		}
 	}
 
 	// Route excluded CIDRs through original gateway (e.g., SSH source IPs).
 	for _, cidr := range excludes {
 		pfx, _ := netip.ParsePrefix(cidr)
-		if pfx.IsSingleIP() {
-			err = run("route", "add", "-host", pfx.Addr().String(), gw)
-		} else {
-			err = run("route", "add", "-net", cidr, gw)
-		}
-		if err != nil {
+		if err := r.addGatewayRoute(pfx); err != nil {
 			return fmt.Errorf("failed to add exclude route for %s: %w", cidr, err)
 		}
-		flog.Infof("TUN route: excluded %s via %s", cidr, gw)
+		log.Infof("TUN route: excluded %s", cidr)
 	}
 
 	// Replace default route with TUN.
@@ -76,18 +76,35 @@ func (r *darwinRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, serverI
 		return fmt.Errorf("failed to set default route via TUN: %w", err)
 	}
 
+	// IPv6 keeps its default route; two /1 routes are more specific.
+	if tunAddr6 != "" {
+		pfx6, err := netip.ParsePrefix(tunAddr6)
+		if err != nil {
+			return fmt.Errorf("invalid TUN IPv6 address: %w", err)
+		}
+		if err := run("ifconfig", tunName, "inet6", pfx6.Addr().String(), "prefixlen", strconv.Itoa(pfx6.Bits())); err != nil {
+			return fmt.Errorf("failed to configure TUN IPv6 address: %w", err)
+		}
+		r.tunName6 = tunName
+		for _, half := range []string{"::/1", "8000::/1"} {
+			if err := run("route", "add", "-inet6", "-net", half, "-interface", tunName); err != nil {
+				return fmt.Errorf("failed to route %s via TUN: %w", half, err)
+			}
+		}
+	}
+
 	// Configure system DNS to use tunnel DNS (like WireGuard does).
 	// This preserves LAN access while ensuring DNS goes through the tunnel.
 	if dnsIP != "" {
 		if err := r.setupDNS(iface, dnsIP); err != nil {
-			flog.Warnf("TUN DNS: failed to configure system DNS: %v", err)
-			flog.Infof("TUN DNS: traffic to port 53 will still be redirected via gVisor")
+			log.Warnf("TUN DNS: failed to configure system DNS: %v", err)
+			log.Infof("TUN DNS: traffic to port 53 will still be redirected via gVisor")
 		} else {
-			flog.Infof("TUN DNS: system DNS set to %s (LAN access preserved)", dnsIP)
+			log.Infof("TUN DNS: system DNS set to %s (LAN access preserved)", dnsIP)
 		}
 	}
 
-	flog.Infof("TUN route: default route via %s (%s), server %s via %s", ip, tunName, serverIP, gw)
+	log.Infof("TUN route: default route via %s (%s), server %s via %s", ip, tunName, serverIP, gw)
 	return nil
 }
 
@@ -102,9 +119,9 @@ func (r *darwinRouteManager) removeRoutes() error {
 	// Restore original DNS settings.
 	if r.networkService != "" {
 		if err := r.restoreDNS(); err != nil {
-			flog.Warnf("TUN DNS: failed to restore DNS: %v", err)
+			log.Warnf("TUN DNS: failed to restore DNS: %v", err)
 		} else {
-			flog.Infof("TUN DNS: restored original DNS settings")
+			log.Infof("TUN DNS: restored original DNS settings")
 		}
 	}
 
@@ -112,29 +129,67 @@ func (r *darwinRouteManager) removeRoutes() error {
 	_ = run("route", "delete", "default")
 	save(run("route", "add", "default", r.origGateway))
 
+	// Remove IPv6 default routes into the TUN.
+	if r.tunName6 != "" {
+		for _, half := range []string{"::/1", "8000::/1"} {
+			save(run("route", "delete", "-inet6", "-net", half, "-interface", r.tunName6))
+		}
+	}
+
 	// Remove server-specific route.
-	save(run("route", "delete", "-host", r.serverIP))
+	if addr, err := netip.ParseAddr(r.serverIP); err == nil {
+		save(run("route", routeArgs("delete", netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))...))
+	}
 
 	// Remove excluded routes.
 	for _, cidr := range r.excludes {
 		pfx, _ := netip.ParsePrefix(cidr)
-		if pfx.IsSingleIP() {
-			save(run("route", "delete", "-host", pfx.Addr().String()))
-		} else {
-			save(run("route", "delete", "-net", cidr))
-		}
+		save(run("route", routeArgs("delete", pfx)...))
 	}
 
 	if firstErr != nil {
-		flog.Errorf("TUN route: errors during route cleanup: %v", firstErr)
+		log.Errorf("TUN route: errors during route cleanup: %v", firstErr)
 	} else {
-		flog.Infof("TUN route: restored original default gateway %s", r.origGateway)
+		log.Infof("TUN route: restored original default gateway %s", r.origGateway)
 	}
 	return firstErr
 }
 
-func (r *darwinRouteManager) getDefaultGateway() (string, string, error) {
-	out, err := exec.Command("route", "-n", "get", "default").Output()
+// addGatewayRoute routes pfx through the original default gateway of its
+// IP version.
+func (r *darwinRouteManager) addGatewayRoute(pfx netip.Prefix) error {
+	gw := r.origGateway
+	if pfx.Addr().Is6() {
+		if r.origGateway6 == "" {
+			gw6, _, err := r.getDefaultGateway(true)
+			if err != nil {
+				return fmt.Errorf("failed to get IPv6 default gateway: %w", err)
+			}
+			r.origGateway6 = gw6
+		}
+		gw = r.origGateway6
+	}
+	return run("route", append(routeArgs("add", pfx), gw)...)
+}
+
+// routeArgs are the route(8) arguments for pfx, without the gateway.
+func routeArgs(verb string, pfx netip.Prefix) []string {
+	args := []string{verb}
+	if pfx.Addr().Is6() {
+		args = append(args, "-inet6")
+	}
+	if pfx.IsSingleIP() {
+		return append(args, "-host", pfx.Addr().String())
+	}
+	return append(args, "-net", pfx.Masked().String())
+}
+
+func (r *darwinRouteManager) getDefaultGateway(inet6 bool) (string, string, error) {
+	args := []string{"-n", "get", "default"}
+	if inet6 {
+		args = []string{"-n", "get", "-inet6", "default"}
+	}
+	out, err := exec.Command("route", args...).Output()
 	if err != nil {
 		return "", "", err
 	}
@@ -175,7 +230,7 @@ func (r *darwinRouteManager) setupDNS(iface, dnsIP string) error {
 
 	// Save original DNS settings.
 	r.origDNS = r.getCurrentDNS(service)
-	flog.Debugf("TUN DNS: original DNS for %s: %v", service, r.origDNS)
+	log.Debugf("TUN DNS: original DNS for %s: %v", service, r.origDNS)
 
 	// Set new DNS.
 	if err := run("networksetup", "-setdnsservers", service, dnsIP); err != nil {
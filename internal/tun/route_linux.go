@@ -3,10 +3,15 @@
 package tun
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
 	"os/exec"
-	"paqet/internal/flog"
+	"paqet/internal/conf"
 	"strings"
+	"syscall"
 
 	wgtun "golang.zx2c4.com/wireguard/tun"
 )
@@ -20,111 +25,261 @@ func run(name string, args ...string) error {
 	return nil
 }
 
+// linuxRouteManager configures the TUN device, routes and DNS over
+// netlink. The default route is left alone: a pair of /1 routes into the
+// device per IP version is more specific, goes away with the device if
+// paqet dies, and leaves sockets bound to the network interface a route
+// out. With tun.apps the device routes go into a table of their own
+// instead, which policy rules select by the mark netfilter gives the
+// applications' packets. Everything else it changes is recorded in the
+// state file first, for Cleanup.
 type linuxRouteManager struct {
-	origGateway string
-	origIface   string
-	serverIP    string
-	tunName     string
-	tunAddr     string
-	excludes    []string
+	state *tunState
 }
 
 func newRouteManager() routeManager {
 	return &linuxRouteManager{}
 }
 
-func (r *linuxRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, serverIP, dnsIP string, excludes []string) error {
-	r.serverIP = serverIP
-	r.tunName = tunName
-	r.tunAddr = tunAddr
-	r.excludes = excludes
-	// TODO: Implement DNS configuration for Linux (modify /etc/resolv.conf or use resolvconf)
-	_ = dnsIP
+func (r *linuxRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, tunAddr6, serverIP, dnsIP string, excludes []string, mark int, apps *conf.TUNApps) error {
+	if st, err := loadState(); err == nil {
+		log.Warnf("TUN route: restoring routes and DNS left by an unclean exit")
+		if err := st.restore(); err != nil {
+			log.Warnf("TUN route: %v", err)
+		}
+	}
 
-	// Get the current default gateway.
-	gw, iface, err := r.getDefaultGateway()
+	prefix, err := netip.ParsePrefix(tunAddr)
 	if err != nil {
-		return fmt.Errorf("failed to get default gateway: %w", err)
+		return fmt.Errorf("invalid TUN address: %w", err)
 	}
-	r.origGateway = gw
-	r.origIface = iface
-	flog.Infof("TUN route: original default gateway %s dev %s", gw, iface)
-
-	// Assign address and bring up TUN interface.
-	if err := run("ip", "addr", "add", tunAddr, "dev", tunName); err != nil {
-		return fmt.Errorf("failed to add address to TUN: %w", err)
+	prefixes := []netip.Prefix{prefix}
+	halves := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/1"), netip.MustParsePrefix("128.0.0.0/1")}
+	var rules []policyRule
+	if apps != nil {
+		halves = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}
+		rules = appRules(apps, false)
 	}
-	if err := run("ip", "link", "set", "dev", tunName, "up"); err != nil {
-		return fmt.Errorf("failed to bring up TUN: %w", err)
+	if tunAddr6 != "" {
+		prefix6, err := netip.ParsePrefix(tunAddr6)
+		if err != nil {
+			return fmt.Errorf("invalid TUN IPv6 address: %w", err)
+		}
+		prefixes = append(prefixes, prefix6)
+		if apps != nil {
+			halves = append(halves, netip.MustParsePrefix("::/0"))
+			rules = append(rules, appRules(apps, true)...)
+		} else {
+			halves = append(halves, netip.MustParsePrefix("::/1"), netip.MustParsePrefix("8000::/1"))
+		}
+	}
+	table := mainTable
+	if apps != nil {
+		table = apps.Table
+	}
+	server, err := netip.ParseAddr(serverIP)
+	if err != nil {
+		return fmt.Errorf("invalid server address: %w", err)
+	}
+	server = server.Unmap()
+	tun, err := net.InterfaceByName(tunName)
+	if err != nil {
+		return err
 	}
 
-	// Route server IP through original gateway to prevent loop.
-	if err := run("ip", "route", "add", serverIP+"/32", "via", gw, "dev", iface); err != nil {
-		return fmt.Errorf("failed to add server route: %w", err)
+	// Exceptions leave through the original default route of their family.
+	type gateway struct {
+		addr netip.Addr
+		dev  *net.Interface
+	}
+	gateways := map[bool]gateway{}
+	gatewayFor := func(a netip.Addr) (gateway, error) {
+		if gw, ok := gateways[a.Is4()]; ok {
+			return gw, nil
+		}
+		addr, dev, err := defaultRoute(a, tunName)
+		if err != nil {
+			return gateway{}, fmt.Errorf("failed to get default gateway: %w", err)
+		}
+		if addr.IsValid() {
+			log.Infof("TUN route: original default gateway %s dev %s", addr, dev.Name)
+		} else {
+			log.Infof("TUN route: original default route dev %s", dev.Name)
+		}
+		gw := gateway{addr, dev}
+		gateways[a.Is4()] = gw
+		return gw, nil
 	}
 
-	// Route excluded CIDRs through original gateway (e.g., SSH source IPs).
+	type route struct {
+		dst netip.Prefix
+		gw  gateway
+	}
+	routes := []route{{dst: netip.PrefixFrom(server, server.BitLen())}}
 	for _, cidr := range excludes {
-		if err := run("ip", "route", "add", cidr, "via", gw, "dev", iface); err != nil {
-			return fmt.Errorf("failed to add exclude route for %s: %w", cidr, err)
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid exclude %q: %w", cidr, err)
 		}
-		flog.Infof("TUN route: excluded %s via %s dev %s", cidr, gw, iface)
+		routes = append(routes, route{dst: p.Masked()})
 	}
-
-	// Replace default route with TUN.
-	if err := run("ip", "route", "replace", "default", "dev", tunName); err != nil {
-		return fmt.Errorf("failed to set default route via TUN: %w", err)
+	for i := range routes {
+		gw, err := gatewayFor(routes[i].dst.Addr())
+		if err != nil {
+			return err
+		}
+		routes[i].gw = gw
 	}
+	st := &tunState{Device: tunName}
+	for _, rt := range routes {
+		st.Routes = append(st.Routes, savedRoute{Dst: rt.dst.String(), Dev: rt.gw.dev.Name})
+	}
+	for _, h := range halves {
+		st.Routes = append(st.Routes, savedRoute{Dst: h.String(), Dev: tunName, Table: table})
+	}
+	st.Rules = rules
+	st.AppMarks = apps != nil
+	if apps != nil {
+		if st.SrcValidMark, err = readSrcValidMark(); err != nil {
+			return err
+		}
+	}
+	if err := saveState(st); err != nil {
+		return fmt.Errorf("failed to save TUN state: %w", err)
+	}
+	r.state = st
 
-	flog.Infof("TUN route: default route via %s, server %s via %s dev %s", tunName, serverIP, gw, iface)
-	return nil
-}
-
-func (r *linuxRouteManager) removeRoutes() error {
-	var firstErr error
-	save := func(err error) {
-		if err != nil && firstErr == nil {
-			firstErr = err
+	// Assign addresses and bring up TUN interface.
+	for _, p := range prefixes {
+		if err := addAddr(tun.Index, p); err != nil {
+			return fmt.Errorf("failed to add address %s to TUN: %w", p, err)
 		}
 	}
+	if err := setLinkUp(tun.Index); err != nil {
+		return fmt.Errorf("failed to bring up TUN: %w", err)
+	}
 
-	// Restore original default route.
-	save(run("ip", "route", "replace", "default", "via", r.origGateway, "dev", r.origIface))
+	// Route the server and excluded CIDRs (e.g., SSH source IPs) through
+	// the original gateway, the server to prevent a loop.
+	for _, rt := range routes {
+		if err := addRoute(rt.dst, rt.gw.addr, rt.gw.dev.Index, mainTable); err != nil {
+			return fmt.Errorf("failed to add route for %s: %w", rt.dst, err)
+		}
+		if rt.dst.Addr() != server {
+			log.Infof("TUN route: excluded %s dev %s", rt.dst, rt.gw.dev.Name)
+		}
+	}
 
-	// Remove server-specific route.
-	save(run("ip", "route", "delete", r.serverIP+"/32"))
+	for _, h := range halves {
+		if err := addRoute(h, netip.Addr{}, tun.Index, table); err != nil {
+			return fmt.Errorf("failed to route %s via TUN: %w", h, err)
+		}
+	}
+	if apps != nil {
+		if err := (&appMarker{apps: apps, direct: mark}).install(); err != nil {
+			return fmt.Errorf("failed to mark tun.apps packets: %w", err)
+		}
+		for _, rule := range rules {
+			if err := addRule(rule); err != nil {
+				return fmt.Errorf("failed to add routing rule %d: %w", rule.Priority, err)
+			}
+		}
+		log.Infof("TUN route: %s tun.apps traffic via %s (mark 0x%x, table %d), server %s dev %s",
+			apps.Mode, tunName, apps.Mark, apps.Table, server, gateways[server.Is4()].dev.Name)
+	} else {
+		log.Infof("TUN route: default traffic via %s, server %s dev %s", tunName, server, gateways[server.Is4()].dev.Name)
+	}
 
-	// Remove excluded routes.
-	for _, cidr := range r.excludes {
-		save(run("ip", "route", "delete", cidr))
+	// With only some applications in the tunnel, the resolver serves the
+	// rest too and keeps the system's servers.
+	if dnsIP != "" && apps != nil && apps.Mode == "include" {
+		log.Infof("TUN DNS: system DNS left unchanged for tun.apps mode include")
+	} else if dnsIP != "" {
+		ip, err := netip.ParseAddr(dnsIP)
+		if err != nil {
+			return fmt.Errorf("invalid DNS address: %w", err)
+		}
+		if err := setDNS(st, tun, ip); err != nil {
+			log.Warnf("TUN DNS: failed to configure system DNS: %v", err)
+		} else {
+			log.Infof("TUN DNS: system DNS set to %s (%s)", ip, st.DNS)
+		}
 	}
+	return nil
+}
 
-	if firstErr != nil {
-		flog.Errorf("TUN route: errors during route cleanup: %v", firstErr)
+func (r *linuxRouteManager) removeRoutes() error {
+	if r.state == nil {
+		return nil
+	}
+	err := r.state.restore()
+	if err != nil {
+		log.Errorf("TUN route: errors during route cleanup: %v", err)
 	} else {
-		flog.Infof("TUN route: restored original default gateway %s dev %s", r.origGateway, r.origIface)
+		log.Infof("TUN route: removed tunnel routes and restored DNS")
 	}
-	return firstErr
+	return err
 }
 
-func (r *linuxRouteManager) getDefaultGateway() (string, string, error) {
-	out, err := exec.Command("ip", "route", "show", "default").Output()
+// Cleanup undoes the route and DNS changes of a TUN client that did not
+// exit cleanly, from the state file it keeps.
+func Cleanup() error {
+	st, err := loadState()
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Infof("TUN cleanup: no state in %s, nothing to restore", stateFile)
+		return nil
+	}
 	if err != nil {
-		return "", "", err
+		return err
+	}
+	if err := st.restore(); err != nil {
+		return err
+	}
+	log.Infof("TUN cleanup: restored routes and DNS changed for %s", st.Device)
+	return nil
+}
+
+// restore deletes the recorded rules and routes, reverts DNS and removes
+// the state file. Routes out of a device that is gone went away with it.
+func (st *tunState) restore() error {
+	var errs []error
+	if err := restoreDNS(st); err != nil {
+		errs = append(errs, fmt.Errorf("failed to restore DNS: %w", err))
+	}
+	for _, rule := range st.Rules {
+		if err := delRule(rule); err != nil && !errors.Is(err, syscall.ENOENT) {
+			errs = append(errs, fmt.Errorf("failed to delete routing rule %d: %w", rule.Priority, err))
+		}
+	}
+	if st.AppMarks {
+		removeAppMarks()
+	}
+	if st.SrcValidMark != "" {
+		if err := restoreSrcValidMark(st.SrcValidMark); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	// Expected: "default via 192.168.1.1 dev eth0 ..."
-	parts := strings.Fields(string(out))
-	var gateway, iface string
-	for i, p := range parts {
-		if p == "via" && i+1 < len(parts) {
-			gateway = parts[i+1]
+	for _, rt := range st.Routes {
+		dst, err := netip.ParsePrefix(rt.Dst)
+		if err != nil {
+			continue
 		}
-		if p == "dev" && i+1 < len(parts) {
-			iface = parts[i+1]
+		dev, err := net.InterfaceByName(rt.Dev)
+		if err != nil {
+			continue
+		}
+		table := rt.Table
+		if table == 0 {
+			table = mainTable
+		}
+		if err := delRoute(dst, dev.Index, table); err != nil && !errors.Is(err, syscall.ESRCH) {
+			errs = append(errs, fmt.Errorf("failed to delete route %s dev %s: %w", dst, rt.Dev, err))
 		}
 	}
-	if gateway == "" {
-		return "", "", fmt.Errorf("could not determine default gateway")
+	if len(errs) == 0 {
+		if err := removeState(); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	return gateway, iface, nil
+	return errors.Join(errs...)
 }
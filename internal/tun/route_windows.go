@@ -7,7 +7,7 @@ import (
 	"net"
 	"net/netip"
 	"os/exec"
-	"paqet/internal/flog"
+	"paqet/internal/conf"
 	"strconv"
 	"strings"
 
@@ -22,13 +22,14 @@ type windowsRouteManager struct {
 	ifIndex     int
 	dnsIP       string
 	excludes    []string
+	ipv6        bool // IPv6 default traffic is routed into the TUN
 }
 
 func newRouteManager() routeManager {
 	return &windowsRouteManager{}
 }
 
-func (r *windowsRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, serverIP, dnsIP string, excludes []string) error {
+func (r *windowsRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, tunAddr6, serverIP, dnsIP string, excludes []string, _ int, _ *conf.TUNApps) error {
 	r.serverIP = serverIP
 	r.tunAddr = tunAddr
 	r.tunName = tunName
@@ -41,7 +42,7 @@ func (r *windowsRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, server
 		return fmt.Errorf("failed to get TUN interface: %w", err)
 	}
 	r.ifIndex = iface.Index
-	flog.Debugf("TUN interface index: %d", r.ifIndex)
+	log.Debugf("TUN interface index: %d", r.ifIndex)
 
 	prefix, err := netip.ParsePrefix(tunAddr)
 	if err != nil {
@@ -56,7 +57,7 @@ func (r *windowsRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, server
 		return fmt.Errorf("failed to get default gateway: %w", err)
 	}
 	r.origGateway = gw
-	flog.Infof("TUN route: original default gateway %s", gw)
+	log.Infof("TUN route: original default gateway %s", gw)
 
 	// Route server IP through original gateway to prevent loop.
 	if err := runWin("route", "add", serverIP, "mask", "255.255.255.255", gw); err != nil {
@@ -66,11 +67,15 @@ func (r *windowsRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, server
 	// Route excluded CIDRs through original gateway (e.g., SSH source IPs).
 	for _, cidr := range excludes {
 		pfx, _ := netip.ParsePrefix(cidr)
+		if pfx.Addr().Is6() {
+			log.Warnf("TUN route: IPv6 exclude %s is not supported on Windows, skipped", cidr)
+			continue
+		}
 		mask := net.CIDRMask(pfx.Bits(), pfx.Addr().BitLen())
 		if err := runWin("route", "add", pfx.Masked().Addr().String(), "mask", net.IP(mask).String(), gw); err != nil {
 			return fmt.Errorf("failed to add exclude route for %s: %w", cidr, err)
 		}
-		flog.Infof("TUN route: excluded %s via %s", cidr, gw)
+		log.Infof("TUN route: excluded %s via %s", cidr, gw)
 	}
 
 	// Use two /1 routes to capture all traffic, specifying the TUN interface index.
@@ -81,16 +86,32 @@ func (r *windowsRouteManager) addRoutes(_ wgtun.Device, tunName, tunAddr, server
 		return fmt.Errorf("failed to add 128.0.0.0/1 route: %w", err)
 	}
 
+	// Likewise for IPv6, after giving the TUN its address.
+	if tunAddr6 != "" {
+		if _, err := netip.ParsePrefix(tunAddr6); err != nil {
+			return fmt.Errorf("invalid TUN IPv6 address: %w", err)
+		}
+		if err := runWin("netsh", "interface", "ipv6", "add", "address", "interface="+ifStr, "address="+tunAddr6, "store=active"); err != nil {
+			return fmt.Errorf("failed to add TUN IPv6 address: %w", err)
+		}
+		r.ipv6 = true
+		for _, half := range []string{"::/1", "8000::/1"} {
+			if err := runWin("netsh", "interface", "ipv6", "add", "route", "prefix="+half, "interface="+ifStr, "metric=5", "store=active"); err != nil {
+				return fmt.Errorf("failed to add %s route: %w", half, err)
+			}
+		}
+	}
+
 	// Configure DNS on the TUN interface.
 	if dnsIP != "" {
 		if err := r.setupDNS(tunName, dnsIP); err != nil {
-			flog.Warnf("TUN DNS: failed to configure: %v", err)
+			log.Warnf("TUN DNS: failed to configure: %v", err)
 		} else {
-			flog.Infof("TUN DNS: set to %s on %s", dnsIP, tunName)
+			log.Infof("TUN DNS: set to %s on %s", dnsIP, tunName)
 		}
 	}
 
-	flog.Infof("TUN route: default route via %s (%s, IF %d), server %s via %s", ip, tunName, r.ifIndex, serverIP, gw)
+	log.Infof("TUN route: default route via %s (%s, IF %d), server %s via %s", ip, tunName, r.ifIndex, serverIP, gw)
 	return nil
 }
 
@@ -105,9 +126,9 @@ func (r *windowsRouteManager) removeRoutes() error {
 	// Restore DNS settings.
 	if r.dnsIP != "" && r.tunName != "" {
 		if err := r.restoreDNS(); err != nil {
-			flog.Warnf("TUN DNS: failed to restore: %v", err)
+			log.Warnf("TUN DNS: failed to restore: %v", err)
 		} else {
-			flog.Infof("TUN DNS: restored")
+			log.Infof("TUN DNS: restored")
 		}
 	}
 
@@ -115,19 +136,28 @@ func (r *windowsRouteManager) removeRoutes() error {
 	save(runWin("route", "delete", "0.0.0.0", "mask", "128.0.0.0"))
 	save(runWin("route", "delete", "128.0.0.0", "mask", "128.0.0.0"))
 
+	if r.ipv6 {
+		ifStr := strconv.Itoa(r.ifIndex)
+		save(runWin("netsh", "interface", "ipv6", "delete", "route", "prefix=::/1", "interface="+ifStr))
+		save(runWin("netsh", "interface", "ipv6", "delete", "route", "prefix=8000::/1", "interface="+ifStr))
+	}
+
 	// Remove server-specific route.
 	save(runWin("route", "delete", r.serverIP))
 
 	// Remove excluded routes.
 	for _, cidr := range r.excludes {
 		pfx, _ := netip.ParsePrefix(cidr)
+		if pfx.Addr().Is6() {
+			continue
+		}
 		save(runWin("route", "delete", pfx.Masked().Addr().String()))
 	}
 
 	if firstErr != nil {
-		flog.Errorf("TUN route: errors during route cleanup: %v", firstErr)
+		log.Errorf("TUN route: errors during route cleanup: %v", firstErr)
 	} else {
-		flog.Infof("TUN route: restored original routes")
+		log.Infof("TUN route: restored original routes")
 	}
 	return firstErr
 }
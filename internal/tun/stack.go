@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/netip"
-	"paqet/internal/flog"
+	"sync"
 
 	wgtun "golang.zx2c4.com/wireguard/tun"
 	"gvisor.dev/gvisor/pkg/buffer"
@@ -27,9 +27,18 @@ type netStack struct {
 	s   *stack.Stack
 	ep  *channel.Endpoint
 	dev wgtun.Device
+
+	// intercept sees every packet read from the device before gVisor does
+	// and returns true if it took the packet. It must not keep pkt.
+	intercept func(pkt []byte) bool
+
+	wmu  sync.Mutex // serializes device writes
+	wbuf []byte
 }
 
-func newNetStack(dev wgtun.Device, prefix netip.Prefix, mtu int) (*netStack, error) {
+// newNetStack creates a gVisor stack on dev with the given addresses, one
+// per IP version.
+func newNetStack(dev wgtun.Device, prefixes []netip.Prefix, mtu int) (*netStack, error) {
 	s := stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
@@ -39,17 +48,17 @@ func newNetStack(dev wgtun.Device, prefix netip.Prefix, mtu int) (*netStack, err
 	// Increase send buffer: min 4KB, default 4MB, max 16MB.
 	tcpSendBufOpt := tcpip.TCPSendBufferSizeRangeOption{Min: 4 << 10, Default: 4 << 20, Max: 16 << 20}
 	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &tcpSendBufOpt); err != nil {
-		flog.Warnf("failed to set TCP send buffer size: %v", err)
+		log.Warnf("failed to set TCP send buffer size: %v", err)
 	}
 	// Increase receive buffer: min 4KB, default 4MB, max 16MB.
 	tcpRecvBufOpt := tcpip.TCPReceiveBufferSizeRangeOption{Min: 4 << 10, Default: 4 << 20, Max: 16 << 20}
 	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &tcpRecvBufOpt); err != nil {
-		flog.Warnf("failed to set TCP receive buffer size: %v", err)
+		log.Warnf("failed to set TCP receive buffer size: %v", err)
 	}
 	// Enable SACK for better loss recovery.
 	sackOpt := tcpip.TCPSACKEnabled(true)
 	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sackOpt); err != nil {
-		flog.Warnf("failed to enable TCP SACK: %v", err)
+		log.Warnf("failed to enable TCP SACK: %v", err)
 	}
 
 	ep := channel.New(channelEndpointSz, uint32(mtu), "")
@@ -58,15 +67,17 @@ func newNetStack(dev wgtun.Device, prefix netip.Prefix, mtu int) (*netStack, err
 		return nil, fmt.Errorf("failed to create NIC: %v", err)
 	}
 
-	addr := prefix.Addr()
-	a4 := addr.As4()
-	protoAddr := tcpip.ProtocolAddress{
-		Protocol:          ipv4.ProtocolNumber,
-		AddressWithPrefix: tcpip.AddrFrom4(a4).WithPrefix(),
-	}
-	protoAddr.AddressWithPrefix.PrefixLen = prefix.Bits()
-	if err := s.AddProtocolAddress(nicID, protoAddr, stack.AddressProperties{}); err != nil {
-		return nil, fmt.Errorf("failed to add address: %v", err)
+	for _, prefix := range prefixes {
+		protoAddr := tcpip.ProtocolAddress{
+			Protocol:          ipv4.ProtocolNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{Address: tcpip.AddrFromSlice(prefix.Addr().AsSlice()), PrefixLen: prefix.Bits()},
+		}
+		if prefix.Addr().Is6() {
+			protoAddr.Protocol = ipv6.ProtocolNumber
+		}
+		if err := s.AddProtocolAddress(nicID, protoAddr, stack.AddressProperties{}); err != nil {
+			return nil, fmt.Errorf("failed to add address %s: %v", prefix, err)
+		}
 	}
 
 	// Route all traffic through this NIC.
@@ -78,7 +89,8 @@ func newNetStack(dev wgtun.Device, prefix netip.Prefix, mtu int) (*netStack, err
 	s.SetPromiscuousMode(nicID, true)
 	s.SetSpoofing(nicID, true)
 
-	return &netStack{s: s, ep: ep, dev: dev}, nil
+	// 65536 + tunOffset covers the maximum IP packet size.
+	return &netStack{s: s, ep: ep, dev: dev, wbuf: make([]byte, tunOffset+65536)}, nil
 }
 
 // tunToStack reads raw IP packets from the TUN device and injects them into gVisor.
@@ -99,12 +111,15 @@ func (ns *netStack) tunToStack(ctx context.Context) {
 			if ctx.Err() != nil {
 				return
 			}
-			flog.Errorf("TUN read error: %v", err)
+			log.Errorf("TUN read error: %v", err)
 			continue
 		}
 		if n == 0 || sizes[0] == 0 {
 			continue
 		}
+		if ns.intercept != nil && ns.intercept(bufs[0][tunOffset:tunOffset+sizes[0]]) {
+			continue
+		}
 
 		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
 			Payload: buffer.MakeWithData(bufs[0][tunOffset : tunOffset+sizes[0]]),
@@ -125,11 +140,6 @@ func (ns *netStack) tunToStack(ctx context.Context) {
 
 // stackToTun reads packets from the gVisor endpoint and writes them to the TUN device.
 func (ns *netStack) stackToTun(ctx context.Context) {
-	// Pre-allocate a reusable write buffer to avoid per-packet allocation.
-	// 65536 + tunOffset covers the maximum IP packet size.
-	buf := make([]byte, tunOffset+65536)
-	bufs := [][]byte{buf}
-
 	for {
 		pkt := ns.ep.ReadContext(ctx)
 		if pkt == nil {
@@ -137,22 +147,28 @@ func (ns *netStack) stackToTun(ctx context.Context) {
 		}
 
 		view := pkt.ToView()
-		data := view.AsSlice()
-		n := len(data)
-
-		copy(buf[tunOffset:], data)
-		bufs[0] = buf[:tunOffset+n]
-		if _, err := ns.dev.Write(bufs, tunOffset); err != nil {
+		if err := ns.writePacket(view.AsSlice()); err != nil {
 			if ctx.Err() != nil {
 				pkt.DecRef()
 				return
 			}
-			flog.Errorf("TUN write error: %v", err)
+			log.Errorf("TUN write error: %v", err)
 		}
 		pkt.DecRef()
 	}
 }
 
+// writePacket writes one raw IP packet to the TUN device. It is shared by
+// the gVisor output path and packets built outside the stack.
+func (ns *netStack) writePacket(data []byte) error {
+	ns.wmu.Lock()
+	defer ns.wmu.Unlock()
+	// Reuse one write buffer to avoid per-packet allocation.
+	n := copy(ns.wbuf[tunOffset:], data)
+	_, err := ns.dev.Write([][]byte{ns.wbuf[:tunOffset+n]}, tunOffset)
+	return err
+}
+
 func (ns *netStack) close() {
 	ns.s.Close()
 	ns.ep.Close()
@@ -0,0 +1,66 @@
+//go:build linux
+
+package tun
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// stateFile lives on tmpfs, like the routes it describes: neither
+// survives a reboot.
+const stateFile = "/run/paqet/tun.json"
+
+// tunState is what a TUN client changed on the system.
+type tunState struct {
+	Device       string       `json:"device"`
+	Routes       []savedRoute `json:"routes"`
+	Rules        []policyRule `json:"rules,omitempty"`          // tun.apps routing rules
+	AppMarks     bool         `json:"app_marks,omitempty"`      // tun.apps netfilter rules installed
+	SrcValidMark string       `json:"src_valid_mark,omitempty"` // original net.ipv4.conf.all.src_valid_mark
+	DNS          string       `json:"dns,omitempty"`            // how DNS was set: resolved, resolvconf or file
+	ResolvConf   string       `json:"resolv_conf,omitempty"`    // original /etc/resolv.conf, for file
+}
+
+type savedRoute struct {
+	Dst   string `json:"dst"`
+	Dev   string `json:"dev"`
+	Table int    `json:"table,omitempty"` // 0 for main
+}
+
+func saveState(st *tunState) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0o755); err != nil {
+		return err
+	}
+	tmp := stateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFile)
+}
+
+func loadState() (*tunState, error) {
+	b, err := os.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	var st tunState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func removeState() error {
+	if err := os.Remove(stateFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
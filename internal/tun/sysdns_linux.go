@@ -0,0 +1,117 @@
+//go:build linux
+
+package tun
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Ways setDNS can configure the system resolver.
+const (
+	dnsResolved   = "resolved"
+	dnsResolvconf = "resolvconf"
+	dnsFile       = "file"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+// setDNS points the system resolver at ip through dev: with
+// systemd-resolved over D-Bus if it runs, else with resolvconf, else by
+// rewriting /etc/resolv.conf. The method, and the file it replaces, are
+// saved in st before anything changes.
+func setDNS(st *tunState, dev *net.Interface, ip netip.Addr) error {
+	switch {
+	case resolvedRunning():
+		st.DNS = dnsResolved
+	case hasCommand("resolvconf"):
+		st.DNS = dnsResolvconf
+	default:
+		orig, err := os.ReadFile(resolvConf)
+		if err != nil {
+			return err
+		}
+		st.DNS, st.ResolvConf = dnsFile, string(orig)
+	}
+	if err := saveState(st); err != nil {
+		return err
+	}
+
+	switch st.DNS {
+	case dnsResolved:
+		return resolvedSetLink(dev.Index, ip)
+	case dnsResolvconf:
+		cmd := exec.Command("resolvconf", "-a", dev.Name)
+		cmd.Stdin = strings.NewReader("nameserver " + ip.String() + "\n")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvconf -a %s: %s: %w", dev.Name, strings.TrimSpace(string(out)), err)
+		}
+		return nil
+	default:
+		return os.WriteFile(resolvConf, []byte("# Written by paqet for "+dev.Name+", restored when the tunnel closes\nnameserver "+ip.String()+"\n"), 0o644)
+	}
+}
+
+// restoreDNS reverts setDNS. resolved drops the settings of a link that
+// is gone by itself.
+func restoreDNS(st *tunState) error {
+	switch st.DNS {
+	case dnsResolved:
+		dev, err := net.InterfaceByName(st.Device)
+		if err != nil {
+			return nil
+		}
+		return resolvedCall("RevertLink", "i", strconv.Itoa(dev.Index))
+	case dnsResolvconf:
+		return run("resolvconf", "-d", st.Device)
+	case dnsFile:
+		return os.WriteFile(resolvConf, []byte(st.ResolvConf), 0o644)
+	}
+	return nil
+}
+
+func resolvedRunning() bool {
+	if _, err := os.Stat("/run/systemd/resolve"); err != nil {
+		return false
+	}
+	return hasCommand("busctl")
+}
+
+// resolvedSetLink makes ip the DNS server of the link and routes every
+// lookup to it with the "~." domain, ahead of the physical links.
+func resolvedSetLink(index int, ip netip.Addr) error {
+	link := strconv.Itoa(index)
+	family := "2" // AF_INET
+	if ip.Is6() {
+		family = "10" // AF_INET6
+	}
+	addr := ip.AsSlice()
+	args := []string{link, "1", family, strconv.Itoa(len(addr))}
+	for _, b := range addr {
+		args = append(args, strconv.Itoa(int(b)))
+	}
+	if err := resolvedCall("SetLinkDNS", "ia(iay)", args...); err != nil {
+		return err
+	}
+	if err := resolvedCall("SetLinkDomains", "ia(sb)", link, "1", "~.", "true"); err != nil {
+		return err
+	}
+	_ = resolvedCall("SetLinkDefaultRoute", "ib", link, "true") // systemd 240 and later
+	return nil
+}
+
+// resolvedCall calls a method of the resolve1 Manager D-Bus interface.
+func resolvedCall(method, signature string, args ...string) error {
+	return run("busctl", append([]string{"call", "org.freedesktop.resolve1", "/org/freedesktop/resolve1",
+		"org.freedesktop.resolve1.Manager", method, signature}, args...)...)
+}
+
+func hasCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
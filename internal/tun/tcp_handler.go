@@ -2,10 +2,16 @@ package tun
 
 import (
 	"context"
-	"fmt"
 	"net"
-	"paqet/internal/flog"
+	"net/netip"
+	"paqet/internal/accesslog"
+	"paqet/internal/client"
+	"paqet/internal/conf"
+	"paqet/internal/dns"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/sniff"
+	"strconv"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
@@ -18,53 +24,97 @@ func (t *TUN) setupTCPForwarder() {
 	fwd := tcp.NewForwarder(t.ns.s, 4<<20, 65535, func(r *tcp.ForwarderRequest) {
 		id := r.ID()
 		dstIP := addrToNetIP(id.LocalAddress)
-		if !t.filter.shouldForward(dstIP) {
-			r.Complete(true) // RST — don't tunnel this traffic
+		if t.resolver != nil && t.filter.shouldForwardDNS(dstIP, id.LocalPort) {
+			var wq waiter.Queue
+			ep, err := r.CreateEndpoint(&wq)
+			if err != nil {
+				r.Complete(true)
+				return
+			}
+			r.Complete(false)
+			go dns.ServeStream(t.ctx, gonet.NewTCPConn(&wq, ep), t.answerDNS)
+			return
+		}
+		targetAddr, ok := t.fakeTarget(id.LocalAddress, id.LocalPort)
+		if !ok {
+			if !t.filter.shouldForward(dstIP) {
+				r.Complete(true) // RST — don't tunnel this traffic
+				return
+			}
+			targetAddr = joinAddr(id.LocalAddress, id.LocalPort)
+		} else if targetAddr == "" {
+			r.Complete(true) // RST — fake IP with no name behind it
+			return
+		}
+		if t.client.Route(inbound, targetAddr) == conf.RouteBlock {
+			r.Complete(true) // RST — blocked by routing rules
 			return
 		}
-		targetAddr := fmt.Sprintf("%s:%d", dstIP, id.LocalPort)
 
 		var wq waiter.Queue
 		ep, err := r.CreateEndpoint(&wq)
 		if err != nil {
-			flog.Errorf("TUN TCP: failed to create endpoint for %s: %v", targetAddr, err)
+			log.Errorf("TUN TCP: failed to create endpoint for %s: %v", targetAddr, err)
 			r.Complete(true)
 			return
 		}
 		r.Complete(false)
 
 		conn := gonet.NewTCPConn(&wq, ep)
-		go t.handleTCP(t.ctx, conn, targetAddr)
+		go t.handleTCP(t.ctx, conn, targetAddr, t.cfg.Sniff && !ok)
 	})
 	t.ns.s.SetTransportProtocolHandler(tcp.ProtocolNumber, fwd.HandlePacket)
 }
 
-func (t *TUN) handleTCP(ctx context.Context, conn net.Conn, targetAddr string) {
+// handleTCP relays conn to targetAddr. With sniff set, a hostname in the
+// first bytes replaces the IP of targetAddr.
+func (t *TUN) handleTCP(ctx context.Context, conn net.Conn, targetAddr string, sniffHost bool) {
 	defer conn.Close()
 
-	strm, err := t.client.TCP(targetAddr)
+	start := time.Now()
+	if sniffHost {
+		var host string
+		host, conn = sniff.Peek(conn)
+		targetAddr = sniff.Override(targetAddr, host)
+	}
+	tstrm, err := t.client.DialTCP(inbound, targetAddr)
 	if err != nil {
-		flog.Errorf("TUN TCP: failed to establish stream for %s: %v", targetAddr, err)
+		log.Errorf("TUN TCP: failed to establish stream for %s: %v", targetAddr, err)
 		return
 	}
-	defer strm.Close()
-	flog.Debugf("TUN TCP: stream %d established for %s", strm.SID(), targetAddr)
+	defer tstrm.Close()
+	log.Debugf("TUN TCP: stream %d established for %s", tstrm.SID(), targetAddr)
 
-	errCh := make(chan error, 2)
-	go func() {
-		errCh <- buffer.CopyT(conn, strm)
-	}()
-	go func() {
-		errCh <- buffer.CopyT(strm, conn)
+	typ := client.LogType(tstrm, "PTCP")
+	strm := accesslog.Count(tstrm)
+	var result error
+	defer func() {
+		accesslog.Stream(strm, "client", conn.RemoteAddr().String(), "", typ, targetAddr, start, accesslog.Reason(ctx, result))
 	}()
 
-	select {
-	case err := <-errCh:
-		if err != nil {
-			flog.Debugf("TUN TCP: stream %d closed for %s: %v", strm.SID(), targetAddr, err)
-		}
-	case <-ctx.Done():
+	result = buffer.Relay(ctx, conn, strm)
+	if result != nil {
+		log.Debugf("TUN TCP: stream %d closed for %s: %v", strm.SID(), targetAddr, result)
+	}
+}
+
+// fakeTarget maps a connection to a fake IP back to the name it was handed
+// out for. ok is false for real addresses; an empty addr means a fake IP
+// whose name is unknown, e.g. one cached from before a restart.
+func (t *TUN) fakeTarget(addr tcpip.Address, port uint16) (target string, ok bool) {
+	if t.fake == nil {
+		return "", false
+	}
+	ip, _ := netip.AddrFromSlice(addr.AsSlice())
+	if !t.fake.contains(ip) {
+		return "", false
+	}
+	name, found := t.fake.lookup(ip)
+	if !found {
+		log.Debugf("TUN: no name for fake IP %s", ip)
+		return "", true
 	}
+	return net.JoinHostPort(name, strconv.Itoa(int(port))), true
 }
 
 func addrToNetIP(addr tcpip.Address) net.IP {
@@ -76,6 +126,7 @@ func addrToNetIP(addr tcpip.Address) net.IP {
 	return net.IP(a[:])
 }
 
-func formatAddr(addr tcpip.Address) string {
-	return addrToNetIP(addr).String()
+// joinAddr formats addr and port as host:port, bracketing IPv6.
+func joinAddr(addr tcpip.Address, port uint16) string {
+	return net.JoinHostPort(addrToNetIP(addr).String(), strconv.Itoa(int(port)))
 }
@@ -3,39 +3,65 @@ package tun
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/netip"
 	"paqet/internal/client"
 	"paqet/internal/conf"
+	"paqet/internal/dns"
 	"paqet/internal/flog"
 	"sync"
+	"sync/atomic"
 
 	wgtun "golang.zx2c4.com/wireguard/tun"
 )
 
+var log = flog.Sub("tun")
+
+// inbound is the name routing rules match TUN traffic by.
+const inbound = "tun"
+
 type TUN struct {
 	client   *client.Client
 	cfg      *conf.TUN
 	serverIP string
+	server   netip.AddrPort
 	dev      wgtun.Device
 	devName  string
 	ns       *netStack
 	router   routeManager
 	filter   *filter
+	fake     *fakeDNS      // nil unless fake-IP DNS is enabled
+	resolver *dns.Resolver // answers DNS traffic when set
 	ctx      context.Context
 	cancel   context.CancelFunc
 	once     sync.Once
 	done     chan struct{}
+
+	icmpMu    sync.Mutex
+	icmpFlows map[icmpKey]*icmpFlow
+	icmpOff   atomic.Bool // set once the server turns out not to support PICMP
 }
 
-func New(c *client.Client, cfg *conf.TUN, serverIP string) (*TUN, error) {
-	return &TUN{
-		client:   c,
-		cfg:      cfg,
-		serverIP: serverIP,
-		router:   newRouteManager(),
-		filter:   newFilter(serverIP, cfg.DNS),
-		done:     make(chan struct{}),
-	}, nil
+func New(c *client.Client, cfg *conf.TUN, server *net.UDPAddr) (*TUN, error) {
+	serverIP := server.IP.String()
+	t := &TUN{
+		client:    c,
+		cfg:       cfg,
+		serverIP:  serverIP,
+		server:    server.AddrPort(),
+		router:    newRouteManager(),
+		filter:    newFilter(serverIP, cfg.DNS),
+		done:      make(chan struct{}),
+		icmpFlows: make(map[icmpKey]*icmpFlow),
+	}
+	if cfg.FakeIP != "" {
+		fake, err := newFakeDNS(cfg.FakeIP)
+		if err != nil {
+			return nil, err
+		}
+		t.fake = fake
+	}
+	return t, nil
 }
 
 func (t *TUN) Start(ctx context.Context) error {
@@ -48,26 +74,44 @@ func (t *TUN) Start(ctx context.Context) error {
 	}
 	t.dev = dev
 	t.devName = name
-	flog.Infof("TUN device created: %s (MTU %d)", name, t.cfg.MTU)
+	log.Infof("TUN device created: %s (MTU %d)", name, t.cfg.MTU)
+
+	// Block leaks before any traffic is routed into the device.
+	if t.cfg.KillSwitch {
+		if err := newKillSwitch(t.cfg, name, t.server).install(); err != nil {
+			t.dev.Close()
+			return fmt.Errorf("failed to enable kill switch: %w", err)
+		}
+	}
 
-	// Parse address prefix.
+	// Parse address prefixes.
 	prefix, err := netip.ParsePrefix(t.cfg.Addr)
 	if err != nil {
 		t.dev.Close()
 		return fmt.Errorf("invalid TUN address: %w", err)
 	}
+	prefixes := []netip.Prefix{prefix}
+	if t.cfg.Addr6 != "" {
+		prefix6, err := netip.ParsePrefix(t.cfg.Addr6)
+		if err != nil {
+			t.dev.Close()
+			return fmt.Errorf("invalid TUN IPv6 address: %w", err)
+		}
+		prefixes = append(prefixes, prefix6)
+	}
 
 	// Create gVisor network stack.
-	ns, err := newNetStack(dev, prefix, t.cfg.MTU)
+	ns, err := newNetStack(dev, prefixes, t.cfg.MTU)
 	if err != nil {
 		t.dev.Close()
 		return fmt.Errorf("failed to create network stack: %w", err)
 	}
 	t.ns = ns
 
-	// Set up TCP and UDP forwarders on the stack.
+	// Set up TCP and UDP forwarders on the stack; echo requests bypass it.
 	t.setupTCPForwarder()
 	t.setupUDPForwarder()
+	ns.intercept = t.interceptICMP
 
 	// Start packet shuttles between TUN device and gVisor.
 	go ns.tunToStack(t.ctx)
@@ -75,13 +119,20 @@ func (t *TUN) Start(ctx context.Context) error {
 
 	// Configure system routes and DNS.
 	if *t.cfg.AutoRoute {
-		if err := t.router.addRoutes(t.dev, t.devName, t.cfg.Addr, t.serverIP, t.cfg.DNS, t.cfg.Exclude); err != nil {
+		if err := t.router.addRoutes(t.dev, t.devName, t.cfg.Addr, t.cfg.Addr6, t.serverIP, t.cfg.DNS, t.cfg.Exclude, t.cfg.Mark, t.cfg.Apps); err != nil {
 			t.Close()
 			return fmt.Errorf("failed to configure routes: %w", err)
 		}
 	}
 
-	flog.Infof("TUN mode started: %s %s -> tunnel -> server", t.devName, prefix.Addr())
+	if t.fake != nil {
+		log.Infof("TUN fake-IP DNS answering from %s", t.cfg.FakeIP)
+	}
+	if t.cfg.Addr6 != "" {
+		log.Infof("TUN mode started: %s %s %s -> tunnel -> server", t.devName, prefix.Addr(), prefixes[1].Addr())
+	} else {
+		log.Infof("TUN mode started: %s %s -> tunnel -> server", t.devName, prefix.Addr())
+	}
 	return nil
 }
 
@@ -92,7 +143,7 @@ func (t *TUN) Close() {
 		defer close(t.done)
 		if *t.cfg.AutoRoute {
 			if err := t.router.removeRoutes(); err != nil {
-				flog.Errorf("TUN: failed to remove routes: %v", err)
+				log.Errorf("TUN: failed to remove routes: %v", err)
 			}
 		}
 		if t.ns != nil {
@@ -101,6 +152,9 @@ func (t *TUN) Close() {
 		if t.dev != nil {
 			t.dev.Close()
 		}
-		flog.Infof("TUN device %s closed", t.devName)
+		log.Infof("TUN device %s closed", t.devName)
+		if t.cfg.KillSwitch {
+			log.Warnf("TUN kill switch stays active; run 'paqet killswitch disable' to allow traffic outside the tunnel")
+		}
 	})
 }
@@ -2,9 +2,14 @@ package tun
 
 import (
 	"context"
-	"fmt"
-	"paqet/internal/flog"
+	"errors"
+	"net"
+	"paqet/internal/accesslog"
+	"paqet/internal/client"
+	"paqet/internal/dns"
 	"paqet/internal/pkg/buffer"
+	"paqet/internal/sniff"
+	"strconv"
 	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
@@ -20,6 +25,7 @@ func (t *TUN) setupUDPForwarder() {
 
 		// Check if this is DNS traffic (port 53).
 		isDNS := t.filter.IsDNS(dstPort)
+		fakeAddr, isFake := t.fakeTarget(id.LocalAddress, dstPort)
 
 		// For DNS: allow even if destination is private (will redirect to configured DNS).
 		// For non-DNS: use normal filtering.
@@ -27,40 +33,53 @@ func (t *TUN) setupUDPForwarder() {
 			if !t.filter.shouldForwardDNS(dstIP, dstPort) {
 				return true // drop
 			}
+		} else if isFake {
+			if fakeAddr == "" {
+				return true // drop — fake IP with no name behind it
+			}
 		} else {
 			if !t.filter.shouldForward(dstIP) {
 				return true // drop — don't tunnel this traffic
 			}
 		}
 
-		localAddr := fmt.Sprintf("%s:%d", formatAddr(id.RemoteAddress), id.RemotePort)
+		localAddr := joinAddr(id.RemoteAddress, id.RemotePort)
 
 		// For DNS traffic, redirect to configured DNS server.
 		var targetAddr string
-		if isDNS {
-			targetAddr = fmt.Sprintf("%s:%d", t.filter.DNSServer(), dstPort)
+		switch {
+		case isDNS:
+			targetAddr = net.JoinHostPort(t.filter.DNSServer(), strconv.Itoa(int(dstPort)))
 			if dstIP.String() != t.filter.DNSServer() {
-				flog.Debugf("TUN DNS: redirecting %s -> %s (was %s)", localAddr, targetAddr, dstIP)
+				log.Debugf("TUN DNS: redirecting %s -> %s (was %s)", localAddr, targetAddr, dstIP)
 			}
-		} else {
-			targetAddr = fmt.Sprintf("%s:%d", dstIP, dstPort)
+		case isFake:
+			targetAddr = fakeAddr
+		default:
+			targetAddr = joinAddr(id.LocalAddress, dstPort)
 		}
 
 		var wq waiter.Queue
 		ep, err := r.CreateEndpoint(&wq)
 		if err != nil {
-			flog.Errorf("TUN UDP: failed to create endpoint for %s -> %s: %v", localAddr, targetAddr, err)
+			log.Errorf("TUN UDP: failed to create endpoint for %s -> %s: %v", localAddr, targetAddr, err)
 			return true
 		}
 
 		conn := gonet.NewUDPConn(&wq, ep)
-		go t.handleUDP(t.ctx, conn, localAddr, targetAddr)
+		if isDNS && (t.fake != nil || t.resolver != nil) {
+			go t.handleDNS(t.ctx, conn, localAddr, targetAddr)
+		} else {
+			go t.handleUDP(t.ctx, conn, localAddr, targetAddr, t.cfg.Sniff && !isFake)
+		}
 		return true
 	})
 	t.ns.s.SetTransportProtocolHandler(udp.ProtocolNumber, fwd.HandlePacket)
 }
 
-func (t *TUN) handleUDP(ctx context.Context, conn *gonet.UDPConn, localAddr, targetAddr string) {
+// handleUDP relays the packets of conn to targetAddr. With sniff set, the
+// SNI of a QUIC ClientHello replaces the IP of targetAddr.
+func (t *TUN) handleUDP(ctx context.Context, conn *gonet.UDPConn, localAddr, targetAddr string, sniffHost bool) {
 	defer conn.Close()
 
 	bufp := buffer.UPool.Get().(*[]byte)
@@ -72,36 +91,45 @@ func (t *TUN) handleUDP(ctx context.Context, conn *gonet.UDPConn, localAddr, tar
 	n, err := conn.Read(buf)
 	conn.SetReadDeadline(time.Time{})
 	if err != nil {
-		flog.Errorf("TUN UDP: failed to read first packet for %s -> %s: %v", localAddr, targetAddr, err)
+		log.Errorf("TUN UDP: failed to read first packet for %s -> %s: %v", localAddr, targetAddr, err)
 		return
 	}
 
-	strm, isNew, key, err := t.client.UDP(localAddr, targetAddr)
+	host, pkts := "", [][]byte{buf[:n]}
+	if sniffHost && sniff.IsQUICInitial(buf[:n]) && !t.client.HasUDP(localAddr, targetAddr) {
+		host, pkts = sniffQUIC(conn, buf[:n])
+	}
+	flow, isNew, key, err := t.client.DialUDPHost(inbound, localAddr, targetAddr, host)
 	if err != nil {
-		flog.Errorf("TUN UDP: failed to establish stream for %s -> %s: %v", localAddr, targetAddr, err)
+		log.Errorf("TUN UDP: failed to establish flow for %s -> %s: %v", localAddr, targetAddr, err)
 		return
 	}
 
-	if err := buffer.WriteUDPFrame(strm, buf[:n]); err != nil {
-		flog.Errorf("TUN UDP: failed to forward %d bytes from %s -> %s: %v", n, localAddr, targetAddr, err)
-		t.client.CloseUDP(key)
-		return
+	for _, p := range pkts {
+		if err := flow.WritePacket(p); err != nil {
+			log.Errorf("TUN UDP: failed to forward %d bytes from %s -> %s: %v", len(p), localAddr, targetAddr, err)
+			t.client.CloseUDP(key)
+			return
+		}
 	}
+	targetAddr = sniff.Override(targetAddr, host)
 
 	if !isNew {
-		// Stream already has a reader goroutine; just keep writing.
-		t.udpWriteLoop(ctx, conn, strm, localAddr, targetAddr)
+		// Flow already has a reader goroutine; just keep writing.
+		t.udpWriteLoop(ctx, conn, flow, localAddr, targetAddr)
 		return
 	}
 
-	flog.Debugf("TUN UDP: stream %d established for %s -> %s", strm.SID(), localAddr, targetAddr)
+	log.Debugf("TUN UDP: flow %d established for %s -> %s", flow.SID(), localAddr, targetAddr)
 
-	// Start reader: strm -> gVisor conn.
-	// Uses length-prefixed framing to preserve UDP datagram boundaries.
+	// Start reader: flow -> gVisor conn.
+	start := time.Now()
 	go func() {
+		var result error
 		defer func() {
-			flog.Debugf("TUN UDP: stream %d closed for %s -> %s", strm.SID(), localAddr, targetAddr)
+			log.Debugf("TUN UDP: flow %d closed for %s -> %s", flow.SID(), localAddr, targetAddr)
 			t.client.CloseUDP(key)
+			accesslog.Stream(flow, "client", localAddr, "", client.LogType(flow, "PUDP"), targetAddr, start, accesslog.Reason(ctx, result))
 		}()
 		rbuf := buffer.UPool.Get().(*[]byte)
 		defer buffer.UPool.Put(rbuf)
@@ -112,25 +140,116 @@ func (t *TUN) handleUDP(ctx context.Context, conn *gonet.UDPConn, localAddr, tar
 				return
 			default:
 			}
-			strm.SetDeadline(time.Now().Add(8 * time.Second))
-			rn, err := buffer.ReadUDPFrame(strm, rb)
-			strm.SetDeadline(time.Time{})
+			flow.SetReadDeadline(time.Now().Add(8 * time.Second))
+			rn, err := flow.ReadPacket(rb)
+			flow.SetReadDeadline(time.Time{})
+			var unreach *buffer.Unreachable
+			if errors.As(err, &unreach) {
+				t.udpUnreachable(localAddr, targetAddr, unreach.Code)
+				continue
+			}
 			if err != nil {
-				flog.Debugf("TUN UDP: stream %d read error for %s -> %s: %v", strm.SID(), localAddr, targetAddr, err)
+				log.Debugf("TUN UDP: flow %d read error for %s -> %s: %v", flow.SID(), localAddr, targetAddr, err)
+				result = err
 				return
 			}
 			if _, err := conn.Write(rb[:rn]); err != nil {
-				flog.Debugf("TUN UDP: gVisor write error for %s -> %s: %v", localAddr, targetAddr, err)
+				log.Debugf("TUN UDP: gVisor write error for %s -> %s: %v", localAddr, targetAddr, err)
+				result = err
 				return
 			}
 		}
 	}()
 
 	// Continue writing in this goroutine.
-	t.udpWriteLoop(ctx, conn, strm, localAddr, targetAddr)
+	t.udpWriteLoop(ctx, conn, flow, localAddr, targetAddr)
+}
+
+// handleDNS answers the queries the fake-IP pool can serve and the rest
+// with the resolver, or without one by passing them to the DNS server
+// through one flow.
+func (t *TUN) handleDNS(ctx context.Context, conn *gonet.UDPConn, localAddr, targetAddr string) {
+	defer conn.Close()
+
+	bufp := buffer.UPool.Get().(*[]byte)
+	defer buffer.UPool.Put(bufp)
+	buf := *bufp
+
+	var flow client.UDPFlow
+	var key uint64
+	defer func() {
+		if flow != nil {
+			t.client.CloseUDP(key)
+		}
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(8 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if t.resolver != nil {
+			query := append([]byte(nil), buf[:n]...)
+			go func() {
+				if resp := dns.Answer(ctx, t.answerDNS, query); resp != nil {
+					conn.Write(dns.Truncate(query, resp))
+				}
+			}()
+			continue
+		}
+		if resp := t.fake.answer(buf[:n]); resp != nil {
+			if _, err := conn.Write(resp); err != nil {
+				return
+			}
+			continue
+		}
+		if flow == nil {
+			f, isNew, k, err := t.client.DialUDP(inbound, localAddr, targetAddr)
+			if err != nil {
+				log.Errorf("TUN DNS: failed to establish flow for %s -> %s: %v", localAddr, targetAddr, err)
+				return
+			}
+			flow, key = f, k
+			if isNew {
+				go t.dnsReplies(ctx, conn, flow, key, localAddr, targetAddr)
+			}
+		}
+		if err := flow.WritePacket(buf[:n]); err != nil {
+			log.Debugf("TUN DNS: write error for %s -> %s: %v", localAddr, targetAddr, err)
+			return
+		}
+	}
 }
 
-func (t *TUN) udpWriteLoop(ctx context.Context, conn *gonet.UDPConn, strm interface{ Write([]byte) (int, error) }, localAddr, targetAddr string) {
+// dnsReplies copies the DNS server's answers from flow back to conn.
+func (t *TUN) dnsReplies(ctx context.Context, conn *gonet.UDPConn, flow client.UDPFlow, key uint64, localAddr, targetAddr string) {
+	start := time.Now()
+	var result error
+	defer func() {
+		t.client.CloseUDP(key)
+		accesslog.Stream(flow, "client", localAddr, "", client.LogType(flow, "PUDP"), targetAddr, start, accesslog.Reason(ctx, result))
+	}()
+	bufp := buffer.UPool.Get().(*[]byte)
+	defer buffer.UPool.Put(bufp)
+	buf := *bufp
+	for ctx.Err() == nil {
+		n, err := flow.ReadPacket(buf)
+		var unreach *buffer.Unreachable
+		if errors.As(err, &unreach) {
+			continue
+		}
+		if err != nil {
+			result = err
+			return
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			result = err
+			return
+		}
+	}
+}
+
+func (t *TUN) udpWriteLoop(ctx context.Context, conn *gonet.UDPConn, flow client.UDPFlow, localAddr, targetAddr string) {
 	bufp := buffer.UPool.Get().(*[]byte)
 	defer buffer.UPool.Put(bufp)
 	buf := *bufp
@@ -147,9 +266,30 @@ func (t *TUN) udpWriteLoop(ctx context.Context, conn *gonet.UDPConn, strm interf
 		if err != nil {
 			return
 		}
-		if err := buffer.WriteUDPFrame(strm, buf[:n]); err != nil {
-			flog.Debugf("TUN UDP: write error for %s -> %s: %v", localAddr, targetAddr, err)
+		if err := flow.WritePacket(buf[:n]); err != nil {
+			log.Debugf("TUN UDP: write error for %s -> %s: %v", localAddr, targetAddr, err)
 			return
 		}
 	}
 }
+
+// sniffQUIC reads the rest of the QUIC ClientHello that first starts, for
+// up to sniff.Timeout, and returns its SNI with the datagrams read so far.
+func sniffQUIC(conn *gonet.UDPConn, first []byte) (string, [][]byte) {
+	var hello sniff.QUICHello
+	pkts := [][]byte{first}
+	host, more := hello.Add(first)
+	deadline := time.Now().Add(sniff.Timeout)
+	for more {
+		b := make([]byte, 65535)
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(b)
+		if err != nil {
+			break
+		}
+		pkts = append(pkts, b[:n])
+		host, more = hello.Add(b[:n])
+	}
+	conn.SetReadDeadline(time.Time{})
+	return host, pkts
+}
@@ -0,0 +1,223 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded is returned by metered streams once their user has used
+// up the daily or monthly quota.
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// Kind is the traffic class a byte count is charged to.
+type Kind int
+
+const (
+	TCP Kind = iota
+	UDP
+)
+
+// Counters are cumulative byte counts. Up is client to target, Down is
+// target to client.
+type Counters struct {
+	TCPUp   uint64 `json:"tcp_up"`
+	TCPDown uint64 `json:"tcp_down"`
+	UDPUp   uint64 `json:"udp_up"`
+	UDPDown uint64 `json:"udp_down"`
+}
+
+// Record is the persisted accounting state of one user.
+type Record struct {
+	Total      Counters  `json:"total"`
+	Day        string    `json:"day"` // UTC date the day counter belongs to
+	DayBytes   uint64    `json:"day_bytes"`
+	Month      string    `json:"month"` // UTC month the month counter belongs to
+	MonthBytes uint64    `json:"month_bytes"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// Limit is a daily and monthly byte quota. Zero disables a period.
+type Limit struct {
+	Daily   uint64
+	Monthly uint64
+}
+
+type file struct {
+	Users map[string]*Record `json:"users"`
+}
+
+// Store keeps per-user byte counters and enforces quotas. It is safe for
+// concurrent use; Flush writes the counters to disk atomically.
+type Store struct {
+	path   string
+	limits func(user string) Limit
+
+	mu    sync.Mutex
+	users map[string]*Record
+	dirty bool
+
+	flushMu sync.Mutex // orders snapshots written by concurrent flushes
+}
+
+// Open loads the accounting file at path, starting empty if it does not exist.
+// limits returns the quota for a user.
+func Open(path string, limits func(user string) Limit) (*Store, error) {
+	users, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{path: path, limits: limits, users: users}, nil
+}
+
+// Load reads an accounting file without opening a store.
+func Load(path string) (map[string]*Record, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]*Record), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if f.Users == nil {
+		f.Users = make(map[string]*Record)
+	}
+	return f.Users, nil
+}
+
+// record returns the user's record with its periods rolled to now.
+// Callers must hold s.mu.
+func (s *Store) record(user string, now time.Time) *Record {
+	r, ok := s.users[user]
+	if !ok {
+		r = &Record{}
+		s.users[user] = r
+	}
+	r.roll(now)
+	return r
+}
+
+func (r *Record) roll(now time.Time) {
+	now = now.UTC()
+	if day := now.Format(time.DateOnly); r.Day != day {
+		r.Day, r.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); r.Month != month {
+		r.Month, r.MonthBytes = month, 0
+	}
+}
+
+// Periods returns the bytes used in the day and month containing now.
+// Counters recorded for an earlier period read as zero.
+func (r *Record) Periods(now time.Time) (day, month uint64) {
+	c := *r
+	c.roll(now)
+	return c.DayBytes, c.MonthBytes
+}
+
+// Add charges n bytes to user and reports whether the user is still within
+// quota afterwards.
+func (s *Store) Add(user string, kind Kind, up bool, n int) bool {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.record(user, now)
+	c := uint64(n)
+	switch {
+	case kind == TCP && up:
+		r.Total.TCPUp += c
+	case kind == TCP:
+		r.Total.TCPDown += c
+	case up:
+		r.Total.UDPUp += c
+	default:
+		r.Total.UDPDown += c
+	}
+	r.DayBytes += c
+	r.MonthBytes += c
+	r.LastSeen = now
+	s.dirty = true
+	return !s.exceeded(user, r)
+}
+
+// Exceeded reports whether user has used up a quota for the current period.
+func (s *Store) Exceeded(user string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.users[user]
+	if !ok {
+		return false
+	}
+	r.roll(time.Now())
+	return s.exceeded(user, r)
+}
+
+func (s *Store) exceeded(user string, r *Record) bool {
+	lim := s.limits(user)
+	return (lim.Daily > 0 && r.DayBytes >= lim.Daily) ||
+		(lim.Monthly > 0 && r.MonthBytes >= lim.Monthly)
+}
+
+// Flush writes the counters to disk if they changed since the last flush.
+// After a failed write the counters stay dirty for the next flush.
+func (s *Store) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(file{Users: s.users}, "", "  ")
+	s.dirty = false
+	s.mu.Unlock()
+	if err == nil {
+		err = s.write(data)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *Store) write(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".usage-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// FormatBytes renders n with a binary unit, e.g. "1.5 GB".
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
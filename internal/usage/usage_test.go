@@ -0,0 +1,89 @@
+package usage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	s, err := Open(path, func(user string) Limit {
+		if user == "alice" {
+			return Limit{Daily: 1000}
+		}
+		return Limit{}
+	})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	if !s.Add("alice", TCP, true, 600) {
+		t.Fatal("alice exceeded quota too early")
+	}
+	if s.Add("alice", UDP, false, 400) {
+		t.Fatal("alice should have exhausted the daily quota")
+	}
+	if !s.Exceeded("alice") {
+		t.Fatal("Exceeded should report alice")
+	}
+	if !s.Add("bob", TCP, true, 1<<30) || s.Exceeded("bob") {
+		t.Fatal("bob has no quota")
+	}
+}
+
+func TestStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	noLimit := func(string) Limit { return Limit{} }
+	s, _ := Open(path, noLimit)
+	s.Add("alice", TCP, true, 10)
+	s.Add("alice", TCP, false, 20)
+	s.Add("alice", UDP, true, 30)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	users, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	got := users["alice"].Total
+	want := Counters{TCPUp: 10, TCPDown: 20, UDPUp: 30}
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestStoreFlushRetriesAfterError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	path := filepath.Join(dir, "usage.json")
+	s, _ := Open(path, func(string) Limit { return Limit{} })
+	s.Add("alice", TCP, true, 10)
+	if err := s.Flush(); err == nil {
+		t.Fatal("Flush into a missing directory should fail")
+	}
+
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	users, err := Load(path)
+	if err != nil || users["alice"] == nil || users["alice"].Total.TCPUp != 10 {
+		t.Fatalf("counters lost after a failed flush: %v, %+v", err, users)
+	}
+}
+
+func TestRecordRollsPeriods(t *testing.T) {
+	r := &Record{}
+	day := time.Date(2026, 1, 31, 23, 0, 0, 0, time.UTC)
+	r.roll(day)
+	r.DayBytes, r.MonthBytes = 5, 5
+
+	r.roll(day.Add(2 * time.Hour))
+	if r.DayBytes != 0 || r.MonthBytes != 0 {
+		t.Fatalf("expected both periods reset, got day=%d month=%d", r.DayBytes, r.MonthBytes)
+	}
+}